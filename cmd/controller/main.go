@@ -21,38 +21,143 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 
 	"knative.dev/networking/pkg/http/probe"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	secretinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/secret"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
 	"knative.dev/pkg/injection/sharedmain"
 	"knative.dev/pkg/signals"
+	"knative.dev/pkg/system"
 
 	"knative.dev/net-http01/pkg/challenger"
+	"knative.dev/net-http01/pkg/dns01"
 	"knative.dev/net-http01/pkg/ordermanager"
 	"knative.dev/net-http01/pkg/reconciler/certificate"
 )
 
-func main() {
-	flag.StringVar(&ordermanager.Endpoint, "acme-endpoint", ordermanager.Endpoint,
-		fmt.Sprintf("The ACME endpoint to use for certificate challenges. Production: %s, Staging: %s",
-			ordermanager.Production, ordermanager.Staging))
+var (
+	enableTLSALPN01 = flag.Bool("enable-tls-alpn01", false,
+		"Whether to solve TLS-ALPN-01 challenges (preferring them over HTTP01) when the CA offers them. "+
+			"This requires port 443 of the domains to be routed to the tls-alpn-challenge port.")
 
-	ctx := signals.NewContext()
+	dns01Provider = flag.String("dns01-provider", "",
+		"The provider used to publish DNS01 challenge records, one of: rfc2136, webhook. DNS01 is disabled when empty.")
 
-	chlr, err := challenger.New(ctx)
-	if err != nil {
-		log.Fatalf("Error creating challenger: %v", err)
-	}
+	rfc2136Nameserver = flag.String("rfc2136-nameserver", "",
+		"The nameserver (host:port) to which RFC2136 dynamic updates are sent.")
+	rfc2136Zone = flag.String("rfc2136-zone", "",
+		"The zone in which RFC2136 dynamic updates are made.")
+	rfc2136TSIGKeyName = flag.String("rfc2136-tsig-key-name", "",
+		"The name of the TSIG key used to sign RFC2136 dynamic updates. The base64 encoded secret is read from $RFC2136_TSIG_SECRET.")
+	rfc2136TSIGAlgorithm = flag.String("rfc2136-tsig-algorithm", "hmac-sha256",
+		"The TSIG algorithm used to sign RFC2136 dynamic updates.")
 
-	port := 8765
+	dns01WebhookURL = flag.String("dns01-webhook-url", "",
+		"The URL of the webhook that manages DNS01 challenge records. A bearer token may be provided through $DNS01_WEBHOOK_TOKEN.")
+
+	dns01PropagationTimeout = flag.Duration("dns01-propagation-timeout", dns01.DefaultPropagation.Timeout,
+		"How long to poll the authoritative nameservers for DNS01 challenge records before giving up on them. Zero disables polling.")
+	dns01PropagationDelay = flag.Duration("dns01-propagation-delay", 0,
+		"How long to wait after DNS01 challenge records are served (or published, when polling is disabled) before the CA is asked to validate them.")
+	dns01PropagationNameservers = flag.String("dns01-propagation-nameservers", "",
+		"Comma separated nameservers (host:port) to poll for DNS01 challenge records instead of the authoritative nameservers.")
+
+	maxInflightOrders = flag.Int("max-inflight-orders", 0,
+		"The maximum number of orders in-flight with the CA of each issuer at once, past which orders are queued. Zero means no limit.")
+
+	revokeOnDelete = flag.Bool("revoke-on-delete", false,
+		"Whether to revoke the certificates of deleted Certificates, which are finalized to that end. Certificates may opt out with the "+certificate.RevokeOnDeleteAnnotationKey+" annotation.")
+)
+
+func main() {
+	// The in-flight orders wind down once we are signalled to stop, which
+	// we wait for before exiting.
+	var shutdown sync.WaitGroup
+	ctx := certificate.WithShutdownWaitGroup(signals.NewContext(), &shutdown)
+	defer shutdown.Wait()
 
-	go http.ListenAndServe(fmt.Sprint(":", port), probe.NewHandler(chlr))
+	port := 8765
+	alpnPort := 8443
 
 	sharedmain.MainWithContext(ctx, "net-http01",
 		func(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
-			return certificate.NewController(ctx, cmw, chlr, port)
+			// Challenges are shared through a Secret, so that whichever
+			// replica the CA's request lands on can answer it.
+			chlr, err := challenger.NewKubernetes(ctx, kubeclient.Get(ctx),
+				secretinformer.Get(ctx).Lister(), system.Namespace(), challenger.ChallengesSecretName)
+			if err != nil {
+				log.Fatalf("Error creating challenger: %v", err)
+			}
+			go http.ListenAndServe(fmt.Sprint(":", port), probe.NewHandler(chlr))
+
+			var solvers []ordermanager.Solver
+			if *enableTLSALPN01 {
+				// Like challenges, the challenge certificates are shared
+				// through a Secret, as port 443 reaches every replica.
+				alpn, err := challenger.NewKubernetesTLSALPN(ctx, kubeclient.Get(ctx),
+					secretinformer.Get(ctx).Lister(), system.Namespace(), challenger.TLSALPNSecretName)
+				if err != nil {
+					log.Fatalf("Error creating TLS-ALPN challenger: %v", err)
+				}
+				l, err := net.Listen("tcp", fmt.Sprint(":", alpnPort))
+				if err != nil {
+					log.Fatalf("Error listening for TLS-ALPN challenges: %v", err)
+				}
+				go challenger.ServeTLSALPN(l, alpn)
+				solvers = append(solvers, ordermanager.NewTLSALPN01Solver(alpn))
+			}
+			solvers = append(solvers, ordermanager.NewHTTP01Solver(chlr))
+			if p, err := newDNS01Provider(); err != nil {
+				log.Fatalf("Error creating DNS01 provider: %v", err)
+			} else if p != nil {
+				solvers = append(solvers, ordermanager.NewDNS01Solver(p, newDNS01Propagation()))
+			}
+
+			return certificate.NewController(ctx, cmw, chlr, port, *revokeOnDelete,
+				ordermanager.WithSolvers(solvers...),
+				ordermanager.WithMaxInflightOrders(*maxInflightOrders))
 		},
 	)
 }
+
+// newDNS01Provider returns the DNS01 provider configured through flags,
+// or nil when DNS01 challenges are disabled.
+func newDNS01Provider() (dns01.Provider, error) {
+	switch *dns01Provider {
+	case "":
+		return nil, nil
+	case "rfc2136":
+		var tsig *dns01.TSIG
+		if *rfc2136TSIGKeyName != "" {
+			tsig = &dns01.TSIG{
+				KeyName:   *rfc2136TSIGKeyName,
+				Algorithm: *rfc2136TSIGAlgorithm,
+				Secret:    os.Getenv("RFC2136_TSIG_SECRET"),
+			}
+		}
+		return dns01.NewRFC2136(*rfc2136Nameserver, *rfc2136Zone, tsig)
+	case "webhook":
+		return dns01.NewWebhook(*dns01WebhookURL, os.Getenv("DNS01_WEBHOOK_TOKEN"), nil)
+	default:
+		return nil, fmt.Errorf("unknown DNS01 provider %q", *dns01Provider)
+	}
+}
+
+// newDNS01Propagation returns how DNS01 challenge records are waited on, as
+// configured through flags.
+func newDNS01Propagation() dns01.Propagation {
+	p := dns01.DefaultPropagation
+	p.Timeout = *dns01PropagationTimeout
+	p.Delay = *dns01PropagationDelay
+	if *dns01PropagationNameservers != "" {
+		p.Nameservers = strings.Split(*dns01PropagationNameservers, ",")
+	}
+	return p
+}
@@ -26,11 +26,15 @@ import (
 	"time"
 
 	"golang.org/x/sync/errgroup"
+	"knative.dev/net-http01/pkg/acmetest"
 	"knative.dev/net-http01/pkg/challenger"
 	"knative.dev/net-http01/pkg/ordermanager"
 )
 
-var domain = flag.String("domain", "", "The domain on which to serve the sample.")
+var (
+	domain  = flag.String("domain", "", "The domain on which to serve the sample.")
+	offline = flag.Bool("offline", false, "Order the certificate from an in-memory ACME server instead of Let's Encrypt.")
+)
 
 func main() {
 	flag.Parse()
@@ -40,8 +44,10 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
+	var opts []ordermanager.Option
+	var orderOpts []ordermanager.OrderOption
 	// Uncomment to use the Let's Encrypt staging endpoint.
-	// ordermanager.Endpoint = ordermanager.Staging
+	// opts = append(opts, ordermanager.WithDirectoryURL(ordermanager.Staging))
 
 	// Start our HTTP server to serve challenges.
 	eg := errgroup.Group{}
@@ -51,20 +57,34 @@ func main() {
 	}
 	eg.Go(func() error { return http.ListenAndServe(":8080", chlr) })
 
+	if *offline {
+		// The in-memory CA validates challenges against our challenger
+		// directly, and we self-check them against our own HTTP server,
+		// so the domain needn't resolve.
+		ca := acmetest.NewServer(chlr)
+		defer ca.Close()
+		opts = append(opts, ordermanager.WithDirectoryURL(ca.URL()))
+
+		sc := ordermanager.DefaultSelfCheck
+		sc.IngressAddress = "localhost:8080"
+		orderOpts = append(orderOpts, ordermanager.WithSelfCheck(sc))
+	}
+
 	// Create our OrderManager, and provide a callback to signal us when
 	// the certificate is ready to be picked up.  Give it our Challenger
-	// to use for handling the HTTP01 challenges.
+	// to use for handling the HTTP01 challenges.  The sample doesn't persist
+	// its ACME account, so each run registers a new one.
 	ready := make(chan struct{})
 	om, err := ordermanager.New(ctx, func(interface{}) {
 		log.Print("Certificate should be ready!")
 		close(ready)
-	}, chlr)
+	}, chlr, ordermanager.NewMemoryAccountKeyStore(), opts...)
 	if err != nil {
 		log.Fatalf("Error creating OrderManager: %v", err)
 	}
 
 	// First call returns the challenges (for us to set up Ingress)
-	challs, _, err := om.Order(ctx, domains, nil)
+	challs, _, err := om.Order(ctx, domains, nil, orderOpts...)
 	if err != nil {
 		log.Fatalf("Error placing Domain order: %v", err)
 	}
@@ -78,7 +98,7 @@ func main() {
 	}
 
 	// Calling order after the certificate is ready should yield the certificate.
-	_, cert, err := om.Order(ctx, domains, nil)
+	_, cert, err := om.Order(ctx, domains, nil, orderOpts...)
 	if err != nil {
 		log.Fatalf("Error placing Domain order: %v", err)
 	}
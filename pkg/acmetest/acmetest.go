@@ -0,0 +1,422 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package acmetest provides an in-memory ACME (RFC 8555) certificate
+// authority for tests.  It supports accounts, orders, authorizations,
+// http-01 validation against a challenger.Interface, finalization and
+// revocation, and can be scripted to fail requests, so that the order
+// manager can be exercised without network access.
+package acmetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+	"knative.dev/net-http01/pkg/challenger"
+)
+
+const (
+	directoryPath  = "/directory"
+	newNoncePath   = "/new-nonce"
+	newAccountPath = "/new-account"
+	newOrderPath   = "/new-order"
+	revokeCertPath = "/revoke-cert"
+	keyChangePath  = "/key-change"
+
+	problemPrefix = "urn:ietf:params:acme:error:"
+)
+
+// Server is an ACME certificate authority served from memory over HTTP.
+type Server struct {
+	srv  *httptest.Server
+	chlr challenger.Interface
+
+	clock    clock.PassiveClock
+	lifetime time.Duration
+	terms    string
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu         sync.Mutex
+	lastID     int
+	nonces     map[string]struct{}
+	accounts   map[string]*account
+	orders     map[string]*order
+	authzs     map[string]*authz
+	challenges map[string]*challenge
+	certs      map[string]*issued
+	faults     []*Fault
+	counts     map[Op]int
+}
+
+// Option configures the Server.
+type Option func(*Server)
+
+// WithCertificateLifetime sets how long the certificates that the Server
+// issues are valid for.  It defaults to 90 days.
+func WithCertificateLifetime(d time.Duration) Option {
+	return func(s *Server) {
+		s.lifetime = d
+	}
+}
+
+// WithTermsOfService advertises terms of service in the directory, which
+// new accounts must then agree to.
+func WithTermsOfService(url string) Option {
+	return func(s *Server) {
+		s.terms = url
+	}
+}
+
+// WithClock sets the clock against which orders and authorizations expire,
+// and from which certificates are valid.
+func WithClock(c clock.PassiveClock) Option {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// NewServer starts a Server, which validates http-01 challenges by asking
+// the challenger for the response to them.  When the challenger is nil,
+// every challenge is deemed valid.  The Server must be closed when done.
+func NewServer(chlr challenger.Interface, opts ...Option) *Server {
+	s := &Server{
+		chlr:       chlr,
+		clock:      clock.RealClock{},
+		lifetime:   90 * 24 * time.Hour,
+		nonces:     make(map[string]struct{}),
+		accounts:   make(map[string]*account),
+		orders:     make(map[string]*order),
+		authzs:     make(map[string]*authz),
+		challenges: make(map[string]*challenge),
+		certs:      make(map[string]*issued),
+		counts:     make(map[Op]int),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.caKey, s.caCert = newCA(s.clock.Now())
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL returns the URL of the ACME directory of the Server.
+func (s *Server) URL() string {
+	return s.srv.URL + directoryPath
+}
+
+// Root returns the certificate of the CA that signs the certificates that
+// the Server issues.
+func (s *Server) Root() *x509.Certificate {
+	return s.caCert
+}
+
+// Close shuts the Server down.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// newCA creates the self-signed certificate of the CA.
+func newCA(now time.Time) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprint("generating CA key: ", err))
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acmetest root"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		panic(fmt.Sprint("creating CA certificate: ", err))
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(fmt.Sprint("parsing CA certificate: ", err))
+	}
+	return key, cert
+}
+
+// request is an authenticated ACME request.
+type request struct {
+	// account is the account that signed the request, which is nil when
+	// the request was signed with a JWK rather than a key ID.
+	account *account
+
+	// key is the public key that signed the request.
+	key crypto.PublicKey
+
+	payload []byte
+}
+
+// reply is the response to an ACME request.
+type reply struct {
+	status   int
+	location string
+
+	// body is marshalled to JSON, unless contentType is set, in which case
+	// it must be a []byte.
+	body        interface{}
+	contentType string
+}
+
+// handler serves an authenticated ACME request.
+type handler func(*request) (*reply, *problem)
+
+// serve is the http.HandlerFunc of the Server.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch r.URL.Path {
+	case directoryPath:
+		s.write(w, &reply{status: http.StatusOK, body: s.directory()})
+		return
+	case newNoncePath:
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	op, h := s.route(r.URL.Path)
+	if h == nil {
+		s.writeProblem(w, newProblem(http.StatusNotFound, "malformed", "No such resource %q", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeProblem(w, newProblem(http.StatusMethodNotAllowed, "malformed", "Method %s not allowed", r.Method))
+		return
+	}
+	req, p := s.authenticate(r, op)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+	if f := s.fault(op); f != nil {
+		s.writeProblem(w, f.problem())
+		return
+	}
+	rep, p := h(req)
+	if p != nil {
+		s.writeProblem(w, p)
+		return
+	}
+	s.write(w, rep)
+}
+
+// route returns the operation and the handler of the resource at the path,
+// or a nil handler when there's no such resource.
+func (s *Server) route(path string) (Op, handler) {
+	switch path {
+	case newAccountPath:
+		return OpNewAccount, s.newAccount
+	case keyChangePath:
+		return OpKeyChange, s.keyChange
+	case newOrderPath:
+		return OpNewOrder, s.newOrder
+	case revokeCertPath:
+		return OpRevoke, s.revokeCert
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	id := parts[len(parts)-1]
+	switch {
+	case len(parts) == 2 && parts[0] == "account":
+		return OpUpdateAccount, func(req *request) (*reply, *problem) { return s.updateAccount(req, id) }
+	case len(parts) == 2 && parts[0] == "order":
+		return OpGetOrder, func(req *request) (*reply, *problem) { return s.getOrder(req, id) }
+	case len(parts) == 3 && parts[0] == "order" && parts[2] == "finalize":
+		id = parts[1]
+		return OpFinalize, func(req *request) (*reply, *problem) { return s.finalize(req, id) }
+	case len(parts) == 2 && parts[0] == "authz":
+		return OpGetAuthorization, func(req *request) (*reply, *problem) { return s.getAuthorization(req, id) }
+	case len(parts) == 2 && parts[0] == "chall":
+		return OpAccept, func(req *request) (*reply, *problem) { return s.accept(req, id) }
+	case len(parts) == 2 && parts[0] == "cert":
+		return OpGetCertificate, func(req *request) (*reply, *problem) { return s.getCertificate(req, id) }
+	}
+	return "", nil
+}
+
+// authenticate verifies the JWS that the request carries.  Only new
+// accounts and revocations may be signed with a JWK instead of the key ID
+// of an account.
+func (s *Server) authenticate(r *http.Request, op Op) (*request, *problem) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Reading request: %v", err)
+	}
+	var j jws
+	if err := json.Unmarshal(body, &j); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Parsing JWS: %v", err)
+	}
+	h, payload, err := j.decode()
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Parsing JWS: %v", err)
+	}
+	if _, ok := s.nonces[h.Nonce]; !ok {
+		return nil, newProblem(http.StatusBadRequest, "badNonce", "Unknown nonce %q", h.Nonce)
+	}
+	delete(s.nonces, h.Nonce)
+	if want := s.srv.URL + r.URL.Path; h.URL != want {
+		return nil, newProblem(http.StatusUnauthorized, "unauthorized", "JWS url %q doesn't match %q", h.URL, want)
+	}
+
+	req := &request{payload: payload}
+	switch {
+	case h.KID != "" && len(h.JWK) != 0:
+		return nil, newProblem(http.StatusBadRequest, "malformed", "JWS has both a kid and a jwk")
+	case h.KID != "":
+		if op == OpNewAccount {
+			return nil, newProblem(http.StatusBadRequest, "malformed", "New accounts must be signed with a jwk")
+		}
+		var acct *account
+		if id := strings.TrimPrefix(h.KID, s.srv.URL+"/account/"); id != h.KID {
+			acct = s.accounts[id]
+		}
+		if acct == nil {
+			return nil, newProblem(http.StatusBadRequest, "accountDoesNotExist", "No account %q", h.KID)
+		}
+		if acct.status != statusValid {
+			return nil, newProblem(http.StatusUnauthorized, "unauthorized", "Account %q is %s", h.KID, acct.status)
+		}
+		req.account, req.key = acct, acct.key
+	case len(h.JWK) != 0:
+		if op != OpNewAccount && op != OpRevoke {
+			return nil, newProblem(http.StatusBadRequest, "malformed", "Request must be signed with a kid")
+		}
+		if req.key, err = publicKey(h.JWK); err != nil {
+			return nil, newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+		}
+	default:
+		return nil, newProblem(http.StatusBadRequest, "malformed", "JWS has neither a kid nor a jwk")
+	}
+	if err := j.verify(h.Alg, req.key); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Verifying JWS: %v", err)
+	}
+	return req, nil
+}
+
+// newNonce returns a fresh nonce for a client to sign a request with.
+func (s *Server) newNonce() string {
+	n := randomToken()
+	s.nonces[n] = struct{}{}
+	return n
+}
+
+// newID returns a fresh identifier for a resource.
+func (s *Server) newID() string {
+	s.lastID++
+	return fmt.Sprint(s.lastID)
+}
+
+// url returns the URL of the resource of the kind with the ID.
+func (s *Server) url(kind, id string) string {
+	return s.srv.URL + "/" + kind + "/" + id
+}
+
+// directory returns the ACME directory of the Server.
+func (s *Server) directory() interface{} {
+	type meta struct {
+		TermsOfService string `json:"termsOfService,omitempty"`
+	}
+	return struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+		RevokeCert string `json:"revokeCert"`
+		KeyChange  string `json:"keyChange"`
+		Meta       meta   `json:"meta"`
+	}{
+		NewNonce:   s.srv.URL + newNoncePath,
+		NewAccount: s.srv.URL + newAccountPath,
+		NewOrder:   s.srv.URL + newOrderPath,
+		RevokeCert: s.srv.URL + revokeCertPath,
+		KeyChange:  s.srv.URL + keyChangePath,
+		Meta:       meta{TermsOfService: s.terms},
+	}
+}
+
+// write sends the reply.
+func (s *Server) write(w http.ResponseWriter, rep *reply) {
+	if rep.location != "" {
+		w.Header().Set("Location", rep.location)
+	}
+	if rep.contentType != "" {
+		w.Header().Set("Content-Type", rep.contentType)
+		w.WriteHeader(rep.status)
+		w.Write(rep.body.([]byte))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(rep.status)
+	json.NewEncoder(w).Encode(rep.body)
+}
+
+// writeProblem sends the problem document.
+func (s *Server) writeProblem(w http.ResponseWriter, p *problem) {
+	if p.retryAfter != "" {
+		w.Header().Set("Retry-After", p.retryAfter)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// problem is an RFC 7807 problem document.
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status"`
+
+	retryAfter string
+}
+
+// newProblem returns a problem of the ACME error type, e.g. "malformed".
+func newProblem(status int, typ, format string, args ...interface{}) *problem {
+	return &problem{
+		Type:   problemPrefix + typ,
+		Detail: fmt.Sprintf(format, args...),
+		Status: status,
+	}
+}
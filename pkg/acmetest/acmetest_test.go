@@ -0,0 +1,417 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acmetest
+
+import (
+	context "context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"knative.dev/net-http01/pkg/challenger"
+	"knative.dev/net-http01/pkg/ordermanager"
+)
+
+func newKey(t *testing.T) crypto.Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	return key
+}
+
+// newClient returns a client of the server with a registered account.
+func newClient(ctx context.Context, t *testing.T, s *Server, key crypto.Signer) *acme.Client {
+	t.Helper()
+	client := &acme.Client{Key: key, DirectoryURL: s.URL()}
+	if _, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	return client
+}
+
+// placeOrder places an order for the domains, and serves the http-01 responses
+// to its challenges from the challenger, if any.
+func placeOrder(ctx context.Context, t *testing.T, client *acme.Client, chlr challenger.Interface, domains ...string) (*acme.Order, []*acme.Challenge) {
+	t.Helper()
+	o, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder() = %v", err)
+	}
+	var challs []*acme.Challenge
+	for _, url := range o.AuthzURLs {
+		z, err := client.GetAuthorization(ctx, url)
+		if err != nil {
+			t.Fatalf("GetAuthorization() = %v", err)
+		}
+		for _, ch := range z.Challenges {
+			if ch.Type != "http-01" {
+				continue
+			}
+			challs = append(challs, ch)
+			if chlr == nil {
+				continue
+			}
+			resp, err := client.HTTP01ChallengeResponse(ch.Token)
+			if err != nil {
+				t.Fatalf("HTTP01ChallengeResponse() = %v", err)
+			}
+			chlr.RegisterChallenge(client.HTTP01ChallengePath(ch.Token), resp)
+		}
+	}
+	return o, challs
+}
+
+func newCSR(t *testing.T, key crypto.Signer, domains ...string) []byte {
+	t.Helper()
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		t.Fatalf("CreateCertificateRequest() = %v", err)
+	}
+	return der
+}
+
+func problemType(err error) string {
+	var ae *acme.Error
+	if errors.As(err, &ae) {
+		return ae.ProblemType
+	}
+	return ""
+}
+
+func TestIssuance(t *testing.T) {
+	ctx := context.Background()
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	s := NewServer(chlr, WithCertificateLifetime(time.Hour))
+	defer s.Close()
+
+	client := newClient(ctx, t, s, newKey(t))
+	domains := []string{"example.com", "www.example.com"}
+	o, challs := placeOrder(ctx, t, client, chlr, domains...)
+	if len(challs) != len(domains) {
+		t.Fatalf("Got %d http-01 challenges, wanted %d", len(challs), len(domains))
+	}
+
+	certKey := newKey(t)
+	if _, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, newCSR(t, certKey, domains...), true); problemType(err) != problemPrefix+"orderNotReady" {
+		t.Errorf("CreateOrderCert() before validation = %v, wanted orderNotReady", err)
+	}
+
+	for _, ch := range challs {
+		if _, err := client.Accept(ctx, ch); err != nil {
+			t.Fatalf("Accept() = %v", err)
+		}
+	}
+	if o, err = client.WaitOrder(ctx, o.URI); err != nil {
+		t.Fatalf("WaitOrder() = %v", err)
+	} else if o.Status != acme.StatusReady {
+		t.Fatalf("Order status = %s, wanted %s", o.Status, acme.StatusReady)
+	}
+
+	if _, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, newCSR(t, certKey, "example.com", "evil.com"), true); problemType(err) != problemPrefix+"badCSR" {
+		t.Errorf("CreateOrderCert() with other names = %v, wanted badCSR", err)
+	}
+	der, _, err := client.CreateOrderCert(ctx, o.FinalizeURL, newCSR(t, certKey, domains...), true)
+	if err != nil {
+		t.Fatalf("CreateOrderCert() = %v", err)
+	}
+	if len(der) != 2 {
+		t.Fatalf("Got a chain of %d certificates, wanted 2", len(der))
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() = %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Root())
+	for _, d := range domains {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: d, Roots: roots}); err != nil {
+			t.Errorf("Verify(%s) = %v", d, err)
+		}
+	}
+	if got, want := leaf.NotAfter.Sub(leaf.NotBefore), time.Hour+time.Minute; got != want {
+		t.Errorf("Certificate lifetime = %v, wanted %v", got, want)
+	}
+
+	if s.Revoked(leaf.SerialNumber) {
+		t.Error("Revoked() = true before revocation")
+	}
+	// Anyone else may only revoke the certificate with its key.
+	other := newClient(ctx, t, s, newKey(t))
+	if err := other.RevokeCert(ctx, nil, der[0], acme.CRLReasonKeyCompromise); problemType(err) != problemPrefix+"unauthorized" {
+		t.Errorf("RevokeCert() by another account = %v, wanted unauthorized", err)
+	}
+	if err := other.RevokeCert(ctx, certKey, der[0], acme.CRLReasonKeyCompromise); err != nil {
+		t.Errorf("RevokeCert() with the certificate key = %v", err)
+	}
+	if !s.Revoked(leaf.SerialNumber) {
+		t.Error("Revoked() = false after revocation")
+	}
+	// Revoking the certificate again is reported as alreadyRevoked, which
+	// the client deems a success.
+	if err := client.RevokeCert(ctx, nil, der[0], acme.CRLReasonUnspecified); err != nil {
+		t.Errorf("RevokeCert() again = %v", err)
+	}
+}
+
+func TestFailedValidation(t *testing.T) {
+	ctx := context.Background()
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	s := NewServer(chlr)
+	defer s.Close()
+
+	// Don't serve the challenge responses.
+	client := newClient(ctx, t, s, newKey(t))
+	o, challs := placeOrder(ctx, t, client, nil, "example.com")
+	if _, err := client.Accept(ctx, challs[0]); err != nil {
+		t.Fatalf("Accept() = %v", err)
+	}
+	_, err = client.WaitAuthorization(ctx, o.AuthzURLs[0])
+	var ae *acme.AuthorizationError
+	if !errors.As(err, &ae) {
+		t.Fatalf("WaitAuthorization() = %v, wanted an AuthorizationError", err)
+	}
+	if got := problemType(ae.Errors[0]); got != problemPrefix+"unauthorized" {
+		t.Errorf("Challenge error = %s, wanted unauthorized", got)
+	}
+
+	o, err = client.GetOrder(ctx, o.URI)
+	if err != nil {
+		t.Fatalf("GetOrder() = %v", err)
+	}
+	if o.Status != acme.StatusInvalid {
+		t.Errorf("Order status = %s, wanted %s", o.Status, acme.StatusInvalid)
+	}
+}
+
+func TestAuthorizationReuse(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(nil)
+	defer s.Close()
+
+	client := newClient(ctx, t, s, newKey(t))
+	o, challs := placeOrder(ctx, t, client, nil, "example.com")
+	if _, err := client.Accept(ctx, challs[0]); err != nil {
+		t.Fatalf("Accept() = %v", err)
+	}
+
+	// A new order for the same domain reuses the valid authorization.
+	o2, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder() = %v", err)
+	}
+	if o2.Status != acme.StatusReady {
+		t.Errorf("Order status = %s, wanted %s", o2.Status, acme.StatusReady)
+	}
+	if o2.AuthzURLs[0] != o.AuthzURLs[0] {
+		t.Errorf("Authorization = %s, wanted %s", o2.AuthzURLs[0], o.AuthzURLs[0])
+	}
+
+	// Until it's deactivated.
+	if err := client.RevokeAuthorization(ctx, o.AuthzURLs[0]); err != nil {
+		t.Fatalf("RevokeAuthorization() = %v", err)
+	}
+	o3, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com"))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder() = %v", err)
+	}
+	if o3.Status != acme.StatusPending {
+		t.Errorf("Order status = %s, wanted %s", o3.Status, acme.StatusPending)
+	}
+	if o2, err = client.GetOrder(ctx, o2.URI); err != nil {
+		t.Fatalf("GetOrder() = %v", err)
+	} else if o2.Status != acme.StatusInvalid {
+		t.Errorf("Order status after deactivation = %s, wanted %s", o2.Status, acme.StatusInvalid)
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(nil, WithTermsOfService("https://example.com/tos"))
+	defer s.Close()
+
+	key := newKey(t)
+	client := &acme.Client{Key: key, DirectoryURL: s.URL()}
+	if _, err := client.GetReg(ctx, ""); !errors.Is(err, acme.ErrNoAccount) {
+		t.Errorf("GetReg() = %v, wanted %v", err, acme.ErrNoAccount)
+	}
+	refuse := func(string) bool { return false }
+	if _, err := client.Register(ctx, &acme.Account{}, refuse); problemType(err) != problemPrefix+"userActionRequired" {
+		t.Errorf("Register() without agreeing = %v, wanted userActionRequired", err)
+	}
+	acct, err := client.Register(ctx, &acme.Account{Contact: []string{"mailto:a@example.com"}}, acme.AcceptTOS)
+	if err != nil {
+		t.Fatalf("Register() = %v", err)
+	}
+	if _, err := client.Register(ctx, &acme.Account{}, acme.AcceptTOS); !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		t.Errorf("Register() again = %v, wanted %v", err, acme.ErrAccountAlreadyExists)
+	}
+	got, err := client.GetReg(ctx, "")
+	if err != nil {
+		t.Fatalf("GetReg() = %v", err)
+	}
+	if got.URI != acct.URI || got.Status != acme.StatusValid {
+		t.Errorf("GetReg() = %s %s, wanted %s %s", got.URI, got.Status, acct.URI, acme.StatusValid)
+	}
+
+	// Roll over to an RSA key.
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	if err := client.AccountKeyRollover(ctx, newKey); err != nil {
+		t.Fatalf("AccountKeyRollover() = %v", err)
+	}
+	if got, err := (&acme.Client{Key: newKey, DirectoryURL: s.URL()}).GetReg(ctx, ""); err != nil || got.URI != acct.URI {
+		t.Errorf("GetReg() with the new key = %v, %v, wanted %s", got, err, acct.URI)
+	}
+	if _, err := (&acme.Client{Key: key, DirectoryURL: s.URL()}).GetReg(ctx, ""); !errors.Is(err, acme.ErrNoAccount) {
+		t.Errorf("GetReg() with the old key = %v, wanted %v", err, acme.ErrNoAccount)
+	}
+
+	if err := client.DeactivateReg(ctx); err != nil {
+		t.Fatalf("DeactivateReg() = %v", err)
+	}
+	if _, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com")); problemType(err) != problemPrefix+"unauthorized" {
+		t.Errorf("AuthorizeOrder() with a deactivated account = %v, wanted unauthorized", err)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	s := NewServer(nil)
+	defer s.Close()
+	client := newClient(ctx, t, s, newKey(t))
+
+	s.Inject(Fault{
+		Op:      OpNewOrder,
+		Problem: acme.Error{StatusCode: http.StatusForbidden, ProblemType: problemPrefix + "rejectedIdentifier", Detail: "Policy forbids it"},
+		Times:   1,
+	})
+	if _, err := client.AuthorizeOrder(ctx, acme.DomainIDs("example.com")); problemType(err) != problemPrefix+"rejectedIdentifier" {
+		t.Errorf("AuthorizeOrder() = %v, wanted rejectedIdentifier", err)
+	}
+	o, challs := placeOrder(ctx, t, client, nil, "example.com")
+	if got, want := s.Count(OpNewOrder), 2; got != want {
+		t.Errorf("Count(OpNewOrder) = %d, wanted %d", got, want)
+	}
+
+	// Retryable faults are retried by the client.
+	s.Inject(Fault{Op: OpAccept, RetryAfter: time.Second, Times: 1})
+	s.Inject(Fault{
+		Op:      OpValidate,
+		Problem: acme.Error{StatusCode: http.StatusBadRequest, ProblemType: problemPrefix + "connection", Detail: "Connection refused"},
+	})
+	if _, err := client.Accept(ctx, challs[0]); err != nil {
+		t.Fatalf("Accept() = %v", err)
+	}
+	if got, want := s.Count(OpAccept), 2; got != want {
+		t.Errorf("Count(OpAccept) = %d, wanted %d", got, want)
+	}
+	z, err := client.GetAuthorization(ctx, o.AuthzURLs[0])
+	if err != nil {
+		t.Fatalf("GetAuthorization() = %v", err)
+	}
+	if z.Status != acme.StatusInvalid || problemType(z.Challenges[0].Error) != problemPrefix+"connection" {
+		t.Errorf("Authorization = %s %v, wanted invalid with a connection error", z.Status, z.Challenges[0].Error)
+	}
+
+	// Faults that aren't spent last until they're cleared.
+	_, challs = placeOrder(ctx, t, client, nil, "example.com")
+	if ch, err := client.Accept(ctx, challs[0]); err != nil || ch.Status != acme.StatusInvalid {
+		t.Errorf("Accept() = %v, %v, wanted an invalid challenge", ch, err)
+	}
+	s.ClearFaults()
+	_, challs = placeOrder(ctx, t, client, nil, "example.com")
+	if ch, err := client.Accept(ctx, challs[0]); err != nil || ch.Status != acme.StatusValid {
+		t.Errorf("Accept() = %v, %v, wanted a valid challenge", ch, err)
+	}
+}
+
+func TestOrderManager(t *testing.T) {
+	ctx := context.Background()
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	s := NewServer(chlr)
+	defer s.Close()
+
+	ready := make(chan struct{}, 1)
+	om, err := ordermanager.New(ctx, func(interface{}) {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}, chlr, ordermanager.NewMemoryAccountKeyStore(), ordermanager.WithDirectoryURL(s.URL()))
+	if err != nil {
+		t.Fatalf("ordermanager.New() = %v", err)
+	}
+
+	domains := []string{"example.com"}
+	noSelfCheck := ordermanager.WithSelfCheck(ordermanager.SelfCheck{})
+	challs, cert, err := om.Order(ctx, domains, "owner", noSelfCheck)
+	if err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	// The challenge is validated as soon as it's accepted, so the order
+	// may well have moved on by the time Order returns.
+	if cert == nil {
+		if len(challs) > 1 {
+			t.Fatalf("Order() = %v, wanted at most one challenge", challs)
+		}
+		select {
+		case <-ready:
+		case <-time.After(30 * time.Second):
+			t.Fatal("Timed out waiting for the order to complete")
+		}
+		if _, cert, err = om.Order(ctx, domains, "owner", noSelfCheck); err != nil {
+			t.Fatalf("Order() = %v", err)
+		}
+	}
+	if cert == nil {
+		t.Fatal("Order() returned no certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() = %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Root())
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: domains[0], Roots: roots}); err != nil {
+		t.Errorf("Verify() = %v", err)
+	}
+}
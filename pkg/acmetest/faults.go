@@ -0,0 +1,149 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acmetest
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Op identifies an operation of the ACME protocol, for injecting failures
+// into the requests for it and counting them.
+type Op string
+
+// The operations of the ACME protocol that the Server handles.
+const (
+	// OpNewAccount is registering or looking up an account.
+	OpNewAccount Op = "newAccount"
+
+	// OpUpdateAccount is updating or deactivating an account.
+	OpUpdateAccount Op = "updateAccount"
+
+	// OpKeyChange is rolling an account over to a new key.
+	OpKeyChange Op = "keyChange"
+
+	// OpNewOrder is placing a new order.
+	OpNewOrder Op = "newOrder"
+
+	// OpGetOrder is fetching an order.
+	OpGetOrder Op = "getOrder"
+
+	// OpGetAuthorization is fetching or deactivating an authorization.
+	OpGetAuthorization Op = "getAuthorization"
+
+	// OpAccept is telling the CA that the response to a challenge is ready.
+	OpAccept Op = "accept"
+
+	// OpValidate is the CA validating the response to a challenge.  Faults
+	// of this operation fail the challenge with their problem, rather than
+	// the request that accepted it.
+	OpValidate Op = "validate"
+
+	// OpFinalize is finalizing an order with a CSR.
+	OpFinalize Op = "finalize"
+
+	// OpGetCertificate is fetching an issued certificate.
+	OpGetCertificate Op = "getCertificate"
+
+	// OpRevoke is revoking a certificate.
+	OpRevoke Op = "revoke"
+)
+
+// Fault is a failure injected into the requests for an operation.
+type Fault struct {
+	// Op is the operation whose requests fail.
+	Op Op
+
+	// Problem is the problem document with which the requests fail.  Its
+	// StatusCode defaults to 500 Internal Server Error, and its ProblemType
+	// to serverInternal.
+	Problem acme.Error
+
+	// RetryAfter, when set, asks clients to wait that long before trying
+	// again.
+	RetryAfter time.Duration
+
+	// Times is how many requests fail, after which the fault is spent.
+	// When zero, requests fail until the faults are cleared.
+	Times int
+}
+
+// Inject makes the requests for the operation of the fault fail.  Faults
+// are applied in the order in which they are injected.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f.Problem.StatusCode == 0 {
+		f.Problem.StatusCode = http.StatusInternalServerError
+	}
+	if f.Problem.ProblemType == "" {
+		f.Problem.ProblemType = problemPrefix + "serverInternal"
+	}
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all of the injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = nil
+}
+
+// Count returns the number of requests for the operation, including those
+// that failed.
+func (s *Server) Count(op Op) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.counts[op]
+}
+
+// fault counts a request for the operation, and returns the fault that
+// the request fails with, if any.  s.mu must be held.
+func (s *Server) fault(op Op) *Fault {
+	s.counts[op]++
+	for i, f := range s.faults {
+		if f.Op != op {
+			continue
+		}
+		if f.Times > 0 {
+			if f.Times--; f.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// problem returns the problem of the fault.
+func (f *Fault) problem() *problem {
+	p := &problem{
+		Status: f.Problem.StatusCode,
+		Type:   f.Problem.ProblemType,
+		Detail: f.Problem.Detail,
+	}
+	if f.RetryAfter > 0 {
+		p.retryAfter = strconv.Itoa(int(f.RetryAfter.Round(time.Second) / time.Second))
+	}
+	return p
+}
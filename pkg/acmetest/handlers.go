@@ -0,0 +1,695 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acmetest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	statusPending     = "pending"
+	statusReady       = "ready"
+	statusValid       = "valid"
+	statusInvalid     = "invalid"
+	statusExpired     = "expired"
+	statusDeactivated = "deactivated"
+
+	// resourceLifetime is how long orders and authorizations stay valid.
+	resourceLifetime = 7 * 24 * time.Hour
+)
+
+type account struct {
+	id      string
+	key     crypto.PublicKey
+	status  string
+	contact []string
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	id          string
+	account     *account
+	status      string
+	expires     time.Time
+	identifiers []identifier
+	authzs      []*authz
+	err         *problem
+	cert        *issued
+}
+
+type authz struct {
+	id         string
+	account    *account
+	identifier identifier
+	status     string
+	expires    time.Time
+	challenges []*challenge
+}
+
+type challenge struct {
+	id        string
+	authz     *authz
+	typ       string
+	token     string
+	status    string
+	validated time.Time
+	err       *problem
+}
+
+type issued struct {
+	id      string
+	order   *order
+	der     []byte
+	revoked bool
+}
+
+// Revoked returns whether the certificate with the serial number, which the
+// Server issued, has been revoked.
+func (s *Server) Revoked(serial *big.Int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.certs[serial.String()]
+	return c != nil && c.revoked
+}
+
+// newAccount registers an account for the key that signed the request, or
+// looks up the account already registered for it.
+func (s *Server) newAccount(req *request) (*reply, *problem) {
+	var payload struct {
+		Contact            []string `json:"contact"`
+		TermsAgreed        bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting bool     `json:"onlyReturnExisting"`
+	}
+	if p := unmarshal(req.payload, &payload); p != nil {
+		return nil, p
+	}
+	tp, err := acme.JWKThumbprint(req.key)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+	}
+	if acct := s.accountFor(tp); acct != nil {
+		if acct.status != statusValid {
+			return nil, newProblem(http.StatusUnauthorized, "unauthorized", "Account is %s", acct.status)
+		}
+		return s.accountReply(http.StatusOK, acct), nil
+	}
+	if payload.OnlyReturnExisting {
+		return nil, newProblem(http.StatusBadRequest, "accountDoesNotExist", "No account exists for the key")
+	}
+	if s.terms != "" && !payload.TermsAgreed {
+		return nil, newProblem(http.StatusForbidden, "userActionRequired", "The terms of service at %s must be agreed to", s.terms)
+	}
+	acct := &account{
+		id:      s.newID(),
+		key:     req.key,
+		status:  statusValid,
+		contact: payload.Contact,
+	}
+	s.accounts[acct.id] = acct
+	return s.accountReply(http.StatusCreated, acct), nil
+}
+
+// updateAccount fetches, updates or deactivates the account.
+func (s *Server) updateAccount(req *request, id string) (*reply, *problem) {
+	if req.account.id != id {
+		return nil, newProblem(http.StatusForbidden, "unauthorized", "Account %s doesn't belong to the requester", id)
+	}
+	var payload struct {
+		Contact []string `json:"contact"`
+		Status  string   `json:"status"`
+	}
+	if p := unmarshal(req.payload, &payload); p != nil {
+		return nil, p
+	}
+	switch payload.Status {
+	case "":
+	case statusDeactivated:
+		req.account.status = statusDeactivated
+	default:
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Invalid account status %q", payload.Status)
+	}
+	if payload.Contact != nil {
+		req.account.contact = payload.Contact
+	}
+	return s.accountReply(http.StatusOK, req.account), nil
+}
+
+// keyChange rolls the account over to the key that signed the inner JWS.
+func (s *Server) keyChange(req *request) (*reply, *problem) {
+	var inner jws
+	if p := unmarshal(req.payload, &inner); p != nil {
+		return nil, p
+	}
+	h, payload, err := inner.decode()
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Parsing inner JWS: %v", err)
+	}
+	if h.URL != s.srv.URL+keyChangePath {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Inner JWS url %q doesn't match", h.URL)
+	}
+	key, err := publicKey(h.JWK)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "badPublicKey", "%v", err)
+	}
+	if err := inner.verify(h.Alg, key); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Verifying inner JWS: %v", err)
+	}
+	var change struct {
+		Account string          `json:"account"`
+		OldKey  json.RawMessage `json:"oldKey"`
+	}
+	if p := unmarshal(payload, &change); p != nil {
+		return nil, p
+	}
+	if change.Account != s.url("account", req.account.id) {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Inner JWS is for account %q", change.Account)
+	}
+	oldKey, err := publicKey(change.OldKey)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Parsing oldKey: %v", err)
+	}
+	if thumbprint(oldKey) != thumbprint(req.account.key) {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "oldKey isn't the key of the account")
+	}
+	if acct := s.accountFor(thumbprint(key)); acct != nil {
+		return nil, newProblem(http.StatusConflict, "malformed", "The new key is in use by account %s", s.url("account", acct.id))
+	}
+	req.account.key = key
+	return s.accountReply(http.StatusOK, req.account), nil
+}
+
+// accountFor returns the account with the key of the thumbprint, if any.
+func (s *Server) accountFor(tp string) *account {
+	for _, acct := range s.accounts {
+		if thumbprint(acct.key) == tp {
+			return acct
+		}
+	}
+	return nil
+}
+
+func (s *Server) accountReply(status int, acct *account) *reply {
+	return &reply{
+		status:   status,
+		location: s.url("account", acct.id),
+		body: struct {
+			Status  string   `json:"status"`
+			Contact []string `json:"contact,omitempty"`
+		}{acct.status, acct.contact},
+	}
+}
+
+// newOrder places an order for the identifiers of the request.  Like most
+// CAs, valid authorizations of the account are reused rather than created
+// anew.
+func (s *Server) newOrder(req *request) (*reply, *problem) {
+	var payload struct {
+		Identifiers []identifier `json:"identifiers"`
+	}
+	if p := unmarshal(req.payload, &payload); p != nil {
+		return nil, p
+	}
+	if len(payload.Identifiers) == 0 {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Order has no identifiers")
+	}
+	now := s.clock.Now()
+	o := &order{
+		id:          s.newID(),
+		account:     req.account,
+		status:      statusPending,
+		expires:     now.Add(resourceLifetime),
+		identifiers: payload.Identifiers,
+	}
+	for _, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			return nil, newProblem(http.StatusBadRequest, "unsupportedIdentifier", "Identifier type %q isn't supported", id.Type)
+		}
+		if id.Value == "" || strings.HasPrefix(id.Value, "*.") {
+			return nil, newProblem(http.StatusBadRequest, "rejectedIdentifier", "Identifier %q can't be validated over http-01", id.Value)
+		}
+		z := s.reusableAuthz(req.account, id)
+		if z == nil {
+			z = s.newAuthz(req.account, id, now)
+		}
+		o.authzs = append(o.authzs, z)
+	}
+	s.orders[o.id] = o
+	s.refresh(o)
+	return s.orderReply(http.StatusCreated, o), nil
+}
+
+// reusableAuthz returns a valid authorization of the account for the
+// identifier, if any.
+func (s *Server) reusableAuthz(acct *account, id identifier) *authz {
+	for _, z := range s.authzs {
+		s.refreshAuthz(z)
+		if z.account == acct && z.identifier == id && z.status == statusValid {
+			return z
+		}
+	}
+	return nil
+}
+
+func (s *Server) newAuthz(acct *account, id identifier, now time.Time) *authz {
+	z := &authz{
+		id:         s.newID(),
+		account:    acct,
+		identifier: id,
+		status:     statusPending,
+		expires:    now.Add(resourceLifetime),
+	}
+	ch := &challenge{
+		id:     s.newID(),
+		authz:  z,
+		typ:    "http-01",
+		token:  randomToken(),
+		status: statusPending,
+	}
+	z.challenges = []*challenge{ch}
+	s.authzs[z.id] = z
+	s.challenges[ch.id] = ch
+	return z
+}
+
+// getOrder fetches the order.
+func (s *Server) getOrder(req *request, id string) (*reply, *problem) {
+	o := s.orders[id]
+	if o == nil {
+		return nil, newProblem(http.StatusNotFound, "malformed", "No order %s", id)
+	}
+	if o.account != req.account {
+		return nil, newProblem(http.StatusForbidden, "unauthorized", "Order %s doesn't belong to the requester", id)
+	}
+	if len(req.payload) != 0 {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Orders can only be fetched with POST-as-GET")
+	}
+	s.refresh(o)
+	return s.orderReply(http.StatusOK, o), nil
+}
+
+// finalize issues the certificate of the ready order for the CSR of the
+// request.
+func (s *Server) finalize(req *request, id string) (*reply, *problem) {
+	o := s.orders[id]
+	if o == nil {
+		return nil, newProblem(http.StatusNotFound, "malformed", "No order %s", id)
+	}
+	if o.account != req.account {
+		return nil, newProblem(http.StatusForbidden, "unauthorized", "Order %s doesn't belong to the requester", id)
+	}
+	s.refresh(o)
+	if o.status != statusReady {
+		return nil, newProblem(http.StatusForbidden, "orderNotReady", "Order %s is %s", id, o.status)
+	}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if p := unmarshal(req.payload, &payload); p != nil {
+		return nil, p
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "badCSR", "Decoding CSR: %v", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "badCSR", "Parsing CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, newProblem(http.StatusBadRequest, "badCSR", "Verifying CSR: %v", err)
+	}
+	names := csrNames(csr)
+	if want := orderNames(o); strings.Join(names, ",") != strings.Join(want, ",") {
+		return nil, newProblem(http.StatusBadRequest, "badCSR", "CSR names %v don't match the order's %v", names, want)
+	}
+
+	c, err := s.issue(o, csr, names)
+	if err != nil {
+		return nil, newProblem(http.StatusInternalServerError, "serverInternal", "Issuing certificate: %v", err)
+	}
+	o.cert = c
+	o.status = statusValid
+	return s.orderReply(http.StatusOK, o), nil
+}
+
+// issue signs a certificate for the names with the key of the CSR.
+func (s *Server) issue(o *order, csr *x509.CertificateRequest, names []string) (*issued, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(s.lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &issued{id: serial.String(), order: o, der: der}
+	s.certs[c.id] = c
+	return c, nil
+}
+
+// refresh updates the status of the order from that of its authorizations.
+func (s *Server) refresh(o *order) {
+	if o.status != statusPending && o.status != statusReady {
+		return
+	}
+	if s.clock.Now().After(o.expires) {
+		o.status = statusInvalid
+		o.err = newProblem(http.StatusForbidden, "malformed", "Order expired")
+		return
+	}
+	ready := true
+	for _, z := range o.authzs {
+		s.refreshAuthz(z)
+		switch z.status {
+		case statusValid:
+		case statusPending:
+			ready = false
+		default:
+			o.status = statusInvalid
+			o.err = newProblem(http.StatusForbidden, "unauthorized", "Authorization for %q is %s", z.identifier.Value, z.status)
+			for _, ch := range z.challenges {
+				if ch.err != nil {
+					o.err = ch.err
+				}
+			}
+			return
+		}
+	}
+	if ready {
+		o.status = statusReady
+	}
+}
+
+// refreshAuthz expires the authorization once it's past its expiry.
+func (s *Server) refreshAuthz(z *authz) {
+	if (z.status == statusPending || z.status == statusValid) && s.clock.Now().After(z.expires) {
+		z.status = statusExpired
+	}
+}
+
+func (s *Server) orderReply(status int, o *order) *reply {
+	v := struct {
+		Status         string       `json:"status"`
+		Expires        time.Time    `json:"expires"`
+		Identifiers    []identifier `json:"identifiers"`
+		Authorizations []string     `json:"authorizations"`
+		Finalize       string       `json:"finalize"`
+		Certificate    string       `json:"certificate,omitempty"`
+		Error          *problem     `json:"error,omitempty"`
+	}{
+		Status:      o.status,
+		Expires:     o.expires,
+		Identifiers: o.identifiers,
+		Finalize:    s.url("order", o.id) + "/finalize",
+		Error:       o.err,
+	}
+	for _, z := range o.authzs {
+		v.Authorizations = append(v.Authorizations, s.url("authz", z.id))
+	}
+	if o.cert != nil {
+		v.Certificate = s.url("cert", o.cert.id)
+	}
+	return &reply{status: status, location: s.url("order", o.id), body: v}
+}
+
+// getAuthorization fetches or deactivates the authorization.
+func (s *Server) getAuthorization(req *request, id string) (*reply, *problem) {
+	z := s.authzs[id]
+	if z == nil {
+		return nil, newProblem(http.StatusNotFound, "malformed", "No authorization %s", id)
+	}
+	if z.account != req.account {
+		return nil, newProblem(http.StatusForbidden, "unauthorized", "Authorization %s doesn't belong to the requester", id)
+	}
+	s.refreshAuthz(z)
+	if len(req.payload) != 0 {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		if p := unmarshal(req.payload, &payload); p != nil {
+			return nil, p
+		}
+		if payload.Status != statusDeactivated {
+			return nil, newProblem(http.StatusBadRequest, "malformed", "Invalid authorization status %q", payload.Status)
+		}
+		if z.status != statusPending && z.status != statusValid {
+			return nil, newProblem(http.StatusForbidden, "malformed", "Authorization %s is %s", id, z.status)
+		}
+		z.status = statusDeactivated
+	}
+	return s.authzReply(z), nil
+}
+
+func (s *Server) authzReply(z *authz) *reply {
+	v := struct {
+		Identifier identifier    `json:"identifier"`
+		Status     string        `json:"status"`
+		Expires    time.Time     `json:"expires"`
+		Challenges []interface{} `json:"challenges"`
+	}{
+		Identifier: z.identifier,
+		Status:     z.status,
+		Expires:    z.expires,
+	}
+	for _, ch := range z.challenges {
+		v.Challenges = append(v.Challenges, s.challengeJSON(ch))
+	}
+	return &reply{status: http.StatusOK, location: s.url("authz", z.id), body: v}
+}
+
+// accept validates the challenge when the request asks for it, or fetches
+// it when the request is a POST-as-GET.
+func (s *Server) accept(req *request, id string) (*reply, *problem) {
+	ch := s.challenges[id]
+	if ch == nil {
+		return nil, newProblem(http.StatusNotFound, "malformed", "No challenge %s", id)
+	}
+	if ch.authz.account != req.account {
+		return nil, newProblem(http.StatusForbidden, "unauthorized", "Challenge %s doesn't belong to the requester", id)
+	}
+	s.refreshAuthz(ch.authz)
+	if len(req.payload) != 0 && ch.status == statusPending && ch.authz.status == statusPending {
+		s.validate(ch)
+	}
+	return &reply{status: http.StatusOK, body: s.challengeJSON(ch)}, nil
+}
+
+// validate checks the response to the challenge and updates the challenge
+// and its authorization accordingly.
+func (s *Server) validate(ch *challenge) {
+	var p *problem
+	if f := s.fault(OpValidate); f != nil {
+		p = f.problem()
+	} else {
+		p = s.check(ch)
+	}
+	if p != nil {
+		ch.status, ch.err = statusInvalid, p
+		ch.authz.status = statusInvalid
+		return
+	}
+	ch.status, ch.validated = statusValid, s.clock.Now()
+	ch.authz.status = statusValid
+}
+
+// check fetches the response to the http-01 challenge from the challenger.
+func (s *Server) check(ch *challenge) *problem {
+	if s.chlr == nil {
+		return nil
+	}
+	want, err := acme.JWKThumbprint(ch.authz.account.key)
+	if err != nil {
+		return newProblem(http.StatusInternalServerError, "serverInternal", "%v", err)
+	}
+	want = ch.token + "." + want
+
+	url := "http://" + ch.authz.identifier.Value + "/.well-known/acme-challenge/" + ch.token
+	rec := httptest.NewRecorder()
+	s.chlr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != http.StatusOK {
+		return newProblem(http.StatusForbidden, "unauthorized", "Invalid response from %s: %d", url, rec.Code)
+	}
+	if got := strings.TrimSpace(rec.Body.String()); got != want {
+		return newProblem(http.StatusForbidden, "unauthorized", "The key authorization at %s was %q, wanted %q", url, got, want)
+	}
+	return nil
+}
+
+func (s *Server) challengeJSON(ch *challenge) interface{} {
+	v := struct {
+		URL       string     `json:"url"`
+		Type      string     `json:"type"`
+		Token     string     `json:"token"`
+		Status    string     `json:"status"`
+		Validated *time.Time `json:"validated,omitempty"`
+		Error     *problem   `json:"error,omitempty"`
+	}{
+		URL:    s.url("chall", ch.id),
+		Type:   ch.typ,
+		Token:  ch.token,
+		Status: ch.status,
+		Error:  ch.err,
+	}
+	if !ch.validated.IsZero() {
+		v.Validated = &ch.validated
+	}
+	return v
+}
+
+// getCertificate fetches the chain of the certificate in PEM.
+func (s *Server) getCertificate(req *request, id string) (*reply, *problem) {
+	c := s.certs[id]
+	if c == nil {
+		return nil, newProblem(http.StatusNotFound, "malformed", "No certificate %s", id)
+	}
+	if c.order.account != req.account {
+		return nil, newProblem(http.StatusForbidden, "unauthorized", "Certificate %s doesn't belong to the requester", id)
+	}
+	var b bytes.Buffer
+	pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	pem.Encode(&b, &pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw})
+	return &reply{
+		status:      http.StatusOK,
+		body:        b.Bytes(),
+		contentType: "application/pem-certificate-chain",
+	}, nil
+}
+
+// revokeCert revokes the certificate of the request, which must be signed
+// by the account that ordered it or by the key of the certificate.
+func (s *Server) revokeCert(req *request) (*reply, *problem) {
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	if p := unmarshal(req.payload, &payload); p != nil {
+		return nil, p
+	}
+	der, err := base64.RawURLEncoding.DecodeString(payload.Certificate)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Decoding certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, "malformed", "Parsing certificate: %v", err)
+	}
+	c := s.certs[cert.SerialNumber.String()]
+	if c == nil || !bytes.Equal(c.der, der) {
+		return nil, newProblem(http.StatusNotFound, "malformed", "Certificate wasn't issued by this CA")
+	}
+	if req.account != c.order.account && (req.account != nil || thumbprint(req.key) != thumbprint(cert.PublicKey)) {
+		return nil, newProblem(http.StatusForbidden, "unauthorized", "Requester may not revoke the certificate")
+	}
+	if c.revoked {
+		return nil, newProblem(http.StatusBadRequest, "alreadyRevoked", "Certificate is already revoked")
+	}
+	c.revoked = true
+	return &reply{status: http.StatusOK, body: struct{}{}}, nil
+}
+
+// unmarshal parses the payload of a request, where an empty payload is
+// taken as an empty object.
+func unmarshal(payload []byte, v interface{}) *problem {
+	if len(payload) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return newProblem(http.StatusBadRequest, "malformed", "Parsing payload: %v", err)
+	}
+	return nil
+}
+
+// csrNames returns the sorted, unique names that the CSR asks for.
+func csrNames(csr *x509.CertificateRequest) []string {
+	names := csr.DNSNames
+	if csr.Subject.CommonName != "" {
+		names = append([]string{csr.Subject.CommonName}, names...)
+	}
+	return uniqueSorted(names)
+}
+
+// orderNames returns the sorted, unique names of the order's identifiers.
+func orderNames(o *order) []string {
+	names := make([]string, 0, len(o.identifiers))
+	for _, id := range o.identifiers {
+		names = append(names, id.Value)
+	}
+	return uniqueSorted(names)
+}
+
+func uniqueSorted(names []string) []string {
+	seen := make(map[string]struct{}, len(names))
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		n = strings.ToLower(n)
+		if _, ok := seen[n]; !ok {
+			seen[n] = struct{}{}
+			out = append(out, n)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// thumbprint returns the JWK thumbprint of the key, or "" when the key isn't
+// supported.
+func thumbprint(key crypto.PublicKey) string {
+	tp, err := acme.JWKThumbprint(key)
+	if err != nil {
+		return ""
+	}
+	return tp
+}
+
+// randomToken returns a random, URL-safe token.
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package acmetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+// jws is a JSON Web Signature in the flattened JSON serialization that
+// ACME requests are sent in.
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// protectedHeader is the protected header of the JWS of ACME requests.
+type protectedHeader struct {
+	Alg   string          `json:"alg"`
+	KID   string          `json:"kid"`
+	JWK   json.RawMessage `json:"jwk"`
+	Nonce string          `json:"nonce"`
+	URL   string          `json:"url"`
+}
+
+// jwk is a JSON Web Key holding the public part of an RSA or ECDSA key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// decode parses the protected header and the payload of the JWS.
+func (j *jws) decode() (*protectedHeader, []byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(j.Protected)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding protected header: %w", err)
+	}
+	var h protectedHeader
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, nil, fmt.Errorf("parsing protected header: %w", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(j.Payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding payload: %w", err)
+	}
+	return &h, payload, nil
+}
+
+// verify checks the signature of the JWS with the public key.
+func (j *jws) verify(alg string, pub crypto.PublicKey) error {
+	sig, err := base64.RawURLEncoding.DecodeString(j.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %w", err)
+	}
+	var h hash.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = sha256.New()
+	case "ES384":
+		h = sha512.New384()
+	case "ES512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h.Write([]byte(j.Protected + "." + j.Payload))
+	digest := h.Sum(nil)
+
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return fmt.Errorf("algorithm %q doesn't match the RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig)
+	case *ecdsa.PublicKey:
+		n := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*n {
+			return errors.New("malformed ECDSA signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// publicKey parses the JWK into the public key it holds.
+func publicKey(raw json.RawMessage) (crypto.PublicKey, error) {
+	var k jwk
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return nil, fmt.Errorf("parsing JWK: %w", err)
+	}
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
@@ -31,6 +31,16 @@ type Interface interface {
 	UnregisterChallenge(path string)
 }
 
+// ContextInterface is implemented by challengers that make calls to register
+// and unregister challenges, e.g. to share them between replicas, which the
+// given context bounds.
+type ContextInterface interface {
+	Interface
+
+	RegisterChallengeContext(ctx context.Context, path, response string) error
+	UnregisterChallengeContext(ctx context.Context, path string) error
+}
+
 // New creates a new challenger instance, which can be exposed on an http.Server.
 func New(ctx context.Context) (Interface, error) {
 	return &challenger{}, nil
@@ -64,17 +74,20 @@ func (c *challenger) UnregisterChallenge(path string) {
 }
 
 func (c *challenger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c.RLock()
-	defer c.RUnlock()
-
-	if c.paths == nil {
-		http.Error(w, "Unknown path", http.StatusNotFound)
-		return
-	}
-	resp, ok := c.paths[r.URL.Path]
+	resp, ok := c.lookup(r.URL.Path)
+	recordRequest("http-01", ok)
 	if !ok {
 		http.Error(w, "Unknown path", http.StatusNotFound)
 		return
 	}
 	w.Write([]byte(resp))
 }
+
+// lookup returns the response registered for the given path, if any.
+func (c *challenger) lookup(path string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	resp, ok := c.paths[path]
+	return resp, ok
+}
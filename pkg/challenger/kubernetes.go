@@ -0,0 +1,278 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package challenger
+
+import (
+	"bytes"
+	context "context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/util/retry"
+	logging "knative.dev/pkg/logging"
+)
+
+// ChallengesSecretName is the name of the Secret in the system namespace
+// through which challenge responses are shared between replicas.
+const ChallengesSecretName = "net-http01-challenges"
+
+// TLSALPNSecretName is the name of the Secret in the system namespace
+// through which TLS-ALPN challenge certificates are shared between replicas.
+const TLSALPNSecretName = "net-http01-tls-alpn-challenges"
+
+// NewKubernetes creates a challenger whose challenge responses are stored in
+// the named Secret, so that every replica of the controller serves the
+// challenges registered by any of them.  Responses are read through the
+// given lister, and registered responses are also served locally while
+// the lister catches up.
+func NewKubernetes(ctx context.Context, client kubernetes.Interface, lister corev1listers.SecretLister, namespace, name string) (Interface, error) {
+	return &kubernetesChallenger{
+		ctx:       ctx,
+		client:    client,
+		lister:    lister,
+		namespace: namespace,
+		name:      name,
+	}, nil
+}
+
+type kubernetesChallenger struct {
+	// local holds the challenges that this replica registered.
+	local challenger
+
+	ctx       context.Context
+	client    kubernetes.Interface
+	lister    corev1listers.SecretLister
+	namespace string
+	name      string
+}
+
+var _ ContextInterface = (*kubernetesChallenger)(nil)
+
+func (c *kubernetesChallenger) RegisterChallenge(path, response string) {
+	if err := c.RegisterChallengeContext(c.ctx, path, response); err != nil {
+		logging.FromContext(c.ctx).Errorf("Error sharing challenge %q: %v", path, err)
+	}
+}
+
+func (c *kubernetesChallenger) UnregisterChallenge(path string) {
+	if err := c.UnregisterChallengeContext(c.ctx, path); err != nil {
+		logging.FromContext(c.ctx).Errorf("Error removing shared challenge %q: %v", path, err)
+	}
+}
+
+// RegisterChallengeContext implements ContextInterface
+func (c *kubernetesChallenger) RegisterChallengeContext(ctx context.Context, path, response string) error {
+	c.local.RegisterChallenge(path, response)
+	return updateSecret(ctx, c.client, c.namespace, c.name, func(data map[string][]byte) {
+		data[secretKey(path)] = []byte(response)
+	})
+}
+
+// UnregisterChallengeContext implements ContextInterface
+func (c *kubernetesChallenger) UnregisterChallengeContext(ctx context.Context, path string) error {
+	c.local.UnregisterChallenge(path)
+	return updateSecret(ctx, c.client, c.namespace, c.name, func(data map[string][]byte) {
+		delete(data, secretKey(path))
+	})
+}
+
+func (c *kubernetesChallenger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp, ok := c.local.lookup(r.URL.Path)
+	if !ok {
+		resp, ok = c.shared(r.URL.Path)
+	}
+	recordRequest("http-01", ok)
+	if !ok {
+		http.Error(w, "Unknown path", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(resp))
+}
+
+// shared returns the response that any of the replicas registered for the
+// given path, if any.
+func (c *kubernetesChallenger) shared(path string) (string, bool) {
+	secret, err := c.lister.Secrets(c.namespace).Get(c.name)
+	if err != nil {
+		return "", false
+	}
+	resp, ok := secret.Data[secretKey(path)]
+	return string(resp), ok
+}
+
+// NewKubernetesTLSALPN creates a TLS-ALPN challenger whose challenge
+// certificates are stored in the named Secret, so that every replica of the
+// controller presents the certificates registered by any of them.
+// Certificates are read through the given lister, and registered
+// certificates are also presented locally while the lister catches up.
+func NewKubernetesTLSALPN(ctx context.Context, client kubernetes.Interface, lister corev1listers.SecretLister, namespace, name string) (TLSALPNInterface, error) {
+	return &kubernetesTLSALPN{
+		ctx:       ctx,
+		client:    client,
+		lister:    lister,
+		namespace: namespace,
+		name:      name,
+	}, nil
+}
+
+type kubernetesTLSALPN struct {
+	// local holds the certificates that this replica registered.
+	local tlsALPN
+
+	ctx       context.Context
+	client    kubernetes.Interface
+	lister    corev1listers.SecretLister
+	namespace string
+	name      string
+}
+
+var _ TLSALPNContextInterface = (*kubernetesTLSALPN)(nil)
+
+func (c *kubernetesTLSALPN) RegisterCertificate(domain string, cert *tls.Certificate) {
+	if err := c.RegisterCertificateContext(c.ctx, domain, cert); err != nil {
+		logging.FromContext(c.ctx).Errorf("Error sharing challenge certificate for %q: %v", domain, err)
+	}
+}
+
+func (c *kubernetesTLSALPN) UnregisterCertificate(domain string) {
+	if err := c.UnregisterCertificateContext(c.ctx, domain); err != nil {
+		logging.FromContext(c.ctx).Errorf("Error removing shared challenge certificate for %q: %v", domain, err)
+	}
+}
+
+// RegisterCertificateContext implements TLSALPNContextInterface
+func (c *kubernetesTLSALPN) RegisterCertificateContext(ctx context.Context, domain string, cert *tls.Certificate) error {
+	c.local.RegisterCertificate(domain, cert)
+	b, err := encodeCertificate(cert)
+	if err != nil {
+		return err
+	}
+	return updateSecret(ctx, c.client, c.namespace, c.name, func(data map[string][]byte) {
+		data[secretKey(strings.ToLower(domain))] = b
+	})
+}
+
+// UnregisterCertificateContext implements TLSALPNContextInterface
+func (c *kubernetesTLSALPN) UnregisterCertificateContext(ctx context.Context, domain string) error {
+	c.local.UnregisterCertificate(domain)
+	return updateSecret(ctx, c.client, c.namespace, c.name, func(data map[string][]byte) {
+		delete(data, secretKey(strings.ToLower(domain)))
+	})
+}
+
+func (c *kubernetesTLSALPN) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// Challenge certificates must only be presented when the CA asks
+	// for them through the acme-tls/1 protocol.
+	if !supportsACMEProto(hello.SupportedProtos) {
+		return nil, errors.New("client did not negotiate the acme-tls/1 protocol")
+	}
+
+	cert, ok := c.local.lookup(hello.ServerName)
+	if !ok {
+		cert, ok = c.shared(hello.ServerName)
+	}
+	recordRequest("tls-alpn-01", ok)
+	if !ok {
+		return nil, fmt.Errorf("unknown server name %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// shared returns the certificate that any of the replicas registered for
+// the given domain, if any.
+func (c *kubernetesTLSALPN) shared(domain string) (*tls.Certificate, bool) {
+	secret, err := c.lister.Secrets(c.namespace).Get(c.name)
+	if err != nil {
+		return nil, false
+	}
+	b, ok := secret.Data[secretKey(strings.ToLower(domain))]
+	if !ok {
+		return nil, false
+	}
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		logging.FromContext(c.ctx).Errorf("Error decoding shared challenge certificate for %q: %v", domain, err)
+		return nil, false
+	}
+	return &cert, true
+}
+
+// encodeCertificate encodes the certificate chain and private key as PEM,
+// in the form that tls.X509KeyPair reads back.
+func encodeCertificate(cert *tls.Certificate) ([]byte, error) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+	if err := pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: key}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// updateSecret applies mutate to the data of the named Secret, which is
+// created if it doesn't exist yet.
+func updateSecret(ctx context.Context, client kubernetes.Interface, namespace, name string, mutate func(map[string][]byte)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: namespace,
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: make(map[string][]byte, 1),
+			}
+			mutate(secret.Data)
+			_, err = client.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		secret = secret.DeepCopy()
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte, 1)
+		}
+		mutate(secret.Data)
+		_, err = client.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// secretKey encodes the path as a valid Secret data key.
+func secretKey(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path))
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package challenger
+
+import (
+	"bytes"
+	context "context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestKubernetesSharesChallenges(t *testing.T) {
+	const (
+		namespace = "knative-serving"
+		path      = "/.well-known/acme-challenge/the-token"
+		payload   = "the-response"
+	)
+	ctx := context.Background()
+	client := fakekube.NewSimpleClientset()
+
+	// Stand in for the informer that each replica's lister is fed by.
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	lister := corev1listers.NewSecretLister(indexer)
+	sync := func() {
+		t.Helper()
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, ChallengesSecretName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get() = %v", err)
+		}
+		indexer.Update(secret)
+	}
+	serve := func(c Interface) (int, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		body, err := io.ReadAll(rec.Result().Body)
+		if err != nil {
+			t.Fatalf("ReadAll() = %v", err)
+		}
+		return rec.Result().StatusCode, string(body)
+	}
+
+	registrar, err := NewKubernetes(ctx, client, lister, namespace, ChallengesSecretName)
+	if err != nil {
+		t.Fatalf("NewKubernetes() = %v", err)
+	}
+	other, err := NewKubernetes(ctx, client, lister, namespace, ChallengesSecretName)
+	if err != nil {
+		t.Fatalf("NewKubernetes() = %v", err)
+	}
+
+	if got, _ := serve(other); got != http.StatusNotFound {
+		t.Errorf("ServeHTTP(before register) = %d, wanted %d", got, http.StatusNotFound)
+	}
+
+	registrar.RegisterChallenge(path, payload)
+
+	// The registering replica serves the challenge right away.
+	if got, body := serve(registrar); got != http.StatusOK || body != payload {
+		t.Errorf("ServeHTTP(registrar) = %d, %q, wanted %d, %q", got, body, http.StatusOK, payload)
+	}
+	// The other replica serves it once its lister has caught up.
+	sync()
+	if got, body := serve(other); got != http.StatusOK || body != payload {
+		t.Errorf("ServeHTTP(other) = %d, %q, wanted %d, %q", got, body, http.StatusOK, payload)
+	}
+
+	registrar.UnregisterChallenge(path)
+	sync()
+	for name, c := range map[string]Interface{"registrar": registrar, "other": other} {
+		if got, _ := serve(c); got != http.StatusNotFound {
+			t.Errorf("ServeHTTP(%s, after unregister) = %d, wanted %d", name, got, http.StatusNotFound)
+		}
+	}
+}
+
+func TestKubernetesSharesTLSALPNCertificates(t *testing.T) {
+	const namespace = "knative-serving"
+	ctx := context.Background()
+	client := fakekube.NewSimpleClientset()
+
+	// Stand in for the informer that each replica's lister is fed by.
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	lister := corev1listers.NewSecretLister(indexer)
+	sync := func() {
+		t.Helper()
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, TLSALPNSecretName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get() = %v", err)
+		}
+		indexer.Update(secret)
+	}
+	hello := &tls.ClientHelloInfo{
+		ServerName:      "example.com",
+		SupportedProtos: []string{acme.ALPNProto},
+	}
+
+	registrar, err := NewKubernetesTLSALPN(ctx, client, lister, namespace, TLSALPNSecretName)
+	if err != nil {
+		t.Fatalf("NewKubernetesTLSALPN() = %v", err)
+	}
+	other, err := NewKubernetesTLSALPN(ctx, client, lister, namespace, TLSALPNSecretName)
+	if err != nil {
+		t.Fatalf("NewKubernetesTLSALPN() = %v", err)
+	}
+
+	if _, err := other.GetCertificate(hello); err == nil {
+		t.Error("GetCertificate(before register) = nil, wanted error")
+	}
+
+	cert := makeChallengeCert(t, "example.com")
+	registrar.RegisterCertificate("example.com", cert)
+
+	// The registering replica presents the certificate right away.
+	if got, err := registrar.GetCertificate(hello); err != nil {
+		t.Errorf("GetCertificate(registrar) = %v", err)
+	} else if got != cert {
+		t.Error("GetCertificate(registrar) returned the wrong certificate")
+	}
+	// The other replica presents it once its lister has caught up.
+	sync()
+	if got, err := other.GetCertificate(hello); err != nil {
+		t.Errorf("GetCertificate(other) = %v", err)
+	} else if !bytes.Equal(got.Certificate[0], cert.Certificate[0]) {
+		t.Error("GetCertificate(other) returned the wrong certificate")
+	}
+
+	registrar.UnregisterCertificate("example.com")
+	sync()
+	for name, c := range map[string]TLSALPNInterface{"registrar": registrar, "other": other} {
+		if _, err := c.GetCertificate(hello); err == nil {
+			t.Errorf("GetCertificate(%s, after unregister) = nil, wanted error", name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package challenger
+
+import (
+	context "context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/pkg/metrics"
+)
+
+var (
+	challengeRequestCountM = stats.Int64(
+		"challenge_request_count",
+		"The number of challenge requests served",
+		stats.UnitDimensionless)
+
+	// challengeTypeKey is the type of challenge, e.g. http-01.
+	challengeTypeKey = tag.MustNewKey("challenge_type")
+
+	// resultKey is whether a challenge response was registered for the
+	// request ("hit") or not ("miss").
+	resultKey = tag.MustNewKey("result")
+)
+
+func init() {
+	if err := view.Register(&view.View{
+		Description: challengeRequestCountM.Description(),
+		Measure:     challengeRequestCountM,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{challengeTypeKey, resultKey},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// recordRequest records a challenge request of the given type, and whether
+// we had a response for it.
+func recordRequest(challengeType string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	ctx, err := tag.New(context.Background(),
+		tag.Insert(challengeTypeKey, challengeType),
+		tag.Insert(resultKey, result))
+	if err != nil {
+		return
+	}
+	metrics.Record(ctx, challengeRequestCountM.M(1))
+}
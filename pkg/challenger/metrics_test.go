@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package challenger
+
+import (
+	context "context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/metrics"
+)
+
+// requestCount returns the number of challenge requests recorded with the
+// given tags.
+func requestCount(t *testing.T, challengeType, result string) int64 {
+	rows, err := view.RetrieveData(challengeRequestCountM.Name())
+	if err != nil {
+		t.Fatalf("RetrieveData() = %v", err)
+	}
+	for _, row := range rows {
+		tags := map[tag.Key]string{}
+		for _, tg := range row.Tags {
+			tags[tg.Key] = tg.Value
+		}
+		if tags[challengeTypeKey] == challengeType && tags[resultKey] == result {
+			return row.Data.(*view.CountData).Value
+		}
+	}
+	return 0
+}
+
+func TestRequestMetrics(t *testing.T) {
+	metrics.InitForTesting()
+	ctx := context.Background()
+
+	inMemory, err := New(ctx)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	lister := corev1listers.NewSecretLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	kube, err := NewKubernetes(ctx, fakekube.NewSimpleClientset(), lister, "knative-serving", ChallengesSecretName)
+	if err != nil {
+		t.Fatalf("NewKubernetes() = %v", err)
+	}
+
+	for name, c := range map[string]Interface{"in-memory": inMemory, "kubernetes": kube} {
+		t.Run(name, func(t *testing.T) {
+			c.RegisterChallenge("/.well-known/acme-challenge/known", "response")
+
+			hits, misses := requestCount(t, "http-01", "hit"), requestCount(t, "http-01", "miss")
+			for _, path := range []string{"/.well-known/acme-challenge/known", "/.well-known/acme-challenge/unknown", "/"} {
+				c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+			}
+
+			if got, want := requestCount(t, "http-01", "hit")-hits, int64(1); got != want {
+				t.Errorf("hits = %d, wanted %d", got, want)
+			}
+			if got, want := requestCount(t, "http-01", "miss")-misses, int64(2); got != want {
+				t.Errorf("misses = %d, wanted %d", got, want)
+			}
+		})
+	}
+}
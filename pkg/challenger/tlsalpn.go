@@ -0,0 +1,138 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package challenger
+
+import (
+	context "context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// TLSALPNInterface defines the interface for registering, unregistering,
+// and serving the certificates that answer tls-alpn-01 challenges.
+type TLSALPNInterface interface {
+	// GetCertificate is suitable for use as tls.Config.GetCertificate.
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	RegisterCertificate(domain string, cert *tls.Certificate)
+	UnregisterCertificate(domain string)
+}
+
+// TLSALPNContextInterface is implemented by TLS-ALPN challengers that make
+// calls to register and unregister certificates, e.g. to share them between
+// replicas, which the given context bounds.
+type TLSALPNContextInterface interface {
+	TLSALPNInterface
+
+	RegisterCertificateContext(ctx context.Context, domain string, cert *tls.Certificate) error
+	UnregisterCertificateContext(ctx context.Context, domain string) error
+}
+
+// NewTLSALPN creates a new tls-alpn-01 challenger instance, which can be
+// exposed through ServeTLSALPN.
+func NewTLSALPN(ctx context.Context) (TLSALPNInterface, error) {
+	return &tlsALPN{}, nil
+}
+
+type tlsALPN struct {
+	sync.RWMutex
+
+	certs map[string]*tls.Certificate
+}
+
+var _ TLSALPNInterface = (*tlsALPN)(nil)
+
+func (c *tlsALPN) RegisterCertificate(domain string, cert *tls.Certificate) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.certs == nil {
+		c.certs = make(map[string]*tls.Certificate, 1)
+	}
+	c.certs[strings.ToLower(domain)] = cert
+}
+
+func (c *tlsALPN) UnregisterCertificate(domain string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.certs != nil {
+		delete(c.certs, strings.ToLower(domain))
+	}
+}
+
+func (c *tlsALPN) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// Challenge certificates must only be presented when the CA asks
+	// for them through the acme-tls/1 protocol.
+	if !supportsACMEProto(hello.SupportedProtos) {
+		return nil, errors.New("client did not negotiate the acme-tls/1 protocol")
+	}
+
+	cert, ok := c.lookup(hello.ServerName)
+	recordRequest("tls-alpn-01", ok)
+	if !ok {
+		return nil, fmt.Errorf("unknown server name %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// lookup returns the certificate registered for the given domain, if any.
+func (c *tlsALPN) lookup(domain string) (*tls.Certificate, bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	cert, ok := c.certs[strings.ToLower(domain)]
+	return cert, ok
+}
+
+func supportsACMEProto(protos []string) bool {
+	for _, p := range protos {
+		if p == acme.ALPNProto {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeTLSALPN accepts connections on the listener and completes the TLS
+// handshake with the certificates registered with the challenger, which is
+// all that the CA needs to validate tls-alpn-01 challenges.
+func ServeTLSALPN(l net.Listener, c TLSALPNInterface) error {
+	tl := tls.NewListener(l, &tls.Config{
+		GetCertificate: c.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	})
+	for {
+		conn, err := tl.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			conn.(*tls.Conn).Handshake()
+		}()
+	}
+}
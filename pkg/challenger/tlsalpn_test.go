@@ -0,0 +1,116 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package challenger
+
+import (
+	context "context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+)
+
+func makeChallengeCert(t *testing.T, domain string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	client := &acme.Client{Key: key}
+	cert, err := client.TLSALPN01ChallengeCert("token", domain)
+	if err != nil {
+		t.Fatalf("TLSALPN01ChallengeCert() = %v", err)
+	}
+	return &cert
+}
+
+func TestTLSALPNGetCertificate(t *testing.T) {
+	c, err := NewTLSALPN(context.Background())
+	if err != nil {
+		t.Fatalf("NewTLSALPN() = %v", err)
+	}
+	cert := makeChallengeCert(t, "example.com")
+
+	acmeHello := &tls.ClientHelloInfo{
+		ServerName:      "Example.com",
+		SupportedProtos: []string{acme.ALPNProto},
+	}
+	if _, err := c.GetCertificate(acmeHello); err == nil {
+		t.Error("GetCertificate(before register) = nil, wanted error")
+	}
+
+	c.RegisterCertificate("example.com", cert)
+	if got, err := c.GetCertificate(acmeHello); err != nil {
+		t.Errorf("GetCertificate() = %v", err)
+	} else if got != cert {
+		t.Error("GetCertificate() returned the wrong certificate")
+	}
+
+	// Regular TLS clients must not be handed challenge certificates.
+	if _, err := c.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "example.com",
+		SupportedProtos: []string{"h2", "http/1.1"},
+	}); err == nil {
+		t.Error("GetCertificate(without acme-tls/1) = nil, wanted error")
+	}
+
+	c.UnregisterCertificate("example.com")
+	if _, err := c.GetCertificate(acmeHello); err == nil {
+		t.Error("GetCertificate(after unregister) = nil, wanted error")
+	}
+}
+
+func TestServeTLSALPN(t *testing.T) {
+	c, err := NewTLSALPN(context.Background())
+	if err != nil {
+		t.Fatalf("NewTLSALPN() = %v", err)
+	}
+	cert := makeChallengeCert(t, "example.com")
+	c.RegisterCertificate("example.com", cert)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() = %v", err)
+	}
+	defer l.Close()
+	go ServeTLSALPN(l, c)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "example.com",
+		NextProtos:         []string{acme.ALPNProto},
+		InsecureSkipVerify: true, //nolint:gosec // Challenge certificates are self-signed.
+	})
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if got, want := state.NegotiatedProtocol, acme.ALPNProto; got != want {
+		t.Errorf("NegotiatedProtocol = %q, wanted %q", got, want)
+	}
+	if len(state.PeerCertificates) == 0 {
+		t.Fatal("No peer certificates presented")
+	}
+	if got, want := state.PeerCertificates[0].Raw, cert.Certificate[0]; string(got) != string(want) {
+		t.Error("Presented certificate doesn't match the registered one")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package dns01 contains the providers used to publish the TXT records
+// that answer ACME DNS-01 challenges.
+package dns01
+
+import (
+	context "context"
+	"strings"
+)
+
+// Provider defines the interface for publishing and removing the TXT
+// records that answer DNS-01 challenges.
+type Provider interface {
+	// Present publishes a TXT record with the given value at the fully
+	// qualified domain name (with a trailing dot).
+	Present(ctx context.Context, fqdn, value string) error
+
+	// CleanUp removes the TXT record with the given value from the fully
+	// qualified domain name (with a trailing dot).  Other TXT records
+	// at the same name must be left untouched.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// RecordName returns the fully qualified name of the TXT record that answers
+// a DNS-01 challenge for the given domain.  Wildcard domains are validated
+// through the record of their base domain.
+func RecordName(domain string) string {
+	domain = strings.TrimPrefix(domain, "*.")
+	return "_acme-challenge." + Fqdn(domain)
+}
+
+// Fqdn returns the given name with a trailing dot.
+func Fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns01
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	logging "knative.dev/pkg/logging"
+)
+
+// ErrNotPropagated is the error (wrapped) when the TXT record wasn't served
+// by the nameservers before the propagation check timed out, in which case
+// the CA isn't asked to validate the challenge.
+var ErrNotPropagated = errors.New("the challenge record didn't propagate")
+
+// Propagation configures how we wait for the TXT records answering DNS-01
+// challenges to be served where the CA will look them up, before asking
+// the CA to validate the challenges.
+type Propagation struct {
+	// Timeout bounds how long we poll the nameservers for the record before
+	// giving up on it.  A zero Timeout disables polling.
+	Timeout time.Duration
+
+	// Interval is the delay between polls.
+	Interval time.Duration
+
+	// Delay is waited once the nameservers serve the record, e.g. for
+	// secondary nameservers that we can't poll to catch up.
+	Delay time.Duration
+
+	// Nameservers are polled ("host:port") for the record.  When empty,
+	// the authoritative nameservers of the record's zone are polled.
+	Nameservers []string
+}
+
+// DefaultPropagation is the Propagation used when none is configured.
+var DefaultPropagation = Propagation{
+	Timeout:  2 * time.Minute,
+	Interval: 5 * time.Second,
+}
+
+// Wait blocks until the TXT record with the given value is served at the
+// fully qualified domain name by all of the nameservers, and then for the
+// Delay.
+func (p Propagation) Wait(ctx context.Context, fqdn, value string) error {
+	if p.Timeout > 0 {
+		if err := p.poll(ctx, fqdn, value); err != nil {
+			return err
+		}
+	}
+	if p.Delay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.Delay):
+		}
+	}
+	return nil
+}
+
+// poll repeatedly checks the nameservers until they serve the record.
+func (p Propagation) poll(ctx context.Context, fqdn, value string) error {
+	logger := logging.FromContext(ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultPropagation.Interval
+	}
+	for {
+		err := p.check(ctx, fqdn, value)
+		if err == nil {
+			return nil
+		}
+		logger.Debugf("Propagation check of %s failed: %v", fqdn, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s: %v", ErrNotPropagated, fqdn, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// check checks that each of the nameservers serves the record.
+func (p Propagation) check(ctx context.Context, fqdn, value string) error {
+	nameservers := p.Nameservers
+	if len(nameservers) == 0 {
+		var err error
+		if nameservers, err = authoritativeNameservers(ctx, fqdn); err != nil {
+			return err
+		}
+	}
+	for _, ns := range nameservers {
+		txts, err := lookupTXT(ctx, ns, fqdn)
+		if err != nil {
+			return fmt.Errorf("querying %s: %w", ns, err)
+		}
+		if !contains(txts, value) {
+			return fmt.Errorf("%s doesn't serve the record yet", ns)
+		}
+	}
+	return nil
+}
+
+// authoritativeNameservers returns the nameservers ("host:port") of the
+// closest enclosing zone of the name.
+func authoritativeNameservers(ctx context.Context, fqdn string) ([]string, error) {
+	for name := Fqdn(fqdn); strings.Count(name, ".") > 1; name = name[strings.Index(name, ".")+1:] {
+		nss, err := net.DefaultResolver.LookupNS(ctx, name)
+		if err != nil || len(nss) == 0 {
+			// The name isn't the apex of a zone.
+			continue
+		}
+		nameservers := make([]string, 0, len(nss))
+		for _, ns := range nss {
+			nameservers = append(nameservers, net.JoinHostPort(strings.TrimSuffix(ns.Host, "."), "53"))
+		}
+		return nameservers, nil
+	}
+	return nil, fmt.Errorf("no nameservers found for %s", fqdn)
+}
+
+// lookupTXT queries the nameserver directly for the TXT records of the
+// name, bypassing any caching resolver.
+func lookupTXT(ctx context.Context, nameserver, fqdn string) ([]string, error) {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, nameserver)
+		},
+	}
+	return r.LookupTXT(ctx, fqdn)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns01
+
+import (
+	context "context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPropagation(t *testing.T) {
+	ctx := context.Background()
+	ns := newFakeNameserver(t, "example.com.", nil)
+	p, err := NewRFC2136(ns.addr(), "example.com.", nil)
+	if err != nil {
+		t.Fatalf("NewRFC2136() = %v", err)
+	}
+	propagation := Propagation{
+		Timeout:     200 * time.Millisecond,
+		Interval:    10 * time.Millisecond,
+		Nameservers: []string{ns.addr()},
+	}
+	fqdn := RecordName("example.com")
+
+	// The record isn't served until it is presented.
+	if err := propagation.Wait(ctx, fqdn, "token"); !errors.Is(err, ErrNotPropagated) {
+		t.Fatalf("Wait() = %v, wanted %v", err, ErrNotPropagated)
+	}
+
+	if err := p.Present(ctx, fqdn, "other"); err != nil {
+		t.Fatalf("Present() = %v", err)
+	}
+	if err := propagation.Wait(ctx, fqdn, "token"); !errors.Is(err, ErrNotPropagated) {
+		t.Errorf("Wait() = %v, wanted %v for another record", err, ErrNotPropagated)
+	}
+
+	if err := p.Present(ctx, fqdn, "token"); err != nil {
+		t.Fatalf("Present() = %v", err)
+	}
+	if err := propagation.Wait(ctx, fqdn, "token"); err != nil {
+		t.Errorf("Wait() = %v", err)
+	}
+}
+
+func TestPropagationDelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// Without polling, only the delay is waited.
+	p := Propagation{Delay: time.Hour}
+	if err := p.Wait(ctx, "_acme-challenge.example.com.", "token"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() = %v, wanted %v", err, context.DeadlineExceeded)
+	}
+}
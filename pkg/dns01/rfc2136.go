@@ -0,0 +1,314 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns01
+
+import (
+	context "context"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha1" //nolint:gosec // hmac-sha1 is still a TSIG algorithm in use.
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// opCodeUpdate is the DNS opcode for dynamic updates (RFC 2136).
+	opCodeUpdate dnsmessage.OpCode = 5
+
+	// classNone is used in the update section to delete a single RR (RFC 2136 §2.5.4).
+	classNone dnsmessage.Class = 254
+
+	// typeTSIG is the RR type of transaction signatures (RFC 8945).
+	typeTSIG dnsmessage.Type = 250
+
+	// tsigFudge is the permitted clock skew in seconds for TSIG signed messages.
+	tsigFudge = 300
+
+	// challengeTTL is the TTL of the TXT records we publish.
+	challengeTTL = 60
+)
+
+// TSIG holds the transaction signature key used to authenticate dynamic updates.
+type TSIG struct {
+	// KeyName is the name of the TSIG key, as configured on the nameserver.
+	KeyName string
+
+	// Algorithm is the name of the TSIG algorithm, e.g. "hmac-sha256.".
+	Algorithm string
+
+	// Secret is the base64 encoded TSIG secret.
+	Secret string
+}
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1.":   sha1.New,
+	"hmac-sha256.": sha256.New,
+	"hmac-sha512.": sha512.New,
+}
+
+// NewRFC2136 returns a Provider that publishes TXT records through RFC 2136
+// dynamic updates of the given zone, sent to nameserver ("host:port").  The
+// updates are signed when tsig is non-nil.
+func NewRFC2136(nameserver, zone string, tsig *TSIG) (Provider, error) {
+	if nameserver == "" {
+		return nil, errors.New("rfc2136: a nameserver is required")
+	}
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(nameserver, "53")
+	}
+	if zone == "" {
+		return nil, errors.New("rfc2136: a zone is required")
+	}
+	p := &rfc2136{
+		nameserver: nameserver,
+		zone:       Fqdn(zone),
+	}
+	if tsig != nil {
+		alg := Fqdn(strings.ToLower(tsig.Algorithm))
+		if alg == "." {
+			alg = "hmac-sha256."
+		}
+		if _, ok := tsigAlgorithms[alg]; !ok {
+			return nil, fmt.Errorf("rfc2136: unsupported TSIG algorithm %q", tsig.Algorithm)
+		}
+		secret, err := base64.StdEncoding.DecodeString(tsig.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("rfc2136: decoding TSIG secret: %w", err)
+		}
+		p.tsig = &TSIG{
+			KeyName:   Fqdn(strings.ToLower(tsig.KeyName)),
+			Algorithm: alg,
+		}
+		p.tsigSecret = secret
+	}
+	return p, nil
+}
+
+type rfc2136 struct {
+	nameserver string
+	zone       string
+
+	tsig       *TSIG
+	tsigSecret []byte
+
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+var _ Provider = (*rfc2136)(nil)
+
+// Present implements Provider
+func (p *rfc2136) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, dnsmessage.ClassINET, challengeTTL)
+}
+
+// CleanUp implements Provider
+func (p *rfc2136) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, classNone, 0)
+}
+
+func (p *rfc2136) update(ctx context.Context, fqdn, value string, class dnsmessage.Class, ttl uint32) error {
+	msg, id, err := p.buildUpdate(fqdn, value, class, ttl)
+	if err != nil {
+		return err
+	}
+
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", p.nameserver)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	var parser dnsmessage.Parser
+	h, err := parser.Start(buf[:n])
+	if err != nil {
+		return fmt.Errorf("rfc2136: parsing response: %w", err)
+	}
+	if h.ID != id || !h.Response {
+		return errors.New("rfc2136: received a response that doesn't match our update")
+	}
+	if h.RCode != dnsmessage.RCodeSuccess {
+		return fmt.Errorf("rfc2136: update of %s was rejected: %v", fqdn, h.RCode)
+	}
+	return nil
+}
+
+// buildUpdate builds the (signed) wire format of a dynamic update that adds or
+// removes a single TXT record, depending on the class.
+func (p *rfc2136) buildUpdate(fqdn, value string, class dnsmessage.Class, ttl uint32) ([]byte, uint16, error) {
+	zone, err := dnsmessage.NewName(p.zone)
+	if err != nil {
+		return nil, 0, err
+	}
+	name, err := dnsmessage.NewName(Fqdn(fqdn))
+	if err != nil {
+		return nil, 0, err
+	}
+	var idBytes [2]byte
+	if _, err := cryptorand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	// In an UPDATE message the question section is the zone section, and
+	// the authority section is the update section (RFC 2136 §2).
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, OpCode: opCodeUpdate})
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  zone,
+		Type:  dnsmessage.TypeSOA,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, 0, err
+	}
+	if err := b.StartAuthorities(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.TXTResource(dnsmessage.ResourceHeader{
+		Name:  name,
+		Class: class,
+		TTL:   ttl,
+	}, dnsmessage.TXTResource{TXT: []string{value}}); err != nil {
+		return nil, 0, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+	if p.tsig == nil {
+		return msg, id, nil
+	}
+	now := time.Now
+	if p.now != nil {
+		now = p.now
+	}
+	msg, err = signTSIG(msg, p.tsig.KeyName, p.tsig.Algorithm, p.tsigSecret, now())
+	return msg, id, err
+}
+
+// signTSIG appends a TSIG record to the given message (RFC 8945 §4.3).
+func signTSIG(msg []byte, keyName, algorithm string, secret []byte, now time.Time) ([]byte, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("rfc2136: message too short to sign")
+	}
+	keyWire, err := wireName(keyName)
+	if err != nil {
+		return nil, err
+	}
+	algWire, err := wireName(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	timeSigned := uint64(now.Unix())
+
+	// The MAC covers the message followed by the TSIG variables.
+	mac := hmac.New(tsigAlgorithms[algorithm], secret)
+	mac.Write(msg)
+	mac.Write(keyWire)
+	mac.Write(u16(uint16(dnsmessage.ClassANY)))
+	mac.Write(u32(0)) // TTL
+	mac.Write(algWire)
+	mac.Write(tsigTimers(timeSigned))
+	mac.Write(u16(0)) // Error
+	mac.Write(u16(0)) // Other Len
+	sum := mac.Sum(nil)
+
+	rdata := append([]byte{}, algWire...)
+	rdata = append(rdata, tsigTimers(timeSigned)...)
+	rdata = append(rdata, u16(uint16(len(sum)))...)
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0:2]...) // Original ID
+	rdata = append(rdata, u16(0)...)   // Error
+	rdata = append(rdata, u16(0)...)   // Other Len
+
+	out := append([]byte{}, msg...)
+	out = append(out, keyWire...)
+	out = append(out, u16(uint16(typeTSIG))...)
+	out = append(out, u16(uint16(dnsmessage.ClassANY))...)
+	out = append(out, u32(0)...)
+	out = append(out, u16(uint16(len(rdata)))...)
+	out = append(out, rdata...)
+
+	// Bump ARCOUNT to account for the TSIG record.
+	arcount := binary.BigEndian.Uint16(out[10:12])
+	binary.BigEndian.PutUint16(out[10:12], arcount+1)
+	return out, nil
+}
+
+// tsigTimers encodes the 48-bit Time Signed followed by the Fudge.
+func tsigTimers(timeSigned uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[0:2], uint16(timeSigned>>32))
+	binary.BigEndian.PutUint32(b[2:6], uint32(timeSigned))
+	binary.BigEndian.PutUint16(b[6:8], tsigFudge)
+	return b
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// wireName returns the uncompressed, lower-cased wire format of a domain name.
+func wireName(name string) ([]byte, error) {
+	name = strings.ToLower(Fqdn(name))
+	var out []byte
+	if name != "." {
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("rfc2136: invalid name %q", name)
+			}
+			out = append(out, byte(len(label)))
+			out = append(out, label...)
+		}
+	}
+	return append(out, 0), nil
+}
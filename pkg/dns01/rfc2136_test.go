@@ -0,0 +1,347 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns01
+
+import (
+	context "context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// fakeNameserver is a minimal RFC 2136 server, which applies the TXT record
+// updates it receives to an in-memory zone, and answers queries for them.
+type fakeNameserver struct {
+	sync.Mutex
+
+	conn    net.PacketConn
+	zone    string
+	secret  []byte // when set, updates must carry a valid TSIG.
+	records map[string]sets.String
+}
+
+func newFakeNameserver(t *testing.T, zone string, secret []byte) *fakeNameserver {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ns := &fakeNameserver{
+		conn:    conn,
+		zone:    zone,
+		secret:  secret,
+		records: make(map[string]sets.String),
+	}
+	go ns.serve()
+	return ns
+}
+
+func (ns *fakeNameserver) addr() string {
+	return ns.conn.LocalAddr().String()
+}
+
+func (ns *fakeNameserver) txt(name string) sets.String {
+	ns.Lock()
+	defer ns.Unlock()
+	return sets.NewString(ns.records[name].List()...)
+}
+
+func (ns *fakeNameserver) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := ns.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		msg := append([]byte{}, buf[:n]...)
+		if resp, ok := ns.answer(msg); ok {
+			ns.conn.WriteTo(resp, addr)
+			continue
+		}
+		rcode := ns.handle(msg)
+
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+			ID:       binary.BigEndian.Uint16(msg[0:2]),
+			Response: true,
+			OpCode:   opCodeUpdate,
+			RCode:    rcode,
+		})
+		resp, _ := b.Finish()
+		ns.conn.WriteTo(resp, addr)
+	}
+}
+
+// answer answers the message if it is a query for TXT records.
+func (ns *fakeNameserver) answer(msg []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.OpCode != 0 {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil || q.Type != dnsmessage.TypeTXT {
+		return nil, false
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:            h.ID,
+		Response:      true,
+		Authoritative: true,
+	})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for _, txt := range ns.txt(q.Name.String()).List() {
+		b.TXTResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: challengeTTL},
+			dnsmessage.TXTResource{TXT: []string{txt}})
+	}
+	resp, err := b.Finish()
+	return resp, err == nil
+}
+
+func (ns *fakeNameserver) handle(msg []byte) dnsmessage.RCode {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.OpCode != opCodeUpdate {
+		return dnsmessage.RCodeFormatError
+	}
+	q, err := p.Question()
+	if err != nil || q.Name.String() != ns.zone || q.Type != dnsmessage.TypeSOA {
+		return dnsmessage.RCodeNotImplemented
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return dnsmessage.RCodeFormatError
+	}
+	if err := p.SkipAllAnswers(); err != nil {
+		return dnsmessage.RCodeFormatError
+	}
+	updates, err := p.AllAuthorities()
+	if err != nil {
+		return dnsmessage.RCodeFormatError
+	}
+	additionals, err := p.AllAdditionals()
+	if err != nil {
+		return dnsmessage.RCodeFormatError
+	}
+
+	if ns.secret != nil {
+		if len(additionals) != 1 || additionals[0].Header.Type != typeTSIG {
+			return dnsmessage.RCodeRefused
+		}
+		if !ns.verify(msg, additionals[0]) {
+			return dnsmessage.RCodeRefused
+		}
+	}
+
+	ns.Lock()
+	defer ns.Unlock()
+	for _, u := range updates {
+		txt, ok := u.Body.(*dnsmessage.TXTResource)
+		if !ok {
+			return dnsmessage.RCodeFormatError
+		}
+		name := u.Header.Name.String()
+		switch u.Header.Class {
+		case dnsmessage.ClassINET:
+			if ns.records[name] == nil {
+				ns.records[name] = sets.NewString()
+			}
+			ns.records[name].Insert(txt.TXT...)
+		case classNone:
+			ns.records[name].Delete(txt.TXT...)
+		default:
+			return dnsmessage.RCodeFormatError
+		}
+	}
+	return dnsmessage.RCodeSuccess
+}
+
+// verify recomputes the TSIG of the message by re-signing the unsigned prefix
+// with the time it was signed at.
+func (ns *fakeNameserver) verify(msg []byte, tsig dnsmessage.Resource) bool {
+	raw, ok := tsig.Body.(*dnsmessage.UnknownResource)
+	if !ok {
+		return false
+	}
+	// Skip the algorithm name, our fake only supports hmac-sha256.
+	i := 0
+	for raw.Data[i] != 0 {
+		i += int(raw.Data[i]) + 1
+	}
+	timers := raw.Data[i+1 : i+9]
+	timeSigned := int64(binary.BigEndian.Uint16(timers[0:2]))<<32 | int64(binary.BigEndian.Uint32(timers[2:6]))
+	macSize := int(binary.BigEndian.Uint16(raw.Data[i+9 : i+11]))
+	mac := raw.Data[i+11 : i+11+macSize]
+
+	// The TSIG record is the final record in the message; strip it off and
+	// restore the original ARCOUNT.
+	keyWire, _ := wireName(tsig.Header.Name.String())
+	tsigLen := len(keyWire) + 10 + len(raw.Data)
+	unsigned := append([]byte{}, msg[:len(msg)-tsigLen]...)
+	binary.BigEndian.PutUint16(unsigned[10:12], binary.BigEndian.Uint16(unsigned[10:12])-1)
+
+	resigned, err := signTSIG(unsigned, tsig.Header.Name.String(), "hmac-sha256.", ns.secret, time.Unix(timeSigned, 0))
+	if err != nil {
+		return false
+	}
+	var p dnsmessage.Parser
+	if _, err := p.Start(resigned); err != nil {
+		return false
+	}
+	p.SkipAllQuestions()
+	p.SkipAllAnswers()
+	p.SkipAllAuthorities()
+	adds, err := p.AllAdditionals()
+	if err != nil || len(adds) != 1 {
+		return false
+	}
+	want := adds[0].Body.(*dnsmessage.UnknownResource).Data[i+11 : i+11+macSize]
+	return hmac.Equal(mac, want)
+}
+
+func TestRFC2136(t *testing.T) {
+	secret := []byte("super secret tsig key")
+
+	tests := []struct {
+		name      string
+		nsSecret  []byte
+		tsig      *TSIG
+		wantError bool
+	}{{
+		name: "unsigned",
+	}, {
+		name:     "signed",
+		nsSecret: secret,
+		tsig: &TSIG{
+			KeyName:   "acme-key",
+			Algorithm: "hmac-sha256",
+			Secret:    base64.StdEncoding.EncodeToString(secret),
+		},
+	}, {
+		name:     "bad signature",
+		nsSecret: secret,
+		tsig: &TSIG{
+			KeyName:   "acme-key",
+			Algorithm: "hmac-sha256",
+			Secret:    base64.StdEncoding.EncodeToString([]byte("wrong")),
+		},
+		wantError: true,
+	}, {
+		name:      "missing signature",
+		nsSecret:  secret,
+		wantError: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			ns := newFakeNameserver(t, "example.com.", test.nsSecret)
+			p, err := NewRFC2136(ns.addr(), "example.com", test.tsig)
+			if err != nil {
+				t.Fatalf("NewRFC2136() = %v", err)
+			}
+
+			fqdn := RecordName("foo.example.com")
+			err = p.Present(ctx, fqdn, "token-1")
+			if test.wantError {
+				if err == nil {
+					t.Fatal("Present() = nil, wanted error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Present() = %v", err)
+			}
+			if err := p.Present(ctx, fqdn, "token-2"); err != nil {
+				t.Fatalf("Present() = %v", err)
+			}
+			if got, want := ns.txt(fqdn), sets.NewString("token-1", "token-2"); !got.Equal(want) {
+				t.Errorf("TXT(%s) = %v, wanted %v", fqdn, got.List(), want.List())
+			}
+
+			if err := p.CleanUp(ctx, fqdn, "token-1"); err != nil {
+				t.Fatalf("CleanUp() = %v", err)
+			}
+			if got, want := ns.txt(fqdn), sets.NewString("token-2"); !got.Equal(want) {
+				t.Errorf("TXT(%s) = %v, wanted %v", fqdn, got.List(), want.List())
+			}
+		})
+	}
+}
+
+func TestRFC2136WrongZone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ns := newFakeNameserver(t, "example.com.", nil)
+	p, err := NewRFC2136(ns.addr(), "example.org", nil)
+	if err != nil {
+		t.Fatalf("NewRFC2136() = %v", err)
+	}
+	if err := p.Present(ctx, RecordName("example.org"), "token"); err == nil {
+		t.Error("Present() = nil, wanted error")
+	}
+}
+
+func TestNewRFC2136Validation(t *testing.T) {
+	tests := []struct {
+		name       string
+		nameserver string
+		zone       string
+		tsig       *TSIG
+	}{{
+		name: "missing nameserver",
+		zone: "example.com",
+	}, {
+		name:       "missing zone",
+		nameserver: "127.0.0.1:53",
+	}, {
+		name:       "bad algorithm",
+		nameserver: "127.0.0.1:53",
+		zone:       "example.com",
+		tsig: &TSIG{
+			KeyName:   "key",
+			Algorithm: "hmac-md5",
+			Secret:    base64.StdEncoding.EncodeToString([]byte("secret")),
+		},
+	}, {
+		name:       "bad secret",
+		nameserver: "127.0.0.1:53",
+		zone:       "example.com",
+		tsig: &TSIG{
+			KeyName: "key",
+			Secret:  "not base64!",
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewRFC2136(test.nameserver, test.zone, test.tsig); err == nil {
+				t.Error("NewRFC2136() = nil, wanted error")
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns01
+
+import (
+	"bytes"
+	context "context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// WebhookRecord is the JSON payload sent to the webhook.
+type WebhookRecord struct {
+	// FQDN is the fully qualified name of the TXT record, with a trailing dot.
+	FQDN string `json:"fqdn"`
+
+	// Value is the content of the TXT record.
+	Value string `json:"value"`
+}
+
+// NewWebhook returns a Provider that delegates the management of TXT records
+// to an HTTP webhook.  Records are published with a POST and removed with a
+// DELETE of a WebhookRecord to the given URL.  When token is non-empty it is
+// sent as a bearer token.
+func NewWebhook(url, token string, client *http.Client) (Provider, error) {
+	if url == "" {
+		return nil, errors.New("webhook: a URL is required")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &webhook{
+		url:    url,
+		token:  token,
+		client: client,
+	}, nil
+}
+
+type webhook struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+var _ Provider = (*webhook)(nil)
+
+// Present implements Provider
+func (w *webhook) Present(ctx context.Context, fqdn, value string) error {
+	return w.do(ctx, http.MethodPost, fqdn, value)
+}
+
+// CleanUp implements Provider
+func (w *webhook) CleanUp(ctx context.Context, fqdn, value string) error {
+	return w.do(ctx, http.MethodDelete, fqdn, value)
+}
+
+func (w *webhook) do(ctx context.Context, method, fqdn, value string) error {
+	body, err := json.Marshal(WebhookRecord{FQDN: fqdn, Value: value})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook: %s %s returned %d: %s", method, w.url, resp.StatusCode, msg)
+	}
+	return nil
+}
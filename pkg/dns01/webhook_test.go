@@ -0,0 +1,97 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns01
+
+import (
+	context "context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestWebhook(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		records = sets.NewString()
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("Authorization"), "Bearer s3cr3t"; got != want {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var rec WebhookRecord
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			records.Insert(rec.FQDN + "=" + rec.Value)
+		case http.MethodDelete:
+			records.Delete(rec.FQDN + "=" + rec.Value)
+		default:
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	p, err := NewWebhook(srv.URL, "s3cr3t", srv.Client())
+	if err != nil {
+		t.Fatalf("NewWebhook() = %v", err)
+	}
+
+	fqdn := RecordName("*.example.com")
+	if err := p.Present(ctx, fqdn, "token"); err != nil {
+		t.Fatalf("Present() = %v", err)
+	}
+	mu.Lock()
+	if got, want := records, sets.NewString("_acme-challenge.example.com.=token"); !got.Equal(want) {
+		t.Errorf("records = %v, wanted %v", got.List(), want.List())
+	}
+	mu.Unlock()
+
+	if err := p.CleanUp(ctx, fqdn, "token"); err != nil {
+		t.Fatalf("CleanUp() = %v", err)
+	}
+	mu.Lock()
+	if records.Len() != 0 {
+		t.Errorf("records = %v, wanted none", records.List())
+	}
+	mu.Unlock()
+
+	// Without the token, the webhook rejects us.
+	p, err = NewWebhook(srv.URL, "", srv.Client())
+	if err != nil {
+		t.Fatalf("NewWebhook() = %v", err)
+	}
+	if err := p.Present(ctx, fqdn, "token"); err == nil {
+		t.Error("Present() = nil, wanted error")
+	}
+}
+
+func TestNewWebhookValidation(t *testing.T) {
+	if _, err := NewWebhook("", "", nil); err == nil {
+		t.Error("NewWebhook() = nil, wanted error")
+	}
+}
@@ -0,0 +1,365 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	logging "knative.dev/pkg/logging"
+)
+
+const (
+	// AccountSecretName is the name of the Secret in the system namespace
+	// that holds the ACME account key.
+	AccountSecretName = "net-http01-account"
+
+	// AccountKeySecretKey is the key within the account Secret under which
+	// the PEM encoded account key is stored.
+	AccountKeySecretKey = "account.key"
+
+	// RotateAccountKeyAnnotation may be set to "true" on the account Secret
+	// to request that the account key is rolled over to a freshly generated
+	// key the next time the controller starts.
+	RotateAccountKeyAnnotation = "net-http01.networking.knative.dev/rotate-account-key"
+
+	// EABKeyIDSecretKey is the key within an External Account Binding Secret
+	// under which the key identifier issued by the CA is stored.
+	EABKeyIDSecretKey = "keyID"
+
+	// EABHMACKeySecretKey is the key within an External Account Binding
+	// Secret under which the base64url encoded HMAC key issued by the CA is
+	// stored.
+	EABHMACKeySecretKey = "hmacKey"
+)
+
+// Registration holds the details with which the ACME account is registered.
+type Registration struct {
+	// Contact is the list of contact URLs of the account, for instance
+	// "mailto:admin@example.com", which the CA uses to notify us of
+	// problems with the account or its certificates.
+	Contact []string
+
+	// ExternalAccountBinding binds the new account to an account the
+	// operator holds with the CA, as required by many commercial and
+	// private CAs.  It is only used when registering a new account.
+	ExternalAccountBinding *acme.ExternalAccountBinding
+}
+
+// LoadExternalAccountBinding reads the External Account Binding issued by
+// the CA from the named Secret.
+func LoadExternalAccountBinding(ctx context.Context, client kubernetes.Interface, namespace, name string) (*acme.ExternalAccountBinding, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	kid := strings.TrimSpace(string(secret.Data[EABKeyIDSecretKey]))
+	if kid == "" {
+		return nil, fmt.Errorf("%s/%s has no %q", namespace, name, EABKeyIDSecretKey)
+	}
+	encoded := strings.TrimSpace(string(secret.Data[EABHMACKeySecretKey]))
+	if encoded == "" {
+		return nil, fmt.Errorf("%s/%s has no %q", namespace, name, EABHMACKeySecretKey)
+	}
+	// CAs hand out the key base64url encoded, with or without padding.
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("decoding %q of %s/%s: %w", EABHMACKeySecretKey, namespace, name, err)
+	}
+	return &acme.ExternalAccountBinding{
+		KID: kid,
+		Key: key,
+	}, nil
+}
+
+// AccountKeyStore persists the ACME account key, so that the same account
+// is used across restarts of the process.
+type AccountKeyStore interface {
+	// Load returns the persisted account key, or nil if no key has been
+	// persisted yet, along with whether a rotation of the key was requested.
+	Load(ctx context.Context) (key crypto.Signer, rotate bool, err error)
+
+	// Save persists the account key in place of the key it replaces, which
+	// is nil on first use, clearing any pending rotation request.  When
+	// another process persisted a key in the meantime, that key is kept and
+	// returned instead, so that all processes use the same account.
+	Save(ctx context.Context, key, replaces crypto.Signer) (crypto.Signer, error)
+}
+
+// NewSecretAccountKeyStore returns an AccountKeyStore that keeps the account key
+// in the named Secret, which is created on first use.
+func NewSecretAccountKeyStore(client kubernetes.Interface, namespace, name string) AccountKeyStore {
+	return &secretAccountKeyStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+type secretAccountKeyStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+var _ AccountKeyStore = (*secretAccountKeyStore)(nil)
+
+// Load implements AccountKeyStore
+func (s *secretAccountKeyStore) Load(ctx context.Context) (crypto.Signer, bool, error) {
+	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	keyPEM, ok := secret.Data[AccountKeySecretKey]
+	if !ok {
+		return nil, false, nil
+	}
+	key, err := decodeKey(keyPEM)
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding %s/%s: %w", s.namespace, s.name, err)
+	}
+	return key, secret.Annotations[RotateAccountKeyAnnotation] == "true", nil
+}
+
+// Save implements AccountKeyStore
+func (s *secretAccountKeyStore) Save(ctx context.Context, key, replaces crypto.Signer) (crypto.Signer, error) {
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := key
+	// Another process may create the Secret, or update it, between our
+	// reading and writing it, in which case we read it again.
+	err = retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrs.IsConflict(err) || apierrs.IsAlreadyExists(err)
+	}, func() error {
+		secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{
+					AccountKeySecretKey: keyPEM,
+				},
+			}
+			_, err = s.client.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if stored, ok := secret.Data[AccountKeySecretKey]; ok {
+			current, err := decodeKey(stored)
+			if err != nil {
+				return fmt.Errorf("decoding %s/%s: %w", s.namespace, s.name, err)
+			}
+			if !sameKey(current, replaces) {
+				saved = current
+				return nil
+			}
+		}
+
+		secret = secret.DeepCopy()
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte, 1)
+		}
+		secret.Data[AccountKeySecretKey] = keyPEM
+		delete(secret.Annotations, RotateAccountKeyAnnotation)
+		_, err = s.client.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return saved, nil
+}
+
+// NewMemoryAccountKeyStore returns an AccountKeyStore that only keeps the
+// account key in memory, so a new account is registered for each process.
+func NewMemoryAccountKeyStore() AccountKeyStore {
+	return &memoryAccountKeyStore{}
+}
+
+type memoryAccountKeyStore struct {
+	sync.Mutex
+
+	key crypto.Signer
+}
+
+var _ AccountKeyStore = (*memoryAccountKeyStore)(nil)
+
+// Load implements AccountKeyStore
+func (m *memoryAccountKeyStore) Load(ctx context.Context) (crypto.Signer, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.key, false, nil
+}
+
+// Save implements AccountKeyStore
+func (m *memoryAccountKeyStore) Save(ctx context.Context, key, replaces crypto.Signer) (crypto.Signer, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.key != nil && !sameKey(m.key, replaces) {
+		return m.key, nil
+	}
+	m.key = key
+	return key, nil
+}
+
+// loadOrCreateAccount configures the client with the account key from
+// the store, generating and persisting a new key on first use.  It then
+// looks up the account associated with that key, registering a new one
+// if the CA doesn't know about it, and performs any requested rotation.
+func loadOrCreateAccount(ctx context.Context, client *acme.Client, keys AccountKeyStore, reg Registration) (*acme.Account, error) {
+	logger := logging.FromContext(ctx)
+
+	key, rotate, err := keys.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		logger.Info("No ACME account key found, generating a new one.")
+		if key, err = newAccountKey(); err != nil {
+			return nil, err
+		}
+		// Persist the key before registering, so that we never register
+		// an account whose key we have lost.  Another replica may beat us
+		// to it, in which case we use its key.
+		if key, err = keys.Save(ctx, key, nil); err != nil {
+			return nil, err
+		}
+		rotate = false
+	}
+	client.Key = key
+
+	acct, err := client.GetReg(ctx, "")
+	if errors.Is(err, acme.ErrNoAccount) {
+		logger.Info("Registering a new ACME account.")
+		acct, err = client.Register(ctx, &acme.Account{
+			Contact:                reg.Contact,
+			ExternalAccountBinding: reg.ExternalAccountBinding,
+		}, autocert.AcceptTOS)
+		if errors.Is(err, acme.ErrAccountAlreadyExists) {
+			acct, err = client.GetReg(ctx, "")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Using ACME account %q", acct.URI)
+
+	if len(reg.Contact) > 0 && !sets.NewString(acct.Contact...).Equal(sets.NewString(reg.Contact...)) {
+		logger.Infof("Updating the contacts of the ACME account to %v", reg.Contact)
+		if acct, err = client.UpdateReg(ctx, &acme.Account{Contact: reg.Contact}); err != nil {
+			return nil, fmt.Errorf("updating account contacts: %w", err)
+		}
+	}
+
+	if rotate {
+		if err := rotateAccountKey(ctx, client, keys); err != nil {
+			return nil, err
+		}
+	}
+	return acct, nil
+}
+
+// rotateAccountKey rolls the client's account over to a newly generated key
+// and persists that key.
+func rotateAccountKey(ctx context.Context, client *acme.Client, keys AccountKeyStore) error {
+	newKey, err := newAccountKey()
+	if err != nil {
+		return err
+	}
+	oldKey := client.Key
+	if err := client.AccountKeyRollover(ctx, newKey); err != nil {
+		return fmt.Errorf("rolling over account key: %w", err)
+	}
+	saved, err := keys.Save(ctx, newKey, oldKey)
+	if err != nil {
+		// The CA now only knows the new key, so losing it here means that
+		// a new account will be registered on the next start.
+		return fmt.Errorf("persisting rotated account key: %w", err)
+	} else if !sameKey(saved, newKey) {
+		return errors.New("persisting rotated account key: the key was replaced by another process")
+	}
+	logging.FromContext(ctx).Info("Rotated the ACME account key.")
+	return nil
+}
+
+// sameKey checks whether the keys are the same, which they are not when
+// either is nil.
+func sameKey(a, b crypto.Signer) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	pub, ok := a.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(b.Public())
+}
+
+func newAccountKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+}
+
+func encodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func decodeKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("account key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported account key type %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,439 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	clientgotesting "k8s.io/client-go/testing"
+)
+
+func TestSecretAccountKeyStore(t *testing.T) {
+	ctx := context.Background()
+	client := fakekube.NewSimpleClientset()
+	store := NewSecretAccountKeyStore(client, "knative-serving", AccountSecretName)
+
+	// Nothing is there to start with.
+	key, rotate, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	} else if key != nil || rotate {
+		t.Fatalf("Load() = %v, %v, wanted nil, false", key, rotate)
+	}
+
+	want, err := newAccountKey()
+	if err != nil {
+		t.Fatalf("newAccountKey() = %v", err)
+	}
+	if saved, err := store.Save(ctx, want, nil); err != nil {
+		t.Fatalf("Save() = %v", err)
+	} else if saved != want {
+		t.Error("Save() returned a different key than was saved")
+	}
+
+	// A fresh store should see the key we saved.
+	store = NewSecretAccountKeyStore(client, "knative-serving", AccountSecretName)
+	got, rotate, err := store.Load(ctx)
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	} else if rotate {
+		t.Error("Load() requested rotation, wanted none")
+	} else if !want.(*ecdsa.PrivateKey).Equal(got) {
+		t.Error("Load() returned a different key than was saved")
+	}
+
+	// Request a rotation through the annotation.
+	secret, err := client.CoreV1().Secrets("knative-serving").Get(ctx, AccountSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	secret.Annotations = map[string]string{RotateAccountKeyAnnotation: "true"}
+	if _, err := client.CoreV1().Secrets("knative-serving").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update() = %v", err)
+	}
+	if _, rotate, err := store.Load(ctx); err != nil {
+		t.Fatalf("Load() = %v", err)
+	} else if !rotate {
+		t.Error("Load() didn't request rotation, wanted one")
+	}
+
+	// Saving the rotated key clears the request.
+	rotated, err := newAccountKey()
+	if err != nil {
+		t.Fatalf("newAccountKey() = %v", err)
+	}
+	if _, err := store.Save(ctx, rotated, want); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	if got, rotate, err := store.Load(ctx); err != nil {
+		t.Fatalf("Load() = %v", err)
+	} else if rotate {
+		t.Error("Load() requested rotation after Save, wanted none")
+	} else if !rotated.(*ecdsa.PrivateKey).Equal(got) {
+		t.Error("Load() returned a different key than was saved")
+	}
+}
+
+func TestSecretAccountKeyStoreRace(t *testing.T) {
+	ctx := context.Background()
+	first, err := newAccountKey()
+	if err != nil {
+		t.Fatalf("newAccountKey() = %v", err)
+	}
+	firstPEM, err := encodeKey(first)
+	if err != nil {
+		t.Fatalf("encodeKey() = %v", err)
+	}
+	second, err := newAccountKey()
+	if err != nil {
+		t.Fatalf("newAccountKey() = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		// race makes another replica save the first key between our
+		// reading and writing the Secret.
+		race func(client *fakekube.Clientset)
+	}{{
+		name: "created by another replica",
+		race: func(client *fakekube.Clientset) {
+			client.PrependReactor("get", "secrets", func(clientgotesting.Action) (bool, runtime.Object, error) {
+				client.ReactionChain = client.ReactionChain[1:]
+				client.Tracker().Add(&corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: AccountSecretName, Namespace: "knative-serving"},
+					Data:       map[string][]byte{AccountKeySecretKey: firstPEM},
+				})
+				return true, nil, apierrs.NewNotFound(corev1.Resource("secrets"), AccountSecretName)
+			})
+		},
+	}, {
+		name: "updated by another replica",
+		race: func(client *fakekube.Clientset) {
+			client.Tracker().Add(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: AccountSecretName, Namespace: "knative-serving"},
+			})
+			client.PrependReactor("update", "secrets", func(clientgotesting.Action) (bool, runtime.Object, error) {
+				client.ReactionChain = client.ReactionChain[1:]
+				client.Tracker().Update(corev1.SchemeGroupVersion.WithResource("secrets"), &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: AccountSecretName, Namespace: "knative-serving"},
+					Data:       map[string][]byte{AccountKeySecretKey: firstPEM},
+				}, "knative-serving")
+				return true, nil, apierrs.NewConflict(corev1.Resource("secrets"), AccountSecretName, errors.New("modified"))
+			})
+		},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fakekube.NewSimpleClientset()
+			test.race(client)
+			store := NewSecretAccountKeyStore(client, "knative-serving", AccountSecretName)
+
+			// We adopt the key of the other replica, rather than
+			// overwriting it.
+			saved, err := store.Save(ctx, second, nil)
+			if err != nil {
+				t.Fatalf("Save() = %v", err)
+			} else if !sameKey(saved, first) {
+				t.Error("Save() = our key, wanted the key of the other replica")
+			}
+			if got, _, err := store.Load(ctx); err != nil {
+				t.Fatalf("Load() = %v", err)
+			} else if !sameKey(got, first) {
+				t.Error("Load() = our key, wanted the key of the other replica")
+			}
+		})
+	}
+}
+
+func TestSecretAccountKeyStoreBadData(t *testing.T) {
+	client := fakekube.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      AccountSecretName,
+			Namespace: "knative-serving",
+		},
+		Data: map[string][]byte{
+			AccountKeySecretKey: []byte("not a key"),
+		},
+	})
+	store := NewSecretAccountKeyStore(client, "knative-serving", AccountSecretName)
+	if _, _, err := store.Load(context.Background()); err == nil {
+		t.Error("Load() = nil, wanted error")
+	}
+}
+
+func TestMemoryAccountKeyStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAccountKeyStore()
+
+	if key, _, err := store.Load(ctx); err != nil || key != nil {
+		t.Fatalf("Load() = %v, %v, wanted nil, nil", key, err)
+	}
+	want, err := newAccountKey()
+	if err != nil {
+		t.Fatalf("newAccountKey() = %v", err)
+	}
+	if _, err := store.Save(ctx, want, nil); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	if got, _, err := store.Load(ctx); err != nil {
+		t.Fatalf("Load() = %v", err)
+	} else if got != want {
+		t.Error("Load() returned a different key than was saved")
+	}
+
+	// The first key saved wins.
+	other, err := newAccountKey()
+	if err != nil {
+		t.Fatalf("newAccountKey() = %v", err)
+	}
+	if saved, err := store.Save(ctx, other, nil); err != nil {
+		t.Fatalf("Save() = %v", err)
+	} else if saved != want {
+		t.Error("Save() replaced the key saved first")
+	}
+}
+
+func TestLoadExternalAccountBinding(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string][]byte
+		want    *acme.ExternalAccountBinding
+		wantErr bool
+	}{{
+		name: "unpadded",
+		data: map[string][]byte{
+			EABKeyIDSecretKey:   []byte("kid-1"),
+			EABHMACKeySecretKey: []byte("c2VjcmV0LWtleQ"),
+		},
+		want: &acme.ExternalAccountBinding{KID: "kid-1", Key: []byte("secret-key")},
+	}, {
+		name: "padded, with a trailing newline",
+		data: map[string][]byte{
+			EABKeyIDSecretKey:   []byte("kid-1\n"),
+			EABHMACKeySecretKey: []byte("c2VjcmV0LWtleQ==\n"),
+		},
+		want: &acme.ExternalAccountBinding{KID: "kid-1", Key: []byte("secret-key")},
+	}, {
+		name: "missing key id",
+		data: map[string][]byte{
+			EABHMACKeySecretKey: []byte("c2VjcmV0LWtleQ"),
+		},
+		wantErr: true,
+	}, {
+		name: "missing hmac key",
+		data: map[string][]byte{
+			EABKeyIDSecretKey: []byte("kid-1"),
+		},
+		wantErr: true,
+	}, {
+		name: "bad hmac key",
+		data: map[string][]byte{
+			EABKeyIDSecretKey:   []byte("kid-1"),
+			EABHMACKeySecretKey: []byte("not base64!"),
+		},
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := fakekube.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "eab",
+					Namespace: "knative-serving",
+				},
+				Data: test.data,
+			})
+			got, err := LoadExternalAccountBinding(context.Background(), client, "knative-serving", "eab")
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("LoadExternalAccountBinding() = %v, wanted error", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("LoadExternalAccountBinding() = %v", err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("LoadExternalAccountBinding() = %v, wanted %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := LoadExternalAccountBinding(context.Background(), fakekube.NewSimpleClientset(), "knative-serving", "eab"); err == nil {
+		t.Error("LoadExternalAccountBinding(missing Secret) = nil, wanted error")
+	}
+}
+
+// fakeAccountCA implements just enough of an ACME directory to register
+// and update accounts.
+type fakeAccountCA struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	account  map[string]interface{}
+	requests []map[string]interface{}
+}
+
+func newFakeAccountCA(t *testing.T) *fakeAccountCA {
+	ca := &fakeAccountCA{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.URL + "/new-nonce",
+			"newAccount": ca.URL + "/new-account",
+			"newOrder":   ca.URL + "/new-order",
+		})
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+	})
+	mux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		payload := ca.payload(t, r)
+		w.Header().Set("Replay-Nonce", "nonce")
+
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		if ca.account == nil {
+			if payload["onlyReturnExisting"] == true {
+				w.Header().Set("Content-Type", "application/problem+json")
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{
+					"type": "urn:ietf:params:acme:error:accountDoesNotExist",
+				})
+				return
+			}
+			ca.account = map[string]interface{}{
+				"status":  "valid",
+				"contact": payload["contact"],
+			}
+			w.Header().Set("Location", ca.URL+"/account")
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.Header().Set("Location", ca.URL+"/account")
+		}
+		json.NewEncoder(w).Encode(ca.account)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		payload := ca.payload(t, r)
+		w.Header().Set("Replay-Nonce", "nonce")
+
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		if contact, ok := payload["contact"]; ok {
+			ca.account["contact"] = contact
+		}
+		json.NewEncoder(w).Encode(ca.account)
+	})
+	ca.Server = httptest.NewServer(mux)
+	t.Cleanup(ca.Close)
+	return ca
+}
+
+// payload records and returns the payload of the JWS request.
+func (ca *fakeAccountCA) payload(t *testing.T, r *http.Request) map[string]interface{} {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		t.Errorf("Decode() = %v", err)
+	}
+	payload := map[string]interface{}{}
+	if jws.Payload != "" {
+		b, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+		if err != nil {
+			t.Errorf("DecodeString() = %v", err)
+		}
+		if err := json.Unmarshal(b, &payload); err != nil {
+			t.Errorf("Unmarshal() = %v", err)
+		}
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.requests = append(ca.requests, payload)
+	return payload
+}
+
+// bindings returns the number of requests that carried an External Account
+// Binding.
+func (ca *fakeAccountCA) bindings() int {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	n := 0
+	for _, req := range ca.requests {
+		if _, ok := req["externalAccountBinding"]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLoadOrCreateAccountRegistration(t *testing.T) {
+	ctx := context.Background()
+	ca := newFakeAccountCA(t)
+	keys := NewMemoryAccountKeyStore()
+
+	reg := Registration{
+		Contact: []string{"mailto:admin@example.com"},
+		ExternalAccountBinding: &acme.ExternalAccountBinding{
+			KID: "kid-1",
+			Key: []byte("secret-key"),
+		},
+	}
+	client := &acme.Client{DirectoryURL: ca.URL + "/directory"}
+	acct, err := loadOrCreateAccount(ctx, client, keys, reg)
+	if err != nil {
+		t.Fatalf("loadOrCreateAccount() = %v", err)
+	}
+	if !cmp.Equal(acct.Contact, reg.Contact) {
+		t.Errorf("Contact = %v, wanted %v", acct.Contact, reg.Contact)
+	}
+
+	if got := ca.bindings(); got != 1 {
+		t.Errorf("Got %d requests with an externalAccountBinding, wanted 1", got)
+	}
+
+	// Changed contacts are updated on the existing account, which isn't
+	// bound again.
+	reg = Registration{Contact: []string{"mailto:ops@example.com"}}
+	client = &acme.Client{DirectoryURL: ca.URL + "/directory"}
+	acct, err = loadOrCreateAccount(ctx, client, keys, reg)
+	if err != nil {
+		t.Fatalf("loadOrCreateAccount() = %v", err)
+	}
+	if !cmp.Equal(acct.Contact, reg.Contact) {
+		t.Errorf("Contact = %v, wanted %v", acct.Contact, reg.Contact)
+	}
+	if got := ca.bindings(); got != 1 {
+		t.Errorf("Got %d requests with an externalAccountBinding, wanted 1", got)
+	}
+}
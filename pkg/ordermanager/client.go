@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"crypto"
+	"crypto/tls"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Client is the subset of the ACME client through which the OrderManager
+// places and fulfills orders.  It is implemented by *acme.Client, and can
+// be faked to exercise the OrderManager without a CA.
+type Client interface {
+	// AuthorizeOrder places a new order for the identifiers.
+	AuthorizeOrder(ctx context.Context, id []acme.AuthzID, opt ...acme.OrderOption) (*acme.Order, error)
+
+	// GetOrder retrieves the current state of the order at the URL.
+	GetOrder(ctx context.Context, url string) (*acme.Order, error)
+
+	// WaitOrder polls the order at the URL until it is ready, valid or
+	// failed.
+	WaitOrder(ctx context.Context, url string) (*acme.Order, error)
+
+	// GetAuthorization retrieves the authorization at the URL.
+	GetAuthorization(ctx context.Context, url string) (*acme.Authorization, error)
+
+	// WaitAuthorization polls the authorization at the URL until it is
+	// valid or failed.
+	WaitAuthorization(ctx context.Context, url string) (*acme.Authorization, error)
+
+	// RevokeAuthorization deactivates the authorization at the URL, which
+	// we no longer need.
+	RevokeAuthorization(ctx context.Context, url string) error
+
+	// Accept tells the CA that the response to the challenge is ready to
+	// be validated.
+	Accept(ctx context.Context, chal *acme.Challenge) (*acme.Challenge, error)
+
+	// CreateOrderCert finalizes the order with the CSR, and returns the
+	// issued certificate chain.
+	CreateOrderCert(ctx context.Context, url string, csr []byte, bundle bool) (der [][]byte, certURL string, err error)
+
+	// RevokeCert revokes the DER encoded certificate, signing the request
+	// with the key, or the account key when nil.
+	RevokeCert(ctx context.Context, key crypto.Signer, cert []byte, reason acme.CRLReasonCode) error
+
+	// The responses to challenges are derived from the account key.
+	HTTP01ChallengeResponse(token string) (string, error)
+	HTTP01ChallengePath(token string) string
+	DNS01ChallengeRecord(token string) (string, error)
+	TLSALPN01ChallengeCert(token, domain string, opt ...acme.CertOption) (tls.Certificate, error)
+}
+
+var _ Client = (*acme.Client)(nil)
+
+// WithClient sets the client through which orders are placed, in place of
+// an ACME client for the directory set by WithDirectoryURL.  The client is
+// used as is, so New neither looks up nor registers its account, and
+// leaves the AccountKeyStore untouched.
+func WithClient(client Client) Option {
+	return func(om *impl) {
+		om.Client = client
+	}
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// fakeClient is a Client that keeps the orders and authorizations of the CA
+// in memory, so that the OrderManager can be exercised offline.  Tests move
+// orders along by changing their status.  The embedded acme.Client only
+// derives the challenge responses from its key, and never talks to a CA.
+type fakeClient struct {
+	*acme.Client
+
+	sync.Mutex
+	orders   map[string]*acme.Order
+	authzs   map[string]*acme.Authorization
+	accepted []string
+	// deactivated are the URLs of the authorizations we deactivated.
+	deactivated []string
+	placed      int
+	fetches     int
+	// trusted holds the identifiers for which the CA has a valid
+	// authorization, which new orders reuse.
+	trusted map[string]bool
+
+	// The errors returned by the respective calls, when set.
+	authorizeErr error
+	getOrderErr  error
+	finalizeErr  error
+
+	// finalizing, when set, is called with the finalize URL of the orders
+	// as they are finalized.
+	finalizing func(url string)
+
+	caKey  crypto.Signer
+	caCert *x509.Certificate
+}
+
+var _ Client = (*fakeClient)(nil)
+
+func newFakeClient(t *testing.T) *fakeClient {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() = %v", err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() = %v", err)
+	}
+	return &fakeClient{
+		Client:  testClient(t),
+		orders:  make(map[string]*acme.Order),
+		authzs:  make(map[string]*acme.Authorization),
+		trusted: make(map[string]bool),
+		caKey:   caKey,
+		caCert:  caCert,
+	}
+}
+
+// setOrderStatus changes the status of the order at the URL.
+func (f *fakeClient) setOrderStatus(url, status string) {
+	f.Lock()
+	defer f.Unlock()
+	f.orders[url].Status = status
+}
+
+// setAuthzStatus changes the status of the authorizations of the order at
+// the URL, failing their challenges with the problem when it is set.
+func (f *fakeClient) setAuthzStatus(url, status string, problem *acme.Error) {
+	f.Lock()
+	defer f.Unlock()
+	for _, zurl := range f.orders[url].AuthzURLs {
+		z := f.authzs[zurl]
+		z.Status = status
+		for _, chal := range z.Challenges {
+			chal.Error = problem
+		}
+	}
+}
+
+// trust makes new orders for the domain reuse a valid authorization.
+func (f *fakeClient) trust(domain string) {
+	f.Lock()
+	defer f.Unlock()
+	f.trusted[domain] = true
+}
+
+// setErrors sets the errors returned by GetOrder and CreateOrderCert.
+func (f *fakeClient) setErrors(getOrder, finalize error) {
+	f.Lock()
+	defer f.Unlock()
+	f.getOrderErr, f.finalizeErr = getOrder, finalize
+}
+
+// ordersPlaced returns the number of orders placed.
+func (f *fakeClient) ordersPlaced() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.placed
+}
+
+// fetched returns the number of orders and authorizations fetched.
+func (f *fakeClient) fetched() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.fetches
+}
+
+// authzsDeactivated returns the URLs of the authorizations deactivated.
+func (f *fakeClient) authzsDeactivated() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string(nil), f.deactivated...)
+}
+
+// challengesAccepted returns the number of challenges accepted.
+func (f *fakeClient) challengesAccepted() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.accepted)
+}
+
+// AuthorizeOrder implements Client
+func (f *fakeClient) AuthorizeOrder(ctx context.Context, ids []acme.AuthzID, opt ...acme.OrderOption) (*acme.Order, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.authorizeErr != nil {
+		return nil, f.authorizeErr
+	}
+
+	f.placed++
+	o := &acme.Order{
+		URI:         fmt.Sprintf("https://ca.example/order/%d", f.placed),
+		Status:      acme.StatusPending,
+		Identifiers: ids,
+		FinalizeURL: fmt.Sprintf("https://ca.example/order/%d/finalize", f.placed),
+	}
+	for _, id := range ids {
+		z := &acme.Authorization{
+			URI:        fmt.Sprintf("%s/authz/%s", o.URI, id.Value),
+			Status:     acme.StatusPending,
+			Identifier: id,
+			Challenges: []*acme.Challenge{{
+				Type:  "http-01",
+				URI:   fmt.Sprintf("%s/chal/%s", o.URI, id.Value),
+				Token: fmt.Sprintf("token-%d-%s", f.placed, id.Value),
+			}},
+		}
+		if f.trusted[id.Value] {
+			z.Status = acme.StatusValid
+		}
+		f.authzs[z.URI] = z
+		o.AuthzURLs = append(o.AuthzURLs, z.URI)
+	}
+	f.orders[o.URI] = o
+	cp := *o
+	return &cp, nil
+}
+
+// GetOrder implements Client
+func (f *fakeClient) GetOrder(ctx context.Context, url string) (*acme.Order, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.fetches++
+	if f.getOrderErr != nil {
+		return nil, f.getOrderErr
+	}
+	o, ok := f.orders[url]
+	if !ok {
+		return nil, &acme.Error{StatusCode: http.StatusNotFound, ProblemType: "urn:ietf:params:acme:error:malformed"}
+	}
+	cp := *o
+	return &cp, nil
+}
+
+// WaitOrder implements Client
+func (f *fakeClient) WaitOrder(ctx context.Context, url string) (*acme.Order, error) {
+	for {
+		o, err := f.GetOrder(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		switch o.Status {
+		case acme.StatusReady, acme.StatusValid:
+			return o, nil
+		case acme.StatusInvalid:
+			return nil, &acme.OrderError{OrderURL: url, Status: o.Status}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// GetAuthorization implements Client
+func (f *fakeClient) GetAuthorization(ctx context.Context, url string) (*acme.Authorization, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.fetches++
+	z, ok := f.authzs[url]
+	if !ok {
+		return nil, &acme.Error{StatusCode: http.StatusNotFound, ProblemType: "urn:ietf:params:acme:error:malformed"}
+	}
+	cp := *z
+	cp.Challenges = make([]*acme.Challenge, 0, len(z.Challenges))
+	for _, chal := range z.Challenges {
+		c := *chal
+		cp.Challenges = append(cp.Challenges, &c)
+	}
+	return &cp, nil
+}
+
+// WaitAuthorization implements Client
+func (f *fakeClient) WaitAuthorization(ctx context.Context, url string) (*acme.Authorization, error) {
+	for {
+		z, err := f.GetAuthorization(ctx, url)
+		if err != nil {
+			return nil, err
+		}
+		switch z.Status {
+		case acme.StatusValid:
+			return z, nil
+		case acme.StatusInvalid:
+			return nil, &acme.AuthorizationError{URI: url, Identifier: z.Identifier.Value}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// RevokeAuthorization implements Client
+func (f *fakeClient) RevokeAuthorization(ctx context.Context, url string) error {
+	f.Lock()
+	defer f.Unlock()
+	z, ok := f.authzs[url]
+	if !ok {
+		return &acme.Error{StatusCode: http.StatusNotFound, ProblemType: "urn:ietf:params:acme:error:malformed"}
+	}
+	z.Status = acme.StatusDeactivated
+	f.deactivated = append(f.deactivated, url)
+	return nil
+}
+
+// Accept implements Client
+func (f *fakeClient) Accept(ctx context.Context, chal *acme.Challenge) (*acme.Challenge, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.accepted = append(f.accepted, chal.URI)
+	return chal, nil
+}
+
+// CreateOrderCert implements Client
+func (f *fakeClient) CreateOrderCert(ctx context.Context, url string, csr []byte, bundle bool) ([][]byte, string, error) {
+	if f.finalizing != nil {
+		f.finalizing(url)
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.finalizeErr != nil {
+		return nil, "", f.finalizeErr
+	}
+	req, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		return nil, "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      req.Subject,
+		DNSNames:     req.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, tmpl, f.caCert, req.PublicKey, f.caKey)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, o := range f.orders {
+		if o.FinalizeURL == url {
+			o.Status = acme.StatusValid
+		}
+	}
+	return [][]byte{der, f.caCert.Raw}, url + "/cert", nil
+}
+
+// RevokeCert implements Client
+func (f *fakeClient) RevokeCert(ctx context.Context, key crypto.Signer, cert []byte, reason acme.CRLReasonCode) error {
+	return nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// The reasons for failing to order a certificate, as classified by
+// ClassifyError.
+const (
+	// ReasonRateLimited is the reason of being rate limited by the CA.
+	ReasonRateLimited = "RateLimited"
+
+	// ReasonBadNonce is the reason of the CA rejecting the anti-replay
+	// nonce of a request.
+	ReasonBadNonce = "BadNonce"
+
+	// ReasonUnauthorized is the reason of the CA refusing to issue a
+	// certificate for the domains, e.g. because validation failed.
+	ReasonUnauthorized = "Unauthorized"
+
+	// ReasonConnectionFailed is the reason of failing to connect, either
+	// us to the CA, or the CA to the challenge responses.
+	ReasonConnectionFailed = "ConnectionFailed"
+
+	// ReasonDNSFailed is the reason of DNS lookups failing, either ours or
+	// those of the CA during validation.
+	ReasonDNSFailed = "DNSFailed"
+
+	// ReasonServerError is the reason of the CA failing to handle requests.
+	ReasonServerError = "ServerError"
+
+	// ReasonValidationFailed is the reason of the CA failing to validate
+	// our responses to the challenges of the domains.
+	ReasonValidationFailed = "ValidationFailed"
+
+	// ReasonFinalizing is the reason of waiting on the CA to issue the
+	// certificate of a finalized order.
+	ReasonFinalizing = "Finalizing"
+
+	// ReasonOrderRejected is the reason of the CA rejecting the order for
+	// any other reason.
+	ReasonOrderRejected = "OrderRejected"
+
+	// ReasonOrderFailed is the reason of errors that aren't otherwise
+	// classified.
+	ReasonOrderFailed = "OrderFailed"
+
+	// ReasonChallengePending is the reason of orders waiting on the CA to
+	// validate the challenges, which isn't an error.
+	ReasonChallengePending = "ChallengePending"
+
+	// ReasonOrderPending is the reason of orders without outstanding
+	// challenges, e.g. because the CA reused valid authorizations, waiting
+	// on the CA to be ready for finalization, which isn't an error.
+	ReasonOrderPending = "OrderPending"
+
+	// ReasonQueued is the reason of orders waiting for other orders to
+	// complete before they are placed, which isn't an error.
+	ReasonQueued = "Queued"
+)
+
+// ErrorClass is the classification of an error ordering a certificate.
+type ErrorClass struct {
+	// Reason is one of the Reason constants.
+	Reason string
+
+	// Transient is whether ordering the certificate may succeed when
+	// retried.
+	Transient bool
+
+	// RetryAfter is how long the CA asked us to wait before trying again,
+	// if it did.
+	RetryAfter time.Duration
+}
+
+// ClassifyError classifies the error of ordering a certificate, by the ACME
+// problem document returned by the CA or the network error, into transient
+// and permanent failures.  Errors that can't be classified are deemed
+// transient.
+func ClassifyError(err error) ErrorClass {
+	if errors.Is(err, ErrFinalizing) {
+		return ErrorClass{Reason: ReasonFinalizing, Transient: true}
+	}
+	if errors.Is(err, ErrQueued) {
+		return ErrorClass{Reason: ReasonQueued, Transient: true}
+	}
+	// Orders whose validation failed may succeed once the challenges are
+	// routed to us.
+	var ze *acme.AuthorizationError
+	if errors.As(err, &ze) {
+		return ErrorClass{Reason: ReasonValidationFailed, Transient: true}
+	}
+	var ae *acme.Error
+	if errors.As(err, &ae) {
+		ec := classifyProblem(ae)
+		ec.RetryAfter = RetryAfter(ae.Header, time.Now())
+		return ec
+	}
+	var oe *acme.OrderError
+	if errors.As(err, &oe) {
+		return ErrorClass{Reason: ReasonOrderRejected}
+	}
+	var de *net.DNSError
+	if errors.As(err, &de) {
+		return ErrorClass{Reason: ReasonDNSFailed, Transient: true}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClass{Reason: ReasonConnectionFailed, Transient: true}
+	}
+	return ErrorClass{Reason: ReasonOrderFailed, Transient: true}
+}
+
+// classifyProblem classifies the ACME problem document, by its type or else
+// its status code.
+func classifyProblem(ae *acme.Error) ErrorClass {
+	// Some CAs use the pre-RFC 8555 "urn:acme:error:" namespace, so only
+	// look at the last part of the problem type.
+	problem := ae.ProblemType[strings.LastIndex(ae.ProblemType, ":")+1:]
+	switch problem {
+	case "rateLimited":
+		return ErrorClass{Reason: ReasonRateLimited, Transient: true}
+	case "badNonce":
+		return ErrorClass{Reason: ReasonBadNonce, Transient: true}
+	case "unauthorized":
+		return ErrorClass{Reason: ReasonUnauthorized}
+	case "connection":
+		return ErrorClass{Reason: ReasonConnectionFailed, Transient: true}
+	case "dns":
+		return ErrorClass{Reason: ReasonDNSFailed, Transient: true}
+	case "serverInternal":
+		return ErrorClass{Reason: ReasonServerError, Transient: true}
+	}
+	if ae.StatusCode >= http.StatusInternalServerError {
+		return ErrorClass{Reason: ReasonServerError, Transient: true}
+	}
+	return ErrorClass{Reason: ReasonOrderRejected}
+}
+
+// RetryAfter parses the Retry-After header, which is either a number of
+// seconds or a date, into how long to wait from now.  It returns zero when
+// the header is missing or invalid.
+func RetryAfter(h http.Header, now time.Time) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// DescribeError renders the error of ordering a certificate for humans, e.g.
+// in the status of a Certificate.  It spells out the details of the ACME
+// problem documents returned by the CA, such as why validating a challenge
+// failed.
+func DescribeError(err error) string {
+	var ze *acme.AuthorizationError
+	if errors.As(err, &ze) {
+		details := make([]string, 0, len(ze.Errors))
+		for _, err := range ze.Errors {
+			details = append(details, DescribeError(err))
+		}
+		return fmt.Sprintf("Validation of %s failed: %s", ze.Identifier, strings.Join(details, "; "))
+	}
+	var ae *acme.Error
+	if errors.As(err, &ae) && ae.Detail != "" {
+		details := []string{ae.Detail}
+		for _, sp := range ae.Subproblems {
+			if sp.Identifier != nil {
+				details = append(details, fmt.Sprintf("%s: %s", sp.Identifier.Value, sp.Detail))
+			} else {
+				details = append(details, sp.Detail)
+			}
+		}
+		return strings.Join(details, "; ")
+	}
+	return err.Error()
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want ErrorClass
+	}{{
+		name: "rate limited",
+		err: &acme.Error{
+			StatusCode:  http.StatusTooManyRequests,
+			ProblemType: "urn:ietf:params:acme:error:rateLimited",
+			Header:      http.Header{"Retry-After": []string{"3600"}},
+		},
+		want: ErrorClass{Reason: ReasonRateLimited, Transient: true, RetryAfter: time.Hour},
+	}, {
+		name: "wrapped bad nonce",
+		err:  fmt.Errorf("getting order: %w", &acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:ietf:params:acme:error:badNonce"}),
+		want: ErrorClass{Reason: ReasonBadNonce, Transient: true},
+	}, {
+		name: "unauthorized",
+		err:  &acme.Error{StatusCode: http.StatusForbidden, ProblemType: "urn:ietf:params:acme:error:unauthorized"},
+		want: ErrorClass{Reason: ReasonUnauthorized},
+	}, {
+		name: "connection",
+		err:  &acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:ietf:params:acme:error:connection"},
+		want: ErrorClass{Reason: ReasonConnectionFailed, Transient: true},
+	}, {
+		name: "dns, in the old namespace",
+		err:  &acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:acme:error:dns"},
+		want: ErrorClass{Reason: ReasonDNSFailed, Transient: true},
+	}, {
+		name: "server error",
+		err: &acme.Error{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{"Retry-After": []string{"120"}},
+		},
+		want: ErrorClass{Reason: ReasonServerError, Transient: true, RetryAfter: 2 * time.Minute},
+	}, {
+		name: "rejected",
+		err:  &acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier"},
+		want: ErrorClass{Reason: ReasonOrderRejected},
+	}, {
+		name: "invalid order",
+		err:  &acme.OrderError{OrderURL: "https://ca.example/order/1", Status: acme.StatusInvalid},
+		want: ErrorClass{Reason: ReasonOrderRejected},
+	}, {
+		name: "validation failed",
+		err: &acme.AuthorizationError{
+			Identifier: "example.com",
+			Errors:     []error{&acme.Error{StatusCode: http.StatusBadRequest, ProblemType: "urn:ietf:params:acme:error:connection"}},
+		},
+		want: ErrorClass{Reason: ReasonValidationFailed, Transient: true},
+	}, {
+		name: "finalizing",
+		err:  ErrFinalizing,
+		want: ErrorClass{Reason: ReasonFinalizing, Transient: true},
+	}, {
+		name: "queued",
+		err:  ErrQueued,
+		want: ErrorClass{Reason: ReasonQueued, Transient: true},
+	}, {
+		name: "dns lookup",
+		err:  &net.DNSError{Err: "no such host", Name: "ca.example"},
+		want: ErrorClass{Reason: ReasonDNSFailed, Transient: true},
+	}, {
+		name: "network",
+		err:  &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+		want: ErrorClass{Reason: ReasonConnectionFailed, Transient: true},
+	}, {
+		name: "timeout",
+		err:  context.DeadlineExceeded,
+		want: ErrorClass{Reason: ReasonConnectionFailed, Transient: true},
+	}, {
+		name: "other",
+		err:  errors.New("oops"),
+		want: ErrorClass{Reason: ReasonOrderFailed, Transient: true},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ClassifyError(test.err); got != test.want {
+				t.Errorf("ClassifyError() = %+v, wanted %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{{
+		value: "",
+		want:  0,
+	}, {
+		value: "30",
+		want:  30 * time.Second,
+	}, {
+		value: now.Add(10 * time.Minute).Format(http.TimeFormat),
+		want:  10 * time.Minute,
+	}, {
+		value: now.Add(-time.Minute).Format(http.TimeFormat),
+		want:  0,
+	}, {
+		value: "soon",
+		want:  0,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			h := http.Header{}
+			if test.value != "" {
+				h.Set("Retry-After", test.value)
+			}
+			if got := RetryAfter(h, now); got != test.want {
+				t.Errorf("RetryAfter() = %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDescribeError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{{
+		name: "validation failed",
+		err: fmt.Errorf("waiting for challenges: %w", &acme.AuthorizationError{
+			Identifier: "example.com",
+			Errors: []error{&acme.Error{
+				StatusCode:  http.StatusBadRequest,
+				ProblemType: "urn:ietf:params:acme:error:connection",
+				Detail:      "Fetching http://example.com/.well-known/acme-challenge/abc: Connection refused",
+			}},
+		}),
+		want: "Validation of example.com failed: Fetching http://example.com/.well-known/acme-challenge/abc: Connection refused",
+	}, {
+		name: "subproblems",
+		err: &acme.Error{
+			StatusCode:  http.StatusBadRequest,
+			ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier",
+			Detail:      "Error creating new order",
+			Subproblems: []acme.Subproblem{{
+				Type:       "urn:ietf:params:acme:error:rejectedIdentifier",
+				Detail:     "Domain name is on the blocklist",
+				Identifier: &acme.AuthzID{Type: "dns", Value: "example.com"},
+			}},
+		},
+		want: "Error creating new order; example.com: Domain name is on the blocklist",
+	}, {
+		name: "no detail",
+		err:  &acme.Error{StatusCode: http.StatusServiceUnavailable},
+		want: "503 : ",
+	}, {
+		name: "other",
+		err:  errors.New("oops"),
+		want: "oops",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := DescribeError(test.err); got != test.want {
+				t.Errorf("DescribeError() = %q, wanted %q", got, test.want)
+			}
+		})
+	}
+}
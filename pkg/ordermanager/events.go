@@ -0,0 +1,55 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+)
+
+// The reasons of the events about the progress of orders.
+const (
+	// ReasonOrderStarted is the reason of placing a new order with the CA.
+	ReasonOrderStarted = "OrderStarted"
+
+	// ReasonChallengeValidated is the reason of the CA validating our
+	// response to the challenge of one of the domains.
+	ReasonChallengeValidated = "ChallengeValidated"
+)
+
+// EventCallback is the signature of the function for notifying owners of
+// the progress of their order, e.g. by recording Kubernetes Events.  The
+// context is derived from that of the call to Order that placed the order.
+type EventCallback func(ctx context.Context, owner interface{}, reason, message string)
+
+// WithEventCallback sets the function through which the owners of orders
+// are notified of their progress.  By default they are not.
+func WithEventCallback(cb EventCallback) Option {
+	return func(om *impl) {
+		om.Events = cb
+	}
+}
+
+// notify notifies the owners of the order for the domains, falling back on
+// the given owner, of the progress of the order.
+func (om *impl) notify(ctx context.Context, domains []string, owner interface{}, reason, message string) {
+	if om.Events == nil {
+		return
+	}
+	for _, o := range om.ownersOf(domains, owner) {
+		om.Events(ctx, o, reason, message)
+	}
+}
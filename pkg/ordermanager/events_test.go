@@ -0,0 +1,63 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestNotify(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com"}
+	first := types.NamespacedName{Namespace: "foo", Name: "first"}
+	second := types.NamespacedName{Namespace: "bar", Name: "second"}
+
+	var got []string
+	om := &impl{
+		Events: func(_ context.Context, owner interface{}, reason, message string) {
+			got = append(got, owner.(types.NamespacedName).Name+" "+reason+" "+message)
+		},
+		inflight: make(map[key]ticket),
+	}
+
+	// Without an order in-flight, the given owner is notified.
+	om.notify(ctx, domains, first, ReasonOrderStarted, "started")
+
+	// Otherwise all of the owners of the order are.
+	om.putTicket(domains, ticket{
+		uri:    "https://ca.example/order/1",
+		owners: []interface{}{first, second},
+	})
+	om.notify(ctx, domains, first, ReasonChallengeValidated, "validated")
+
+	want := []string{
+		"first OrderStarted started",
+		"first ChallengeValidated validated",
+		"second ChallengeValidated validated",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("notify() (-want, +got) = %s", cmp.Diff(want, got))
+	}
+
+	// Notifying without a callback is a no-op.
+	om.Events = nil
+	om.notify(ctx, domains, first, ReasonOrderStarted, "started")
+}
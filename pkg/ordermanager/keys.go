@@ -0,0 +1,170 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"time"
+)
+
+const (
+	// RSA is the KeySpec algorithm for RSA keys.
+	RSA = "rsa"
+
+	// ECDSA is the KeySpec algorithm for ECDSA keys.
+	ECDSA = "ecdsa"
+)
+
+// KeySpec describes the private key of a certificate.
+type KeySpec struct {
+	// Algorithm is one of RSA or ECDSA.
+	Algorithm string
+
+	// Size is the modulus size of RSA keys (2048, 3072 or 4096), or the
+	// curve size of ECDSA keys (256 or 384).  Zero picks the default size
+	// for the algorithm.
+	Size int
+}
+
+// DefaultKeySpec is the KeySpec used when none is specified.
+var DefaultKeySpec = KeySpec{Algorithm: ECDSA, Size: 256}
+
+// String implements fmt.Stringer
+func (k KeySpec) String() string {
+	k = k.withDefaults()
+	return fmt.Sprintf("%s-%d", k.Algorithm, k.Size)
+}
+
+// Validate checks that the KeySpec describes a supported key.
+func (k KeySpec) Validate() error {
+	k = k.withDefaults()
+	switch k.Algorithm {
+	case RSA:
+		switch k.Size {
+		case 2048, 3072, 4096:
+			return nil
+		}
+	case ECDSA:
+		switch k.Size {
+		case 256, 384:
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported key algorithm %q", k.Algorithm)
+	}
+	return fmt.Errorf("unsupported %s key size %d", k.Algorithm, k.Size)
+}
+
+// Generate creates a new private key matching the KeySpec.
+func (k KeySpec) Generate() (crypto.Signer, error) {
+	if err := k.Validate(); err != nil {
+		return nil, err
+	}
+	k = k.withDefaults()
+	switch k.Algorithm {
+	case RSA:
+		return rsa.GenerateKey(cryptorand.Reader, k.Size)
+	default:
+		return ecdsa.GenerateKey(curve(k.Size), cryptorand.Reader)
+	}
+}
+
+// Matches checks whether the public key matches the KeySpec.
+func (k KeySpec) Matches(pub crypto.PublicKey) bool {
+	k = k.withDefaults()
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		return k.Algorithm == RSA && p.N.BitLen() == k.Size
+	case *ecdsa.PublicKey:
+		return k.Algorithm == ECDSA && p.Curve == curve(k.Size)
+	default:
+		return false
+	}
+}
+
+func (k KeySpec) withDefaults() KeySpec {
+	if k.Algorithm == "" {
+		k.Algorithm = DefaultKeySpec.Algorithm
+	}
+	if k.Size == 0 {
+		switch k.Algorithm {
+		case RSA:
+			k.Size = 2048
+		case ECDSA:
+			k.Size = 256
+		}
+	}
+	return k
+}
+
+func curve(size int) elliptic.Curve {
+	if size == 384 {
+		return elliptic.P384()
+	}
+	return elliptic.P256()
+}
+
+// OrderOption customizes a single call to Order.
+type OrderOption func(*orderOptions)
+
+type orderOptions struct {
+	keySpec   KeySpec
+	key       crypto.Signer
+	selfCheck SelfCheck
+	timeout   time.Duration
+	renewing  time.Time
+}
+
+// WithKeySpec sets the kind of private key of the certificate.
+func WithKeySpec(spec KeySpec) OrderOption {
+	return func(o *orderOptions) {
+		o.keySpec = spec
+	}
+}
+
+// WithPrivateKey reuses the given private key for the certificate, instead
+// of generating a new one, as long as it matches the KeySpec.
+func WithPrivateKey(key crypto.Signer) OrderOption {
+	return func(o *orderOptions) {
+		o.key = key
+	}
+}
+
+func newOrderOptions(opts []OrderOption) orderOptions {
+	o := orderOptions{
+		keySpec:   DefaultKeySpec,
+		selfCheck: DefaultSelfCheck,
+		timeout:   DefaultOrderTimeout,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// privateKey returns the private key for the certificate.
+func (o orderOptions) privateKey() (crypto.Signer, error) {
+	if o.key != nil && o.keySpec.Matches(o.key.Public()) {
+		return o.key, nil
+	}
+	return o.keySpec.Generate()
+}
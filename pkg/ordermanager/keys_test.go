@@ -0,0 +1,107 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	"testing"
+)
+
+func TestKeySpec(t *testing.T) {
+	tests := []struct {
+		spec    KeySpec
+		want    string
+		wantErr bool
+	}{{
+		spec: KeySpec{},
+		want: "ecdsa-256",
+	}, {
+		spec: KeySpec{Algorithm: ECDSA, Size: 384},
+		want: "ecdsa-384",
+	}, {
+		spec: KeySpec{Algorithm: RSA},
+		want: "rsa-2048",
+	}, {
+		spec: KeySpec{Algorithm: RSA, Size: 3072},
+		want: "rsa-3072",
+	}, {
+		spec:    KeySpec{Algorithm: RSA, Size: 1024},
+		wantErr: true,
+	}, {
+		spec:    KeySpec{Algorithm: ECDSA, Size: 521},
+		wantErr: true,
+	}, {
+		spec:    KeySpec{Algorithm: "ed25519"},
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.spec.String(), func(t *testing.T) {
+			key, err := test.spec.Generate()
+			if test.wantErr {
+				if err == nil {
+					t.Error("Generate() = nil, wanted error")
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Generate() = %v", err)
+			}
+			if got := test.spec.String(); got != test.want {
+				t.Errorf("String() = %s, wanted %s", got, test.want)
+			}
+			if !test.spec.Matches(key.Public()) {
+				t.Errorf("Matches(generated key) = false, wanted true")
+			}
+			for _, other := range []KeySpec{{Algorithm: ECDSA, Size: 256}, {Algorithm: ECDSA, Size: 384}, {Algorithm: RSA, Size: 2048}, {Algorithm: RSA, Size: 3072}} {
+				if other.String() == test.want {
+					continue
+				}
+				if other.Matches(key.Public()) {
+					t.Errorf("%s.Matches(generated key) = true, wanted false", other)
+				}
+			}
+		})
+	}
+}
+
+func TestPrivateKeyReuse(t *testing.T) {
+	existing, err := DefaultKeySpec.Generate()
+	if err != nil {
+		t.Fatalf("Generate() = %v", err)
+	}
+
+	// A matching key is reused.
+	key, err := newOrderOptions([]OrderOption{WithPrivateKey(existing)}).privateKey()
+	if err != nil {
+		t.Fatalf("privateKey() = %v", err)
+	}
+	if key != existing {
+		t.Error("privateKey() generated a new key, wanted the existing key")
+	}
+
+	// A key that doesn't match the spec is replaced.
+	spec := KeySpec{Algorithm: ECDSA, Size: 384}
+	key, err = newOrderOptions([]OrderOption{WithPrivateKey(existing), WithKeySpec(spec)}).privateKey()
+	if err != nil {
+		t.Fatalf("privateKey() = %v", err)
+	}
+	if key == existing {
+		t.Error("privateKey() reused the existing key, wanted a new key")
+	}
+	if !spec.Matches(key.Public()) {
+		t.Errorf("privateKey() doesn't match %s", spec)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"knative.dev/pkg/logging"
+)
+
+// DefaultOrderTimeout is how long an order may take when no timeout is
+// configured.
+const DefaultOrderTimeout = 5 * time.Minute
+
+// cleanUpTimeout bounds unregistering the challenges of an order, which
+// happens after the order was cut short as well.
+const cleanUpTimeout = 30 * time.Second
+
+// ErrShutdown is returned by Order once the OrderManager has been shut
+// down.
+var ErrShutdown = errors.New("the OrderManager has been shut down")
+
+// WithContext ties the lifetime of the OrderManager to ctx: the work on
+// in-flight orders, which continues in the background between calls to
+// Order, stops once ctx is done.  It defaults to context.Background(), so
+// that the work continues until Shutdown is called.
+func WithContext(ctx context.Context) Option {
+	return func(om *impl) {
+		om.ctx = ctx
+	}
+}
+
+// WithOrderTimeout bounds how long the order may take, from placing it
+// until the certificate is issued, including the calls made to the CA.
+// Orders that run out of time fail, so that the next call to Order places
+// a new one.  It defaults to DefaultOrderTimeout.
+func WithOrderTimeout(timeout time.Duration) OrderOption {
+	return func(o *orderOptions) {
+		o.timeout = timeout
+	}
+}
+
+// Shutdown implements Interface
+func (om *impl) Shutdown(ctx context.Context) error {
+	logger := logging.FromContext(ctx)
+
+	func() {
+		om.Lock()
+		defer om.Unlock()
+		// Under the lock, so that no work is started past this point.
+		om.stop()
+	}()
+
+	// The challenges are cleaned up as the work on the orders stops.
+	stopped := make(chan struct{})
+	go func() {
+		om.background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var errs []error
+	abandoned, authzs := om.abandonOrders()
+	for _, domains := range abandoned {
+		// Don't pick the order back up once we restart.
+		if err := om.Orders.Delete(ctx, domains); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, z := range authzs {
+		logger.Infof("Deactivating the authorization for %q", z.Identifier.Value)
+		if err := om.Client.RevokeAuthorization(ctx, z.URI); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// abandonOrders drops the in-flight orders, and returns the domains of those
+// that won't be resumed after a restart, along with their authorizations that
+// were pending as of the last time we polled them.
+func (om *impl) abandonOrders() ([][]string, []*acme.Authorization) {
+	om.Lock()
+	defer om.Unlock()
+
+	var (
+		abandoned [][]string
+		authzs    []*acme.Authorization
+	)
+	for k, t := range om.inflight {
+		delete(om.inflight, k)
+		if om.resumes(t) {
+			// We need the authorizations once we resume the order.
+			continue
+		}
+		abandoned = append(abandoned, t.domains)
+		for _, z := range t.cache.get().authzs {
+			if z.Status == acme.StatusPending {
+				authzs = append(authzs, z)
+			}
+		}
+	}
+	return abandoned, authzs
+}
+
+// resumes returns whether the order of the ticket is resumed after a
+// restart, which takes it being persisted, and neither having failed nor
+// having been finalized already.
+func (om *impl) resumes(t ticket) bool {
+	return om.persistent && t.err == nil && t.cert == nil
+}
+
+// begin registers work that runs in the background until Shutdown, and
+// returns false when we are shutting down, in which case the work must not
+// be started.  The work calls om.background.Done() once it stops.
+func (om *impl) begin() bool {
+	om.Lock()
+	defer om.Unlock()
+
+	if om.ctx.Err() != nil {
+		return false
+	}
+	om.background.Add(1)
+	return true
+}
+
+// orderContext returns the context of the work on an order, which carries
+// the values of ctx, but outlives it in the background.  It is done once
+// the order runs out of time, or the OrderManager shuts down.
+func (om *impl) orderContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(detached{ctx}, timeout)
+	go func() {
+		select {
+		case <-om.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// detached is a context that carries the values of its parent, but not
+// its deadline or cancellation.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
@@ -0,0 +1,267 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/acme"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/clock"
+	"knative.dev/net-http01/pkg/challenger"
+)
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com", "www.example.com"}
+	fc := newFakeClient(t)
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	om, err := New(ctx, func(interface{}) {}, chlr, nil, WithClient(fc), WithPollBackoff(testPollBackoff))
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+
+	// The CA never validates the challenges, so the order stays pending.
+	chall, _, err := om.Order(ctx, domains, nil, WithSelfCheck(SelfCheck{}))
+	if err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	if len(chall) != len(domains) {
+		t.Fatalf("Order() = %v, wanted %d challenges", chall, len(domains))
+	}
+
+	if err := om.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	for _, url := range chall {
+		rec := httptest.NewRecorder()
+		chlr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url.Path, nil))
+		if got, want := rec.Code, http.StatusNotFound; got != want {
+			t.Errorf("ServeHTTP(%s) = %d, wanted %d", url, got, want)
+		}
+	}
+	// The order can't be resumed, so its authorizations are deactivated.
+	got := fc.authzsDeactivated()
+	sort.Strings(got)
+	want := []string{
+		"https://ca.example/order/1/authz/example.com",
+		"https://ca.example/order/1/authz/www.example.com",
+	}
+	if !cmp.Equal(got, want) {
+		t.Errorf("deactivated = %v, wanted %v", got, want)
+	}
+
+	if _, _, err := om.Order(ctx, domains, nil); !errors.Is(err, ErrShutdown) {
+		t.Errorf("Order() = %v, wanted %v", err, ErrShutdown)
+	}
+}
+
+func TestShutdownKeepsResumableOrders(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com"}
+	fc := newFakeClient(t)
+	store := NewSecretOrderStore(fakekube.NewSimpleClientset(), "knative-serving", OrdersSecretName)
+	om := newTestOrderManager(t, ctx, fc, clock.RealClock{}, WithOrderStore(store))
+
+	if _, _, err := om.Order(ctx, domains, nil, WithSelfCheck(SelfCheck{})); err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	if err := om.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if got := fc.authzsDeactivated(); len(got) != 0 {
+		t.Errorf("deactivated = %v, wanted none", got)
+	}
+	records, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	if len(records) != 1 || records[0].URI != "https://ca.example/order/1" {
+		t.Errorf("List() = %v, wanted the order to resume", records)
+	}
+}
+
+func TestShutdownAbandonsFailedOrders(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com"}
+	fc := newFakeClient(t)
+	store := NewSecretOrderStore(fakekube.NewSimpleClientset(), "knative-serving", OrdersSecretName)
+	om := newTestOrderManager(t, ctx, fc, clock.RealClock{}, WithOrderStore(store))
+
+	// The CA never validates the challenge, so the order runs out of time.
+	if _, _, err := om.Order(ctx, domains, nil, WithSelfCheck(SelfCheck{}), WithOrderTimeout(50*time.Millisecond)); err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	if err := wait.PollUntilContextTimeout(ctx, 10*time.Millisecond, 5*time.Second, true, func(context.Context) (bool, error) {
+		t, _ := om.(*impl).getTicket(domains, nil, "")
+		return t.err != nil, nil
+	}); err != nil {
+		t.Fatal("The order didn't run out of time")
+	}
+
+	if err := om.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	// The failed order isn't resumed, so its authorization is deactivated.
+	if got := fc.authzsDeactivated(); len(got) != 1 {
+		t.Errorf("deactivated = %v, wanted the order's authorization", got)
+	}
+	records, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List() = %v", err)
+	}
+	if len(records) != 0 {
+		t.Errorf("List() = %v, wanted no orders to resume", records)
+	}
+}
+
+func TestResumeOrder(t *testing.T) {
+	domains := []string{"example.com"}
+	owner := types.NamespacedName{Namespace: "foo", Name: "bar"}
+
+	tests := []struct {
+		status  string
+		resumed bool
+	}{{
+		status:  acme.StatusPending,
+		resumed: true,
+	}, {
+		status:  acme.StatusReady,
+		resumed: true,
+	}, {
+		// The order was finalized before the restart, so a new order is
+		// placed.
+		status: acme.StatusProcessing,
+	}, {
+		status: acme.StatusValid,
+	}, {
+		status: acme.StatusInvalid,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.status, func(t *testing.T) {
+			ctx := context.Background()
+			fc := newFakeClient(t)
+			o, err := fc.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+			if err != nil {
+				t.Fatalf("AuthorizeOrder() = %v", err)
+			}
+			if test.status != acme.StatusPending {
+				fc.setAuthzStatus(o.URI, acme.StatusValid, nil)
+			}
+			fc.setOrderStatus(o.URI, test.status)
+			store := NewMemoryOrderStore()
+			if err := store.Save(ctx, OrderRecord{Domains: domains, URI: o.URI, AuthzURLs: o.AuthzURLs}); err != nil {
+				t.Fatalf("Save() = %v", err)
+			}
+			om := newTestOrderManager(t, ctx, fc, clock.RealClock{}, WithOrderStore(store))
+
+			if _, _, err := om.Order(ctx, domains, owner, WithSelfCheck(SelfCheck{})); err != nil {
+				t.Fatalf("Order() = %v", err)
+			}
+			want := 2
+			if test.resumed {
+				want = 1
+			}
+			if got := fc.ordersPlaced(); got != want {
+				t.Errorf("Placed %d orders, wanted %d", got, want)
+			}
+			if !test.resumed {
+				records, err := store.List(ctx)
+				if err != nil {
+					t.Fatalf("List() = %v", err)
+				}
+				if len(records) != 1 || records[0].URI == o.URI {
+					t.Errorf("List() = %v, wanted only the new order", records)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	domains := []string{"example.com"}
+	fc := newFakeClient(t)
+	om := newTestOrderManager(t, context.Background(), fc, clock.RealClock{}, WithContext(ctx))
+
+	if _, _, err := om.Order(ctx, domains, nil, WithSelfCheck(SelfCheck{})); err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	cancel()
+	if _, _, err := om.Order(context.Background(), domains, nil); !errors.Is(err, ErrShutdown) {
+		t.Errorf("Order() = %v, wanted %v", err, ErrShutdown)
+	}
+	// The work on the order stopped with the context, but the authorizations
+	// are only deactivated by Shutdown.
+	if err := om.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if got := fc.authzsDeactivated(); len(got) != 1 {
+		t.Errorf("deactivated = %v, wanted the order's authorization", got)
+	}
+}
+
+func TestOrderTimeout(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com"}
+	owner := types.NamespacedName{Namespace: "foo", Name: "bar"}
+	fc := newFakeClient(t)
+	up := make(chan interface{}, 1)
+	om := newTestOrderManager(t, ctx, fc, clock.RealClock{}, withCallback(func(owner interface{}) {
+		select {
+		case up <- owner:
+		default:
+		}
+	}))
+
+	// The CA never validates the challenge, so the order runs out of time.
+	opts := []OrderOption{WithSelfCheck(SelfCheck{}), WithOrderTimeout(50 * time.Millisecond)}
+	if _, _, err := om.Order(ctx, domains, owner, opts...); err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	select {
+	case got := <-up:
+		if got != owner {
+			t.Errorf("Callback(%v), wanted %v", got, owner)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The owner wasn't notified of the order running out of time")
+	}
+	if _, _, err := om.Order(ctx, domains, owner, opts...); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Order() = %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	// The next attempt places a new order.
+	if _, _, err := om.Order(ctx, domains, owner, opts...); err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	if got := fc.ordersPlaced(); got != 2 {
+		t.Errorf("Placed %d orders, wanted 2", got)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/pkg/metrics"
+)
+
+var (
+	orderStartedCountM = stats.Int64(
+		"order_started_count",
+		"The number of orders placed with the CA",
+		stats.UnitDimensionless)
+	orderCompletedCountM = stats.Int64(
+		"order_completed_count",
+		"The number of orders for which the CA issued a certificate",
+		stats.UnitDimensionless)
+	orderFailedCountM = stats.Int64(
+		"order_failed_count",
+		"The number of orders that failed",
+		stats.UnitDimensionless)
+	orderDurationM = stats.Float64(
+		"order_duration",
+		"The time from placing an order to the CA issuing the certificate in seconds",
+		stats.UnitSeconds)
+
+	// errorTypeKey is the reason the order failed, as classified by
+	// ClassifyError.
+	errorTypeKey = tag.MustNewKey("error_type")
+)
+
+func init() {
+	if err := view.Register(
+		&view.View{
+			Description: orderStartedCountM.Description(),
+			Measure:     orderStartedCountM,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Description: orderCompletedCountM.Description(),
+			Measure:     orderCompletedCountM,
+			Aggregation: view.Count(),
+		},
+		&view.View{
+			Description: orderFailedCountM.Description(),
+			Measure:     orderFailedCountM,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{errorTypeKey},
+		},
+		&view.View{
+			Description: orderDurationM.Description(),
+			Measure:     orderDurationM,
+			Aggregation: view.Distribution(metrics.Buckets125(1, 10000)...), // [1 2 5 10 20 50 100 200 500 1000 2000 5000 10000]s
+		},
+	); err != nil {
+		panic(err)
+	}
+}
+
+func recordOrderStarted(ctx context.Context) {
+	metrics.Record(ctx, orderStartedCountM.M(1))
+}
+
+func recordOrderCompleted(ctx context.Context, duration time.Duration) {
+	metrics.RecordBatch(ctx, orderCompletedCountM.M(1),
+		orderDurationM.M(duration.Seconds()))
+}
+
+func recordOrderFailed(ctx context.Context, err error) {
+	ctx, terr := tag.New(ctx, tag.Insert(errorTypeKey, ClassifyError(err).Reason))
+	if terr != nil {
+		return
+	}
+	metrics.Record(ctx, orderFailedCountM.M(1))
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"golang.org/x/crypto/acme"
+	"knative.dev/pkg/metrics"
+)
+
+// count returns the count recorded by the named view for the rows
+// matching the given error type, or all rows when it is empty.
+func count(t *testing.T, name, errorType string) int64 {
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("RetrieveData(%q) = %v", name, err)
+	}
+	var total int64
+	for _, row := range rows {
+		if errorType != "" {
+			matched := false
+			for _, tg := range row.Tags {
+				matched = matched || (tg.Key == errorTypeKey && tg.Value == errorType)
+			}
+			if !matched {
+				continue
+			}
+		}
+		total += row.Data.(*view.CountData).Value
+	}
+	return total
+}
+
+func TestOrderMetrics(t *testing.T) {
+	metrics.InitForTesting()
+	ctx := context.Background()
+
+	started := count(t, orderStartedCountM.Name(), "")
+	completed := count(t, orderCompletedCountM.Name(), "")
+	rateLimited := count(t, orderFailedCountM.Name(), ReasonRateLimited)
+	failed := count(t, orderFailedCountM.Name(), ReasonOrderFailed)
+
+	recordOrderStarted(ctx)
+	recordOrderCompleted(ctx, time.Minute)
+	recordOrderFailed(ctx, &acme.Error{ProblemType: "urn:ietf:params:acme:error:rateLimited"})
+	recordOrderFailed(ctx, errors.New("boom"))
+	recordOrderFailed(ctx, errors.New("bang"))
+
+	for _, tc := range []struct {
+		name      string
+		view      string
+		errorType string
+		before    int64
+		want      int64
+	}{
+		{"started", orderStartedCountM.Name(), "", started, 1},
+		{"completed", orderCompletedCountM.Name(), "", completed, 1},
+		{"rate limited", orderFailedCountM.Name(), ReasonRateLimited, rateLimited, 1},
+		{"failed", orderFailedCountM.Name(), ReasonOrderFailed, failed, 2},
+	} {
+		if got := count(t, tc.view, tc.errorType) - tc.before; got != tc.want {
+			t.Errorf("%s = %d, wanted %d", tc.name, got, tc.want)
+		}
+	}
+
+	rows, err := view.RetrieveData(orderDurationM.Name())
+	if err != nil {
+		t.Fatalf("RetrieveData() = %v", err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("len(rows) = %d, wanted 1", len(rows))
+	}
+	if d := rows[0].Data.(*view.DistributionData); d.Max < 60 {
+		t.Errorf("max duration = %v, wanted at least 60s", d.Max)
+	}
+}
@@ -18,12 +18,13 @@ package ordermanager
 
 import (
 	context "context"
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"crypto"
 	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
@@ -33,7 +34,11 @@ import (
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
 	"knative.dev/net-http01/pkg/challenger"
 	"knative.dev/pkg/apis"
 	logging "knative.dev/pkg/logging"
@@ -41,7 +46,23 @@ import (
 
 // Interface defines the interface for ordering new certificates.
 type Interface interface {
-	Order(ctx context.Context, domains []string, owner interface{}) (challenges []*apis.URL, cert *tls.Certificate, err error)
+	Order(ctx context.Context, domains []string, owner interface{}, opts ...OrderOption) (challenges []*apis.URL, cert *tls.Certificate, err error)
+
+	// Revoke revokes the given DER encoded certificate, which was issued to
+	// our account, for the given RFC 5280 reason.
+	Revoke(ctx context.Context, der []byte, reason acme.CRLReasonCode) error
+
+	// Forget drops the owner from the in-flight orders for any set of domains
+	// other than the given one, e.g. because the owner changed its domains,
+	// or went away, in which case domains is nil.  Orders left without
+	// owners are dropped.
+	Forget(ctx context.Context, owner interface{}, domains []string)
+
+	// Shutdown stops the work on in-flight orders and unregisters their
+	// challenges.  The pending authorizations of orders that can't be
+	// resumed after a restart are deactivated.  Order fails once Shutdown
+	// was called.
+	Shutdown(ctx context.Context) error
 }
 
 // OrderUpCallback is the signature of the function for notifying
@@ -59,54 +80,159 @@ const (
 	// signed by their root CA.  This allows ~50 certificates to be issued per
 	// registered domain per week.
 	Production = autocert.DefaultACMEDirectory
-)
-
-var (
-	// Endpoint is the ACME API to use, it defaults to Production, but
-	// can be pointed at Staging or other compatible endpoints.
-	Endpoint = Production
 
 	// UserAgent is the HTTP user agent that is used with the ACME client,
 	// so that traffic from this client may be distinguished from others.
-	// It is intentionally exposed as a mutable variable in case users with
-	// to distinguish their traffic further.
 	UserAgent = "knative.dev/net-http01"
 )
 
-// New creates a new OrderManager.
-func New(ctx context.Context, cb OrderUpCallback, chlr challenger.Interface) (Interface, error) {
-	acctKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
-	if err != nil {
-		return nil, err
+// Option customizes the OrderManager returned by New.
+type Option func(*impl)
+
+// WithDirectoryURL sets the directory of the ACME CA with which certificates
+// are ordered.  It defaults to Production, but can be pointed at Staging or
+// other compatible CAs.
+func WithDirectoryURL(url string) Option {
+	return func(om *impl) {
+		om.directoryURL = url
 	}
-	a := &acme.Account{}
-	client := &acme.Client{
-		DirectoryURL: Endpoint,
-		UserAgent:    UserAgent,
-		Key:          acctKey,
+}
+
+// WithSolvers sets the solvers used to satisfy the challenges of new orders.
+// For each authorization, the first solver whose challenge type the CA offers
+// is used.  By default only http-01 challenges are solved, through the
+// Challenger passed to New.
+func WithSolvers(solvers ...Solver) Option {
+	return func(om *impl) {
+		om.Solvers = solvers
 	}
+}
 
-	if _, err := client.Register(ctx, a, autocert.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
-		return nil, err
+// WithOrderStore sets the store in which in-flight orders are persisted, so
+// that they can be resumed after a restart.  By default orders are only
+// tracked in memory, and the pending authorizations of all in-flight orders
+// are deactivated on Shutdown.
+func WithOrderStore(store OrderStore) Option {
+	return func(om *impl) {
+		om.Orders = store
+		om.persistent = true
 	}
+}
 
-	return &impl{
-		Client:     client,
-		Callback:   cb,
-		Challenger: chlr,
-		inflight:   make(map[key]ticket, 10),
-	}, nil
+// WithRegistration sets the contacts and External Account Binding with which
+// the ACME account is registered.  By default the account is registered
+// without either.
+func WithRegistration(reg Registration) Option {
+	return func(om *impl) {
+		om.Registration = reg
+	}
+}
+
+// WithClock sets the clock that times orders.  It defaults to the real
+// clock.
+func WithClock(c clock.PassiveClock) Option {
+	return func(om *impl) {
+		om.clock = c
+	}
+}
+
+// New creates a new OrderManager.  The ACME account key is read from the
+// provided AccountKeyStore (and persisted there when first created), so
+// that the same ACME account is reused across restarts.
+func New(ctx context.Context, cb OrderUpCallback, chlr challenger.Interface, keys AccountKeyStore, opts ...Option) (Interface, error) {
+	om := &impl{
+		ctx:          context.Background(),
+		directoryURL: Production,
+		clock:        clock.RealClock{},
+		pollBackoff:  DefaultPollBackoff,
+		Callback:     cb,
+		Solvers:      []Solver{NewHTTP01Solver(chlr)},
+		Orders:       NewMemoryOrderStore(),
+		inflight:     make(map[key]ticket, 10),
+		resumable:    make(map[key]OrderRecord),
+	}
+	for _, opt := range opts {
+		opt(om)
+	}
+	om.ctx, om.stop = context.WithCancel(om.ctx)
+
+	if om.Client == nil {
+		client := &acme.Client{
+			DirectoryURL: om.directoryURL,
+			UserAgent:    UserAgent,
+		}
+		if _, err := loadOrCreateAccount(ctx, client, keys, om.Registration); err != nil {
+			return nil, err
+		}
+		om.Client = client
+	}
+
+	// Pick up the orders that were in-flight when we last stopped.  They are
+	// resumed by the first call to Order for their domains, which happens as
+	// the owners are reconciled on startup.
+	records, err := om.Orders.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		om.resumable[asKey(r.Domains)] = r
+	}
+	om.resumeBy = om.clock.Now().Add(queueClaimTimeout)
+	if len(records) > 0 {
+		logging.FromContext(ctx).Infof("Found %d in-flight orders to resume.", len(records))
+	}
+	return om, nil
 }
 
 // impl implements Interface.
 type impl struct {
-	sync.Mutex // guards access to inflight.
+	sync.Mutex // guards access to inflight and resumable.
+
+	// finalizing collapses concurrent finalizations of the same order, by
+	// URI, so that an order shared by several owners is only finalized once.
+	finalizing singleflight.Group
+
+	Solvers  []Solver
+	Client   Client
+	Callback OrderUpCallback
+	Events   EventCallback
+	Orders   OrderStore
+
+	Registration Registration
+
+	// persistent is whether Orders outlives us, so that the orders in it
+	// are resumed after a restart.
+	persistent bool
+
+	// directoryURL is the directory of the CA, unless Client is set.
+	directoryURL string
+
+	// clock tells the time at which orders are placed and completed.
+	clock clock.PassiveClock
+
+	// pollBackoff governs how often in-flight orders are polled.
+	pollBackoff wait.Backoff
 
-	Challenger challenger.Interface
-	Client     *acme.Client
-	Callback   OrderUpCallback
+	// ctx is done once we shut down, which stop initiates.  The work on
+	// in-flight orders is tracked by background.
+	ctx        context.Context
+	stop       context.CancelFunc
+	background sync.WaitGroup
 
-	inflight map[key]ticket
+	inflight  map[key]ticket
+	resumable map[key]OrderRecord
+
+	// resumeBy is when the owners of the resumable orders ought to have
+	// resumed them, as they are reconciled on startup.  Until then, the
+	// resumable orders hold on to their in-flight spots.
+	resumeBy time.Time
+
+	// maxInflight caps the number of in-flight orders, when positive, with
+	// the orders being placed counted by starting.  The orders past the cap
+	// wait in queue.
+	maxInflight int
+	starting    int
+	queue       []*queued
 }
 
 var _ Interface = (*impl)(nil)
@@ -114,48 +240,155 @@ var _ Interface = (*impl)(nil)
 // ticket is used to represent an unclaimed order that is working
 // it's way through the system.
 type ticket struct {
-	uri   string
-	owner interface{}
-	err   error
+	domains   []string
+	uri       string
+	authzURLs []string
+	err       error
+
+	// owners are all of the owners that ordered the same set of domains,
+	// each of which is notified when the order is up.  They share the
+	// private key of the certificate, so they are all in the same namespace
+	// and ask for the same kind of key, or reuse the same key, which share
+	// describes.
+	owners []interface{}
+	share  string
+
+	// waiting are the owners that ordered the same set of domains, but
+	// can't share the order, which are notified once it is done.
+	waiting []interface{}
+
+	// cert is the certificate issued for the order, once it has been
+	// finalized, which is handed to each of the owners in turn.
+	cert *tls.Certificate
+
+	// delivered are the owners that picked up cert.
+	delivered []interface{}
+
+	// started is when we placed or resumed the order.
+	started time.Time
+
+	// cache holds the state of the order at the CA, as last polled.
+	cache *orderCache
+}
+
+func newTicket(o *acme.Order, domains []string, owner interface{}, share string, started time.Time) ticket {
+	t := ticket{
+		domains:   domains,
+		share:     share,
+		uri:       o.URI,
+		authzURLs: o.AuthzURLs,
+		started:   started,
+		cache:     newOrderCache(snapshot{order: o}),
+	}
+	if owner != nil {
+		t.owners = []interface{}{owner}
+	}
+	return t
+}
+
+// record returns the durable form of the ticket.  Only the first owner is
+// recorded, as the others order the domains again as they are reconciled.
+func (t *ticket) record(domains []string) OrderRecord {
+	r := OrderRecord{
+		Domains:   domains,
+		URI:       t.uri,
+		AuthzURLs: t.authzURLs,
+	}
+	if len(t.owners) > 0 {
+		r.Owner = ownerKey(t.owners[0])
+	}
+	return r
+}
+
+// pickedUp returns whether all of the owners picked up the certificate.
+func (t *ticket) pickedUp() bool {
+	for _, owner := range t.owners {
+		if !hasOwner(t.delivered, owner) {
+			return false
+		}
+	}
+	return true
 }
 
 // Order implements Interface
-func (om *impl) Order(ctx context.Context, domains []string, owner interface{}) ([]*apis.URL, *tls.Certificate, error) {
+func (om *impl) Order(ctx context.Context, domains []string, owner interface{}, opts ...OrderOption) ([]*apis.URL, *tls.Certificate, error) {
 	logger := logging.FromContext(ctx)
-	t, found := om.getTicket(domains)
+	oo := newOrderOptions(opts)
+	if err := oo.keySpec.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if om.ctx.Err() != nil {
+		return nil, nil, ErrShutdown
+	}
+	// Don't let the OrderManager hang on client calls.
+	ctx, cancel := context.WithTimeout(ctx, oo.timeout)
+	defer cancel()
+
+	share := sharing(owner, oo)
+	t, found := om.getTicket(domains, owner, share)
+	if found && t.share != share {
+		// The private key of the order's certificate must not be shared
+		// with this owner, so it waits for the order to be done.
+		logger.Infof("Order for %v waits for the order of other owners", domains)
+		return nil, nil, ErrQueued
+	}
+	if !found {
+		// If there is an order left over from before a restart, then pick it back up.
+		t, found = om.resumeOrder(ctx, domains, owner, share, oo)
+	}
 	if !found {
-		// If there isn't an in-flight order, then initiate a new order.
+		// If there isn't an in-flight order, then initiate a new order,
+		// once there is room for it.
+		if !om.admit(domains, owner, oo) {
+			logger.Infof("Order for %v is queued", domains)
+			return nil, nil, ErrQueued
+		}
 		var err error
-		if t, err = om.initiateNewOrder(ctx, domains, owner); err != nil {
+		t, err = om.initiateNewOrder(ctx, domains, owner, share, oo)
+		om.release()
+		if err != nil {
+			recordOrderFailed(ctx, err)
 			return nil, nil, err
 		}
 		// Fall through to return the challenges
 	}
 	if t.err != nil {
-		om.cancelOrder(ctx, domains)
+		om.forgetOrder(ctx, domains)
 		logger.Infof("Cancelling order for %v due to error: %v", domains, t.err)
+		recordOrderFailed(ctx, t.err)
 		return nil, nil, t.err
 	}
+	if t.cert != nil {
+		// The order was finalized for one of the other owners, or for this
+		// owner, which asks again, e.g. because it failed to record the
+		// certificate.  The certificate is handed out until all of the
+		// owners picked it up, or went away.
+		cert, err := om.completeOrder(ctx, domains, t, owner, oo)
+		return nil, cert, err
+	}
 
-	// See if the order specified by this ticket is ready.
-	status, err := t.GetStatus(ctx, om.Client)
-	if err != nil {
-		// TODO(mattmoor): If the error isn't transient,
-		// then we should clear the ticket here, otherwise
-		// we are in an unrecoverable state.
-		return nil, nil, err
+	// See if the order specified by this ticket is ready, as of the last
+	// time its poller asked the CA.
+	snap := t.cache.get()
+	if snap.err != nil {
+		// The poller keeps trying, but meanwhile report the trouble.
+		return nil, nil, snap.err
 	}
-	switch status {
+	switch status := snap.order.Status; status {
 	case acme.StatusReady, acme.StatusValid:
 		logger.Infof("Order is ready for %v", domains)
-		// This removes the ticket, a subsequent Order will start
-		// the process over.
-		cert, err := om.completeOrder(ctx, domains, t)
+		// This removes the ticket once every owner has picked up the
+		// certificate, a subsequent Order will start the process over.
+		cert, err := om.completeOrder(ctx, domains, t, owner, oo)
 		return nil, cert, err
 
-	case acme.StatusPending, acme.StatusProcessing, acme.StatusUnknown:
+	case acme.StatusProcessing:
+		logger.Infof("Order is being finalized for %v", domains)
+		return nil, nil, ErrFinalizing
+
+	case acme.StatusPending, acme.StatusUnknown:
 		logger.Infof("Order is pending for %v", domains)
-		urls, err := t.ChallengeURLs(ctx, om.Client)
+		urls, err := snap.challengeURLs(om.Client, om.Solvers)
 		return urls, nil, err
 
 	case acme.StatusDeactivated, acme.StatusExpired, acme.StatusInvalid, acme.StatusRevoked:
@@ -163,124 +396,406 @@ func (om *impl) Order(ctx context.Context, domains []string, owner interface{})
 		// This is a permanently bad state, we should flush the ticket
 		// and return an error to the client which can retry as it sees
 		// fit.
-		om.cancelOrder(ctx, domains)
-		if err1, err2 := t.GetError(ctx, om.Client); err2 != nil {
-			// An error getting the error.
-			logging.FromContext(ctx).Errorf("Error getting error: %v", err)
-			return nil, nil, err2
-		} else if err1 != nil {
+		om.forgetOrder(ctx, domains)
+		orderErr := snap.failure()
+		if orderErr != nil {
 			// The error returned by the CA leading to the above state.
-			logging.FromContext(ctx).Errorf("Error from the CA: %v", err)
-			return nil, nil, err1
+			logging.FromContext(ctx).Errorf("Error from the CA: %v", orderErr)
+		} else {
+			// Fallback on reporting the status.
+			logging.FromContext(ctx).Errorf("Bad status for order: %s", status)
+			orderErr = fmt.Errorf("Order resulted in bad status: %q", status)
 		}
-		// Fallback on reporting the status.
-		logging.FromContext(ctx).Errorf("Bad status for order: %s", status)
-		return nil, nil, fmt.Errorf("Order resulted in bad status: %q", status)
+		recordOrderFailed(ctx, orderErr)
+		return nil, nil, orderErr
 
 	default:
 		return nil, nil, fmt.Errorf("Unknown order status: %q", status)
 	}
 }
 
-func (om *impl) getTicket(domains []string) (t ticket, found bool) {
+// Revoke implements Interface
+func (om *impl) Revoke(ctx context.Context, der []byte, reason acme.CRLReasonCode) error {
+	// A nil key signs the request with our account key.
+	return om.Client.RevokeCert(ctx, nil, der, reason)
+}
+
+// getTicket returns the in-flight ticket for the domains, if any.  The given
+// owner joins the owners of the ticket, so that it is notified as well when
+// the order is up, if it may share the order, and otherwise waits for the
+// order to be done.
+func (om *impl) getTicket(domains []string, owner interface{}, share string) (t ticket, found bool) {
 	om.Lock()
 	defer om.Unlock()
 
 	key := asKey(domains)
 	t, found = om.inflight[key]
+	switch {
+	case !found || owner == nil:
+	case t.share == share && !hasOwner(t.owners, owner):
+		t.owners = append(t.owners[:len(t.owners):len(t.owners)], owner)
+		om.inflight[key] = t
+	case t.share != share && !hasOwner(t.waiting, owner):
+		t.waiting = append(t.waiting[:len(t.waiting):len(t.waiting)], owner)
+		om.inflight[key] = t
+	}
 	return
 }
 
-func (om *impl) initiateNewOrder(ctx context.Context, domains []string, owner interface{}) (ticket, error) {
+// sharing returns what the owners of an order have in common, as they share
+// the private key of its certificate: their namespace and the kind of key,
+// or the key itself for owners that reuse theirs.
+func sharing(owner interface{}, oo orderOptions) string {
+	namespace, _, _ := cache.SplitMetaNamespaceKey(ownerKey(owner))
+	share := namespace + "/" + oo.keySpec.String()
+	if oo.key == nil || !oo.keySpec.Matches(oo.key.Public()) {
+		// A new key is generated for the order.
+		return share
+	}
+	der, err := x509.MarshalPKIXPublicKey(oo.key.Public())
+	if err != nil {
+		// Don't share the order with anybody.
+		return share + "/" + ownerKey(owner)
+	}
+	sum := sha256.Sum256(der)
+	return share + "/" + hex.EncodeToString(sum[:])
+}
+
+// ownersOf returns the owners of the in-flight order for the domains,
+// falling back on the given owner.
+func (om *impl) ownersOf(domains []string, fallback interface{}) []interface{} {
+	om.Lock()
+	defer om.Unlock()
+
+	if t, ok := om.inflight[asKey(domains)]; ok && len(t.owners) > 0 {
+		return append([]interface{}(nil), t.owners...)
+	}
+	return []interface{}{fallback}
+}
+
+func (om *impl) initiateNewOrder(ctx context.Context, domains []string, owner interface{}, share string, oo orderOptions) (ticket, error) {
 	o, err := om.Client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
 	if err != nil {
 		logging.FromContext(ctx).Errorf("Error creating new order: %v", err)
 		return ticket{}, err
 	}
+	t := newTicket(o, domains, owner, share, om.clock.Now())
+
+	// Persist the order before publishing any challenges, so that we can
+	// pick it back up if we are restarted part way through.
+	if err := om.Orders.Save(ctx, t.record(domains)); err != nil {
+		return ticket{}, err
+	}
+
+	// The work on the order continues in the background, past the return
+	// of Order.
+	octx, cancel := om.orderContext(ctx, oo.timeout)
+	eg, err := om.solveAuthorizations(octx, domains, owner, o, t.cache, oo)
+	if err != nil {
+		cancel()
+		om.forgetOrder(ctx, domains)
+		return ticket{}, err
+	}
+	om.putTicket(domains, t)
+	om.pollOrder(octx, cancel, domains, t, eg, owner)
 
+	recordOrderStarted(ctx)
+	om.notify(ctx, domains, owner, ReasonOrderStarted,
+		fmt.Sprintf("Placed order %s for %s.", o.URI, strings.Join(domains, ", ")))
+	logging.FromContext(ctx).Infof("Order %q has been initiated.", o.URI)
+	return t, nil
+}
+
+// resumeOrder picks back up an order that was in-flight before a restart,
+// re-publishing the challenges of its pending authorizations and waiting
+// for it to complete.
+func (om *impl) resumeOrder(ctx context.Context, domains []string, owner interface{}, share string, oo orderOptions) (ticket, bool) {
+	logger := logging.FromContext(ctx)
+
+	r, ok := func() (OrderRecord, bool) {
+		om.Lock()
+		defer om.Unlock()
+
+		r, ok := om.resumable[asKey(domains)]
+		delete(om.resumable, asKey(domains))
+		return r, ok
+	}()
+	if !ok {
+		return ticket{}, false
+	}
+
+	o, err := om.Client.GetOrder(ctx, r.URI)
+	if err != nil {
+		logger.Warnf("Unable to resume order %q for %v: %v", r.URI, domains, err)
+		om.forgetOrder(ctx, domains)
+		return ticket{}, false
+	}
+	switch o.Status {
+	case acme.StatusPending, acme.StatusReady:
+	default:
+		// Orders that were finalized can't be picked back up, as the
+		// private key of their certificate is lost with the restart.
+		logger.Infof("Not resuming order %q for %v with status %q", r.URI, domains, o.Status)
+		om.forgetOrder(ctx, domains)
+		return ticket{}, false
+	}
+
+	if owner == nil {
+		owner = ownerFromKey(r.Owner)
+		share = sharing(owner, oo)
+	}
+	t := newTicket(o, domains, owner, share, om.clock.Now())
+	octx, cancel := om.orderContext(ctx, oo.timeout)
+	eg, err := om.solveAuthorizations(octx, domains, owner, o, t.cache, oo)
+	if err != nil {
+		cancel()
+		logger.Warnf("Unable to resume order %q for %v: %v", r.URI, domains, err)
+		om.forgetOrder(ctx, domains)
+		return ticket{}, false
+	}
+	om.putTicket(domains, t)
+	om.pollOrder(octx, cancel, domains, t, eg, owner)
+
+	logger.Infof("Order %q has been resumed.", o.URI)
+	return t, true
+}
+
+// solveAuthorizations presents a challenge response for each of the order's
+// pending authorizations, and returns an errgroup that completes once the CA
+// has validated all of them.  Authorizations that are no longer pending, e.g.
+// because the CA reused a valid authorization from an earlier order or we are
+// resuming the order, are skipped.  The owners of the order are notified as
+// each authorization is validated.  The authorizations are stored in the
+// cache, which their validation is then awaited on.  The challenges are
+// unregistered once ctx is done, if not before.
+func (om *impl) solveAuthorizations(ctx context.Context, domains []string, owner interface{}, o *acme.Order, cache *orderCache, oo orderOptions) (*errgroup.Group, error) {
+	snap := snapshot{order: o}
 	eg := &errgroup.Group{}
 	for _, zurl := range o.AuthzURLs {
 		z, err := om.Client.GetAuthorization(ctx, zurl)
 		if err != nil {
-			return ticket{}, err
+			return nil, err
 		}
-		// Find the HTTP01 challenge (all we support)
-		chal, err := getHTTP01(z.Challenges)
-		if err != nil {
-			return ticket{}, err
+		snap.authzs = append(snap.authzs, z)
+		if z.Status != acme.StatusPending {
+			logging.FromContext(ctx).Debugf("Skipping %s authorization for %q", z.Status, z.Identifier.Value)
+			continue
 		}
-		resp, err := om.Client.HTTP01ChallengeResponse(chal.Token)
+		// Find the first challenge that we are able to solve.
+		solver, chal, err := pickSolver(om.Solvers, z)
 		if err != nil {
-			return ticket{}, err
+			return nil, err
+		}
+		if !om.begin() {
+			return nil, ErrShutdown
+		}
+		if err := solver.Present(ctx, om.Client, z, chal); err != nil {
+			om.background.Done()
+			return nil, err
 		}
-		path := om.Client.HTTP01ChallengePath(chal.Token)
-		om.Challenger.RegisterChallenge(path, resp)
 
 		eg.Go(func() error {
-			defer om.Challenger.UnregisterChallenge(path)
-
-			// TODO(mattmoor): Wait until we have successfully probed the
-			// challenge ourselves before "Accepting" to get positive hand-off
-			// to the routing layer that things have been successfully plumbed.
-			// something something wait.Until()
-			time.Sleep(2 * time.Second)
+			defer om.background.Done()
+			defer func() {
+				// Clean up after orders that were cut short as well.
+				ctx, cancel := context.WithTimeout(detached{ctx}, cleanUpTimeout)
+				defer cancel()
+				if err := solver.CleanUp(ctx, om.Client, z, chal); err != nil {
+					logging.FromContext(ctx).Errorf("Error cleaning up %s challenge for %q: %v", solver.Type(), z.Identifier.Value, err)
+				}
+			}()
+
+			// Wait until we have successfully probed the challenge ourselves
+			// before "Accepting" to get positive hand-off from the routing
+			// layer that things have been successfully plumbed.
+			if err := om.selfCheck(ctx, oo.selfCheck, solver, z, chal); err != nil {
+				return err
+			}
+			// Likewise, don't have the CA look for DNS records before the
+			// nameservers serve them.
+			if pa, ok := solver.(propagationAwaiter); ok {
+				if err := pa.awaitPropagation(ctx, om.Client, z, chal); err != nil {
+					return err
+				}
+			}
 
 			if _, err := om.Client.Accept(ctx, chal); err != nil {
 				return err
 			}
-			if _, err := om.Client.WaitAuthorization(ctx, z.URI); err != nil {
+			cache.refresh()
+			if err := cache.waitAuthorization(ctx, z.URI); err != nil {
 				return err
 			}
+			om.notify(ctx, domains, owner, ReasonChallengeValidated,
+				fmt.Sprintf("The CA validated the %s challenge for %q.", solver.Type(), z.Identifier.Value))
 			return nil
 		})
 	}
+	cache.set(snap)
+	return eg, nil
+}
 
-	go func() {
-		if err := eg.Wait(); err != nil {
-			logging.FromContext(ctx).Errorf("Encountered an error waiting for challenges: %v.", err)
-			om.setError(ctx, domains, err)
-		} else if _, err := om.Client.WaitOrder(ctx, o.URI); err != nil {
-			logging.FromContext(ctx).Errorf("Encountered an error waiting for order: %v.", err)
-			om.setError(ctx, domains, err)
-		} else {
-			logging.FromContext(ctx).Infof("Order %q has completed without error.", o.URI)
+func (om *impl) putTicket(domains []string, t ticket) {
+	om.Lock()
+	defer om.Unlock()
+
+	om.inflight[asKey(domains)] = t
+}
+
+// completeOrder finalizes the order, unless that already happened for
+// another owner, and hands the certificate to the owner.  Owners sharing
+// an order share the certificate, including its private key, which is why
+// only owners in the same namespace asking for the same kind of key, and
+// reusing the same key if any, share orders.
+func (om *impl) completeOrder(ctx context.Context, domains []string, t ticket, owner interface{}, oo orderOptions) (*tls.Certificate, error) {
+	if t.cert == nil {
+		v, err, _ := om.finalizing.Do(t.uri, func() (interface{}, error) {
+			return om.finalize(ctx, domains, t, oo)
+		})
+		if err != nil {
+			return nil, err
 		}
+		t.cert = v.(*tls.Certificate)
+	}
 
-		// The order is ready for fulfillment (one way or another)!
-		om.Callback(owner)
-	}()
+	om.deliver(domains, t, owner)
+	om.wakeQueued()
+	return t.cert, nil
+}
 
-	logging.FromContext(ctx).Infof("Order %q has been initiated.", o.URI)
-	t := ticket{
-		uri:   o.URI,
-		owner: owner,
+// finalize finalizes the order, and records the issued certificate on its
+// ticket for the other owners to pick up.
+func (om *impl) finalize(ctx context.Context, domains []string, t ticket, oo orderOptions) (*tls.Certificate, error) {
+	// Another owner may have finalized the order since we looked.
+	if cur, ok := om.getTicket(domains, nil, ""); ok && cur.uri == t.uri && cur.cert != nil {
+		return cur.cert, nil
+	}
+	key, err := oo.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := t.GetCertificate(ctx, om.Client, domains, key)
+	if err != nil {
+		if !ClassifyError(err).Transient {
+			// The order can't be finalized, so start over.
+			logging.FromContext(ctx).Infof("Cancelling order for %v due to error: %v", domains, err)
+			om.forgetOrder(ctx, domains)
+			recordOrderFailed(ctx, err)
+		}
+		return nil, err
 	}
 	func() {
 		om.Lock()
 		defer om.Unlock()
-		om.inflight[asKey(domains)] = t
+
+		if cur, ok := om.inflight[asKey(domains)]; ok && cur.uri == t.uri {
+			cur.cert = cert
+			om.inflight[asKey(domains)] = cur
+		}
 	}()
-	return t, nil
+	recordOrderCompleted(ctx, om.clock.Since(t.started))
+	// There is nothing left to resume once the order is finalized.
+	if err := om.Orders.Delete(ctx, domains); err != nil {
+		logging.FromContext(ctx).Errorf("Error deleting persisted order for %v: %v", domains, err)
+	}
+	return cert, nil
 }
 
-func (om *impl) completeOrder(ctx context.Context, domains []string, t ticket) (*tls.Certificate, error) {
-	cert, err := t.GetCertificate(ctx, om.Client, domains)
-	if err != nil {
-		return nil, err
+// deliver records that the owner picked up the certificate of the order,
+// and drops the order once all of its owners did.
+func (om *impl) deliver(domains []string, t ticket, owner interface{}) {
+	var waiting []interface{}
+	func() {
+		om.Lock()
+		defer om.Unlock()
+
+		key := asKey(domains)
+		cur, ok := om.inflight[key]
+		if !ok || cur.uri != t.uri {
+			return
+		}
+		cur.cert = t.cert
+		if owner != nil && !hasOwner(cur.delivered, owner) {
+			cur.delivered = append(cur.delivered[:len(cur.delivered):len(cur.delivered)], owner)
+		}
+		if cur.pickedUp() {
+			delete(om.inflight, key)
+			waiting = cur.waiting
+		} else {
+			om.inflight[key] = cur
+		}
+	}()
+	om.notifyWaiting(waiting)
+}
+
+// notifyWaiting notifies the owners that waited for an order to be done
+// that it is their turn.
+func (om *impl) notifyWaiting(waiting []interface{}) {
+	for _, owner := range waiting {
+		om.Callback(owner)
 	}
+}
 
-	om.Lock()
-	defer om.Unlock()
+// Forget implements Interface
+func (om *impl) Forget(ctx context.Context, owner interface{}, domains []string) {
+	var dropped [][]string
+	func() {
+		om.Lock()
+		defer om.Unlock()
 
-	delete(om.inflight, asKey(domains))
-	return cert, nil
+		for k, t := range om.inflight {
+			if domains != nil && k == asKey(domains) {
+				continue
+			}
+			if !hasOwner(t.owners, owner) && !hasOwner(t.waiting, owner) {
+				continue
+			}
+			t.owners = withoutOwner(t.owners, owner)
+			t.delivered = withoutOwner(t.delivered, owner)
+			t.waiting = withoutOwner(t.waiting, owner)
+			if len(t.owners) == 0 || (t.cert != nil && t.pickedUp()) {
+				// Nobody is left to pick up the certificate.
+				dropped = append(dropped, t.domains)
+			}
+			om.inflight[k] = t
+		}
+
+		kept := om.queue[:0]
+		for _, q := range om.queue {
+			q.owners = withoutOwner(q.owners, owner)
+			if len(q.owners) > 0 {
+				kept = append(kept, q)
+			}
+		}
+		om.queue = kept
+	}()
+
+	for _, domains := range dropped {
+		logging.FromContext(ctx).Infof("Dropping the order for %v, which has no owners left", domains)
+		om.forgetOrder(ctx, domains)
+	}
 }
 
-func (om *impl) cancelOrder(ctx context.Context, domains []string) {
-	om.Lock()
-	defer om.Unlock()
+// forgetOrder drops all of the state we hold for the order for the domains.
+func (om *impl) forgetOrder(ctx context.Context, domains []string) {
+	t, ok := func() (ticket, bool) {
+		om.Lock()
+		defer om.Unlock()
+
+		t, ok := om.inflight[asKey(domains)]
+		delete(om.inflight, asKey(domains))
+		return t, ok
+	}()
+	if ok && t.cache != nil {
+		// Have the poller notice that the order was dropped.
+		t.cache.refresh()
+	}
 
-	delete(om.inflight, asKey(domains))
+	if err := om.Orders.Delete(ctx, domains); err != nil {
+		logging.FromContext(ctx).Errorf("Error deleting persisted order for %v: %v", domains, err)
+	}
+	om.notifyWaiting(t.waiting)
+	om.wakeQueued()
 }
 
 func (om *impl) setError(ctx context.Context, domains []string, err error) {
@@ -295,65 +810,8 @@ func (om *impl) setError(ctx context.Context, domains []string, err error) {
 	om.inflight[asKey(domains)] = t
 }
 
-func (t *ticket) GetStatus(ctx context.Context, client *acme.Client) (string, error) {
-	o, err := client.GetOrder(ctx, t.uri)
-	if err != nil {
-		return "", err
-	}
-	return o.Status, nil
-}
-
-func (t *ticket) GetError(ctx context.Context, client *acme.Client) (orderError error, getError error) {
-	o, err := client.GetOrder(ctx, t.uri)
-	if err != nil {
-		return nil, err
-	}
-	if o.Error != nil {
-		return o.Error, nil
-	}
-	return nil, nil
-}
-
-func (t *ticket) ChallengeURLs(ctx context.Context, client *acme.Client) ([]*apis.URL, error) {
-	o, err := client.GetOrder(ctx, t.uri)
-	if err != nil {
-		return nil, err
-	}
-	urls := make([]*apis.URL, 0, len(o.AuthzURLs))
-
-	// Satisfy all pending authorizations.
-	for _, zurl := range o.AuthzURLs {
-		z, err := client.GetAuthorization(ctx, zurl)
-		if err != nil {
-			return nil, err
-		}
-		// autocert skips authorizations that aren't pending,
-		// but we include them to avoid churn.
-
-		// Find the HTTP01 challenge (all we support)
-		chal, err := getHTTP01(z.Challenges)
-		if err != nil {
-			return nil, err
-		}
-
-		urls = append(urls, &apis.URL{
-			Scheme: "http",
-			Host:   z.Identifier.Value,
-			Path:   client.HTTP01ChallengePath(chal.Token),
-		})
-	}
-	return urls, nil
-}
-
-func (t *ticket) GetCertificate(ctx context.Context, client *acme.Client, domains []string) (*tls.Certificate, error) {
-	order, err := client.GetOrder(ctx, t.uri)
-	if err != nil {
-		return nil, err
-	}
-	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
-	if err != nil {
-		return nil, err
-	}
+func (t *ticket) GetCertificate(ctx context.Context, client Client, domains []string, key crypto.Signer) (*tls.Certificate, error) {
+	order := t.cache.get().order
 	req := &x509.CertificateRequest{
 		Subject:  pkix.Name{CommonName: domains[0]},
 		DNSNames: domains,
@@ -377,20 +835,45 @@ func (t *ticket) GetCertificate(ctx context.Context, client *acme.Client, domain
 	}, nil
 }
 
+// ErrFinalizing is the error returned while the CA is issuing the
+// certificate of a finalized order.
+var ErrFinalizing = errors.New("the CA is issuing the certificate")
+
+// ErrNoViableChallenge is the error returned when none of the challenges
+// offered in the order we receive can be solved by our solvers.
+var ErrNoViableChallenge = errors.New("The CA didn't list a challenge that we can solve as a viable certificate challenge.")
+
 // ErrHTTP01Unavailable is the error returned when the HTTP01 challenge
 // option isn't available in the order we receive.
-var ErrHTTP01Unavailable = errors.New("The CA didn't list HTTP01 as a viable certificate challenge.")
+//
+// Deprecated: use ErrNoViableChallenge.
+var ErrHTTP01Unavailable = ErrNoViableChallenge
+
+type key string
 
-func getHTTP01(challs []*acme.Challenge) (*acme.Challenge, error) {
-	for _, c := range challs {
-		if c.Type == "http-01" {
-			return c, nil
+// hasOwner checks whether the owner is among the owners.  Owners are
+// compared by their namespace/name key, so that an owner restored from
+// its key matches the object it stands for.
+func hasOwner(owners []interface{}, owner interface{}) bool {
+	k := ownerKey(owner)
+	for _, o := range owners {
+		if (k != "" && ownerKey(o) == k) || (k == "" && o == owner) {
+			return true
 		}
 	}
-	return nil, ErrHTTP01Unavailable
+	return false
 }
 
-type key string
+// withoutOwner returns the owners, less the given owner.
+func withoutOwner(owners []interface{}, owner interface{}) []interface{} {
+	var kept []interface{}
+	for _, o := range owners {
+		if !hasOwner([]interface{}{o}, owner) {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
 
 func asKey(domains []string) key {
 	return key(strings.Join(sets.NewString(domains...).List(), ","))
@@ -0,0 +1,610 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/acme"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+	"knative.dev/net-http01/pkg/challenger"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+func TestOrderOwners(t *testing.T) {
+	domains := []string{"example.com"}
+	first := types.NamespacedName{Namespace: "foo", Name: "first"}
+	second := &v1alpha1.Certificate{ObjectMeta: metav1.ObjectMeta{Namespace: "foo", Name: "second"}}
+	other := types.NamespacedName{Namespace: "bar", Name: "other"}
+	share := sharing(first, newOrderOptions(nil))
+
+	om := &impl{
+		Orders:   NewMemoryOrderStore(),
+		inflight: make(map[key]ticket),
+	}
+	om.putTicket(domains, ticket{uri: "https://ca.example/order/1", owners: []interface{}{first}, share: share})
+
+	// Both owners of the domains are notified, once each.
+	om.getTicket(domains, second, share)
+	om.getTicket(domains, types.NamespacedName{Namespace: "foo", Name: "second"}, share)
+	om.getTicket(domains, nil, share)
+	// Owners in other namespaces don't share the order, but wait for it.
+	om.getTicket(domains, other, sharing(other, newOrderOptions(nil)))
+	if got, want := om.ownersOf(domains, nil), []interface{}{first, second}; !cmp.Equal(got, want) {
+		t.Errorf("ownersOf() = %v, wanted %v", got, want)
+	}
+	var notified []interface{}
+	om.Callback = func(owner interface{}) {
+		notified = append(notified, owner)
+	}
+	for _, owner := range om.ownersOf(domains, nil) {
+		om.Callback(owner)
+	}
+	if want := []interface{}{first, second}; !cmp.Equal(notified, want) {
+		t.Errorf("notified = %v, wanted %v", notified, want)
+	}
+}
+
+func TestOrderSharing(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com"}
+	first := types.NamespacedName{Namespace: "foo", Name: "first"}
+	fc := newFakeClient(t)
+	var notified []interface{}
+	om := newTestOrderManager(t, ctx, fc, clock.RealClock{})
+	om.(*impl).Callback = func(owner interface{}) {
+		notified = append(notified, owner)
+	}
+
+	opts := []OrderOption{WithSelfCheck(SelfCheck{})}
+	if _, _, err := om.Order(ctx, domains, first, opts...); err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+
+	// Owners in other namespaces, or asking for another kind of key, must not
+	// be handed the private key of the order's certificate.
+	otherNamespace := types.NamespacedName{Namespace: "bar", Name: "second"}
+	if _, _, err := om.Order(ctx, domains, otherNamespace, opts...); !errors.Is(err, ErrQueued) {
+		t.Errorf("Order(other namespace) = %v, wanted %v", err, ErrQueued)
+	}
+	otherKey := types.NamespacedName{Namespace: "foo", Name: "second"}
+	rsa := append(opts, WithKeySpec(KeySpec{Algorithm: RSA}))
+	if _, _, err := om.Order(ctx, domains, otherKey, rsa...); !errors.Is(err, ErrQueued) {
+		t.Errorf("Order(other key) = %v, wanted %v", err, ErrQueued)
+	}
+	// Nor must owners reusing their key be handed another key, or hand
+	// theirs to the owners of the order.
+	reused, err := DefaultKeySpec.Generate()
+	if err != nil {
+		t.Fatalf("Generate() = %v", err)
+	}
+	reusing := types.NamespacedName{Namespace: "foo", Name: "third"}
+	if _, _, err := om.Order(ctx, domains, reusing, append(opts, WithPrivateKey(reused))...); !errors.Is(err, ErrQueued) {
+		t.Errorf("Order(reused key) = %v, wanted %v", err, ErrQueued)
+	}
+	if got := fc.ordersPlaced(); got != 1 {
+		t.Errorf("Placed %d orders, wanted 1", got)
+	}
+
+	// Once the order is done, those waiting on it are notified.
+	om.Forget(ctx, first, nil)
+	if want := []interface{}{otherNamespace, otherKey, reusing}; !cmp.Equal(notified, want) {
+		t.Errorf("notified = %v, wanted %v", notified, want)
+	}
+	if _, _, err := om.Order(ctx, domains, otherNamespace, opts...); err != nil {
+		t.Fatalf("Order(other namespace) = %v", err)
+	}
+	if got := fc.ordersPlaced(); got != 2 {
+		t.Errorf("Placed %d orders, wanted 2", got)
+	}
+}
+
+func TestForget(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com", "www.example.com"}
+	first := types.NamespacedName{Namespace: "foo", Name: "first"}
+	second := types.NamespacedName{Namespace: "foo", Name: "second"}
+	cert := &tls.Certificate{}
+
+	om := &impl{
+		ctx:      ctx,
+		Orders:   NewMemoryOrderStore(),
+		inflight: make(map[key]ticket),
+		Callback: func(interface{}) {},
+	}
+	// The order was finalized when the first owner picked it up.
+	om.putTicket(domains, ticket{
+		domains:   domains,
+		uri:       "https://ca.example/order/1",
+		owners:    []interface{}{first, second},
+		cert:      cert,
+		delivered: []interface{}{first},
+	})
+
+	// The first owner still wants the domains, so nothing changes.
+	om.Forget(ctx, first, domains)
+	if tkt, found := om.getTicket(domains, nil, ""); !found || len(tkt.owners) != 2 {
+		t.Fatalf("ticket = %+v, wanted both owners", tkt)
+	}
+	// The second owner moved on to other domains, which leaves nobody to
+	// pick up the certificate.
+	om.Forget(ctx, second, []string{"example.com"})
+	if _, found := om.getTicket(domains, nil, ""); found {
+		t.Error("The order is still in-flight after its owners went away")
+	}
+}
+
+func TestOrderFanOut(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com", "www.example.com"}
+	first := types.NamespacedName{Namespace: "foo", Name: "first"}
+	second := types.NamespacedName{Namespace: "foo", Name: "second"}
+	cert := &tls.Certificate{}
+
+	om := &impl{
+		ctx:      ctx,
+		Orders:   NewMemoryOrderStore(),
+		inflight: make(map[key]ticket),
+	}
+	// The order was finalized when the first owner picked it up.
+	om.putTicket(domains, ticket{
+		uri:       "https://ca.example/order/1",
+		owners:    []interface{}{first, second},
+		share:     sharing(first, newOrderOptions(nil)),
+		cert:      cert,
+		delivered: []interface{}{first},
+	})
+
+	// The second owner gets the same certificate, without finalizing the
+	// order again, after which the order is done.
+	chall, got, err := om.Order(ctx, domains, second)
+	if err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	if len(chall) != 0 || got != cert {
+		t.Errorf("Order() = %v, %p, wanted the issued certificate %p", chall, got, cert)
+	}
+	if _, found := om.getTicket(domains, nil, ""); found {
+		t.Error("The order is still in-flight after all owners picked it up")
+	}
+}
+
+func TestOrderFanOutPending(t *testing.T) {
+	ctx := context.Background()
+	domains := []string{"example.com"}
+	first := types.NamespacedName{Namespace: "foo", Name: "first"}
+	second := types.NamespacedName{Namespace: "foo", Name: "second"}
+	cert := &tls.Certificate{}
+
+	om := &impl{
+		ctx:      ctx,
+		Orders:   NewMemoryOrderStore(),
+		inflight: make(map[key]ticket),
+	}
+	om.putTicket(domains, ticket{
+		uri:    "https://ca.example/order/1",
+		owners: []interface{}{first, second},
+		share:  sharing(first, newOrderOptions(nil)),
+		cert:   cert,
+	})
+
+	// The first owner gets the same certificate, should it ask again.
+	for i := 0; i < 2; i++ {
+		if _, got, err := om.Order(ctx, domains, first); err != nil {
+			t.Fatalf("Order() = %v", err)
+		} else if got != cert {
+			t.Errorf("Order() = %p, wanted the issued certificate %p", got, cert)
+		}
+	}
+	// The certificate is kept for the second owner.
+	tkt, found := om.getTicket(domains, nil, "")
+	if !found {
+		t.Fatal("The order was dropped before all owners picked it up")
+	}
+	if tkt.cert != cert || !hasOwner(tkt.delivered, first) || hasOwner(tkt.delivered, second) {
+		t.Errorf("ticket = %+v, wanted the certificate delivered to %v only", tkt, first)
+	}
+}
+
+func TestConcurrentFinalization(t *testing.T) {
+	ctx := context.Background()
+	slow := []string{"slow.example.com"}
+	fast := []string{"fast.example.com"}
+	first := types.NamespacedName{Namespace: "foo", Name: "first"}
+	second := types.NamespacedName{Namespace: "foo", Name: "second"}
+	other := types.NamespacedName{Namespace: "foo", Name: "other"}
+	noSelfCheck := WithSelfCheck(SelfCheck{})
+
+	fc := newFakeClient(t)
+	// The finalization of the first order hangs until we let it go.
+	entered, unblock := make(chan struct{}, 2), make(chan struct{})
+	var finalized sync.Map
+	fc.finalizing = func(url string) {
+		if _, dup := finalized.LoadOrStore(url, true); dup {
+			t.Errorf("Order %s was finalized more than once", url)
+		}
+		if url == "https://ca.example/order/1/finalize" {
+			entered <- struct{}{}
+			<-unblock
+		}
+	}
+	om := newTestOrderManager(t, ctx, fc, clock.RealClock{})
+
+	for _, domains := range [][]string{slow, fast} {
+		if _, _, err := om.Order(ctx, domains, first, noSelfCheck); err != nil {
+			t.Fatalf("Order(%v) = %v", domains, err)
+		}
+	}
+	for _, uri := range []string{"https://ca.example/order/1", "https://ca.example/order/2"} {
+		fc.setAuthzStatus(uri, acme.StatusValid, nil)
+		fc.setOrderStatus(uri, acme.StatusReady)
+	}
+	awaitPoll(t, om, slow)
+	awaitPoll(t, om, fast)
+
+	// Both owners of the slow order wait on the same finalization.
+	certs := make(chan *tls.Certificate, 2)
+	for _, owner := range []interface{}{first, second} {
+		owner := owner
+		go func() {
+			_, cert, err := om.Order(ctx, slow, owner, noSelfCheck)
+			if err != nil {
+				t.Errorf("Order(%v) = %v", slow, err)
+			}
+			certs <- cert
+		}()
+	}
+	<-entered
+
+	// Other orders are finalized meanwhile.
+	if _, cert, err := om.Order(ctx, fast, other, noSelfCheck); err != nil || cert == nil {
+		t.Errorf("Order(%v) = %v, %v, wanted a certificate", fast, cert, err)
+	}
+
+	close(unblock)
+	if a, b := <-certs, <-certs; a == nil || a != b {
+		t.Errorf("Order(%v) = %p and %p, wanted the same certificate", slow, a, b)
+	}
+}
+
+// newTestOrderManager returns an OrderManager that orders certificates
+// through the fake client, polling orders without delay unless the options
+// say otherwise.  It is shut down at the end of the test.
+func newTestOrderManager(t *testing.T, ctx context.Context, fc *fakeClient, clk clock.PassiveClock, opts ...Option) Interface {
+	t.Helper()
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	opts = append([]Option{WithClient(fc), WithClock(clk), WithPollBackoff(testPollBackoff)}, opts...)
+	om, err := New(ctx, func(interface{}) {}, chlr, nil, opts...)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	t.Cleanup(func() { om.Shutdown(context.Background()) })
+	return om
+}
+
+// withCallback sets the callback through which owners are told that their
+// order is up.
+func withCallback(cb OrderUpCallback) Option {
+	return func(om *impl) {
+		om.Callback = cb
+	}
+}
+
+// testPollBackoff polls orders without delay.
+var testPollBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Cap: time.Millisecond}
+
+// awaitPoll waits until the order for the domains has been polled from
+// start to end since it was called, or the poller stopped.
+func awaitPoll(t *testing.T, om Interface, domains []string) {
+	t.Helper()
+	tkt, found := om.(*impl).getTicket(domains, nil, "")
+	if !found {
+		t.Fatalf("No order in-flight for %v", domains)
+	}
+	// The first change may come from a poll that was already underway.
+	for i := 0; i < 2; i++ {
+		tkt.cache.mu.Lock()
+		changed := tkt.cache.changed
+		tkt.cache.mu.Unlock()
+		select {
+		case <-changed:
+		case <-tkt.cache.stopped:
+			return
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for the order to be polled")
+		}
+	}
+}
+
+func TestOrderStates(t *testing.T) {
+	domains := []string{"example.com"}
+	owner := types.NamespacedName{Namespace: "foo", Name: "bar"}
+	noSelfCheck := WithSelfCheck(SelfCheck{})
+
+	tests := []struct {
+		name string
+		// advance moves the order placed by the first call to Order along
+		// at the CA.
+		advance func(fc *fakeClient, uri string)
+		// wantReason is the reason of the error of the second call to
+		// Order, if it fails.
+		wantReason     string
+		wantChallenges int
+		wantCert       bool
+		// wantNewOrder is whether the third call to Order places a new
+		// order, rather than carrying on with the first.
+		wantNewOrder bool
+	}{{
+		name:           "pending",
+		advance:        func(*fakeClient, string) {},
+		wantChallenges: 1,
+	}, {
+		name: "ready",
+		advance: func(fc *fakeClient, uri string) {
+			fc.setAuthzStatus(uri, acme.StatusValid, nil)
+			fc.setOrderStatus(uri, acme.StatusReady)
+		},
+		wantCert:     true,
+		wantNewOrder: true,
+	}, {
+		name: "valid",
+		advance: func(fc *fakeClient, uri string) {
+			fc.setAuthzStatus(uri, acme.StatusValid, nil)
+			fc.setOrderStatus(uri, acme.StatusValid)
+		},
+		wantCert:     true,
+		wantNewOrder: true,
+	}, {
+		name: "processing",
+		advance: func(fc *fakeClient, uri string) {
+			fc.setAuthzStatus(uri, acme.StatusValid, nil)
+			fc.setOrderStatus(uri, acme.StatusProcessing)
+		},
+		wantReason: ReasonFinalizing,
+	}, {
+		name: "invalid",
+		advance: func(fc *fakeClient, uri string) {
+			fc.setAuthzStatus(uri, acme.StatusInvalid, &acme.Error{
+				StatusCode:  http.StatusForbidden,
+				ProblemType: "urn:ietf:params:acme:error:unauthorized",
+				Detail:      "Invalid response",
+			})
+			fc.setOrderStatus(uri, acme.StatusInvalid)
+		},
+		wantReason:   ReasonValidationFailed,
+		wantNewOrder: true,
+	}, {
+		name: "expired",
+		advance: func(fc *fakeClient, uri string) {
+			fc.setOrderStatus(uri, acme.StatusExpired)
+		},
+		wantReason:   ReasonOrderFailed,
+		wantNewOrder: true,
+	}, {
+		name: "transient error",
+		advance: func(fc *fakeClient, uri string) {
+			fc.setErrors(&acme.Error{StatusCode: http.StatusServiceUnavailable}, nil)
+		},
+		wantReason: ReasonServerError,
+	}, {
+		name: "permanent error",
+		advance: func(fc *fakeClient, uri string) {
+			fc.setErrors(&acme.Error{StatusCode: http.StatusNotFound, ProblemType: "urn:ietf:params:acme:error:malformed"}, nil)
+		},
+		wantReason:   ReasonOrderRejected,
+		wantNewOrder: true,
+	}, {
+		name: "finalization rejected",
+		advance: func(fc *fakeClient, uri string) {
+			fc.setAuthzStatus(uri, acme.StatusValid, nil)
+			fc.setOrderStatus(uri, acme.StatusReady)
+			fc.setErrors(nil, &acme.Error{StatusCode: http.StatusForbidden, ProblemType: "urn:ietf:params:acme:error:badCSR"})
+		},
+		wantReason:   ReasonOrderRejected,
+		wantNewOrder: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			fc := newFakeClient(t)
+			om := newTestOrderManager(t, ctx, fc, clock.RealClock{})
+
+			// Placing the order publishes the challenge.
+			chall, cert, err := om.Order(ctx, domains, owner, noSelfCheck)
+			if err != nil {
+				t.Fatalf("Order() = %v", err)
+			}
+			if len(chall) != 1 || cert != nil {
+				t.Fatalf("Order() = %v, %v, wanted one challenge", chall, cert)
+			}
+			if got, want := chall[0].String(), "http://example.com/.well-known/acme-challenge/token-1-example.com"; got != want {
+				t.Errorf("challenge = %s, wanted %s", got, want)
+			}
+
+			test.advance(fc, "https://ca.example/order/1")
+			awaitPoll(t, om, domains)
+			chall, cert, err = om.Order(ctx, domains, owner, noSelfCheck)
+			switch {
+			case test.wantReason != "":
+				if err == nil {
+					t.Fatalf("Order() = nil, wanted %s error", test.wantReason)
+				}
+				if got := ClassifyError(err).Reason; got != test.wantReason {
+					t.Errorf("ClassifyError(%v) = %s, wanted %s", err, got, test.wantReason)
+				}
+			case err != nil:
+				t.Fatalf("Order() = %v", err)
+			}
+			if len(chall) != test.wantChallenges {
+				t.Errorf("Order() = %d challenges, wanted %d", len(chall), test.wantChallenges)
+			}
+			if got := cert != nil; got != test.wantCert {
+				t.Errorf("Order() = %v, wanted a certificate: %v", cert, test.wantCert)
+			} else if got && !cmp.Equal(cert.Leaf.DNSNames, domains) {
+				t.Errorf("DNSNames = %v, wanted %v", cert.Leaf.DNSNames, domains)
+			}
+
+			// Recover from the injected errors, and see whether we carry
+			// on with the same order.
+			fc.setErrors(nil, nil)
+			if _, _, err := om.Order(ctx, domains, owner, noSelfCheck); err != nil && test.wantReason == "" {
+				t.Errorf("Order() = %v", err)
+			}
+			want := 1
+			if test.wantNewOrder {
+				want = 2
+			}
+			if got := fc.ordersPlaced(); got != want {
+				t.Errorf("placed %d orders, wanted %d", got, want)
+			}
+		})
+	}
+}
+
+func TestOrderPlacementFails(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fc := newFakeClient(t)
+	fc.authorizeErr = &acme.Error{StatusCode: http.StatusTooManyRequests, ProblemType: "urn:ietf:params:acme:error:rateLimited"}
+	om := newTestOrderManager(t, ctx, fc, clock.RealClock{})
+
+	_, _, err := om.Order(ctx, []string{"example.com"}, nil, WithSelfCheck(SelfCheck{}))
+	if got, want := ClassifyError(err).Reason, ReasonRateLimited; got != want {
+		t.Errorf("Order() = %v, wanted %s error", err, want)
+	}
+	if _, found := om.(*impl).getTicket([]string{"example.com"}, nil, ""); found {
+		t.Error("The order is in-flight after failing to place it")
+	}
+}
+
+func TestOrderCallback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	domains := []string{"example.com", "www.example.com"}
+	owner := types.NamespacedName{Namespace: "foo", Name: "bar"}
+	fc := newFakeClient(t)
+	clk := clocktesting.NewFakePassiveClock(time.Now())
+
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	up := make(chan interface{}, 1)
+	om := newTestOrderManager(t, ctx, fc, clk,
+		withCallback(func(owner interface{}) { up <- owner }),
+		WithSolvers(NewHTTP01Solver(chlr)))
+
+	chall, _, err := om.Order(ctx, domains, owner, WithSelfCheck(SelfCheck{}))
+	if err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	// The responses to the challenges are served while the CA validates
+	// them.
+	for _, url := range chall {
+		rec := httptest.NewRecorder()
+		chlr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url.String(), nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, wanted %d", url, rec.Code, http.StatusOK)
+		}
+	}
+
+	// The owner is told once the CA validated the challenges.
+	fc.setAuthzStatus("https://ca.example/order/1", acme.StatusValid, nil)
+	fc.setOrderStatus("https://ca.example/order/1", acme.StatusReady)
+	select {
+	case got := <-up:
+		if got != owner {
+			t.Errorf("Callback(%v), wanted %v", got, owner)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the order to be up")
+	}
+	if got, want := fc.challengesAccepted(), len(domains); got != want {
+		t.Errorf("accepted %d challenges, wanted %d", got, want)
+	}
+
+	clk.SetTime(clk.Now().Add(time.Minute))
+	_, cert, err := om.Order(ctx, domains, owner)
+	if err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	if cert == nil || !cmp.Equal(cert.Leaf.DNSNames, domains) {
+		t.Errorf("Order() = %v, wanted a certificate for %v", cert, domains)
+	}
+}
+
+func TestValidAuthorizationsSkipped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	domains := []string{"example.com", "www.example.com"}
+	owner := types.NamespacedName{Namespace: "foo", Name: "bar"}
+	fc := newFakeClient(t)
+	// The CA reuses a valid authorization for example.com.
+	fc.trust("example.com")
+	clk := clocktesting.NewFakePassiveClock(time.Now())
+
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	up := make(chan interface{}, 1)
+	om := newTestOrderManager(t, ctx, fc, clk,
+		withCallback(func(owner interface{}) { up <- owner }),
+		WithSolvers(NewHTTP01Solver(chlr)))
+
+	chall, _, err := om.Order(ctx, domains, owner, WithSelfCheck(SelfCheck{}))
+	if err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	if len(chall) != 1 || chall[0].Host != "www.example.com" {
+		t.Fatalf("Order() = %v, wanted a single challenge for www.example.com", chall)
+	}
+	// No response is served for the valid authorization.
+	rec := httptest.NewRecorder()
+	chlr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/.well-known/acme-challenge/token-1-example.com", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET challenge for example.com = %d, wanted %d", rec.Code, http.StatusNotFound)
+	}
+
+	fc.setAuthzStatus("https://ca.example/order/1", acme.StatusValid, nil)
+	fc.setOrderStatus("https://ca.example/order/1", acme.StatusReady)
+	select {
+	case <-up:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the order to be up")
+	}
+	if got, want := fc.challengesAccepted(), 1; got != want {
+		t.Errorf("accepted %d challenges, wanted %d", got, want)
+	}
+}
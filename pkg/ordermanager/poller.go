@@ -0,0 +1,331 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"knative.dev/pkg/apis"
+	"knative.dev/pkg/logging"
+)
+
+// DefaultPollBackoff is the backoff with which in-flight orders are polled
+// when none is configured.
+var DefaultPollBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   1.5,
+	Jitter:   0.1,
+	Cap:      30 * time.Second,
+}
+
+// WithPollBackoff configures how often the state of in-flight orders is
+// polled from the CA.  The delay between polls grows up to backoff.Cap
+// while we wait on the CA, and starts over from backoff.Duration as we
+// accept challenges.  It defaults to DefaultPollBackoff.
+func WithPollBackoff(backoff wait.Backoff) Option {
+	return func(om *impl) {
+		om.pollBackoff = backoff
+	}
+}
+
+// snapshot is the state of an order and of its authorizations at the CA,
+// as of the last time we polled it.
+type snapshot struct {
+	order  *acme.Order
+	authzs []*acme.Authorization
+
+	// err is the error of the last poll, if it failed, in which case order
+	// and authzs are those of the last poll that succeeded.
+	err error
+}
+
+// authz returns the authorization at the URL, if we have it.
+func (s snapshot) authz(url string) *acme.Authorization {
+	for _, z := range s.authzs {
+		if z.URI == url {
+			return z
+		}
+	}
+	return nil
+}
+
+// failure returns the reason the order failed: the validation errors of its
+// first failed authorization, or else the error of the order itself.
+func (s snapshot) failure() error {
+	for _, z := range s.authzs {
+		if z.Status != acme.StatusInvalid {
+			continue
+		}
+		if ae := authorizationError(z); len(ae.Errors) > 0 {
+			return ae
+		}
+	}
+	if s.order.Error != nil {
+		return s.order.Error
+	}
+	return nil
+}
+
+// challengeURLs returns the URLs at which the challenge responses of the
+// order's outstanding authorizations must be served.  Authorizations the
+// CA already deems valid need no routing, so they are skipped.
+func (s snapshot) challengeURLs(client Client, solvers []Solver) ([]*apis.URL, error) {
+	urls := make([]*apis.URL, 0, len(s.authzs))
+	for _, z := range s.authzs {
+		if z.Status != acme.StatusPending {
+			continue
+		}
+		solver, chal, err := pickSolver(solvers, z)
+		if err != nil {
+			return nil, err
+		}
+		// Only some challenge types need to be routed to us.
+		if url := solver.URL(client, z, chal); url != nil {
+			urls = append(urls, url)
+		}
+	}
+	return urls, nil
+}
+
+// authorizationError returns the error of the failed authorization, with
+// the errors of its challenges.
+func authorizationError(z *acme.Authorization) *acme.AuthorizationError {
+	ae := &acme.AuthorizationError{URI: z.URI, Identifier: z.Identifier.Value}
+	for _, chal := range z.Challenges {
+		if chal.Error != nil {
+			ae.Errors = append(ae.Errors, chal.Error)
+		}
+	}
+	return ae
+}
+
+// orderCache holds the latest snapshot of an order, which the copies of its
+// ticket share, so that Order is answered without asking the CA.
+type orderCache struct {
+	mu   sync.Mutex
+	snap snapshot
+	// changed is closed, and replaced, whenever snap changes.
+	changed chan struct{}
+
+	// poke asks the poller to poll right away.
+	poke chan struct{}
+	// stopped is closed once the poller stops.
+	stopped chan struct{}
+}
+
+func newOrderCache(snap snapshot) *orderCache {
+	return &orderCache{
+		snap:    snap,
+		changed: make(chan struct{}),
+		poke:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+}
+
+// get returns the latest snapshot.
+func (c *orderCache) get() snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.snap
+}
+
+// set replaces the snapshot, and wakes up those waiting on it.
+func (c *orderCache) set(snap snapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.snap = snap
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// setErr records that the last poll failed, keeping the last snapshot.
+func (c *orderCache) setErr(err error) {
+	snap := c.get()
+	snap.err = err
+	c.set(snap)
+}
+
+// refresh asks the poller to poll right away, e.g. because we accepted a
+// challenge.
+func (c *orderCache) refresh() {
+	select {
+	case c.poke <- struct{}{}:
+	default:
+	}
+}
+
+// errStopped is returned when waiting on an authorization that is still
+// pending after the poller stopped.
+var errStopped = errors.New("stopped polling the order")
+
+// waitAuthorization blocks until the authorization at the URL is no longer
+// pending, and returns its error if the CA failed to validate it.
+func (c *orderCache) waitAuthorization(ctx context.Context, url string) error {
+	stopped := false
+	for {
+		c.mu.Lock()
+		z, changed := c.snap.authz(url), c.changed
+		c.mu.Unlock()
+
+		switch {
+		case z != nil && z.Status == acme.StatusValid:
+			return nil
+		case z != nil && z.Status != acme.StatusPending:
+			return authorizationError(z)
+		case stopped:
+			return errStopped
+		}
+		select {
+		case <-changed:
+		case <-c.stopped:
+			// Take a last look at the final snapshot.
+			stopped = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pollOrder polls the order of the ticket in the background until it
+// settles, keeping the snapshot in its cache up to date, and notifies the
+// owners of the order once it did.  This is the only place that asks the
+// CA about in-flight orders, however often they are reconciled.  The
+// errgroup completes once the challenges are validated.  Polling stops,
+// calling cancel, once ctx is done, failing the order when it ran out of
+// time.
+func (om *impl) pollOrder(ctx context.Context, cancel context.CancelFunc, domains []string, t ticket, eg *errgroup.Group, owner interface{}) {
+	if !om.begin() {
+		cancel()
+		close(t.cache.stopped)
+		return
+	}
+	solved := make(chan error, 1)
+	go func() { solved <- eg.Wait() }()
+
+	go func() {
+		defer om.background.Done()
+		defer cancel()
+		defer close(t.cache.stopped)
+		logger := logging.FromContext(ctx)
+
+		backoff := om.pollBackoff
+		backoff.Steps = math.MaxInt32
+		next := time.After(backoff.Step())
+		for {
+			select {
+			case <-ctx.Done():
+				if om.ctx.Err() == nil && om.tracking(domains, t.uri) {
+					logger.Errorf("Order %q did not complete in time.", t.uri)
+					om.setError(ctx, domains, fmt.Errorf("order %q did not complete in time: %w", t.uri, ctx.Err()))
+					om.orderUp(domains, owner)
+				}
+				return
+			case err := <-solved:
+				if err != nil && om.ctx.Err() != nil {
+					// The challenges were cut short as we shut down, which
+					// doesn't fail the order.
+					return
+				} else if err != nil {
+					logger.Errorf("Encountered an error waiting for challenges: %v.", err)
+					om.setError(ctx, domains, err)
+					om.orderUp(domains, owner)
+					return
+				}
+				// The order should be ready now.
+				solved = nil
+			case <-t.cache.poke:
+				backoff = om.pollBackoff
+				backoff.Steps = math.MaxInt32
+			case <-next:
+			}
+			if !om.tracking(domains, t.uri) {
+				// The order was dropped, e.g. by a failed Order.
+				return
+			}
+
+			snap, err := om.poll(ctx, t.cache.get())
+			delay := backoff.Step()
+			switch {
+			case err != nil && ClassifyError(err).Transient:
+				logger.Warnf("Error polling order %q: %v", t.uri, err)
+				t.cache.setErr(err)
+				if ra := ClassifyError(err).RetryAfter; ra > delay {
+					delay = ra
+				}
+			case err != nil:
+				logger.Errorf("Encountered an error polling order %q: %v.", t.uri, err)
+				om.setError(ctx, domains, err)
+				om.orderUp(domains, owner)
+				return
+			default:
+				t.cache.set(snap)
+				if s := snap.order.Status; s != acme.StatusPending && s != acme.StatusProcessing {
+					logger.Infof("Order %q has settled with status %q.", t.uri, s)
+					om.orderUp(domains, owner)
+					return
+				}
+			}
+			next = time.After(delay)
+		}
+	}()
+}
+
+// poll fetches the order of the snapshot and its authorizations from the
+// CA.  Authorizations that were no longer pending don't change anymore, so
+// they aren't fetched again.
+func (om *impl) poll(ctx context.Context, last snapshot) (snapshot, error) {
+	o, err := om.Client.GetOrder(ctx, last.order.URI)
+	if err != nil {
+		return snapshot{}, err
+	}
+	snap := snapshot{order: o}
+	for _, url := range o.AuthzURLs {
+		z := last.authz(url)
+		if z == nil || z.Status == acme.StatusPending {
+			if z, err = om.Client.GetAuthorization(ctx, url); err != nil {
+				return snapshot{}, err
+			}
+		}
+		snap.authzs = append(snap.authzs, z)
+	}
+	return snap, nil
+}
+
+// orderUp notifies the owners of the order for the domains that it is up.
+func (om *impl) orderUp(domains []string, owner interface{}) {
+	for _, owner := range om.ownersOf(domains, owner) {
+		om.Callback(owner)
+	}
+}
+
+// tracking returns whether the order at the URI is the one in-flight for
+// the domains.
+func (om *impl) tracking(domains []string, uri string) bool {
+	om.Lock()
+	defer om.Unlock()
+
+	t, ok := om.inflight[asKey(domains)]
+	return ok && t.uri == uri
+}
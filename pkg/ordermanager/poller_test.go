@@ -0,0 +1,170 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/clock"
+)
+
+func TestOrderAnsweredFromCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	domains := []string{"example.com", "www.example.com"}
+	owner := types.NamespacedName{Namespace: "foo", Name: "bar"}
+	fc := newFakeClient(t)
+	om := newTestOrderManager(t, ctx, fc, clock.RealClock{}, WithPollBackoff(wait.Backoff{Duration: time.Hour}))
+
+	// The challenges are never plumbed, so we don't accept them, which
+	// leaves the poller waiting.
+	ingress := httptest.NewServer(http.NotFoundHandler())
+	defer ingress.Close()
+	check := WithSelfCheck(SelfCheck{
+		Timeout:        time.Minute,
+		Backoff:        wait.Backoff{Duration: 10 * time.Millisecond},
+		IngressAddress: ingress.Listener.Addr().String(),
+	})
+
+	if _, _, err := om.Order(ctx, domains, owner, check); err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+	// Placing the order fetches each of its authorizations once.
+	if got, want := fc.fetched(), len(domains); got != want {
+		t.Errorf("fetched %d resources, wanted %d", got, want)
+	}
+	for i := 0; i < 5; i++ {
+		chall, _, err := om.Order(ctx, domains, owner, check)
+		if err != nil {
+			t.Fatalf("Order() = %v", err)
+		}
+		if len(chall) != len(domains) {
+			t.Errorf("Order() = %v, wanted %d challenges", chall, len(domains))
+		}
+	}
+	if got, want := fc.fetched(), len(domains); got != want {
+		t.Errorf("fetched %d resources after answering from the cache, wanted %d", got, want)
+	}
+}
+
+func TestPollSkipsSettledAuthorizations(t *testing.T) {
+	ctx := context.Background()
+	fc := newFakeClient(t)
+	o, err := fc.AuthorizeOrder(ctx, acme.DomainIDs("example.com", "www.example.com"))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder() = %v", err)
+	}
+	om := &impl{Client: fc}
+
+	snap, err := om.poll(ctx, snapshot{order: o})
+	if err != nil {
+		t.Fatalf("poll() = %v", err)
+	}
+	if got, want := len(snap.authzs), 2; got != want {
+		t.Fatalf("poll() = %d authorizations, wanted %d", got, want)
+	}
+
+	// Once validated, an authorization isn't fetched again.
+	fc.setAuthzStatus(o.URI, acme.StatusValid, nil)
+	before := fc.fetched()
+	if snap, err = om.poll(ctx, snap); err != nil {
+		t.Fatalf("poll() = %v", err)
+	}
+	if got, want := fc.fetched()-before, 3; got != want {
+		t.Errorf("fetched %d resources, wanted %d", got, want)
+	}
+	before = fc.fetched()
+	if _, err = om.poll(ctx, snap); err != nil {
+		t.Fatalf("poll() = %v", err)
+	}
+	if got, want := fc.fetched()-before, 1; got != want {
+		t.Errorf("fetched %d resources, wanted %d", got, want)
+	}
+}
+
+func TestWaitAuthorization(t *testing.T) {
+	const url = "https://ca.example/order/1/authz/example.com"
+	problem := &acme.Error{StatusCode: http.StatusForbidden, ProblemType: "urn:ietf:params:acme:error:unauthorized"}
+	authz := func(status string) snapshot {
+		return snapshot{
+			order: &acme.Order{URI: "https://ca.example/order/1"},
+			authzs: []*acme.Authorization{{
+				URI:        url,
+				Status:     status,
+				Identifier: acme.AuthzID{Type: "dns", Value: "example.com"},
+				Challenges: []*acme.Challenge{{Type: "http-01", Error: problem}},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		// next is the snapshot that the poller stores, if any.
+		next    *snapshot
+		stop    bool
+		wantErr error
+	}{{
+		name: "validated",
+		next: func() *snapshot { s := authz(acme.StatusValid); return &s }(),
+	}, {
+		name:    "invalid",
+		next:    func() *snapshot { s := authz(acme.StatusInvalid); return &s }(),
+		wantErr: problem,
+	}, {
+		name:    "poller stopped",
+		stop:    true,
+		wantErr: errStopped,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			c := newOrderCache(authz(acme.StatusPending))
+
+			errCh := make(chan error, 1)
+			go func() { errCh <- c.waitAuthorization(ctx, url) }()
+			if test.next != nil {
+				c.set(*test.next)
+			}
+			if test.stop {
+				close(c.stopped)
+			}
+
+			err := <-errCh
+			var ae *acme.AuthorizationError
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Errorf("waitAuthorization() = %v", err)
+			case errors.As(err, &ae):
+				if len(ae.Errors) != 1 || ae.Errors[0] != test.wantErr {
+					t.Errorf("waitAuthorization() = %v, wanted %v", err, test.wantErr)
+				}
+			case err != test.wantErr:
+				t.Errorf("waitAuthorization() = %v, wanted %v", err, test.wantErr)
+			}
+		})
+	}
+}
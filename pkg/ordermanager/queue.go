@@ -0,0 +1,175 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrQueued is returned by Order when the order for the domains waits for
+// other orders to complete before it is placed.  The owner is notified
+// through the OrderUpCallback once it is its turn.
+var ErrQueued = errors.New("the order is queued behind other orders")
+
+// queueClaimTimeout is how long the owners of a queued order have to place
+// it once they were notified that it is its turn, before it gives up its
+// spot, e.g. because the owners went away.
+const queueClaimTimeout = time.Minute
+
+// WithMaxInflightOrders caps the number of orders in-flight at once, so that
+// ordering many certificates at once doesn't trip the rate limits of the CA.
+// Orders past the cap wait in a queue, in which renewals come first, those
+// of the certificates that expire soonest ahead of the others, followed by
+// the other orders in the order they arrived.  Orders resumed after a
+// restart count towards the cap as well.  There is no cap by default.
+func WithMaxInflightOrders(n int) Option {
+	return func(om *impl) {
+		om.maxInflight = n
+	}
+}
+
+// WithRenewal marks the order as renewing a certificate that expires at
+// notAfter, which gives it priority when orders are queued.
+func WithRenewal(notAfter time.Time) OrderOption {
+	return func(o *orderOptions) {
+		o.renewing = notAfter
+	}
+}
+
+// queued is an order waiting in the queue.
+type queued struct {
+	key    key
+	owners []interface{}
+
+	// expiry is when the certificate that the order renews expires, if it
+	// is a renewal.
+	expiry time.Time
+
+	// arrived is when the order was first queued, and woken is when its
+	// owners were notified that it is its turn.
+	arrived time.Time
+	woken   time.Time
+}
+
+// before returns whether the order goes ahead of the other in the queue.
+func (q *queued) before(other *queued) bool {
+	switch {
+	case q.expiry.IsZero() != other.expiry.IsZero():
+		return !q.expiry.IsZero()
+	case !q.expiry.Equal(other.expiry):
+		return q.expiry.Before(other.expiry)
+	default:
+		return q.arrived.Before(other.arrived)
+	}
+}
+
+// admit returns whether the order for the domains may be placed, in which
+// case it takes up one of the in-flight spots until release is called.
+// Otherwise the order is queued until enough orders ahead of it complete.
+func (om *impl) admit(domains []string, owner interface{}, oo orderOptions) bool {
+	om.Lock()
+	defer om.Unlock()
+
+	if om.maxInflight <= 0 {
+		om.starting++
+		return true
+	}
+
+	now := om.clock.Now()
+	k := asKey(domains)
+	var q *queued
+	kept := om.queue[:0]
+	for _, e := range om.queue {
+		switch {
+		case e.key == k:
+			q = e
+		case !e.woken.IsZero() && now.Sub(e.woken) >= queueClaimTimeout:
+			// The owners didn't claim the spot in time.
+			continue
+		}
+		kept = append(kept, e)
+	}
+	om.queue = kept
+	if q == nil {
+		q = &queued{key: k, arrived: now}
+		om.queue = append(om.queue, q)
+	}
+	if !oo.renewing.IsZero() {
+		q.expiry = oo.renewing
+	}
+	if owner != nil && !hasOwner(q.owners, owner) {
+		q.owners = append(q.owners, owner)
+	}
+	sort.SliceStable(om.queue, func(i, j int) bool {
+		return om.queue[i].before(om.queue[j])
+	})
+
+	for i := 0; i < om.free() && i < len(om.queue); i++ {
+		if om.queue[i] == q {
+			om.queue = append(om.queue[:i], om.queue[i+1:]...)
+			om.starting++
+			return true
+		}
+	}
+	return false
+}
+
+// release gives back the in-flight spot taken up by admit, once the order
+// has been placed, as it then counts among the in-flight orders, or failed
+// to.
+func (om *impl) release() {
+	func() {
+		om.Lock()
+		defer om.Unlock()
+
+		om.starting--
+	}()
+	om.wakeQueued()
+}
+
+// wakeQueued notifies the owners of the queued orders that it is their turn,
+// as in-flight orders complete.
+func (om *impl) wakeQueued() {
+	var owners []interface{}
+	func() {
+		om.Lock()
+		defer om.Unlock()
+
+		for i := 0; i < om.free() && i < len(om.queue); i++ {
+			if q := om.queue[i]; q.woken.IsZero() {
+				q.woken = om.clock.Now()
+				owners = append(owners, q.owners...)
+			}
+		}
+	}()
+	for _, owner := range owners {
+		om.Callback(owner)
+	}
+}
+
+// free returns the number of orders that may be placed before reaching the
+// cap, counting the orders that are yet to be resumed after a restart as
+// in-flight.  It must be called with the lock held.
+func (om *impl) free() int {
+	n := om.maxInflight - len(om.inflight) - om.starting
+	if len(om.resumable) > 0 && om.clock.Now().Before(om.resumeBy) {
+		n -= len(om.resumable)
+	}
+	return n
+}
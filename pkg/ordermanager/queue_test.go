@@ -0,0 +1,225 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/acme"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/clock"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+func TestQueuePriority(t *testing.T) {
+	now := time.Now()
+	clk := clocktesting.NewFakePassiveClock(now)
+	var woken []interface{}
+	om := &impl{
+		clock:       clk,
+		Orders:      NewMemoryOrderStore(),
+		inflight:    make(map[key]ticket),
+		maxInflight: 1,
+		Callback: func(owner interface{}) {
+			woken = append(woken, owner)
+		},
+	}
+	om.putTicket([]string{"busy.example.com"}, ticket{uri: "https://ca.example/order/1"})
+
+	// New orders queue in the order they arrive, behind the renewals, of
+	// which those of the certificates that expire soonest come first.
+	orders := []struct {
+		domain string
+		opts   []OrderOption
+	}{
+		{domain: "first.example.com"},
+		{domain: "second.example.com"},
+		{domain: "later.example.com", opts: []OrderOption{WithRenewal(now.Add(20 * 24 * time.Hour))}},
+		{domain: "sooner.example.com", opts: []OrderOption{WithRenewal(now.Add(time.Hour))}},
+	}
+	for _, o := range orders {
+		clk.SetTime(clk.Now().Add(time.Second))
+		if om.admit([]string{o.domain}, o.domain, newOrderOptions(o.opts)) {
+			t.Fatalf("admit(%s) = true, wanted the order to be queued", o.domain)
+		}
+	}
+	got := make([]key, 0, len(om.queue))
+	for _, q := range om.queue {
+		got = append(got, q.key)
+	}
+	want := []key{"sooner.example.com", "later.example.com", "first.example.com", "second.example.com"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("queue = %v, wanted %v", got, want)
+	}
+
+	// Once the in-flight order completes, the head of the queue is notified,
+	// and no one else may take its spot.
+	om.forgetOrder(context.Background(), []string{"busy.example.com"})
+	if want := []interface{}{"sooner.example.com"}; !cmp.Equal(woken, want) {
+		t.Errorf("woken = %v, wanted %v", woken, want)
+	}
+	if om.admit([]string{"first.example.com"}, "first.example.com", newOrderOptions(nil)) {
+		t.Error("admit(first.example.com) = true, wanted it to wait for its turn")
+	}
+	if !om.admit([]string{"sooner.example.com"}, "sooner.example.com", newOrderOptions(nil)) {
+		t.Error("admit(sooner.example.com) = false, wanted it to be its turn")
+	}
+	if om.admit([]string{"later.example.com"}, "later.example.com", newOrderOptions(nil)) {
+		t.Error("admit(later.example.com) = true, while the spot is taken")
+	}
+}
+
+func TestQueueClaimTimeout(t *testing.T) {
+	clk := clocktesting.NewFakePassiveClock(time.Now())
+	om := &impl{
+		clock:       clk,
+		Orders:      NewMemoryOrderStore(),
+		inflight:    make(map[key]ticket),
+		maxInflight: 1,
+		Callback:    func(interface{}) {},
+	}
+	om.putTicket([]string{"busy.example.com"}, ticket{uri: "https://ca.example/order/1"})
+	for _, domain := range []string{"gone.example.com", "next.example.com"} {
+		if om.admit([]string{domain}, domain, newOrderOptions(nil)) {
+			t.Fatalf("admit(%s) = true, wanted the order to be queued", domain)
+		}
+	}
+	om.forgetOrder(context.Background(), []string{"busy.example.com"})
+
+	// The owners of the head of the queue never claim its spot, which
+	// passes on once they had their chance.
+	if om.admit([]string{"next.example.com"}, "next.example.com", newOrderOptions(nil)) {
+		t.Error("admit(next.example.com) = true, wanted it to wait for its turn")
+	}
+	clk.SetTime(clk.Now().Add(queueClaimTimeout))
+	if !om.admit([]string{"next.example.com"}, "next.example.com", newOrderOptions(nil)) {
+		t.Error("admit(next.example.com) = false, wanted it to be its turn")
+	}
+}
+
+func TestOrderQueued(t *testing.T) {
+	ctx := context.Background()
+	first := types.NamespacedName{Namespace: "foo", Name: "first"}
+	second := types.NamespacedName{Namespace: "foo", Name: "second"}
+	fc := newFakeClient(t)
+	up := make(chan interface{}, 10)
+	om := newTestOrderManager(t, ctx, fc, clock.RealClock{},
+		withCallback(func(owner interface{}) { up <- owner }), WithMaxInflightOrders(1))
+	noSelfCheck := WithSelfCheck(SelfCheck{})
+
+	if _, _, err := om.Order(ctx, []string{"first.example.com"}, first, noSelfCheck); err != nil {
+		t.Fatalf("Order(first) = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := om.Order(ctx, []string{"second.example.com"}, second, noSelfCheck); !errors.Is(err, ErrQueued) {
+			t.Fatalf("Order(second) = %v, wanted %v", err, ErrQueued)
+		}
+	}
+	if got := fc.ordersPlaced(); got != 1 {
+		t.Errorf("Placed %d orders, wanted 1", got)
+	}
+
+	// Once the first order completes, it's the turn of the second.
+	uri := "https://ca.example/order/1"
+	fc.setAuthzStatus(uri, acme.StatusValid, nil)
+	fc.setOrderStatus(uri, acme.StatusReady)
+	awaitOwner(t, up, first)
+	if _, cert, err := om.Order(ctx, []string{"first.example.com"}, first, noSelfCheck); err != nil || cert == nil {
+		t.Fatalf("Order(first) = %v, %v, wanted the certificate", cert, err)
+	}
+	awaitOwner(t, up, second)
+	if chall, _, err := om.Order(ctx, []string{"second.example.com"}, second, noSelfCheck); err != nil {
+		t.Fatalf("Order(second) = %v", err)
+	} else if len(chall) != 1 {
+		t.Errorf("Order(second) = %v, wanted 1 challenge", chall)
+	}
+}
+
+func TestOrderQueuedBehindResumed(t *testing.T) {
+	ctx := context.Background()
+	resumed := types.NamespacedName{Namespace: "foo", Name: "resumed"}
+	other := types.NamespacedName{Namespace: "foo", Name: "other"}
+	fc := newFakeClient(t)
+	noSelfCheck := WithSelfCheck(SelfCheck{})
+
+	// An order was in-flight before the restart.
+	o, err := fc.AuthorizeOrder(ctx, acme.DomainIDs("resumed.example.com"))
+	if err != nil {
+		t.Fatalf("AuthorizeOrder() = %v", err)
+	}
+	store := NewMemoryOrderStore()
+	if err := store.Save(ctx, OrderRecord{Domains: []string{"resumed.example.com"}, URI: o.URI, AuthzURLs: o.AuthzURLs}); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	clk := clocktesting.NewFakePassiveClock(time.Now())
+	om := newTestOrderManager(t, ctx, fc, clk, WithOrderStore(store), WithMaxInflightOrders(1))
+
+	// It holds on to its spot until it is resumed, and after.
+	if _, _, err := om.Order(ctx, []string{"other.example.com"}, other, noSelfCheck); !errors.Is(err, ErrQueued) {
+		t.Fatalf("Order(other) = %v, wanted %v", err, ErrQueued)
+	}
+	if _, _, err := om.Order(ctx, []string{"resumed.example.com"}, resumed, noSelfCheck); err != nil {
+		t.Fatalf("Order(resumed) = %v", err)
+	}
+	if _, _, err := om.Order(ctx, []string{"other.example.com"}, other, noSelfCheck); !errors.Is(err, ErrQueued) {
+		t.Fatalf("Order(other) = %v, wanted %v", err, ErrQueued)
+	}
+	if got := fc.ordersPlaced(); got != 1 {
+		t.Errorf("Placed %d orders, wanted 1", got)
+	}
+}
+
+func TestResumableOrdersUnclaimed(t *testing.T) {
+	clk := clocktesting.NewFakePassiveClock(time.Now())
+	om := &impl{
+		clock:       clk,
+		Orders:      NewMemoryOrderStore(),
+		inflight:    make(map[key]ticket),
+		resumable:   map[key]OrderRecord{"gone.example.com": {URI: "https://ca.example/order/1"}},
+		resumeBy:    clk.Now().Add(queueClaimTimeout),
+		maxInflight: 1,
+		Callback:    func(interface{}) {},
+	}
+	if om.admit([]string{"next.example.com"}, "next.example.com", newOrderOptions(nil)) {
+		t.Error("admit(next.example.com) = true, wanted it to wait for the order to resume")
+	}
+	// The owner of the order to resume went away while we were down.
+	clk.SetTime(om.resumeBy)
+	if !om.admit([]string{"next.example.com"}, "next.example.com", newOrderOptions(nil)) {
+		t.Error("admit(next.example.com) = false, wanted it to be its turn")
+	}
+}
+
+// awaitOwner waits until the owner is notified.
+func awaitOwner(t *testing.T, up <-chan interface{}, owner interface{}) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-up:
+			if got == owner {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%v wasn't notified", owner)
+		}
+	}
+}
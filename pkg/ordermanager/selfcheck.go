@@ -0,0 +1,170 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"knative.dev/pkg/apis"
+	logging "knative.dev/pkg/logging"
+)
+
+// ErrSelfCheckFailed is the error (wrapped) when we were unable to fetch
+// the expected challenge response ourselves before the self-check timed out,
+// in which case the CA isn't asked to validate the challenge.
+var ErrSelfCheckFailed = errors.New("self-check of the challenge response failed")
+
+// SelfCheck configures how we probe challenge responses ourselves before
+// asking the CA to validate them, so that a failed validation isn't spent
+// on routing that hasn't been plumbed yet.
+type SelfCheck struct {
+	// Timeout bounds how long we probe a challenge before giving up on it.
+	// A zero Timeout disables the self-check.
+	Timeout time.Duration
+
+	// Backoff governs the delay between probes.  Probes continue until
+	// Timeout regardless of Backoff.Steps, with the delay limited by
+	// Backoff.Cap.
+	Backoff wait.Backoff
+
+	// IngressAddress is the host:port to which probes are sent, e.g. the
+	// cluster ingress' Service.  When empty, probes are sent to the host of
+	// the challenge URL.
+	IngressAddress string
+}
+
+// DefaultSelfCheck is the SelfCheck used when none is configured.
+var DefaultSelfCheck = SelfCheck{
+	Timeout: 2 * time.Minute,
+	Backoff: wait.Backoff{
+		Duration: time.Second,
+		Factor:   1.5,
+		Jitter:   0.1,
+		Cap:      10 * time.Second,
+	},
+}
+
+// WithSelfCheck configures the self-check of the challenge responses of the
+// order.  It defaults to DefaultSelfCheck.
+func WithSelfCheck(sc SelfCheck) OrderOption {
+	return func(o *orderOptions) {
+		o.selfCheck = sc
+	}
+}
+
+// selfCheckable is implemented by Solvers whose challenge responses we can
+// fetch ourselves from the URL returned by the Solver.
+type selfCheckable interface {
+	// expectedResponse returns the body that the challenge URL should serve.
+	expectedResponse(client Client, z *acme.Authorization, chal *acme.Challenge) (string, error)
+}
+
+// selfCheck blocks until the challenge response is served where the CA will
+// look for it, or the self-check fails.
+func (om *impl) selfCheck(ctx context.Context, check SelfCheck, solver Solver, z *acme.Authorization, chal *acme.Challenge) error {
+	if check.Timeout <= 0 {
+		return nil
+	}
+	sc, ok := solver.(selfCheckable)
+	if !ok {
+		return nil
+	}
+	url := solver.URL(om.Client, z, chal)
+	if url == nil {
+		return nil
+	}
+	want, err := sc.expectedResponse(om.Client, z, chal)
+	if err != nil {
+		return err
+	}
+	return check.probe(ctx, url, want)
+}
+
+// probe repeatedly fetches the URL until it serves the wanted body.
+func (sc SelfCheck) probe(ctx context.Context, url *apis.URL, want string) error {
+	logger := logging.FromContext(ctx)
+
+	ctx, cancel := context.WithTimeout(ctx, sc.Timeout)
+	defer cancel()
+
+	client := sc.httpClient()
+	backoff := sc.Backoff
+	backoff.Steps = math.MaxInt32
+	for {
+		err := fetch(ctx, client, url, want)
+		if err == nil {
+			return nil
+		}
+		logger.Debugf("Self-check of %s failed: %v", url, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s: %v", ErrSelfCheckFailed, url, err)
+		case <-time.After(backoff.Step()):
+		}
+	}
+}
+
+// httpClient returns the client through which probes are sent.
+func (sc SelfCheck) httpClient() *http.Client {
+	if sc.IngressAddress == "" {
+		return &http.Client{Timeout: 10 * time.Second}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		// Send everything to the ingress, which routes on the Host header.
+		return dialer.DialContext(ctx, network, sc.IngressAddress)
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+	}
+}
+
+func fetch(ctx context.Context, client *http.Client, url *apis.URL, want string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return err
+	}
+	if got := string(body); got != want {
+		return fmt.Errorf("unexpected response %q", got)
+	}
+	return nil
+}
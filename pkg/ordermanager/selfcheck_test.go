@@ -0,0 +1,94 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"knative.dev/net-http01/pkg/challenger"
+)
+
+func TestSelfCheck(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	solver := NewHTTP01Solver(chlr)
+	z := &acme.Authorization{Identifier: acme.AuthzID{Type: "dns", Value: "example.com"}}
+	chal := &acme.Challenge{Type: "http-01", Token: "the-token"}
+
+	// Stand in for the ingress, which isn't routing to us for the first
+	// few probes.
+	var probes int32
+	ingress := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "example.com" {
+			t.Errorf("Host = %q, wanted example.com", r.Host)
+		}
+		if atomic.AddInt32(&probes, 1) <= 2 {
+			http.Error(w, "no route", http.StatusNotFound)
+			return
+		}
+		chlr.ServeHTTP(w, r)
+	}))
+	defer ingress.Close()
+
+	om := &impl{Client: client}
+	check := SelfCheck{
+		Timeout:        5 * time.Second,
+		Backoff:        wait.Backoff{Duration: time.Millisecond, Factor: 2},
+		IngressAddress: strings.TrimPrefix(ingress.URL, "http://"),
+	}
+
+	if err := solver.Present(ctx, client, z, chal); err != nil {
+		t.Fatalf("Present() = %v", err)
+	}
+	if err := om.selfCheck(ctx, check, solver, z, chal); err != nil {
+		t.Errorf("selfCheck() = %v", err)
+	}
+	if got := atomic.LoadInt32(&probes); got != 3 {
+		t.Errorf("probes = %d, wanted 3", got)
+	}
+
+	// Once the response is gone, the self-check times out.
+	if err := solver.CleanUp(ctx, client, z, chal); err != nil {
+		t.Fatalf("CleanUp() = %v", err)
+	}
+	check.Timeout = 50 * time.Millisecond
+	if err := om.selfCheck(ctx, check, solver, z, chal); !errors.Is(err, ErrSelfCheckFailed) {
+		t.Errorf("selfCheck() = %v, wanted %v", err, ErrSelfCheckFailed)
+	}
+
+	// Solvers that can't be probed, and a disabled self-check, pass right away.
+	if err := om.selfCheck(ctx, check, typedSolver("dns-01"), z, chal); err != nil {
+		t.Errorf("selfCheck(dns-01) = %v", err)
+	}
+	check.Timeout = 0
+	if err := om.selfCheck(ctx, check, solver, z, chal); err != nil {
+		t.Errorf("selfCheck(disabled) = %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+
+	"golang.org/x/crypto/acme"
+	"knative.dev/net-http01/pkg/challenger"
+	"knative.dev/net-http01/pkg/dns01"
+	"knative.dev/pkg/apis"
+)
+
+// Solver defines the interface for presenting and cleaning up the response
+// to a particular type of ACME challenge.
+type Solver interface {
+	// Type returns the ACME challenge type that this solver handles,
+	// e.g. "http-01".
+	Type() string
+
+	// Present makes the response to the challenge available to the CA.
+	Present(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error
+
+	// CleanUp removes the response to the challenge once it is no longer needed.
+	CleanUp(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error
+
+	// URL returns the URL that must be routed to us for the CA to validate
+	// the challenge, or nil if the challenge doesn't require any routing.
+	URL(client Client, z *acme.Authorization, chal *acme.Challenge) *apis.URL
+}
+
+// NewHTTP01Solver returns a Solver for http-01 challenges, which serves the
+// responses through the given Challenger.
+func NewHTTP01Solver(chlr challenger.Interface) Solver {
+	return &http01Solver{chlr: chlr}
+}
+
+type http01Solver struct {
+	chlr challenger.Interface
+}
+
+var _ Solver = (*http01Solver)(nil)
+var _ selfCheckable = (*http01Solver)(nil)
+
+// Type implements Solver
+func (s *http01Solver) Type() string {
+	return "http-01"
+}
+
+// Present implements Solver
+func (s *http01Solver) Present(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error {
+	resp, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	path := client.HTTP01ChallengePath(chal.Token)
+	if cc, ok := s.chlr.(challenger.ContextInterface); ok {
+		return cc.RegisterChallengeContext(ctx, path, resp)
+	}
+	s.chlr.RegisterChallenge(path, resp)
+	return nil
+}
+
+// CleanUp implements Solver
+func (s *http01Solver) CleanUp(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error {
+	path := client.HTTP01ChallengePath(chal.Token)
+	if cc, ok := s.chlr.(challenger.ContextInterface); ok {
+		return cc.UnregisterChallengeContext(ctx, path)
+	}
+	s.chlr.UnregisterChallenge(path)
+	return nil
+}
+
+// URL implements Solver
+func (s *http01Solver) URL(client Client, z *acme.Authorization, chal *acme.Challenge) *apis.URL {
+	return &apis.URL{
+		Scheme: "http",
+		Host:   z.Identifier.Value,
+		Path:   client.HTTP01ChallengePath(chal.Token),
+	}
+}
+
+// expectedResponse implements selfCheckable
+func (s *http01Solver) expectedResponse(client Client, z *acme.Authorization, chal *acme.Challenge) (string, error) {
+	return client.HTTP01ChallengeResponse(chal.Token)
+}
+
+// propagationAwaiter is implemented by Solvers whose challenge responses
+// take a while to be served where the CA will look for them, which we can't
+// self-check through a URL.
+type propagationAwaiter interface {
+	// awaitPropagation blocks until the challenge response has propagated.
+	awaitPropagation(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error
+}
+
+// NewDNS01Solver returns a Solver for dns-01 challenges, which publishes
+// the _acme-challenge TXT records through the given provider, and waits for
+// them to propagate as configured before the challenges are accepted.
+func NewDNS01Solver(provider dns01.Provider, propagation dns01.Propagation) Solver {
+	return &dns01Solver{provider: provider, propagation: propagation}
+}
+
+type dns01Solver struct {
+	provider    dns01.Provider
+	propagation dns01.Propagation
+}
+
+var _ Solver = (*dns01Solver)(nil)
+var _ propagationAwaiter = (*dns01Solver)(nil)
+
+// Type implements Solver
+func (s *dns01Solver) Type() string {
+	return "dns-01"
+}
+
+// Present implements Solver
+func (s *dns01Solver) Present(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	return s.provider.Present(ctx, dns01.RecordName(z.Identifier.Value), value)
+}
+
+// CleanUp implements Solver
+func (s *dns01Solver) CleanUp(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	return s.provider.CleanUp(ctx, dns01.RecordName(z.Identifier.Value), value)
+}
+
+// URL implements Solver
+func (s *dns01Solver) URL(client Client, z *acme.Authorization, chal *acme.Challenge) *apis.URL {
+	// The CA queries DNS directly, so nothing needs to be routed to us.
+	return nil
+}
+
+// awaitPropagation implements propagationAwaiter
+func (s *dns01Solver) awaitPropagation(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error {
+	value, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		return err
+	}
+	return s.propagation.Wait(ctx, dns01.RecordName(z.Identifier.Value), value)
+}
+
+// NewTLSALPN01Solver returns a Solver for tls-alpn-01 challenges, which
+// serves the challenge certificates through the given TLS-ALPN challenger.
+func NewTLSALPN01Solver(chlr challenger.TLSALPNInterface) Solver {
+	return &tlsALPN01Solver{chlr: chlr}
+}
+
+type tlsALPN01Solver struct {
+	chlr challenger.TLSALPNInterface
+}
+
+var _ Solver = (*tlsALPN01Solver)(nil)
+
+// Type implements Solver
+func (s *tlsALPN01Solver) Type() string {
+	return "tls-alpn-01"
+}
+
+// Present implements Solver
+func (s *tlsALPN01Solver) Present(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error {
+	cert, err := client.TLSALPN01ChallengeCert(chal.Token, z.Identifier.Value)
+	if err != nil {
+		return err
+	}
+	if cc, ok := s.chlr.(challenger.TLSALPNContextInterface); ok {
+		return cc.RegisterCertificateContext(ctx, z.Identifier.Value, &cert)
+	}
+	s.chlr.RegisterCertificate(z.Identifier.Value, &cert)
+	return nil
+}
+
+// CleanUp implements Solver
+func (s *tlsALPN01Solver) CleanUp(ctx context.Context, client Client, z *acme.Authorization, chal *acme.Challenge) error {
+	if cc, ok := s.chlr.(challenger.TLSALPNContextInterface); ok {
+		return cc.UnregisterCertificateContext(ctx, z.Identifier.Value)
+	}
+	s.chlr.UnregisterCertificate(z.Identifier.Value)
+	return nil
+}
+
+// URL implements Solver
+func (s *tlsALPN01Solver) URL(client Client, z *acme.Authorization, chal *acme.Challenge) *apis.URL {
+	// The CA connects to port 443 of the domain, which is routed to our
+	// TLS listener outside of the Knative Ingress.
+	return nil
+}
+
+// pickSolver returns the first of the solvers for which the authorization
+// offers a challenge, along with that challenge.
+func pickSolver(solvers []Solver, z *acme.Authorization) (Solver, *acme.Challenge, error) {
+	for _, s := range solvers {
+		for _, c := range z.Challenges {
+			if c.Type == s.Type() {
+				return s, c, nil
+			}
+		}
+	}
+	return nil, nil, ErrNoViableChallenge
+}
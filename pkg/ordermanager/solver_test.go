@@ -0,0 +1,265 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"knative.dev/net-http01/pkg/challenger"
+	"knative.dev/net-http01/pkg/dns01"
+	"knative.dev/pkg/apis"
+)
+
+func testClient(t *testing.T) *acme.Client {
+	t.Helper()
+	key, err := newAccountKey()
+	if err != nil {
+		t.Fatalf("newAccountKey() = %v", err)
+	}
+	return &acme.Client{Key: key}
+}
+
+func TestHTTP01Solver(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	chlr, err := challenger.New(ctx)
+	if err != nil {
+		t.Fatalf("challenger.New() = %v", err)
+	}
+	s := NewHTTP01Solver(chlr)
+
+	z := &acme.Authorization{Identifier: acme.AuthzID{Type: "dns", Value: "example.com"}}
+	chal := &acme.Challenge{Type: "http-01", Token: "the-token"}
+
+	url := s.URL(client, z, chal)
+	if got, want := url.String(), "http://example.com/.well-known/acme-challenge/the-token"; got != want {
+		t.Errorf("URL() = %s, wanted %s", got, want)
+	}
+
+	if err := s.Present(ctx, client, z, chal); err != nil {
+		t.Fatalf("Present() = %v", err)
+	}
+	rec := httptest.NewRecorder()
+	chlr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url.Path, nil))
+	body, _ := io.ReadAll(rec.Result().Body)
+	want, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		t.Fatalf("HTTP01ChallengeResponse() = %v", err)
+	}
+	if got := string(body); got != want {
+		t.Errorf("ServeHTTP() = %q, wanted %q", got, want)
+	}
+
+	if err := s.CleanUp(ctx, client, z, chal); err != nil {
+		t.Fatalf("CleanUp() = %v", err)
+	}
+	rec = httptest.NewRecorder()
+	chlr.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url.Path, nil))
+	if got, want := rec.Result().StatusCode, http.StatusNotFound; got != want {
+		t.Errorf("ServeHTTP(after cleanup) = %d, wanted %d", got, want)
+	}
+}
+
+type fakeProvider struct {
+	records map[string]string
+	err     error
+}
+
+func (p *fakeProvider) Present(ctx context.Context, fqdn, value string) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.records[fqdn] = value
+	return nil
+}
+
+func (p *fakeProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	if p.err != nil {
+		return p.err
+	}
+	delete(p.records, fqdn)
+	return nil
+}
+
+func TestDNS01Solver(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	p := &fakeProvider{records: make(map[string]string, 1)}
+	s := NewDNS01Solver(p, dns01.Propagation{})
+
+	z := &acme.Authorization{
+		Identifier: acme.AuthzID{Type: "dns", Value: "example.com"},
+		Wildcard:   true,
+	}
+	chal := &acme.Challenge{Type: "dns-01", Token: "the-token"}
+
+	if url := s.URL(client, z, chal); url != nil {
+		t.Errorf("URL() = %v, wanted nil", url)
+	}
+	if err := s.Present(ctx, client, z, chal); err != nil {
+		t.Fatalf("Present() = %v", err)
+	}
+	want, err := client.DNS01ChallengeRecord(chal.Token)
+	if err != nil {
+		t.Fatalf("DNS01ChallengeRecord() = %v", err)
+	}
+	if got := p.records["_acme-challenge.example.com."]; got != want {
+		t.Errorf("TXT = %q, wanted %q", got, want)
+	}
+	if err := s.CleanUp(ctx, client, z, chal); err != nil {
+		t.Fatalf("CleanUp() = %v", err)
+	}
+	if len(p.records) != 0 {
+		t.Errorf("records = %v, wanted none", p.records)
+	}
+
+	// Challenges aren't accepted until the record propagates.
+	s = NewDNS01Solver(p, dns01.Propagation{
+		Timeout:     50 * time.Millisecond,
+		Interval:    10 * time.Millisecond,
+		Nameservers: []string{"127.0.0.1:1"},
+	})
+	if err := s.(propagationAwaiter).awaitPropagation(ctx, client, z, chal); !errors.Is(err, dns01.ErrNotPropagated) {
+		t.Errorf("awaitPropagation() = %v, wanted %v", err, dns01.ErrNotPropagated)
+	}
+
+	p.err = errors.New("boom")
+	if err := s.Present(ctx, client, z, chal); err == nil {
+		t.Error("Present() = nil, wanted error")
+	}
+}
+
+func TestTLSALPN01Solver(t *testing.T) {
+	ctx := context.Background()
+	client := testClient(t)
+	chlr, err := challenger.NewTLSALPN(ctx)
+	if err != nil {
+		t.Fatalf("challenger.NewTLSALPN() = %v", err)
+	}
+	s := NewTLSALPN01Solver(chlr)
+
+	z := &acme.Authorization{Identifier: acme.AuthzID{Type: "dns", Value: "example.com"}}
+	chal := &acme.Challenge{Type: "tls-alpn-01", Token: "the-token"}
+	hello := &tls.ClientHelloInfo{
+		ServerName:      "example.com",
+		SupportedProtos: []string{acme.ALPNProto},
+	}
+
+	if url := s.URL(client, z, chal); url != nil {
+		t.Errorf("URL() = %v, wanted nil", url)
+	}
+	if err := s.Present(ctx, client, z, chal); err != nil {
+		t.Fatalf("Present() = %v", err)
+	}
+	cert, err := chlr.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("GetCertificate() = %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() = %v", err)
+	}
+	if got, want := leaf.DNSNames, []string{"example.com"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("DNSNames = %v, wanted %v", got, want)
+	}
+
+	if err := s.CleanUp(ctx, client, z, chal); err != nil {
+		t.Fatalf("CleanUp() = %v", err)
+	}
+	if _, err := chlr.GetCertificate(hello); err == nil {
+		t.Error("GetCertificate(after cleanup) = nil, wanted error")
+	}
+}
+
+type typedSolver string
+
+func (s typedSolver) Type() string { return string(s) }
+func (s typedSolver) Present(context.Context, Client, *acme.Authorization, *acme.Challenge) error {
+	return nil
+}
+func (s typedSolver) CleanUp(context.Context, Client, *acme.Authorization, *acme.Challenge) error {
+	return nil
+}
+func (s typedSolver) URL(Client, *acme.Authorization, *acme.Challenge) *apis.URL { return nil }
+
+func TestPickSolver(t *testing.T) {
+	tests := []struct {
+		name    string
+		solvers []Solver
+		offered []string
+		want    string
+		wantErr bool
+	}{{
+		name:    "only http",
+		solvers: []Solver{typedSolver("http-01")},
+		offered: []string{"dns-01", "http-01"},
+		want:    "http-01",
+	}, {
+		name:    "preference order",
+		solvers: []Solver{typedSolver("http-01"), typedSolver("dns-01")},
+		offered: []string{"dns-01", "http-01"},
+		want:    "http-01",
+	}, {
+		name:    "wildcard falls back to dns",
+		solvers: []Solver{typedSolver("http-01"), typedSolver("dns-01")},
+		offered: []string{"dns-01"},
+		want:    "dns-01",
+	}, {
+		name:    "tls-alpn preferred when enabled",
+		solvers: []Solver{typedSolver("tls-alpn-01"), typedSolver("http-01")},
+		offered: []string{"http-01", "dns-01", "tls-alpn-01"},
+		want:    "tls-alpn-01",
+	}, {
+		name:    "nothing viable",
+		solvers: []Solver{typedSolver("http-01")},
+		offered: []string{"dns-01"},
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			z := &acme.Authorization{}
+			for _, typ := range test.offered {
+				z.Challenges = append(z.Challenges, &acme.Challenge{Type: typ})
+			}
+			s, chal, err := pickSolver(test.solvers, z)
+			if test.wantErr {
+				if !errors.Is(err, ErrNoViableChallenge) {
+					t.Errorf("pickSolver() = %v, wanted %v", err, ErrNoViableChallenge)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("pickSolver() = %v", err)
+			}
+			if got := s.Type(); got != test.want {
+				t.Errorf("pickSolver() = %s, wanted %s", got, test.want)
+			}
+			if got := chal.Type; got != test.want {
+				t.Errorf("pickSolver() challenge = %s, wanted %s", got, test.want)
+			}
+		})
+	}
+}
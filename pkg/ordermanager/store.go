@@ -0,0 +1,240 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"knative.dev/pkg/kmeta"
+)
+
+// OrdersSecretName is the name of the Secret in the system namespace
+// that holds the state of in-flight orders.
+const OrdersSecretName = "net-http01-orders"
+
+// OrderRecord is the durable state of an in-flight order, from which
+// the order can be resumed after a restart.
+type OrderRecord struct {
+	// Domains is the set of domains being ordered.
+	Domains []string `json:"domains"`
+
+	// URI is the URL of the ACME order.
+	URI string `json:"uri"`
+
+	// AuthzURLs are the URLs of the order's authorizations.
+	AuthzURLs []string `json:"authzURLs,omitempty"`
+
+	// Owner is the namespace/name key of the owner of the order, if known.
+	Owner string `json:"owner,omitempty"`
+}
+
+// OrderStore persists the state of in-flight orders.
+type OrderStore interface {
+	// List returns all of the persisted orders.
+	List(ctx context.Context) ([]OrderRecord, error)
+
+	// Save persists the given order, replacing any order for the same domains.
+	Save(ctx context.Context, r OrderRecord) error
+
+	// Delete removes the order for the given domains, if any.
+	Delete(ctx context.Context, domains []string) error
+}
+
+// NewSecretOrderStore returns an OrderStore that keeps in-flight orders in
+// the named Secret, which is created on first use.
+func NewSecretOrderStore(client kubernetes.Interface, namespace, name string) OrderStore {
+	return &secretOrderStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+type secretOrderStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+var _ OrderStore = (*secretOrderStore)(nil)
+
+// List implements OrderStore
+func (s *secretOrderStore) List(ctx context.Context) ([]OrderRecord, error) {
+	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	records := make([]OrderRecord, 0, len(secret.Data))
+	for k, v := range secret.Data {
+		var r OrderRecord
+		if err := json.Unmarshal(v, &r); err != nil {
+			return nil, fmt.Errorf("decoding order %q: %w", k, err)
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return asKey(records[i].Domains) < asKey(records[j].Domains)
+	})
+	return records, nil
+}
+
+// Save implements OrderStore
+func (s *secretOrderStore) Save(ctx context.Context, r OrderRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.update(ctx, func(data map[string][]byte) {
+		data[recordKey(r.Domains)] = b
+	})
+}
+
+// Delete implements OrderStore
+func (s *secretOrderStore) Delete(ctx context.Context, domains []string) error {
+	return s.update(ctx, func(data map[string][]byte) {
+		delete(data, recordKey(domains))
+	})
+}
+
+func (s *secretOrderStore) update(ctx context.Context, mutate func(map[string][]byte)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+		if apierrs.IsNotFound(err) {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+				},
+				Type: corev1.SecretTypeOpaque,
+				Data: make(map[string][]byte, 1),
+			}
+			mutate(secret.Data)
+			_, err = s.client.CoreV1().Secrets(s.namespace).Create(ctx, secret, metav1.CreateOptions{})
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		secret = secret.DeepCopy()
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte, 1)
+		}
+		mutate(secret.Data)
+		_, err = s.client.CoreV1().Secrets(s.namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// recordKey returns a valid Secret data key for the given set of domains.
+func recordKey(domains []string) string {
+	sum := sha256.Sum256([]byte(asKey(domains)))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewMemoryOrderStore returns an OrderStore that only keeps orders in memory,
+// so in-flight orders are not resumed across restarts.
+func NewMemoryOrderStore() OrderStore {
+	return &memoryOrderStore{
+		records: make(map[key]OrderRecord),
+	}
+}
+
+type memoryOrderStore struct {
+	sync.Mutex
+
+	records map[key]OrderRecord
+}
+
+var _ OrderStore = (*memoryOrderStore)(nil)
+
+// List implements OrderStore
+func (m *memoryOrderStore) List(ctx context.Context) ([]OrderRecord, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	records := make([]OrderRecord, 0, len(m.records))
+	for _, r := range m.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return asKey(records[i].Domains) < asKey(records[j].Domains)
+	})
+	return records, nil
+}
+
+// Save implements OrderStore
+func (m *memoryOrderStore) Save(ctx context.Context, r OrderRecord) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.records[asKey(r.Domains)] = r
+	return nil
+}
+
+// Delete implements OrderStore
+func (m *memoryOrderStore) Delete(ctx context.Context, domains []string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	delete(m.records, asKey(domains))
+	return nil
+}
+
+// ownerKey returns the namespace/name key of the owner, or "" if the
+// owner isn't a Kubernetes object.
+func ownerKey(owner interface{}) string {
+	switch o := owner.(type) {
+	case types.NamespacedName:
+		return o.String()
+	case kmeta.Accessor:
+		key, err := cache.MetaNamespaceKeyFunc(o)
+		if err != nil {
+			return ""
+		}
+		return key
+	default:
+		return ""
+	}
+}
+
+// ownerFromKey is the inverse of ownerKey.  Restored owners are represented
+// as a types.NamespacedName.
+func ownerFromKey(k string) interface{} {
+	if k == "" {
+		return nil
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(k)
+	if err != nil {
+		return nil
+	}
+	return types.NamespacedName{Namespace: namespace, Name: name}
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ordermanager
+
+import (
+	context "context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+func TestOrderStores(t *testing.T) {
+	stores := map[string]func() OrderStore{
+		"secret": func() OrderStore {
+			return NewSecretOrderStore(fakekube.NewSimpleClientset(), "knative-serving", OrdersSecretName)
+		},
+		"memory": NewMemoryOrderStore,
+	}
+
+	first := OrderRecord{
+		Domains:   []string{"example.com", "www.example.com"},
+		URI:       "https://ca.example/order/1",
+		AuthzURLs: []string{"https://ca.example/authz/1", "https://ca.example/authz/2"},
+		Owner:     "default/my-cert",
+	}
+	second := OrderRecord{
+		Domains: []string{"*.example.org"},
+		URI:     "https://ca.example/order/2",
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore()
+
+			if got, err := store.List(ctx); err != nil {
+				t.Fatalf("List() = %v", err)
+			} else if len(got) != 0 {
+				t.Fatalf("List() = %v, wanted empty", got)
+			}
+			// Deleting something that isn't there is fine.
+			if err := store.Delete(ctx, first.Domains); err != nil {
+				t.Fatalf("Delete() = %v", err)
+			}
+
+			if err := store.Save(ctx, first); err != nil {
+				t.Fatalf("Save() = %v", err)
+			}
+			if err := store.Save(ctx, second); err != nil {
+				t.Fatalf("Save() = %v", err)
+			}
+			got, err := store.List(ctx)
+			if err != nil {
+				t.Fatalf("List() = %v", err)
+			}
+			if !cmp.Equal(got, []OrderRecord{second, first}) {
+				t.Errorf("List (-want, +got) = %s", cmp.Diff([]OrderRecord{second, first}, got))
+			}
+
+			// Saving the same domains (in any order) replaces the record.
+			replaced := first
+			replaced.Domains = []string{"www.example.com", "example.com"}
+			replaced.URI = "https://ca.example/order/3"
+			if err := store.Save(ctx, replaced); err != nil {
+				t.Fatalf("Save() = %v", err)
+			}
+			if err := store.Delete(ctx, second.Domains); err != nil {
+				t.Fatalf("Delete() = %v", err)
+			}
+			got, err = store.List(ctx)
+			if err != nil {
+				t.Fatalf("List() = %v", err)
+			}
+			if !cmp.Equal(got, []OrderRecord{replaced}) {
+				t.Errorf("List (-want, +got) = %s", cmp.Diff([]OrderRecord{replaced}, got))
+			}
+		})
+	}
+}
+
+func TestOwnerKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		owner interface{}
+		want  string
+	}{{
+		name: "nil",
+	}, {
+		name:  "string",
+		owner: "not an object",
+	}, {
+		name:  "namespaced name",
+		owner: types.NamespacedName{Namespace: "ns", Name: "name"},
+		want:  "ns/name",
+	}, {
+		name: "certificate",
+		owner: &v1alpha1.Certificate{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns",
+			Name:      "name",
+		}},
+		want: "ns/name",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ownerKey(test.owner)
+			if got != test.want {
+				t.Errorf("ownerKey() = %q, wanted %q", got, test.want)
+			}
+			if got == "" {
+				return
+			}
+			if got, want := ownerFromKey(got), (types.NamespacedName{Namespace: "ns", Name: "name"}); got != want {
+				t.Errorf("ownerFromKey() = %v, wanted %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+	"knative.dev/net-http01/pkg/renewal"
+	"knative.dev/pkg/apis"
+	logging "knative.dev/pkg/logging"
+)
+
+// configuredACME implements ordermanager.Interface and renewal.Policy through
+// an OrderManager and a renewal Policy per issuer, for the issuer and config
+// in the context.  They are replaced when the issuer's settings change.
+// A replaced OrderManager is shut down before its replacement is created,
+// which resumes the orders left in-flight through the issuer's order store.
+type configuredACME struct {
+	newOrderManager func(context.Context, *config.Issuer) (ordermanager.Interface, error)
+
+	mu sync.Mutex
+	// oms and policies are keyed by issuer name, and hold the settings that
+	// their value was created for in omKeys and policyKeys.
+	oms        map[string]ordermanager.Interface
+	omKeys     map[string]string
+	policies   map[string]renewal.Policy
+	policyKeys map[string]string
+	// replacing holds, by issuer name, a channel that is closed once the
+	// OrderManager being created for the issuer is in place, or failed.
+	// The OrderManagers are created, and replaced ones shut down, outside
+	// of mu, as both involve calls to the CA.
+	replacing map[string]chan struct{}
+	// shutdown is set once Shutdown was called.
+	shutdown bool
+}
+
+var _ ordermanager.Interface = (*configuredACME)(nil)
+var _ renewal.Policy = (*configuredACME)(nil)
+
+// orderManager returns the OrderManager for the issuer in the context,
+// creating it when there is none for the issuer's settings.  Callers wait
+// for the OrderManager that is being created for the issuer, if any.
+func (c *configuredACME) orderManager(ctx context.Context) (ordermanager.Interface, error) {
+	issuer := issuerFromContext(ctx)
+	key := strings.Join(append([]string{issuer.ACMEDirectory, issuer.EABSecretName}, issuer.ContactEmails...), ",")
+
+	for {
+		om, old, wait, err := c.lookup(issuer.Name, key)
+		switch {
+		case err != nil:
+			return nil, err
+		case om != nil:
+			return om, nil
+		case wait == nil:
+			// It is up to us to create the OrderManager.
+			return c.replace(ctx, issuer, key, old)
+		}
+		select {
+		case <-wait:
+			// Check that the OrderManager was created for our settings.
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// lookup returns the OrderManager for the issuer if it was created for the
+// settings in key.  Otherwise it returns the channel to wait on for the
+// OrderManager that is being created for the issuer, or, if none is, it
+// leaves the creation to the caller, handing over the OrderManager to replace,
+// if any.
+func (c *configuredACME) lookup(name, key string) (om, old ordermanager.Interface, wait <-chan struct{}, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.shutdown {
+		return nil, nil, nil, ordermanager.ErrShutdown
+	}
+	if done, ok := c.replacing[name]; ok {
+		return nil, nil, done, nil
+	}
+	old, ok := c.oms[name]
+	if ok && c.omKeys[name] == key {
+		return old, nil, nil, nil
+	}
+	// Stop handing out the OrderManager to replace.
+	delete(c.oms, name)
+	delete(c.omKeys, name)
+	if c.replacing == nil {
+		c.replacing = make(map[string]chan struct{}, 1)
+	}
+	c.replacing[name] = make(chan struct{})
+	return nil, old, nil, nil
+}
+
+// replace shuts down the OrderManager for the former settings of the issuer,
+// if any, and then creates one for its settings in key, which resumes the
+// orders that the former one left in-flight.
+func (c *configuredACME) replace(ctx context.Context, issuer *config.Issuer, key string, old ordermanager.Interface) (om ordermanager.Interface, err error) {
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if err == nil {
+			if c.oms == nil {
+				c.oms = make(map[string]ordermanager.Interface, 1)
+				c.omKeys = make(map[string]string, 1)
+			}
+			c.oms[issuer.Name], c.omKeys[issuer.Name] = om, key
+		}
+		close(c.replacing[issuer.Name])
+		delete(c.replacing, issuer.Name)
+	}()
+
+	if old != nil {
+		logging.FromContext(ctx).Infof("Shutting down the OrderManager for the former settings of issuer %q", issuer.Name)
+		// Don't cut the shutdown short with the reconciliation.
+		sctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), logging.FromContext(ctx)), shutdownTimeout)
+		defer cancel()
+		if err := old.Shutdown(sctx); err != nil {
+			logging.FromContext(ctx).Errorf("Error shutting down the OrderManager for issuer %q: %v", issuer.Name, err)
+		}
+	}
+	om, err = c.newOrderManager(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("creating OrderManager for issuer %q: %w", issuer.Name, err)
+	}
+	return om, nil
+}
+
+// Order implements ordermanager.Interface
+func (c *configuredACME) Order(ctx context.Context, domains []string, owner interface{}, opts ...ordermanager.OrderOption) ([]*apis.URL, *tls.Certificate, error) {
+	om, err := c.orderManager(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return om.Order(ctx, domains, owner, opts...)
+}
+
+// Revoke implements ordermanager.Interface
+func (c *configuredACME) Revoke(ctx context.Context, der []byte, reason acme.CRLReasonCode) error {
+	om, err := c.orderManager(ctx)
+	if err != nil {
+		return err
+	}
+	return om.Revoke(ctx, der, reason)
+}
+
+// Forget implements ordermanager.Interface
+func (c *configuredACME) Forget(ctx context.Context, owner interface{}, domains []string) {
+	// The owner may have ordered through the OrderManager of any issuer.
+	for _, om := range c.all() {
+		om.Forget(ctx, owner, domains)
+	}
+}
+
+// all returns the OrderManagers of all issuers.
+func (c *configuredACME) all() []ordermanager.Interface {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oms := make([]ordermanager.Interface, 0, len(c.oms))
+	for _, om := range c.oms {
+		oms = append(oms, om)
+	}
+	return oms
+}
+
+// Shutdown implements ordermanager.Interface
+func (c *configuredACME) Shutdown(ctx context.Context) error {
+	replacing := func() []chan struct{} {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.shutdown = true
+		replacing := make([]chan struct{}, 0, len(c.replacing))
+		for _, done := range c.replacing {
+			replacing = append(replacing, done)
+		}
+		return replacing
+	}()
+	// Let the OrderManagers being created take their place, so that they
+	// are shut down as well.
+	for _, done := range replacing {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	oms := c.all()
+
+	var errs []error
+	for _, om := range oms {
+		if err := om.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// Decide implements renewal.Policy
+func (c *configuredACME) Decide(ctx context.Context, cert *x509.Certificate) renewal.Decision {
+	issuer := issuerFromContext(ctx)
+	fraction := config.FromContextOrDefaults(ctx).HTTP01.RenewalLifetimeFraction
+	key := fmt.Sprint(issuer.ACMEDirectory, ",", fraction)
+
+	policy := func() renewal.Policy {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if p, ok := c.policies[issuer.Name]; ok && c.policyKeys[issuer.Name] == key {
+			return p
+		}
+		// Follow the CA's renewal windows when its directory offers them.
+		p := renewal.New(
+			renewal.WithLifetimeFraction(fraction),
+			renewal.WithARI(issuer.ACMEDirectory, nil))
+		if c.policies == nil {
+			c.policies = make(map[string]renewal.Policy, 1)
+			c.policyKeys = make(map[string]string, 1)
+		}
+		c.policies[issuer.Name], c.policyKeys[issuer.Name] = p, key
+		return p
+	}()
+	return policy.Decide(ctx, cert)
+}
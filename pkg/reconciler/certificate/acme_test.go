@@ -0,0 +1,202 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+)
+
+func TestConfiguredACME(t *testing.T) {
+	var created []*config.Issuer
+	var createErr error
+	ca := &configuredACME{
+		newOrderManager: func(ctx context.Context, issuer *config.Issuer) (ordermanager.Interface, error) {
+			if createErr != nil {
+				return nil, createErr
+			}
+			created = append(created, issuer)
+			return &fakeOM{}, nil
+		},
+	}
+	withIssuerConfig := func(f func(*config.Issuer)) context.Context {
+		issuer := &config.Issuer{
+			Name:          config.DefaultIssuerName,
+			ACMEDirectory: ordermanager.Production,
+		}
+		f(issuer)
+		return withIssuer(context.Background(), issuer)
+	}
+
+	// The OrderManager is created on first use, and then reused.
+	ctx := withIssuerConfig(func(*config.Issuer) {})
+	for i := 0; i < 2; i++ {
+		if err := ca.Revoke(ctx, nil, acme.CRLReasonUnspecified); err != nil {
+			t.Fatalf("Revoke() = %v", err)
+		}
+	}
+	if len(created) != 1 {
+		t.Fatalf("Created %d OrderManagers, wanted 1", len(created))
+	}
+
+	// Settings that don't concern the ACME account don't replace it.
+	ctx = withIssuerConfig(func(i *config.Issuer) {
+		i.Key.Spec = ordermanager.KeySpec{Algorithm: ordermanager.RSA}
+	})
+	if err := ca.Revoke(ctx, nil, acme.CRLReasonUnspecified); err != nil {
+		t.Fatalf("Revoke() = %v", err)
+	}
+	if len(created) != 1 {
+		t.Fatalf("Created %d OrderManagers, wanted 1", len(created))
+	}
+
+	// Changing the directory or contacts does.
+	for _, f := range []func(*config.Issuer){
+		func(i *config.Issuer) { i.ACMEDirectory = ordermanager.Staging },
+		func(i *config.Issuer) {
+			i.ACMEDirectory = ordermanager.Staging
+			i.ContactEmails = []string{"admin@example.com"}
+		},
+	} {
+		if err := ca.Revoke(withIssuerConfig(f), nil, acme.CRLReasonUnspecified); err != nil {
+			t.Fatalf("Revoke() = %v", err)
+		}
+	}
+	if len(created) != 3 {
+		t.Fatalf("Created %d OrderManagers, wanted 3", len(created))
+	}
+	if got := created[2].ContactEmails; len(got) != 1 {
+		t.Errorf("ContactEmails = %v, wanted [admin@example.com]", got)
+	}
+
+	// Each issuer has its own OrderManager, alongside the others.
+	ctx = withIssuerConfig(func(i *config.Issuer) {
+		i.Name = "internal"
+		i.ACMEDirectory = "https://ca.internal/acme/directory"
+	})
+	for i := 0; i < 2; i++ {
+		if err := ca.Revoke(ctx, nil, acme.CRLReasonUnspecified); err != nil {
+			t.Fatalf("Revoke() = %v", err)
+		}
+	}
+	if len(created) != 4 || created[3].Name != "internal" {
+		t.Fatalf("Created %d OrderManagers, wanted 4 with the last for internal", len(created))
+	}
+	if len(ca.oms) != 2 {
+		t.Errorf("Holding %d OrderManagers, wanted 2", len(ca.oms))
+	}
+
+	// Failures to create the OrderManager are surfaced.
+	createErr = errors.New("directory unreachable")
+	if err := ca.Revoke(withIssuerConfig(func(*config.Issuer) {}), nil, acme.CRLReasonUnspecified); !errors.Is(err, createErr) {
+		t.Errorf("Revoke() = %v, wanted %v", err, createErr)
+	}
+}
+
+func TestConfiguredACMEShutdown(t *testing.T) {
+	var created []*fakeOM
+	ca := &configuredACME{
+		newOrderManager: func(ctx context.Context, issuer *config.Issuer) (ordermanager.Interface, error) {
+			om := &fakeOM{}
+			created = append(created, om)
+			return om, nil
+		},
+	}
+	withDirectory := func(url string) context.Context {
+		return withIssuer(context.Background(), &config.Issuer{
+			Name:          config.DefaultIssuerName,
+			ACMEDirectory: url,
+		})
+	}
+
+	// The replaced OrderManager is shut down before its replacement is
+	// created, and the current one on Shutdown.
+	for _, url := range []string{ordermanager.Production, ordermanager.Staging} {
+		if err := ca.Revoke(withDirectory(url), nil, acme.CRLReasonUnspecified); err != nil {
+			t.Fatalf("Revoke() = %v", err)
+		}
+	}
+	if len(created) != 2 || !created[0].shutdown || created[1].shutdown {
+		t.Fatalf("Created %d OrderManagers, wanted 2 with the first shut down", len(created))
+	}
+	if err := ca.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if len(created) != 2 {
+		t.Fatalf("Created %d OrderManagers, wanted 2", len(created))
+	}
+	for i, om := range created {
+		if !om.shutdown {
+			t.Errorf("OrderManager %d wasn't shut down", i)
+		}
+	}
+
+	// No OrderManagers are created once we shut down.
+	if err := ca.Revoke(withDirectory("https://ca.internal/acme/directory"), nil, acme.CRLReasonUnspecified); !errors.Is(err, ordermanager.ErrShutdown) {
+		t.Errorf("Revoke() = %v, wanted %v", err, ordermanager.ErrShutdown)
+	}
+	if len(created) != 2 {
+		t.Errorf("Created %d OrderManagers, wanted 2", len(created))
+	}
+}
+
+func TestConfiguredACMEReplacing(t *testing.T) {
+	slow := make(chan struct{})
+	ca := &configuredACME{
+		newOrderManager: func(ctx context.Context, issuer *config.Issuer) (ordermanager.Interface, error) {
+			if issuer.Name == "slow" {
+				<-slow
+			}
+			return &fakeOM{pending: true}, nil
+		},
+	}
+	withName := func(name string) context.Context {
+		return withIssuer(context.Background(), &config.Issuer{
+			Name:          name,
+			ACMEDirectory: ordermanager.Production,
+		})
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := ca.Order(withName("slow"), []string{"example.com"}, nil)
+			errs <- err
+		}()
+	}
+	// The OrderManager of an issuer is created without holding up the others.
+	if _, _, err := ca.Order(withName("fast"), []string{"example.com"}, nil); err != nil {
+		t.Fatalf("Order() = %v", err)
+	}
+
+	// Callers wait for the OrderManager being created, rather than creating
+	// their own.
+	close(slow)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Order() = %v", err)
+		}
+	}
+	if len(ca.oms) != 2 || len(ca.replacing) != 0 {
+		t.Errorf("Holding %d OrderManagers with %d being created, wanted 2 and none", len(ca.oms), len(ca.replacing))
+	}
+}
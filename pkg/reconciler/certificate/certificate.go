@@ -18,6 +18,10 @@ package certificate
 
 import (
 	context "context"
+	"crypto/x509"
+	"errors"
+	"sort"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -25,14 +29,21 @@ import (
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/kubernetes"
 	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
 	"knative.dev/net-http01/pkg/reconciler/certificate/resources"
+	"knative.dev/net-http01/pkg/renewal"
 	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
 	certificate "knative.dev/networking/pkg/client/injection/reconciler/networking/v1alpha1/certificate"
+	controller "knative.dev/pkg/controller"
 	logging "knative.dev/pkg/logging"
 	reconciler "knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
 )
 
 // Reconciler implements controller.Reconciler for Certificate resources.
@@ -41,20 +52,51 @@ type Reconciler struct {
 
 	challengePort int
 
+	// controllerService is the name of the Service in the system namespace
+	// that selects every replica of the controller.
+	controllerService string
+
 	secretLister    corev1listers.SecretLister
 	serviceLister   corev1listers.ServiceLister
 	endpointsLister corev1listers.EndpointsLister
 
 	orderManager ordermanager.Interface
+	renewal      renewal.Policy
+
+	// enqueueAfter schedules the Certificate to be reconciled again.
+	enqueueAfter func(interface{}, time.Duration)
+
+	// backoff tracks the failures to order certificates for each set of
+	// domains, for retries to back off exponentially.
+	backoff workqueue.RateLimiter
 }
 
 // Check that our Reconciler implements Interface
 var _ certificate.Interface = (*Reconciler)(nil)
 
+// forgetDeleted returns the handler for the deletion of Certificates, which
+// drops what we hold for them.
+func (r *Reconciler) forgetDeleted(ctx context.Context) func(interface{}) {
+	return func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		o, ok := obj.(*v1alpha1.Certificate)
+		if !ok {
+			return
+		}
+		r.orderManager.Forget(ctx, o, nil)
+	}
+}
+
 // ReconcileKind implements Interface.ReconcileKind.
 func (r *Reconciler) ReconcileKind(ctx context.Context, o *v1alpha1.Certificate) reconciler.Event {
 	o.Status.InitializeConditions()
 
+	// Leave the orders for domains that the Certificate no longer has to
+	// their other owners, if any.
+	r.orderManager.Forget(ctx, o, o.Spec.DNSNames)
+
 	svc, err := r.reconcileService(ctx, o)
 	if err != nil {
 		return err
@@ -63,35 +105,105 @@ func (r *Reconciler) ReconcileKind(ctx context.Context, o *v1alpha1.Certificate)
 		return err
 	}
 
+	cfg := config.FromContextOrDefaults(ctx).HTTP01
+
+	primary, err := cfg.IssuerFor(o.Namespace, o.Annotations[IssuerAnnotationKey])
+	if err != nil {
+		o.Status.MarkNotReady("UnknownIssuer", err.Error())
+		return controller.NewPermanentError(err)
+	}
+	// Certificates are ordered with the first issuer of the chain, unless
+	// it failed and we failed over to the next.
+	chain := cfg.IssuerChain(primary)
+	issuer := activeIssuer(o, chain)
+	ctx = withIssuer(ctx, issuer)
+
+	kc, err := keyConfigFor(o, issuer.Key)
+	if err != nil {
+		o.Status.MarkNotReady("InvalidKeyConfig", err.Error())
+		return controller.NewPermanentError(err)
+	}
+
 	// Lookup the secret, and ensure that it's contents are still valid.
 	secret, err := r.secretLister.Secrets(o.Namespace).Get(o.Spec.SecretName)
-	if apierrs.IsNotFound(err) {
+	if err != nil && !apierrs.IsNotFound(err) {
+		return err
+	}
+	// Describe the certificate currently in the Secret, whatever becomes
+	// of it.
+	var current *x509.Certificate
+	if secret != nil {
+		current, _ = resources.ParseCertificate(secret)
+	}
+	setCertificateMetadata(o, current)
+	recordExpiration(ctx, o.Namespace, o.Name, current)
+
+	revoked, err := r.reconcileRevocation(ctx, o, secret)
+	if err != nil {
+		o.Status.MarkNotReady("RevocationFailed", err.Error())
+		return err
+	}
+	if revoked {
+		// Never reuse the key of a revoked certificate.
+		kc.RotationPolicy = config.RotateAlways
+	}
+
+	if secret == nil {
 		// We have to create it!
 		logging.FromContext(ctx).Info("Secret doesn't exist, we must provision a new Certificate.")
-	} else if err != nil {
-		return err
-	} else if valid, err := resources.IsValidCertificate(secret, o.Spec.DNSNames, 30*24*time.Hour); err == nil && valid {
+	} else if revoked {
+		logging.FromContext(ctx).Info("Certificate has been revoked.")
+	} else if !inChain(chain, issuerOf(secret)) {
+		logging.FromContext(ctx).Infof("Certificate was issued by %q, rather than %q.", issuerOf(secret), primary.Name)
+	} else if current == nil || !resources.CoversDomains(current, o.Spec.DNSNames) || !kc.Spec.Matches(current.PublicKey) {
+		logging.FromContext(ctx).Info("Certificate is not (or no longer) valid.")
+	} else if d := r.renewal.Decide(withIssuer(ctx, cfg.Issuers[issuerOf(secret)]), current); time.Now().Before(d.RenewAt) {
 		o.Status.MarkReady()
+		setIssuedBy(o, issuerOf(secret))
+		setRenewAt(o, d.RenewAt)
 		o.Status.ObservedGeneration = o.Generation
-		logging.FromContext(ctx).Info("Existing Certificate is valid.")
+		// Look at the Certificate again when it is due for renewal, or when
+		// the CA asked us to check back for an updated renewal window.
+		r.enqueueAfter(o, time.Until(d.Next()))
+		logging.FromContext(ctx).Infof("Existing Certificate is valid, renewing at %v.", d.RenewAt)
 		return nil
 	} else {
-		logging.FromContext(ctx).Info("Certificate is not (or no longer) valid.")
+		logging.FromContext(ctx).Info("Certificate is due for renewal.")
+		// Until the renewal completes the Certificate isn't Ready, so this
+		// is only recorded once per renewal.
+		if o.Status.GetCondition(v1alpha1.CertificateConditionReady).IsTrue() {
+			controller.GetEventRecorder(ctx).Eventf(o, corev1.EventTypeNormal, ReasonRenewalTriggered,
+				"Renewing the certificate, which expires at %s.", current.NotAfter.UTC().Format(time.RFC3339))
+		}
 	}
 
-	// Don't let the OrderManager hang on client calls.
-	// We don't "cancel" this context, because it is passed
-	// to Go routines that extend pass this function's return.
-	// TODO(mattmoor): 5 minutes is too long for this.
-	// nolint
-	ctx, _ = context.WithTimeout(ctx, 5*time.Minute)
-
-	chall, cert, err := r.orderManager.Order(ctx, o.Spec.DNSNames, o)
+	opts := append(keyOrderOptions(ctx, kc, secret),
+		ordermanager.WithSelfCheck(cfg.SelfCheck()),
+		ordermanager.WithOrderTimeout(cfg.OrderTimeout))
+	if current != nil {
+		// Renewals take priority over new certificates while orders are
+		// queued, the sooner the certificate expires the higher.
+		opts = append(opts, ordermanager.WithRenewal(current.NotAfter))
+	}
+	chall, cert, err := r.orderManager.Order(ctx, o.Spec.DNSNames, o, opts...)
 	switch {
-	case err != nil:
+	case errors.Is(err, ordermanager.ErrSelfCheckFailed):
+		o.Status.MarkNotReady("SelfCheckFailed", err.Error())
 		return err
 
+	case errors.Is(err, ordermanager.ErrQueued):
+		// We are notified once it is our turn, but look again in a while
+		// in case that is lost.
+		o.Status.HTTP01Challenges = nil
+		o.Status.MarkNotReady(ordermanager.ReasonQueued, "Waiting for other orders to complete before placing the order.")
+		r.enqueueAfter(o, queuedRecheckDelay)
+
+	case err != nil:
+		return r.orderFailed(ctx, o, cfg, chain, issuer, err)
+
 	case len(chall) != 0:
+		r.backoff.Forget(domainsKey(o.Spec.DNSNames))
+		published := challengeURLs(o.Status.HTTP01Challenges)
 		o.Status.HTTP01Challenges = nil
 		for _, url := range chall {
 			o.Status.HTTP01Challenges = append(o.Status.HTTP01Challenges, v1alpha1.HTTP01Challenge{
@@ -101,31 +213,89 @@ func (r *Reconciler) ReconcileKind(ctx context.Context, o *v1alpha1.Certificate)
 				ServicePort:      intstr.FromInt(80),
 			})
 		}
-		o.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+		o.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
+		if urls := challengeURLs(o.Status.HTTP01Challenges); urls != published {
+			controller.GetEventRecorder(ctx).Eventf(o, corev1.EventTypeNormal, ReasonChallengesPublished,
+				"Published the HTTP01 challenges at %s.", urls)
+		}
 
 	case cert != nil:
 		wantSecret, err := resources.MakeSecret(o, cert)
 		if err != nil {
 			return err
 		}
+		setIssuer(wantSecret, issuer)
+		recorder := controller.GetEventRecorder(ctx)
+		recorder.Event(o, corev1.EventTypeNormal, ReasonCertificateIssued, describeIssued(cert, issuer.Name))
 		if secret == nil {
 			if _, err := r.kubeClient.CoreV1().Secrets(wantSecret.Namespace).Create(ctx, wantSecret, metav1.CreateOptions{}); err != nil {
 				return err
 			}
+			recorder.Eventf(o, corev1.EventTypeNormal, ReasonSecretCreated, "Created Secret %q with the certificate.", wantSecret.Name)
 		} else {
 			secret := secret.DeepCopy()
 			secret.Data = wantSecret.Data
+			setIssuer(secret, issuer)
 			if _, err := r.kubeClient.CoreV1().Secrets(secret.Namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
 				return err
 			}
+			recorder.Eventf(o, corev1.EventTypeNormal, ReasonSecretUpdated, "Updated Secret %q with the certificate.", secret.Name)
 		}
+		r.backoff.Forget(domainsKey(o.Spec.DNSNames))
+		recordIssued(o, cfg, chain, issuer)
+		// The renewal is scheduled when we see the new Secret.
+		setCertificateMetadata(o, cert.Leaf)
+		recordExpiration(ctx, o.Namespace, o.Name, cert.Leaf)
+		delete(o.Status.Annotations, RenewAtAnnotationKey)
 		o.Status.MarkReady()
+
+	default:
+		// The CA deems all of the authorizations valid, so there are no
+		// challenges left to route.
+		r.backoff.Forget(domainsKey(o.Spec.DNSNames))
+		o.Status.HTTP01Challenges = nil
+		o.Status.MarkNotReady(ordermanager.ReasonOrderPending, "Waiting for the CA to complete the order.")
 	}
 
 	o.Status.ObservedGeneration = o.Generation
 	return nil
 }
 
+// orderFailed reflects the failure to order the certificate in the status,
+// and decides when to try again: transient failures are retried, backing
+// off exponentially per set of domains unless the CA asked us to wait for
+// longer, while permanent ones are not.
+func (r *Reconciler) orderFailed(ctx context.Context, o *v1alpha1.Certificate, cfg *config.HTTP01, chain []*config.Issuer, issuer *config.Issuer, err error) error {
+	ec := ordermanager.ClassifyError(err)
+	o.Status.MarkNotReady(ec.Reason, ordermanager.DescribeError(err))
+	if !errors.Is(err, ordermanager.ErrFinalizing) {
+		// Finalizing is progress, rather than a failure.
+		controller.GetEventRecorder(ctx).Event(o, corev1.EventTypeWarning, ec.Reason, ordermanager.DescribeError(err))
+	}
+
+	key := domainsKey(o.Spec.DNSNames)
+	if recordOrderFailure(ctx, o, cfg, chain, issuer, err) {
+		// Start afresh with the next issuer.
+		r.backoff.Forget(key)
+		return controller.NewRequeueImmediately()
+	}
+	if !ec.Transient {
+		return controller.NewPermanentError(err)
+	}
+
+	delay := r.backoff.When(key)
+	if ec.RetryAfter > delay {
+		delay = ec.RetryAfter
+	}
+	logging.FromContext(ctx).Infof("Retrying the order in %v after %s error: %v", delay, ec.Reason, err)
+	return controller.NewRequeueAfter(delay)
+}
+
+// domainsKey identifies the set of domains for backing off.
+func domainsKey(domains []string) string {
+	return strings.Join(sets.NewString(domains...).List(), ",")
+}
+
 func (r *Reconciler) reconcileService(ctx context.Context, o *v1alpha1.Certificate) (*corev1.Service, error) {
 	svc, err := r.serviceLister.Services(o.Namespace).Get(resources.ServiceName(o))
 	if apierrs.IsNotFound(err) {
@@ -150,22 +320,48 @@ func (r *Reconciler) reconcileService(ctx context.Context, o *v1alpha1.Certifica
 }
 
 func (r *Reconciler) reconcileEndpoints(ctx context.Context, o *v1alpha1.Certificate) error {
+	desired := resources.MakeEndpoints(o,
+		resources.WithEndpointsPort(r.challengePort),
+		resources.WithEndpointsAddresses(r.replicaIPs()...))
+
 	if ep, err := r.endpointsLister.Endpoints(o.Namespace).Get(resources.ServiceName(o)); apierrs.IsNotFound(err) {
-		ep = resources.MakeEndpoints(o, resources.WithEndpointsPort(r.challengePort))
-		if _, err := r.kubeClient.CoreV1().Endpoints(o.Namespace).Create(ctx, ep, metav1.CreateOptions{}); err != nil {
+		if _, err := r.kubeClient.CoreV1().Endpoints(o.Namespace).Create(ctx, desired, metav1.CreateOptions{}); err != nil {
 			return err
 		}
 	} else if err != nil {
 		return err
-	} else {
-		desired := resources.MakeEndpoints(o, resources.WithEndpointsPort(r.challengePort))
-		if !equality.Semantic.DeepEqual(ep.Subsets, desired.Subsets) {
-			ep = ep.DeepCopy()
-			ep.Subsets = desired.Subsets
-			if _, err := r.kubeClient.CoreV1().Endpoints(o.Namespace).Update(ctx, ep, metav1.UpdateOptions{}); err != nil {
-				return err
-			}
+	} else if !equality.Semantic.DeepEqual(ep.Subsets, desired.Subsets) {
+		ep = ep.DeepCopy()
+		ep.Subsets = desired.Subsets
+		if _, err := r.kubeClient.CoreV1().Endpoints(o.Namespace).Update(ctx, ep, metav1.UpdateOptions{}); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+// replicaIPs returns the sorted IPs of the ready replicas of the controller,
+// any of which can serve the challenges.  It returns nothing when they are
+// not known, in which case the Endpoints point at this replica alone.
+func (r *Reconciler) replicaIPs() []string {
+	if r.controllerService == "" {
+		return nil
+	}
+	ep, err := r.endpointsLister.Endpoints(system.Namespace()).Get(r.controllerService)
+	if err != nil {
+		return nil
+	}
+	seen := make(map[string]struct{})
+	var ips []string
+	for _, ss := range ep.Subsets {
+		for _, addr := range ss.Addresses {
+			if _, ok := seen[addr.IP]; ok {
+				continue
+			}
+			seen[addr.IP] = struct{}{}
+			ips = append(ips, addr.IP)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
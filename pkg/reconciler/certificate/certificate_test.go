@@ -27,18 +27,26 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"math/big"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	clientgotesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
 	"knative.dev/net-http01/pkg/reconciler/certificate/resources"
+	"knative.dev/net-http01/pkg/renewal"
 	"knative.dev/networking/pkg/apis/networking"
 	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
 	certreconciler "knative.dev/networking/pkg/client/injection/reconciler/networking/v1alpha1/certificate"
@@ -46,6 +54,7 @@ import (
 	configmap "knative.dev/pkg/configmap"
 	controller "knative.dev/pkg/controller"
 	logging "knative.dev/pkg/logging"
+	"knative.dev/pkg/system"
 
 	networkingclient "knative.dev/networking/pkg/client/injection/client/fake"
 	_ "knative.dev/networking/pkg/client/injection/informers/networking/v1alpha1/certificate/fake"
@@ -53,12 +62,16 @@ import (
 	_ "knative.dev/pkg/client/injection/kube/informers/core/v1/endpoints/fake"
 	_ "knative.dev/pkg/client/injection/kube/informers/core/v1/secret/fake"
 	_ "knative.dev/pkg/client/injection/kube/informers/core/v1/service/fake"
+	_ "knative.dev/pkg/system/testing"
 
 	. "knative.dev/net-http01/pkg/reconciler/testing"
 	. "knative.dev/pkg/reconciler/testing"
 )
 
 func TestReconcileMakingOrders(t *testing.T) {
+	valid := makeTLSCert(t, []string{"example.com"}, time.Now().Add(100*24*time.Hour))
+	expiring := makeTLSCert(t, []string{"example.com"}, time.Now().Add(1*time.Hour))
+
 	table := TableTest{{
 		Name: "bad workqueue key",
 		Key:  "too/many/parts",
@@ -74,7 +87,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
 			Object: cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -87,13 +100,43 @@ func TestReconcileMakingOrders(t *testing.T) {
 					}}
 				}),
 		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonChallengesPublished, "Published the HTTP01 challenges at http://example.com/.acme/well-known/gobbledy-gook."),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "not finalized",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withoutFinalizer),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withoutFinalizer,
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
+					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
+						ServiceName:      "kn-cert",
+						ServiceNamespace: "foo",
+						ServicePort:      intstr.FromInt(80),
+						URL: &apis.URL{
+							Scheme: "http",
+							Host:   "example.com",
+							Path:   "/.acme/well-known/gobbledy-gook",
+						},
+					}}
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonChallengesPublished, "Published the HTTP01 challenges at http://example.com/.acme/well-known/gobbledy-gook."),
+		},
 		Key: "foo/kn-cert",
 	}, {
 		Name: "steady state post creation",
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -114,7 +157,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn.cert.io", "foo", withDomains("example.com"), withUID("42-42-42"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -135,7 +178,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -162,7 +205,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -184,6 +227,61 @@ func TestReconcileMakingOrders(t *testing.T) {
 			Object: resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
 		}},
 		Key: "foo/kn-cert",
+	}, {
+		Name: "endpoints point at every replica",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
+					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
+						ServiceName:      "kn-cert",
+						ServiceNamespace: "foo",
+						ServicePort:      intstr.FromInt(80),
+						URL: &apis.URL{
+							Scheme: "http",
+							Host:   "example.com",
+							Path:   "/.acme/well-known/gobbledy-gook",
+						},
+					}}
+				}),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			&corev1.Endpoints{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      ControllerServiceName,
+					Namespace: system.Namespace(),
+				},
+				Subsets: []corev1.EndpointSubset{{
+					Addresses: []corev1.EndpointAddress{{IP: "10.0.0.2"}, {IP: "10.0.0.1"}},
+				}, {
+					Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+				}},
+			},
+		},
+		WantUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com")),
+				resources.WithEndpointsAddresses("10.0.0.1", "10.0.0.2")),
+		}},
+		Key: "foo/kn-cert",
+	}, {
+		Name:    "invalid key annotation",
+		WantErr: true,
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(KeyAlgorithmAnnotationKey, "dsa")),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(KeyAlgorithmAnnotationKey, "dsa"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.InitializeConditions()
+					c.Status.MarkNotReady("InvalidKeyConfig", `unsupported key algorithm "dsa"`)
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `unsupported key algorithm "dsa"`),
+		},
+		Key: "foo/kn-cert",
 	}, {
 		Name:    "error creating service",
 		WantErr: true,
@@ -238,7 +336,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -272,7 +370,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -302,7 +400,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -323,7 +421,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 					Namespace: "foo",
 				},
 				Data: map[string][]byte{
-					corev1.TLSCertKey: makeCert(t, []string{"example.com"}, time.Now().Add(100*24*time.Hour)),
+					corev1.TLSCertKey: makeCert(t, valid),
 				},
 			},
 		},
@@ -342,8 +440,8 @@ func TestReconcileMakingOrders(t *testing.T) {
 						},
 					}}
 					// Becomes ready.
-					c.Status.MarkReady()
-				}),
+					markIssued(c, config.DefaultIssuerName)
+				}, withCertMetadata(valid.Leaf), withRenewAt(valid.Leaf)),
 		}},
 		Key: "foo/kn-cert",
 	}, {
@@ -359,7 +457,7 @@ func TestReconcileMakingOrders(t *testing.T) {
 					Namespace: "foo",
 				},
 				Data: map[string][]byte{
-					corev1.TLSCertKey: makeCert(t, []string{"example.com"}, time.Now().Add(1*time.Hour)),
+					corev1.TLSCertKey: makeCert(t, expiring),
 				},
 			},
 		},
@@ -377,42 +475,258 @@ func TestReconcileMakingOrders(t *testing.T) {
 							Path:   "/.acme/well-known/gobbledy-gook",
 						},
 					}}
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
+				}, withCertMetadata(expiring.Leaf)),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonChallengesPublished, "Published the HTTP01 challenges at http://example.com/.acme/well-known/gobbledy-gook."),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "renewal triggered",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), func(c *v1alpha1.Certificate) {
+				markIssued(c, config.DefaultIssuerName)
+			}, withCertMetadata(expiring.Leaf)),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "kn-cert",
+					Namespace: "foo",
+				},
+				Data: map[string][]byte{
+					corev1.TLSCertKey: makeCert(t, expiring),
+				},
+			},
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"),
+				func(c *v1alpha1.Certificate) {
+					markIssued(c, config.DefaultIssuerName)
+					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
+						ServiceName:      "kn-cert",
+						ServiceNamespace: "foo",
+						ServicePort:      intstr.FromInt(80),
+						URL: &apis.URL{
+							Scheme: "http",
+							Host:   "example.com",
+							Path:   "/.acme/well-known/gobbledy-gook",
+						},
+					}}
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
+				}, withCertMetadata(expiring.Leaf)),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonRenewalTriggered, "Renewing the certificate, which expires at %s.",
+				expiring.Leaf.NotAfter.UTC().Format(time.RFC3339)),
+			Eventf(corev1.EventTypeNormal, ReasonChallengesPublished, "Published the HTTP01 challenges at http://example.com/.acme/well-known/gobbledy-gook."),
+		},
+		Key: "foo/kn-cert",
+	}}
+
+	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+		return newTestReconciler(ctx, listers, &fakeOM{challenges: fakeChallenges})
+	}))
+}
+
+func TestReconcileOrderError(t *testing.T) {
+	unauthorized := &acme.Error{StatusCode: 403, ProblemType: "urn:ietf:params:acme:error:unauthorized", Detail: "Account is not authorized"}
+	validation := &acme.AuthorizationError{
+		URI:        "https://ca.example/authz/1",
+		Identifier: "example.com",
+		Errors: []error{&acme.Error{
+			StatusCode:  403,
+			ProblemType: "urn:ietf:params:acme:error:unauthorized",
+			Detail:      "Invalid response from http://example.com/.well-known/acme-challenge/gobbledy-gook: 404",
+		}},
+	}
+
+	table := TableTest{{
+		Name:    "transient error placing order",
+		WantErr: true,
+		Ctx:     withOrderResult(context.Background(), nil, errors.New("an error")),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonOrderFailed, "an error")
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, ordermanager.ReasonOrderFailed, "an error"),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name:    "permanent error placing order",
+		WantErr: true,
+		Ctx:     withOrderResult(context.Background(), nil, unauthorized),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonUnauthorized, "Account is not authorized")
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, ordermanager.ReasonUnauthorized, "Account is not authorized"),
+			Eventf(corev1.EventTypeWarning, "InternalError", unauthorized.Error()),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name:    "validation failed",
+		WantErr: true,
+		Ctx:     withOrderResult(context.Background(), nil, validation),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonValidationFailed,
+						"Validation of example.com failed: Invalid response from http://example.com/.well-known/acme-challenge/gobbledy-gook: 404")
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, ordermanager.ReasonValidationFailed,
+				"Validation of example.com failed: Invalid response from http://example.com/.well-known/acme-challenge/gobbledy-gook: 404"),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name:    "finalizing",
+		WantErr: true,
+		Ctx:     withOrderResult(context.Background(), nil, ordermanager.ErrFinalizing),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonFinalizing, ordermanager.ErrFinalizing.Error())
+				}),
+		}},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "queued",
+		Ctx:  withOrderResult(context.Background(), nil, ordermanager.ErrQueued),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonQueued, "Waiting for other orders to complete before placing the order.")
 				}),
 		}},
 		Key: "foo/kn-cert",
 	}}
 
 	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
-		r := &Reconciler{
-			kubeClient:      kubeclient.Get(ctx),
-			secretLister:    listers.GetSecretLister(),
-			serviceLister:   listers.GetK8sServiceLister(),
-			endpointsLister: listers.GetEndpointsLister(),
-			challengePort:   8080,
-
-			orderManager: &fakeOM{
-				challenges: []*apis.URL{{
-					Scheme: "http",
-					Host:   "example.com",
-					Path:   "/.acme/well-known/gobbledy-gook",
-				}},
-			},
-		}
+		return newTestReconciler(ctx, listers, fakeOMFrom(ctx))
+	}))
+}
 
-		return certreconciler.NewReconciler(ctx, logging.FromContext(ctx), networkingclient.Get(ctx),
-			listers.GetCertificateLister(), controller.GetEventRecorder(ctx), r, CertificateClassName)
+func TestReconcileNoOutstandingChallenges(t *testing.T) {
+	table := TableTest{{
+		Name: "challenges validated, order pending",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonOrderPending, "Waiting for the CA to complete the order.")
+				}),
+		}},
+		Key: "foo/kn-cert",
+	}}
+
+	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+		return newTestReconciler(ctx, listers, &fakeOM{pending: true})
 	}))
 }
 
-func TestReconcileOrderError(t *testing.T) {
+func TestOrderFailedBackoff(t *testing.T) {
+	ctx := controller.WithEventRecorder(context.Background(), record.NewFakeRecorder(10))
+	cfg := config.FromContextOrDefaults(ctx).HTTP01
+	chain := cfg.IssuerChain(cfg.Issuers[config.DefaultIssuerName])
+	r := &Reconciler{
+		backoff: workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Minute),
+	}
+
+	rateLimited := &acme.Error{
+		StatusCode:  429,
+		ProblemType: "urn:ietf:params:acme:error:rateLimited",
+		Header:      http.Header{"Retry-After": []string{"3600"}},
+	}
+	tests := []struct {
+		name string
+		o    *v1alpha1.Certificate
+		err  error
+		want time.Duration
+	}{{
+		name: "first failure",
+		o:    cert("kn-cert", "foo", withDomains("example.com", "www.example.com")),
+		err:  errors.New("oops"),
+		want: time.Second,
+	}, {
+		name: "second failure",
+		o:    cert("kn-cert", "foo", withDomains("example.com", "www.example.com")),
+		err:  errors.New("oops"),
+		want: 2 * time.Second,
+	}, {
+		name: "same domains, different Certificate",
+		o:    cert("other-cert", "bar", withDomains("www.example.com", "example.com")),
+		err:  errors.New("oops"),
+		want: 4 * time.Second,
+	}, {
+		name: "other domains",
+		o:    cert("kn-cert", "foo", withDomains("example.org")),
+		err:  errors.New("oops"),
+		want: time.Second,
+	}, {
+		name: "retry after",
+		o:    cert("kn-cert", "foo", withDomains("example.com", "www.example.com")),
+		err:  rateLimited,
+		want: time.Hour,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := r.orderFailed(ctx, test.o, cfg, chain, chain[0], test.err)
+			if ok, got := controller.IsRequeueKey(err); !ok || got != test.want {
+				t.Errorf("orderFailed() = %v, wanted a requeue after %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestReconcileSelfCheckFailed(t *testing.T) {
+	selfCheckErr := fmt.Errorf("%w: http://example.com/.acme/well-known/gobbledy-gook: unexpected status 404", ordermanager.ErrSelfCheckFailed)
+
 	table := TableTest{{
-		Name:    "error placing order",
+		Name:    "self-check failed",
 		WantErr: true,
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -427,27 +741,30 @@ func TestReconcileOrderError(t *testing.T) {
 			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
 			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
 		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady("SelfCheckFailed", selfCheckErr.Error())
+					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
+						ServiceName:      "kn-cert",
+						ServiceNamespace: "foo",
+						ServicePort:      intstr.FromInt(80),
+						URL: &apis.URL{
+							Scheme: "http",
+							Host:   "example.com",
+							Path:   "/.acme/well-known/gobbledy-gook",
+						},
+					}}
+				}),
+		}},
 		Key: "foo/kn-cert",
 		WantEvents: []string{
-			Eventf(corev1.EventTypeWarning, "InternalError", "an error"),
+			Eventf(corev1.EventTypeWarning, "InternalError", selfCheckErr.Error()),
 		},
 	}}
 
 	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
-		r := &Reconciler{
-			kubeClient:      kubeclient.Get(ctx),
-			secretLister:    listers.GetSecretLister(),
-			serviceLister:   listers.GetK8sServiceLister(),
-			endpointsLister: listers.GetEndpointsLister(),
-			challengePort:   8080,
-
-			orderManager: &fakeOM{
-				err: errors.New("an error"),
-			},
-		}
-
-		return certreconciler.NewReconciler(ctx, logging.FromContext(ctx), networkingclient.Get(ctx),
-			listers.GetCertificateLister(), controller.GetEventRecorder(ctx), r, CertificateClassName)
+		return newTestReconciler(ctx, listers, &fakeOM{err: selfCheckErr})
 	}))
 }
 
@@ -460,7 +777,7 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -478,6 +795,10 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 		WantCreates: []runtime.Object{
 			mustMakeSecret(t, cert("kn-cert", "foo"), tc),
 		},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonCertificateIssued, describeIssued(tc, config.DefaultIssuerName)),
+			Eventf(corev1.EventTypeNormal, ReasonSecretCreated, `Created Secret "kn-cert" with the certificate.`),
+		},
 		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
 			Object: cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
@@ -492,8 +813,8 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 							Path:   "/.acme/well-known/gobbledy-gook",
 						},
 					}}
-					c.Status.MarkReady()
-				}),
+					markIssued(c, config.DefaultIssuerName)
+				}, withCertMetadata(tc.Leaf)),
 		}},
 		Key: "foo/kn-cert",
 	}, {
@@ -501,7 +822,7 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -522,6 +843,10 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 		WantUpdates: []clientgotesting.UpdateActionImpl{{
 			Object: mustMakeSecret(t, cert("kn-cert", "foo"), tc),
 		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonCertificateIssued, describeIssued(tc, config.DefaultIssuerName)),
+			Eventf(corev1.EventTypeNormal, ReasonSecretUpdated, `Updated Secret "kn-cert" with the certificate.`),
+		},
 		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
 			Object: cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
@@ -536,8 +861,8 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 							Path:   "/.acme/well-known/gobbledy-gook",
 						},
 					}}
-					c.Status.MarkReady()
-				}),
+					markIssued(c, config.DefaultIssuerName)
+				}, withCertMetadata(tc.Leaf)),
 		}},
 		Key: "foo/kn-cert",
 	}, {
@@ -549,7 +874,7 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -568,6 +893,7 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 			mustMakeSecret(t, cert("kn-cert", "foo"), tc),
 		},
 		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonCertificateIssued, describeIssued(tc, config.DefaultIssuerName)),
 			Eventf(corev1.EventTypeWarning, "InternalError", "inducing failure for create secrets"),
 		},
 		Key: "foo/kn-cert",
@@ -580,7 +906,7 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 		Objects: []runtime.Object{
 			cert("kn-cert", "foo", withDomains("example.com"),
 				func(c *v1alpha1.Certificate) {
-					c.Status.MarkNotReady("OrderCert", "Provisioning Certificate through HTTP01 challenges.")
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
 					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
 						ServiceName:      "kn-cert",
 						ServiceNamespace: "foo",
@@ -602,26 +928,14 @@ func TestReconcileOrderFulfillment(t *testing.T) {
 			Object: mustMakeSecret(t, cert("kn-cert", "foo"), tc),
 		}},
 		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonCertificateIssued, describeIssued(tc, config.DefaultIssuerName)),
 			Eventf(corev1.EventTypeWarning, "InternalError", "inducing failure for update secrets"),
 		},
 		Key: "foo/kn-cert",
 	}}
 
 	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
-		r := &Reconciler{
-			kubeClient:      kubeclient.Get(ctx),
-			secretLister:    listers.GetSecretLister(),
-			serviceLister:   listers.GetK8sServiceLister(),
-			endpointsLister: listers.GetEndpointsLister(),
-			challengePort:   8080,
-
-			orderManager: &fakeOM{
-				cert: tc,
-			},
-		}
-
-		return certreconciler.NewReconciler(ctx, logging.FromContext(ctx), networkingclient.Get(ctx),
-			listers.GetCertificateLister(), controller.GetEventRecorder(ctx), r, CertificateClassName)
+		return newTestReconciler(ctx, listers, &fakeOM{cert: tc})
 	}))
 }
 
@@ -635,6 +949,9 @@ func cert(name, namespace string, opts ...certOption) *v1alpha1.Certificate {
 			Annotations: map[string]string{
 				networking.CertificateClassAnnotationKey: CertificateClassName,
 			},
+			// The finalizer has been added by a previous reconciliation, if
+			// Certificates are finalized.
+			Finalizers: []string{finalizerName},
 		},
 		Spec: v1alpha1.CertificateSpec{
 			SecretName: name,
@@ -652,21 +969,99 @@ func withDomains(domains ...string) certOption {
 	}
 }
 
+func withoutFinalizer(c *v1alpha1.Certificate) {
+	c.Finalizers = nil
+}
+
+func withDeletion(c *v1alpha1.Certificate) {
+	c.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+}
+
+func patchFinalizers(namespace, name string, finalizers ...string) clientgotesting.PatchActionImpl {
+	action := clientgotesting.PatchActionImpl{}
+	action.Name = name
+	action.Namespace = namespace
+	quoted := make([]string, 0, len(finalizers))
+	for _, f := range finalizers {
+		quoted = append(quoted, `"`+f+`"`)
+	}
+	action.Patch = []byte(`{"metadata":{"finalizers":[` + strings.Join(quoted, ",") + `],"resourceVersion":""}}`)
+	return action
+}
+
+func withAnnotation(key, value string) certOption {
+	return func(c *v1alpha1.Certificate) {
+		if c.Annotations == nil {
+			c.Annotations = make(map[string]string, 1)
+		}
+		c.Annotations[key] = value
+	}
+}
+
 func withUID(uid types.UID) certOption {
 	return func(c *v1alpha1.Certificate) {
 		c.UID = uid
 	}
 }
 
+// newTestReconciler returns the Reconciler of table tests, which orders
+// certificates through om.
+func newTestReconciler(ctx context.Context, listers *Listers, om ordermanager.Interface, opts ...controller.Options) controller.Reconciler {
+	return certreconciler.NewReconciler(ctx, logging.FromContext(ctx), networkingclient.Get(ctx),
+		listers.GetCertificateLister(), controller.GetEventRecorder(ctx), testReconciler(ctx, listers, om), CertificateClassName, opts...)
+}
+
+// newFinalizingTestReconciler returns the Reconciler of table tests of
+// controllers that revoke the certificates of deleted Certificates.
+func newFinalizingTestReconciler(ctx context.Context, listers *Listers, om ordermanager.Interface) controller.Reconciler {
+	return certreconciler.NewReconciler(ctx, logging.FromContext(ctx), networkingclient.Get(ctx),
+		listers.GetCertificateLister(), controller.GetEventRecorder(ctx), finalizingReconciler{testReconciler(ctx, listers, om)}, CertificateClassName)
+}
+
+// testReconciler returns the Reconciler wrapped by the Reconcilers of table
+// tests.
+func testReconciler(ctx context.Context, listers *Listers, om ordermanager.Interface) *Reconciler {
+	return &Reconciler{
+		kubeClient:      kubeclient.Get(ctx),
+		secretLister:    listers.GetSecretLister(),
+		serviceLister:   listers.GetK8sServiceLister(),
+		endpointsLister: listers.GetEndpointsLister(),
+		challengePort:   8080,
+		renewal:         renewal.New(),
+		enqueueAfter:    func(interface{}, time.Duration) {},
+		backoff:         workqueue.NewItemExponentialFailureRateLimiter(time.Second, time.Minute),
+
+		controllerService: ControllerServiceName,
+
+		orderManager: om,
+	}
+}
+
+// fakeChallenges are the challenges of pending orders in table tests.
+var fakeChallenges = []*apis.URL{{
+	Scheme: "http",
+	Host:   "example.com",
+	Path:   "/.acme/well-known/gobbledy-gook",
+}}
+
 type fakeOM struct {
 	challenges []*apis.URL
 	cert       *tls.Certificate
 	err        error
+	// pending is whether the order is pending without outstanding
+	// challenges.
+	pending bool
+
+	revoked   []acme.CRLReasonCode
+	revokeErr error
+
+	forgotten []interface{}
+	shutdown  bool
 }
 
 var _ ordermanager.Interface = (*fakeOM)(nil)
 
-func (fom *fakeOM) Order(ctx context.Context, domains []string, owner interface{}) ([]*apis.URL, *tls.Certificate, error) {
+func (fom *fakeOM) Order(ctx context.Context, domains []string, owner interface{}, opts ...ordermanager.OrderOption) ([]*apis.URL, *tls.Certificate, error) {
 	switch {
 	case fom.challenges != nil:
 		return fom.challenges, nil, nil
@@ -674,11 +1069,64 @@ func (fom *fakeOM) Order(ctx context.Context, domains []string, owner interface{
 		return nil, fom.cert, nil
 	case fom.err != nil:
 		return nil, nil, fom.err
+	case fom.pending:
+		return nil, nil, nil
 	default:
 		panic("fakeOM was improperly configured")
 	}
 }
 
+func (fom *fakeOM) Revoke(ctx context.Context, der []byte, reason acme.CRLReasonCode) error {
+	if fom.revokeErr != nil {
+		return fom.revokeErr
+	}
+	fom.revoked = append(fom.revoked, reason)
+	return nil
+}
+
+func (fom *fakeOM) Forget(ctx context.Context, owner interface{}, domains []string) {
+	if domains == nil {
+		fom.forgotten = append(fom.forgotten, owner)
+	}
+}
+
+func (fom *fakeOM) Shutdown(ctx context.Context) error {
+	fom.shutdown = true
+	return nil
+}
+
+// orderResultKey is the context key of the result of orders in
+// table tests, which differs per row.
+type orderResultKey struct{}
+
+// withOrderResult sets the result of the orders of the table test row, with
+// which fakeOMFrom configures the fakeOM of the row.
+func withOrderResult(ctx context.Context, cert *tls.Certificate, err error) context.Context {
+	return context.WithValue(ctx, orderResultKey{}, &fakeOM{cert: cert, err: err})
+}
+
+// fakeOMFrom returns a fakeOM with the order result set for the table test
+// row.
+func fakeOMFrom(ctx context.Context) *fakeOM {
+	fom, ok := ctx.Value(orderResultKey{}).(*fakeOM)
+	if !ok {
+		return &fakeOM{}
+	}
+	return &fakeOM{cert: fom.cert, err: fom.err}
+}
+
+func withCertMetadata(cert *x509.Certificate) certOption {
+	return func(c *v1alpha1.Certificate) {
+		setCertificateMetadata(c, cert)
+	}
+}
+
+func withRenewAt(cert *x509.Certificate) certOption {
+	return func(c *v1alpha1.Certificate) {
+		setRenewAt(c, renewal.New().Decide(context.Background(), cert).RenewAt)
+	}
+}
+
 func mustMakeSecret(t *testing.T, o *v1alpha1.Certificate, cert *tls.Certificate, opts ...func(*corev1.Secret)) *corev1.Secret {
 	s, err := resources.MakeSecret(o, cert)
 	if err != nil {
@@ -738,9 +1186,7 @@ func makeTLSCert(t *testing.T, domains []string, expiry time.Time) *tls.Certific
 }
 
 // Based on ./test/conformance/ingress/util.go#L700-L701 in knative/serving
-func makeCert(t *testing.T, domains []string, expiry time.Time) []byte {
-	tc := makeTLSCert(t, domains, expiry)
-
+func makeCert(t *testing.T, tc *tls.Certificate) []byte {
 	certPEM := &bytes.Buffer{}
 	if err := pem.Encode(certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: tc.Leaf.Raw}); err != nil {
 		t.Fatalf("Failed to write data to cert.pem: %s", err)
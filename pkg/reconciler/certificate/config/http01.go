@@ -0,0 +1,164 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/renewal"
+	cm "knative.dev/pkg/configmap"
+)
+
+const (
+	// HTTP01ConfigName is the name of the ConfigMap in the system namespace
+	// that configures the controller.
+	HTTP01ConfigName = "config-http01"
+
+	renewalLifetimeFractionKey = "renewal-lifetime-fraction"
+	orderTimeoutKey            = "order-timeout"
+	selfCheckTimeoutKey        = "self-check-timeout"
+	selfCheckIngressAddressKey = "self-check-ingress-address"
+	failoverFailuresKey        = "failover-failures"
+	failbackOnRenewalKey       = "failback-on-renewal"
+)
+
+// HTTP01 contains the configuration of the controller.
+type HTTP01 struct {
+	// Issuers are the issuers that Certificates may pick from, by name.  It
+	// always contains DefaultIssuerName.
+	Issuers map[string]*Issuer
+
+	// NamespaceIssuers maps namespaces to the name of the issuer used by
+	// the Certificates within them that don't pick one.
+	NamespaceIssuers map[string]string
+
+	// RenewalLifetimeFraction is the fraction of a certificate's lifetime
+	// after which it is renewed, when the CA doesn't suggest a window.
+	RenewalLifetimeFraction float64
+
+	// OrderTimeout bounds how long an order may take, from placing it
+	// until the certificate is issued.
+	OrderTimeout time.Duration
+
+	// SelfCheckTimeout is how long we probe challenges ourselves before
+	// giving up on them.  Zero disables the self-check.
+	SelfCheckTimeout time.Duration
+
+	// SelfCheckIngressAddress is the host:port of the cluster ingress through
+	// which challenges are probed, instead of the challenge's domain.
+	SelfCheckIngressAddress string
+
+	// FailoverFailures is the number of consecutive failures to order a
+	// certificate, through timeouts or errors of the CA, after which the
+	// order fails over to the next fallback issuer.  Rate limits fail over
+	// right away.  Zero disables failover.
+	FailoverFailures int
+
+	// FailbackOnRenewal is whether certificates issued by a fallback issuer
+	// are renewed with the Certificate's own issuer again.
+	FailbackOnRenewal bool
+}
+
+// defaultHTTP01 returns the configuration used for unset keys.
+func defaultHTTP01() *HTTP01 {
+	return &HTTP01{
+		Issuers: map[string]*Issuer{
+			DefaultIssuerName: defaultIssuer(),
+		},
+		NamespaceIssuers:        map[string]string{},
+		RenewalLifetimeFraction: renewal.DefaultLifetimeFraction,
+		OrderTimeout:            5 * time.Minute,
+		SelfCheckTimeout:        ordermanager.DefaultSelfCheck.Timeout,
+		FailoverFailures:        3,
+		FailbackOnRenewal:       true,
+	}
+}
+
+// NewHTTP01FromConfigMap creates an HTTP01 from the supplied ConfigMap.
+func NewHTTP01FromConfigMap(configMap *corev1.ConfigMap) (*HTTP01, error) {
+	c := defaultHTTP01()
+
+	if err := cm.Parse(configMap.Data,
+		cm.AsFloat64(renewalLifetimeFractionKey, &c.RenewalLifetimeFraction),
+		cm.AsDuration(orderTimeoutKey, &c.OrderTimeout),
+		cm.AsDuration(selfCheckTimeoutKey, &c.SelfCheckTimeout),
+		cm.AsString(selfCheckIngressAddressKey, &c.SelfCheckIngressAddress),
+		cm.AsInt(failoverFailuresKey, &c.FailoverFailures),
+		cm.AsBool(failbackOnRenewalKey, &c.FailbackOnRenewal),
+	); err != nil {
+		return nil, fmt.Errorf("failed to parse data: %w", err)
+	}
+	if err := parseIssuers(configMap.Data, c); err != nil {
+		return nil, err
+	}
+
+	if c.RenewalLifetimeFraction <= 0 || c.RenewalLifetimeFraction >= 1 {
+		return nil, fmt.Errorf("%s = %v, must be between 0 and 1", renewalLifetimeFractionKey, c.RenewalLifetimeFraction)
+	}
+	if c.OrderTimeout <= 0 {
+		return nil, fmt.Errorf("%s = %v, must be positive", orderTimeoutKey, c.OrderTimeout)
+	}
+	if c.SelfCheckTimeout < 0 {
+		return nil, fmt.Errorf("%s = %v, must not be negative", selfCheckTimeoutKey, c.SelfCheckTimeout)
+	}
+	if c.FailoverFailures < 0 {
+		return nil, fmt.Errorf("%s = %v, must not be negative", failoverFailuresKey, c.FailoverFailures)
+	}
+	return c, nil
+}
+
+// IssuerFor returns the issuer of a Certificate in the namespace, which
+// picked the named issuer.  Certificates that don't pick one (empty name)
+// use the default of their namespace, or else DefaultIssuerName.
+func (c *HTTP01) IssuerFor(namespace, name string) (*Issuer, error) {
+	if name == "" {
+		name = DefaultIssuerName
+		if n, ok := c.NamespaceIssuers[namespace]; ok {
+			name = n
+		}
+	}
+	issuer, ok := c.Issuers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown issuer %q", name)
+	}
+	return issuer, nil
+}
+
+// IssuerChain returns the issuer followed by its fallback issuers, in the
+// order in which certificates fail over to them.
+func (c *HTTP01) IssuerChain(issuer *Issuer) []*Issuer {
+	chain := []*Issuer{issuer}
+	seen := map[string]bool{issuer.Name: true}
+	for _, name := range issuer.FallbackIssuers {
+		if fallback, ok := c.Issuers[name]; ok && !seen[name] {
+			chain = append(chain, fallback)
+			seen[name] = true
+		}
+	}
+	return chain
+}
+
+// SelfCheck returns the self-check of challenge responses.
+func (c *HTTP01) SelfCheck() ordermanager.SelfCheck {
+	sc := ordermanager.DefaultSelfCheck
+	sc.Timeout = c.SelfCheckTimeout
+	sc.IngressAddress = c.SelfCheckIngressAddress
+	return sc
+}
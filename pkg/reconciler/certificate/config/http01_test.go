@@ -0,0 +1,187 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/pkg/system"
+
+	_ "knative.dev/pkg/system/testing"
+)
+
+func TestHTTP01(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    *HTTP01
+		wantErr bool
+	}{{
+		name: "defaults",
+		want: defaultHTTP01(),
+	}, {
+		name: "everything",
+		data: map[string]string{
+			acmeDirectoryKey:           ordermanager.Staging,
+			contactEmailsKey:           "admin@example.com, ops@example.com",
+			eabSecretNameKey:           "eab",
+			renewalLifetimeFractionKey: "0.5",
+			keyAlgorithmKey:            "rsa",
+			keySizeKey:                 "3072",
+			keyRotationPolicyKey:       "reuse",
+			orderTimeoutKey:            "2m",
+			selfCheckTimeoutKey:        "0s",
+			selfCheckIngressAddressKey: "ingress.example.com:80",
+			failoverFailuresKey:        "1",
+			failbackOnRenewalKey:       "false",
+		},
+		want: &HTTP01{
+			Issuers: map[string]*Issuer{
+				DefaultIssuerName: {
+					Name:          DefaultIssuerName,
+					ACMEDirectory: ordermanager.Staging,
+					ContactEmails: []string{"admin@example.com", "ops@example.com"},
+					EABSecretName: "eab",
+					Key: KeyConfig{
+						Spec:           ordermanager.KeySpec{Algorithm: ordermanager.RSA, Size: 3072},
+						RotationPolicy: ReuseKey,
+					},
+				},
+			},
+			NamespaceIssuers:        map[string]string{},
+			RenewalLifetimeFraction: 0.5,
+			OrderTimeout:            2 * time.Minute,
+			SelfCheckIngressAddress: "ingress.example.com:80",
+			FailoverFailures:        1,
+		},
+	}, {
+		name: "rsa with the default size",
+		data: map[string]string{
+			keyAlgorithmKey: "rsa",
+		},
+		want: func() *HTTP01 {
+			c := defaultHTTP01()
+			c.Issuers[DefaultIssuerName].Key.Spec = ordermanager.KeySpec{Algorithm: ordermanager.RSA}
+			return c
+		}(),
+	}, {
+		name: "empty directory",
+		data: map[string]string{
+			acmeDirectoryKey: "",
+		},
+		wantErr: true,
+	}, {
+		name: "bad renewal fraction",
+		data: map[string]string{
+			renewalLifetimeFractionKey: "1.5",
+		},
+		wantErr: true,
+	}, {
+		name: "unsupported key size",
+		data: map[string]string{
+			keySizeKey: "1024",
+		},
+		wantErr: true,
+	}, {
+		name: "bad rotation policy",
+		data: map[string]string{
+			keyRotationPolicyKey: "sometimes",
+		},
+		wantErr: true,
+	}, {
+		name: "bad order timeout",
+		data: map[string]string{
+			orderTimeoutKey: "0s",
+		},
+		wantErr: true,
+	}, {
+		name: "negative failover failures",
+		data: map[string]string{
+			failoverFailuresKey: "-1",
+		},
+		wantErr: true,
+	}, {
+		name: "unparseable self-check timeout",
+		data: map[string]string{
+			selfCheckTimeoutKey: "soon",
+		},
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NewHTTP01FromConfigMap(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      HTTP01ConfigName,
+					Namespace: system.Namespace(),
+				},
+				Data: test.data,
+			})
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("NewHTTP01FromConfigMap() = %v, wanted error", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("NewHTTP01FromConfigMap() = %v", err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("NewHTTP01FromConfigMap() (-want, +got) = %s", cmp.Diff(test.want, got))
+			}
+		})
+	}
+}
+
+func TestIssuerChain(t *testing.T) {
+	c, err := NewHTTP01FromConfigMap(&corev1.ConfigMap{Data: map[string]string{
+		fallbackIssuersKey:                 "zerossl, internal, zerossl",
+		"issuer.zerossl.acme-directory":    "https://acme.zerossl.com/v2/DV90",
+		"issuer.internal.acme-directory":   "https://ca.internal/acme/directory",
+		"issuer.internal.fallback-issuers": "default",
+	}})
+	if err != nil {
+		t.Fatalf("NewHTTP01FromConfigMap() = %v", err)
+	}
+
+	names := func(chain []*Issuer) []string {
+		var names []string
+		for _, i := range chain {
+			names = append(names, i.Name)
+		}
+		return names
+	}
+	if got, want := names(c.IssuerChain(c.Issuers[DefaultIssuerName])), []string{DefaultIssuerName, "zerossl", "internal"}; !cmp.Equal(got, want) {
+		t.Errorf("IssuerChain(default) = %v, wanted %v", got, want)
+	}
+	if got, want := names(c.IssuerChain(c.Issuers["internal"])), []string{"internal", DefaultIssuerName}; !cmp.Equal(got, want) {
+		t.Errorf("IssuerChain(internal) = %v, wanted %v", got, want)
+	}
+	if got, want := names(c.IssuerChain(c.Issuers["zerossl"])), []string{"zerossl"}; !cmp.Equal(got, want) {
+		t.Errorf("IssuerChain(zerossl) = %v, wanted %v", got, want)
+	}
+
+	if _, err := NewHTTP01FromConfigMap(&corev1.ConfigMap{Data: map[string]string{
+		fallbackIssuersKey: "nope",
+	}}); err == nil {
+		t.Error("NewHTTP01FromConfigMap(unknown fallback) = nil, wanted error")
+	}
+}
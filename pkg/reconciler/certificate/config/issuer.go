@@ -0,0 +1,236 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/net-http01/pkg/ordermanager"
+	cm "knative.dev/pkg/configmap"
+)
+
+const (
+	// DefaultIssuerName is the name of the issuer configured through the
+	// top-level keys of the ConfigMap.
+	DefaultIssuerName = "default"
+
+	// issuerKeyPrefix prefixes the keys that configure the named issuers,
+	// e.g. "issuer.staging.acme-directory".
+	issuerKeyPrefix = "issuer."
+
+	acmeDirectoryKey     = "acme-directory"
+	contactEmailsKey     = "contact-emails"
+	eabSecretNameKey     = "eab-secret-name"
+	keyAlgorithmKey      = "key-algorithm"
+	keySizeKey           = "key-size"
+	keyRotationPolicyKey = "key-rotation-policy"
+	namespacesKey        = "namespaces"
+	fallbackIssuersKey   = "fallback-issuers"
+)
+
+// Issuer is an ACME CA with which certificates are ordered, along with the
+// account used with it.
+type Issuer struct {
+	// Name identifies the issuer.
+	Name string
+
+	// ACMEDirectory is the directory URL of the ACME CA.
+	ACMEDirectory string
+
+	// ContactEmails are the email addresses registered as the contacts of
+	// the ACME account.
+	ContactEmails []string
+
+	// EABSecretName is the name of the Secret in the system namespace that
+	// holds the External Account Binding issued by the CA, if it requires
+	// one.
+	EABSecretName string
+
+	// Key configures the private keys of certificates.
+	Key KeyConfig
+
+	// FallbackIssuers are the names of the issuers that certificates fail
+	// over to, in order, when this issuer keeps failing to issue them.
+	FallbackIssuers []string
+}
+
+func defaultIssuer() *Issuer {
+	return &Issuer{
+		Name:          DefaultIssuerName,
+		ACMEDirectory: ordermanager.Production,
+		Key:           DefaultKeyConfig,
+	}
+}
+
+// Contact returns the contact URLs of the ACME account.
+func (i *Issuer) Contact() []string {
+	contact := make([]string, 0, len(i.ContactEmails))
+	for _, email := range i.ContactEmails {
+		contact = append(contact, "mailto:"+email)
+	}
+	return contact
+}
+
+// AccountSecretName returns the name of the Secret in which the key of the
+// issuer's ACME account is kept.
+func (i *Issuer) AccountSecretName() string {
+	return i.secretName(ordermanager.AccountSecretName)
+}
+
+// OrdersSecretName returns the name of the Secret in which the issuer's
+// in-flight orders are kept.
+func (i *Issuer) OrdersSecretName() string {
+	return i.secretName(ordermanager.OrdersSecretName)
+}
+
+// secretName suffixes the name with that of the issuer, keeping the names
+// of the default issuer's Secrets from before issuers could be named.
+func (i *Issuer) secretName(name string) string {
+	if i.Name == DefaultIssuerName {
+		return name
+	}
+	return name + "-" + i.Name
+}
+
+// parseIssuers parses the default issuer from the top-level keys, and the
+// named issuers from the keys prefixed with their name.  Named issuers
+// inherit the contacts and key settings of the default issuer.
+func parseIssuers(data map[string]string, c *HTTP01) error {
+	if _, ok := data[namespacesKey]; ok {
+		// The default issuer is used wherever no named issuer is.
+		return fmt.Errorf("%s only applies to named issuers, the %q issuer serves the other namespaces", namespacesKey, DefaultIssuerName)
+	}
+	def, _, err := parseIssuer(data, defaultIssuer())
+	if err != nil {
+		return err
+	}
+	c.Issuers = map[string]*Issuer{DefaultIssuerName: def}
+
+	named := map[string]map[string]string{}
+	for k, v := range data {
+		if !strings.HasPrefix(k, issuerKeyPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(k, issuerKeyPrefix), ".", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("malformed issuer key %q, wanted %s<name>.<key>", k, issuerKeyPrefix)
+		}
+		if errs := validation.IsDNS1123Label(parts[0]); len(errs) != 0 {
+			return fmt.Errorf("invalid issuer name %q: %s", parts[0], strings.Join(errs, ", "))
+		}
+		if named[parts[0]] == nil {
+			named[parts[0]] = map[string]string{}
+		}
+		named[parts[0]][parts[1]] = v
+	}
+
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == DefaultIssuerName {
+			return fmt.Errorf("the %q issuer is configured through the top-level keys", DefaultIssuerName)
+		}
+		if _, ok := named[name][acmeDirectoryKey]; !ok {
+			return fmt.Errorf("issuer %q has no %s", name, acmeDirectoryKey)
+		}
+		base := *def
+		base.Name = name
+		base.EABSecretName = ""
+		base.FallbackIssuers = nil
+		issuer, namespaces, err := parseIssuer(named[name], &base)
+		if err != nil {
+			return fmt.Errorf("issuer %q: %w", name, err)
+		}
+		c.Issuers[name] = issuer
+		for _, ns := range namespaces {
+			if other, ok := c.NamespaceIssuers[ns]; ok {
+				return fmt.Errorf("namespace %q is claimed by issuers %q and %q", ns, other, name)
+			}
+			c.NamespaceIssuers[ns] = name
+		}
+	}
+
+	for _, issuer := range c.Issuers {
+		for _, name := range issuer.FallbackIssuers {
+			if _, ok := c.Issuers[name]; !ok {
+				return fmt.Errorf("issuer %q falls back to unknown issuer %q", issuer.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseIssuer parses the issuer's keys on top of the base issuer, returning
+// the issuer and the namespaces that default to it.
+func parseIssuer(data map[string]string, base *Issuer) (*Issuer, []string, error) {
+	i := *base
+
+	var contactEmails, keyRotationPolicy, namespaces, fallbackIssuers string
+	if err := cm.Parse(data,
+		cm.AsString(acmeDirectoryKey, &i.ACMEDirectory),
+		cm.AsString(contactEmailsKey, &contactEmails),
+		cm.AsString(eabSecretNameKey, &i.EABSecretName),
+		cm.AsString(keyAlgorithmKey, &i.Key.Spec.Algorithm),
+		cm.AsInt(keySizeKey, &i.Key.Spec.Size),
+		cm.AsString(keyRotationPolicyKey, &keyRotationPolicy),
+		cm.AsString(namespacesKey, &namespaces),
+		cm.AsString(fallbackIssuersKey, &fallbackIssuers),
+	); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse data: %w", err)
+	}
+
+	if _, ok := data[contactEmailsKey]; ok {
+		i.ContactEmails = splitList(contactEmails)
+	}
+	if _, ok := data[keyAlgorithmKey]; ok && i.Key.Spec.Algorithm != base.Key.Spec.Algorithm {
+		if _, ok := data[keySizeKey]; !ok {
+			// The base size is for another algorithm.
+			i.Key.Spec.Size = 0
+		}
+	}
+	if keyRotationPolicy != "" {
+		i.Key.RotationPolicy = KeyRotationPolicy(keyRotationPolicy)
+	}
+	if _, ok := data[fallbackIssuersKey]; ok {
+		i.FallbackIssuers = splitList(fallbackIssuers)
+	}
+
+	if i.ACMEDirectory == "" {
+		return nil, nil, fmt.Errorf("%s must not be empty", acmeDirectoryKey)
+	}
+	if err := i.Key.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return &i, splitList(namespaces), nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
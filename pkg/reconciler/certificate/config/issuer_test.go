@@ -0,0 +1,210 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/net-http01/pkg/ordermanager"
+)
+
+func TestIssuers(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           map[string]string
+		wantIssuers    map[string]*Issuer
+		wantNamespaces map[string]string
+		wantErr        bool
+	}{{
+		name: "named issuers inherit from the default",
+		data: map[string]string{
+			contactEmailsKey:                      "admin@example.com",
+			eabSecretNameKey:                      "eab",
+			keyRotationPolicyKey:                  "reuse",
+			"issuer.staging.acme-directory":       ordermanager.Staging,
+			"issuer.staging.namespaces":           "dev, test",
+			"issuer.internal.acme-directory":      "https://ca.internal/acme/directory",
+			"issuer.internal.contact-emails":      "pki@example.com",
+			"issuer.internal.eab-secret-name":     "internal-eab",
+			"issuer.internal.key-algorithm":       "rsa",
+			"issuer.internal.key-rotation-policy": "always",
+		},
+		wantIssuers: map[string]*Issuer{
+			DefaultIssuerName: {
+				Name:          DefaultIssuerName,
+				ACMEDirectory: ordermanager.Production,
+				ContactEmails: []string{"admin@example.com"},
+				EABSecretName: "eab",
+				Key:           KeyConfig{Spec: ordermanager.DefaultKeySpec, RotationPolicy: ReuseKey},
+			},
+			"staging": {
+				Name:          "staging",
+				ACMEDirectory: ordermanager.Staging,
+				ContactEmails: []string{"admin@example.com"},
+				Key:           KeyConfig{Spec: ordermanager.DefaultKeySpec, RotationPolicy: ReuseKey},
+			},
+			"internal": {
+				Name:          "internal",
+				ACMEDirectory: "https://ca.internal/acme/directory",
+				ContactEmails: []string{"pki@example.com"},
+				EABSecretName: "internal-eab",
+				Key:           KeyConfig{Spec: ordermanager.KeySpec{Algorithm: ordermanager.RSA}, RotationPolicy: RotateAlways},
+			},
+		},
+		wantNamespaces: map[string]string{
+			"dev":  "staging",
+			"test": "staging",
+		},
+	}, {
+		name: "named issuer without a directory",
+		data: map[string]string{
+			"issuer.staging.contact-emails": "admin@example.com",
+		},
+		wantErr: true,
+	}, {
+		name: "malformed key",
+		data: map[string]string{
+			"issuer.staging": ordermanager.Staging,
+		},
+		wantErr: true,
+	}, {
+		name: "invalid name",
+		data: map[string]string{
+			"issuer.Staging.acme-directory": ordermanager.Staging,
+		},
+		wantErr: true,
+	}, {
+		name: "redefined default",
+		data: map[string]string{
+			"issuer.default.acme-directory": ordermanager.Staging,
+		},
+		wantErr: true,
+	}, {
+		name: "namespaces of the default",
+		data: map[string]string{
+			"namespaces": "dev",
+		},
+		wantErr: true,
+	}, {
+		name: "bad key settings",
+		data: map[string]string{
+			"issuer.staging.acme-directory": ordermanager.Staging,
+			"issuer.staging.key-size":       "1024",
+		},
+		wantErr: true,
+	}, {
+		name: "namespace claimed twice",
+		data: map[string]string{
+			"issuer.staging.acme-directory":  ordermanager.Staging,
+			"issuer.staging.namespaces":      "dev",
+			"issuer.internal.acme-directory": "https://ca.internal/acme/directory",
+			"issuer.internal.namespaces":     "dev",
+		},
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NewHTTP01FromConfigMap(&corev1.ConfigMap{Data: test.data})
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("NewHTTP01FromConfigMap() = %v, wanted error", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("NewHTTP01FromConfigMap() = %v", err)
+			}
+			if !cmp.Equal(got.Issuers, test.wantIssuers) {
+				t.Errorf("Issuers (-want, +got) = %s", cmp.Diff(test.wantIssuers, got.Issuers))
+			}
+			if !cmp.Equal(got.NamespaceIssuers, test.wantNamespaces) {
+				t.Errorf("NamespaceIssuers (-want, +got) = %s", cmp.Diff(test.wantNamespaces, got.NamespaceIssuers))
+			}
+		})
+	}
+}
+
+func TestIssuerFor(t *testing.T) {
+	c, err := NewHTTP01FromConfigMap(&corev1.ConfigMap{Data: map[string]string{
+		"issuer.staging.acme-directory": ordermanager.Staging,
+		"issuer.staging.namespaces":     "dev",
+	}})
+	if err != nil {
+		t.Fatalf("NewHTTP01FromConfigMap() = %v", err)
+	}
+
+	tests := []struct {
+		namespace string
+		name      string
+		want      string
+		wantErr   bool
+	}{{
+		namespace: "prod",
+		want:      DefaultIssuerName,
+	}, {
+		namespace: "dev",
+		want:      "staging",
+	}, {
+		namespace: "prod",
+		name:      "staging",
+		want:      "staging",
+	}, {
+		namespace: "dev",
+		name:      DefaultIssuerName,
+		want:      DefaultIssuerName,
+	}, {
+		namespace: "prod",
+		name:      "internal",
+		wantErr:   true,
+	}}
+
+	for _, test := range tests {
+		got, err := c.IssuerFor(test.namespace, test.name)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("IssuerFor(%q, %q) = %v, wanted error", test.namespace, test.name, got.Name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("IssuerFor(%q, %q) = %v", test.namespace, test.name, err)
+			continue
+		}
+		if got.Name != test.want {
+			t.Errorf("IssuerFor(%q, %q) = %s, wanted %s", test.namespace, test.name, got.Name, test.want)
+		}
+	}
+}
+
+func TestIssuerSecretNames(t *testing.T) {
+	def := &Issuer{Name: DefaultIssuerName, ContactEmails: []string{"admin@example.com"}}
+	if got, want := def.AccountSecretName(), ordermanager.AccountSecretName; got != want {
+		t.Errorf("AccountSecretName() = %s, wanted %s", got, want)
+	}
+	if got, want := def.Contact(), []string{"mailto:admin@example.com"}; !cmp.Equal(got, want) {
+		t.Errorf("Contact() = %v, wanted %v", got, want)
+	}
+
+	staging := &Issuer{Name: "staging"}
+	if got, want := staging.AccountSecretName(), ordermanager.AccountSecretName+"-staging"; got != want {
+		t.Errorf("AccountSecretName() = %s, wanted %s", got, want)
+	}
+	if got, want := staging.OrdersSecretName(), ordermanager.OrdersSecretName+"-staging"; got != want {
+		t.Errorf("OrdersSecretName() = %s, wanted %s", got, want)
+	}
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+
+	"knative.dev/net-http01/pkg/ordermanager"
+)
+
+// KeyRotationPolicy determines whether the private key of a Certificate is
+// rotated when the Certificate is renewed.
+type KeyRotationPolicy string
+
+const (
+	// RotateAlways generates a new private key for every certificate.
+	RotateAlways KeyRotationPolicy = "always"
+
+	// ReuseKey keeps the private key already in the Secret, as long as it
+	// matches the desired key algorithm and size.
+	ReuseKey KeyRotationPolicy = "reuse"
+)
+
+// KeyConfig configures the private keys of certificates.  Certificates may
+// override it through annotations.
+type KeyConfig struct {
+	Spec           ordermanager.KeySpec
+	RotationPolicy KeyRotationPolicy
+}
+
+// DefaultKeyConfig is the KeyConfig used when none is configured.
+var DefaultKeyConfig = KeyConfig{
+	Spec:           ordermanager.DefaultKeySpec,
+	RotationPolicy: RotateAlways,
+}
+
+// Validate checks that the KeyConfig is supported.
+func (kc KeyConfig) Validate() error {
+	if err := kc.Spec.Validate(); err != nil {
+		return err
+	}
+	switch kc.RotationPolicy {
+	case RotateAlways, ReuseKey:
+		return nil
+	default:
+		return fmt.Errorf("unsupported key rotation policy %q", kc.RotationPolicy)
+	}
+}
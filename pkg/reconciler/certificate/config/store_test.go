@@ -0,0 +1,58 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/pkg/system"
+
+	logtesting "knative.dev/pkg/logging/testing"
+)
+
+func TestStoreLoadWithContext(t *testing.T) {
+	store := NewStore(logtesting.TestLogger(t))
+
+	store.OnConfigChanged(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      HTTP01ConfigName,
+			Namespace: system.Namespace(),
+		},
+		Data: map[string]string{
+			acmeDirectoryKey: ordermanager.Staging,
+		},
+	})
+
+	cfg := FromContext(store.ToContext(context.Background()))
+	if got := cfg.HTTP01.Issuers[DefaultIssuerName].ACMEDirectory; got != ordermanager.Staging {
+		t.Errorf("ACMEDirectory = %s, wanted %s", got, ordermanager.Staging)
+	}
+}
+
+func TestFromContextOrDefaults(t *testing.T) {
+	if cfg := FromContext(context.Background()); cfg != nil {
+		t.Errorf("FromContext() = %v, wanted nil", cfg)
+	}
+	cfg := FromContextOrDefaults(context.Background())
+	if got := cfg.HTTP01.Issuers[DefaultIssuerName].ACMEDirectory; got != ordermanager.Production {
+		t.Errorf("ACMEDirectory = %s, wanted %s", got, ordermanager.Production)
+	}
+}
@@ -18,13 +18,18 @@ package certificate
 
 import (
 	context "context"
+	"sync"
 	"time"
 
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 	"knative.dev/net-http01/pkg/challenger"
 	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
 	"knative.dev/networking/pkg/apis/networking"
 	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+	networkingclient "knative.dev/networking/pkg/client/injection/client"
 	certificate "knative.dev/networking/pkg/client/injection/informers/networking/v1alpha1/certificate"
 	v1alpha1certificate "knative.dev/networking/pkg/client/injection/reconciler/networking/v1alpha1/certificate"
 	kubeclient "knative.dev/pkg/client/injection/kube/client"
@@ -35,16 +40,51 @@ import (
 	controller "knative.dev/pkg/controller"
 	logging "knative.dev/pkg/logging"
 	"knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
 )
 
 const CertificateClassName = "net-http01.certificate.networking.knative.dev"
 
+// ControllerServiceName is the name of the Service in the system namespace
+// that selects every replica of the controller.  The challenge Endpoints
+// are populated with its addresses.
+const ControllerServiceName = "net-http01-controller"
+
+// orderRetryBaseDelay and orderRetryMaxDelay bound the exponential backoff
+// of retrying failed orders.
+const (
+	orderRetryBaseDelay = 10 * time.Second
+	orderRetryMaxDelay  = time.Hour
+)
+
+// queuedRecheckDelay is how long Certificates whose order is queued wait
+// before asking for their turn again.
+const queuedRecheckDelay = time.Minute
+
+// shutdownTimeout bounds winding down the in-flight orders as the
+// controller stops, or their OrderManager is replaced.  It leaves time to
+// deactivate authorizations past the 30 seconds that the OrderManager gives
+// unregistering challenges, and is within the terminationGracePeriodSeconds
+// of the controller.
+const shutdownTimeout = 45 * time.Second
+
+type shutdownKey struct{}
+
+// WithShutdownWaitGroup returns a context with which NewController adds the
+// winding down of the in-flight orders, as the controller stops, to wg, so
+// that the process can wait for it before exiting.
+func WithShutdownWaitGroup(ctx context.Context, wg *sync.WaitGroup) context.Context {
+	return context.WithValue(ctx, shutdownKey{}, wg)
+}
+
 // NewController creates a Reconciler for Certificate and returns the result of NewImpl.
 func NewController(
 	ctx context.Context,
 	cmw configmap.Watcher,
 	chlr challenger.Interface,
 	challengePort int,
+	revokeOnDelete bool,
+	opts ...ordermanager.Option,
 ) *controller.Impl {
 	certificateInformer := certificate.Get(ctx)
 	secretInformer := secretinformer.Get(ctx)
@@ -60,17 +100,72 @@ func NewController(
 		serviceLister:   serviceInformer.Lister(),
 		endpointsLister: endpointsInformer.Lister(),
 		challengePort:   challengePort,
+
+		controllerService: ControllerServiceName,
 	}
-	impl := v1alpha1certificate.NewImpl(ctx, r, CertificateClassName, func(impl *controller.Impl) controller.Options {
+	// Certificates are only finalized when their certificates are revoked
+	// on deletion.
+	var rec v1alpha1certificate.Interface = r
+	if revokeOnDelete {
+		rec = finalizingReconciler{r}
+	}
+	impl := v1alpha1certificate.NewImpl(ctx, rec, CertificateClassName, func(impl *controller.Impl) controller.Options {
+		configStore := config.NewStore(logging.FromContext(ctx).Named("config-store"))
+		configStore.WatchConfigs(cmw)
 		return controller.Options{
+			ConfigStore:       configStore,
 			PromoteFilterFunc: classFilterFunc,
 		}
 	})
+	r.enqueueAfter = impl.EnqueueAfter
+	r.backoff = workqueue.NewItemExponentialFailureRateLimiter(orderRetryBaseDelay, orderRetryMaxDelay)
+
+	// The OrderManager and renewal Policy are created for the ACME settings
+	// of the current config, when they are first needed.  The work on the
+	// orders lasts as long as the controller.
+	ca := &configuredACME{
+		newOrderManager: newOrderManager(impl, chlr,
+			append([]ordermanager.Option{ordermanager.WithContext(ctx)}, opts...)),
+	}
+	r.orderManager = ca
+	r.renewal = ca
+	// Wind down the in-flight orders as the controller stops.
+	wg, _ := ctx.Value(shutdownKey{}).(*sync.WaitGroup)
+	if wg == nil {
+		wg = &sync.WaitGroup{}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		ctx, cancel := context.WithTimeout(logging.WithLogger(context.Background(), logging.FromContext(ctx)), shutdownTimeout)
+		defer cancel()
+		if err := ca.Shutdown(ctx); err != nil {
+			logging.FromContext(ctx).Errorf("Error shutting down the OrderManagers: %v", err)
+		}
+	}()
 
 	certificateInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
 		FilterFunc: classFilterFunc,
 		Handler:    controller.HandleAll(impl.Enqueue),
 	})
+	// Drop what we hold for Certificates once they are gone, whether or not
+	// they were finalized.
+	certificateInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: r.forgetDeleted(ctx),
+	})
+
+	if !revokeOnDelete {
+		// Let go of the Certificates that were finalized before.
+		release := releaseFinalizer(ctx, networkingclient.Get(ctx))
+		certificateInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: classFilterFunc,
+			Handler: cache.ResourceEventHandlerFuncs{
+				AddFunc:    release,
+				UpdateFunc: controller.PassNew(release),
+			},
+		})
+	}
 
 	secretInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
 		FilterFunc: controller.FilterController(&v1alpha1.Certificate{}),
@@ -84,16 +179,58 @@ func NewController(
 		FilterFunc: controller.FilterController(&v1alpha1.Certificate{}),
 		Handler:    controller.HandleAll(impl.EnqueueControllerOf),
 	})
+	// When the set of replicas changes, repoint the challenge Endpoints.
+	endpointsInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithNameAndNamespace(system.Namespace(), ControllerServiceName),
+		Handler: controller.HandleAll(func(interface{}) {
+			impl.FilteredGlobalResync(classFilterFunc, certificateInformer.Informer())
+		}),
+	})
+
+	return impl
+}
+
+// newOrderManager returns a function that creates an OrderManager for the
+// ACME directory and account of the issuer.
+func newOrderManager(impl *controller.Impl, chlr challenger.Interface, opts []ordermanager.Option) func(context.Context, *config.Issuer) (ordermanager.Interface, error) {
+	return func(ctx context.Context, issuer *config.Issuer) (ordermanager.Interface, error) {
+		// Don't let the OrderManager hang on client calls.
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
 
-	// Don't let the OrderManager hang on client calls.
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+		kc := kubeclient.Get(ctx)
+		reg := ordermanager.Registration{Contact: issuer.Contact()}
+		if issuer.EABSecretName != "" {
+			eab, err := ordermanager.LoadExternalAccountBinding(ctx, kc, system.Namespace(), issuer.EABSecretName)
+			if err != nil {
+				return nil, err
+			}
+			reg.ExternalAccountBinding = eab
+		}
 
-	om, err := ordermanager.New(ctx, impl.Enqueue, chlr)
-	if err != nil {
-		logging.FromContext(ctx).Fatalf("Error creating OrderManager: %v", err)
+		logging.FromContext(ctx).Infof("Creating OrderManager for issuer %q at %s", issuer.Name, issuer.ACMEDirectory)
+		keys := ordermanager.NewSecretAccountKeyStore(kc, system.Namespace(), issuer.AccountSecretName())
+		return ordermanager.New(ctx, enqueueOwner(impl), chlr, keys, append([]ordermanager.Option{
+			ordermanager.WithEventCallback(recordOwnerEvent),
+			ordermanager.WithDirectoryURL(issuer.ACMEDirectory),
+			ordermanager.WithRegistration(reg),
+			ordermanager.WithOrderStore(ordermanager.NewSecretOrderStore(kc, system.Namespace(), issuer.OrdersSecretName())),
+		}, opts...)...)
 	}
-	r.orderManager = om
+}
 
-	return impl
+// enqueueOwner returns an OrderUpCallback that enqueues the owning Certificate.
+// Owners of orders resumed after a restart are identified by their key.
+func enqueueOwner(impl *controller.Impl) ordermanager.OrderUpCallback {
+	return func(owner interface{}) {
+		switch o := owner.(type) {
+		case nil:
+			// The order was resumed before its owner reconciled, and the
+			// owner will pick up the result when it does.
+		case types.NamespacedName:
+			impl.EnqueueKey(o)
+		default:
+			impl.Enqueue(o)
+		}
+	}
 }
@@ -19,28 +19,35 @@ package certificate
 import (
 	"testing"
 
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"knative.dev/net-http01/pkg/challenger"
 	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
 	configmap "knative.dev/pkg/configmap"
+	"knative.dev/pkg/system"
 
 	. "knative.dev/pkg/reconciler/testing"
 )
 
 func TestNewController(t *testing.T) {
 	ctx, _ := SetupFakeContext(t)
-	configMapWatcher := configmap.NewStaticWatcher()
+	configMapWatcher := configmap.NewStaticWatcher(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      config.HTTP01ConfigName,
+			Namespace: system.Namespace(),
+		},
+		Data: map[string]string{
+			"acme-directory": ordermanager.Staging,
+		},
+	})
 
 	chlr, err := challenger.New(ctx)
 	if err != nil {
 		t.Fatalf("challenger.New() = %v", err)
 	}
 
-	ordermanager.Endpoint = ordermanager.Staging
-	defer func() {
-		ordermanager.Endpoint = ordermanager.Production
-	}()
-
-	c := NewController(ctx, configMapWatcher, chlr, 1234)
+	c := NewController(ctx, configMapWatcher, chlr, 1234, false)
 	if c == nil {
 		t.Fatal("Expected NewController to return a non-nil value")
 	}
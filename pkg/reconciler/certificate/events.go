@@ -0,0 +1,87 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+	controller "knative.dev/pkg/controller"
+)
+
+// The reasons of the Events recorded on Certificates as they are issued.
+// Failed orders are recorded with the reason of the failure, as classified
+// by ordermanager.ClassifyError.
+const (
+	// ReasonChallengesPublished is the reason of publishing new HTTP01
+	// challenges in the status.
+	ReasonChallengesPublished = "ChallengesPublished"
+
+	// ReasonCertificateIssued is the reason of the CA issuing a certificate.
+	ReasonCertificateIssued = "CertificateIssued"
+
+	// ReasonSecretCreated is the reason of creating the Secret with the
+	// issued certificate.
+	ReasonSecretCreated = "SecretCreated"
+
+	// ReasonSecretUpdated is the reason of updating the Secret with the
+	// issued certificate.
+	ReasonSecretUpdated = "SecretUpdated"
+
+	// ReasonRenewalTriggered is the reason of starting to renew a
+	// certificate that is due for renewal.
+	ReasonRenewalTriggered = "RenewalTriggered"
+)
+
+// recordOwnerEvent is an ordermanager.EventCallback that records the
+// progress of orders as Events on the Certificates that placed them.
+func recordOwnerEvent(ctx context.Context, owner interface{}, reason, message string) {
+	// Owners of orders resumed after a restart are only known by their key,
+	// until they are reconciled.
+	o, ok := owner.(runtime.Object)
+	if !ok {
+		return
+	}
+	if recorder := controller.GetEventRecorder(ctx); recorder != nil {
+		recorder.Event(o, corev1.EventTypeNormal, reason, message)
+	}
+}
+
+// challengeURLs returns the URLs of the HTTP01 challenges, for comparing
+// and describing them.
+func challengeURLs(chall []v1alpha1.HTTP01Challenge) string {
+	urls := make([]string, 0, len(chall))
+	for _, c := range chall {
+		urls = append(urls, c.URL.String())
+	}
+	return strings.Join(urls, ", ")
+}
+
+// describeIssued describes the certificate issued by the issuer.
+func describeIssued(cert *tls.Certificate, issuer string) string {
+	if cert.Leaf == nil {
+		return fmt.Sprintf("Issued by %q.", issuer)
+	}
+	return fmt.Sprintf("Issued by %q, serial number %s, valid until %s.",
+		issuer, serialOf(cert.Leaf), cert.Leaf.NotAfter.UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/net-http01/pkg/ordermanager"
+	controller "knative.dev/pkg/controller"
+)
+
+func TestRecordOwnerEvent(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	ctx := controller.WithEventRecorder(context.Background(), recorder)
+
+	recordOwnerEvent(ctx, cert("kn-cert", "foo"), ordermanager.ReasonOrderStarted, "Placed order.")
+	// Owners only known by their key are skipped.
+	recordOwnerEvent(ctx, types.NamespacedName{Namespace: "foo", Name: "kn-cert"}, ordermanager.ReasonOrderStarted, "Placed order.")
+	// As are events without a recorder.
+	recordOwnerEvent(context.Background(), cert("kn-cert", "foo"), ordermanager.ReasonOrderStarted, "Placed order.")
+
+	close(recorder.Events)
+	var got []string
+	for e := range recorder.Events {
+		got = append(got, e)
+	}
+	if want := "Normal OrderStarted Placed order."; len(got) != 1 || got[0] != want {
+		t.Errorf("Events = %q, wanted [%q]", got, want)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"golang.org/x/crypto/acme"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+	logging "knative.dev/pkg/logging"
+)
+
+const (
+	// IssuedByAnnotationKey is the status annotation that names the issuer
+	// of the Certificate's current certificate.
+	IssuedByAnnotationKey = "net-http01.networking.knative.dev/issued-by"
+
+	// activeIssuerAnnotationKey is the status annotation that names the
+	// fallback issuer with which the Certificate is ordered, after its own
+	// issuer failed.
+	activeIssuerAnnotationKey = "net-http01.networking.knative.dev/active-issuer"
+
+	// issuerFailuresAnnotationKey is the status annotation that counts the
+	// consecutive failures to order the certificate with the active issuer.
+	issuerFailuresAnnotationKey = "net-http01.networking.knative.dev/issuer-failures"
+)
+
+// activeIssuer returns the issuer in the chain with which the certificate is
+// ordered: the one failed over to, if any, or else the Certificate's own.
+func activeIssuer(o *v1alpha1.Certificate, chain []*config.Issuer) *config.Issuer {
+	if name, ok := o.Status.Annotations[activeIssuerAnnotationKey]; ok {
+		for _, issuer := range chain {
+			if issuer.Name == name {
+				return issuer
+			}
+		}
+	}
+	return chain[0]
+}
+
+// inChain checks whether the named issuer is in the chain.
+func inChain(chain []*config.Issuer, name string) bool {
+	for _, issuer := range chain {
+		if issuer.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverCause classifies the error of an order, returning whether it
+// counts towards failing over, and whether it fails over right away.
+func failoverCause(err error) (counts, immediate bool) {
+	switch ordermanager.ClassifyError(err).Reason {
+	case ordermanager.ReasonRateLimited:
+		return true, true
+	case ordermanager.ReasonServerError:
+		return true, false
+	case ordermanager.ReasonConnectionFailed, ordermanager.ReasonDNSFailed:
+		// We failed to reach the CA, unless it is the CA that failed to
+		// reach us to validate the challenges.
+		var ae *acme.Error
+		return !errors.As(err, &ae), false
+	}
+	// Otherwise the CA rejected what we asked for.
+	return false, false
+}
+
+// recordOrderFailure counts the failure to order the certificate with the
+// issuer, and fails over to the next issuer in the chain once the CA has
+// failed often enough.  After the last issuer, we go back to the first.  It
+// returns whether it failed over.
+func recordOrderFailure(ctx context.Context, o *v1alpha1.Certificate, cfg *config.HTTP01, chain []*config.Issuer, issuer *config.Issuer, err error) bool {
+	counts, immediate := failoverCause(err)
+	if !counts || cfg.FailoverFailures == 0 || len(chain) < 2 {
+		return false
+	}
+
+	failures, _ := strconv.Atoi(o.Status.Annotations[issuerFailuresAnnotationKey])
+	failures++
+	if o.Status.Annotations == nil {
+		o.Status.Annotations = make(map[string]string, 2)
+	}
+	if !immediate && failures < cfg.FailoverFailures {
+		o.Status.Annotations[issuerFailuresAnnotationKey] = strconv.Itoa(failures)
+		return false
+	}
+
+	next := chain[0]
+	for i, candidate := range chain {
+		if candidate.Name == issuer.Name {
+			next = chain[(i+1)%len(chain)]
+			break
+		}
+	}
+	logging.FromContext(ctx).Warnf("Failing over from issuer %q to %q after %d failure(s): %v", issuer.Name, next.Name, failures, err)
+	delete(o.Status.Annotations, issuerFailuresAnnotationKey)
+	setActiveIssuer(o, chain, next)
+	o.Status.MarkNotReady("FailingOver", fmt.Sprintf("Failing over from issuer %q to %q: %v", issuer.Name, next.Name, err))
+	return true
+}
+
+// recordIssued records that the issuer issued the certificate.  Unless the
+// Certificate fails back to its own issuer on renewal, it sticks with the
+// issuer.
+func recordIssued(o *v1alpha1.Certificate, cfg *config.HTTP01, chain []*config.Issuer, issuer *config.Issuer) {
+	setIssuedBy(o, issuer.Name)
+	delete(o.Status.Annotations, issuerFailuresAnnotationKey)
+	if cfg.FailbackOnRenewal {
+		setActiveIssuer(o, chain, chain[0])
+	}
+}
+
+// setActiveIssuer records the issuer with which the certificate is ordered.
+func setActiveIssuer(o *v1alpha1.Certificate, chain []*config.Issuer, issuer *config.Issuer) {
+	if issuer.Name == chain[0].Name {
+		delete(o.Status.Annotations, activeIssuerAnnotationKey)
+		return
+	}
+	if o.Status.Annotations == nil {
+		o.Status.Annotations = make(map[string]string, 1)
+	}
+	o.Status.Annotations[activeIssuerAnnotationKey] = issuer.Name
+}
+
+// setIssuedBy records the issuer of the Certificate's current certificate.
+func setIssuedBy(o *v1alpha1.Certificate, name string) {
+	if o.Status.Annotations == nil {
+		o.Status.Annotations = make(map[string]string, 1)
+	}
+	o.Status.Annotations[IssuedByAnnotationKey] = name
+}
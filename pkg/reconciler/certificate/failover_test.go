@@ -0,0 +1,244 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+	"knative.dev/net-http01/pkg/reconciler/certificate/resources"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+	configmap "knative.dev/pkg/configmap"
+	controller "knative.dev/pkg/controller"
+
+	. "knative.dev/net-http01/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+func markIssued(c *v1alpha1.Certificate, issuer string) {
+	c.Status.MarkReady()
+	setIssuedBy(c, issuer)
+}
+
+func withStatusAnnotation(key, value string) certOption {
+	return func(c *v1alpha1.Certificate) {
+		if c.Status.Annotations == nil {
+			c.Status.Annotations = make(map[string]string, 1)
+		}
+		c.Status.Annotations[key] = value
+	}
+}
+
+func TestFailoverCause(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantCounts    bool
+		wantImmediate bool
+	}{{
+		name:          "rate limited",
+		err:           fmt.Errorf("ordering: %w", &acme.Error{StatusCode: 429, ProblemType: "urn:ietf:params:acme:error:rateLimited"}),
+		wantCounts:    true,
+		wantImmediate: true,
+	}, {
+		name:          "rate limited, pre-RFC 8555",
+		err:           &acme.Error{StatusCode: 429, ProblemType: "urn:acme:error:rateLimited"},
+		wantCounts:    true,
+		wantImmediate: true,
+	}, {
+		name:       "server error",
+		err:        &acme.Error{StatusCode: 503, ProblemType: "urn:ietf:params:acme:error:serverInternal"},
+		wantCounts: true,
+	}, {
+		name: "rejected",
+		err:  &acme.Error{StatusCode: 400, ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier"},
+	}, {
+		name:       "timeout",
+		err:        fmt.Errorf("waiting for order: %w", context.DeadlineExceeded),
+		wantCounts: true,
+	}, {
+		name:       "network error",
+		err:        &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+		wantCounts: true,
+	}, {
+		name: "validation connection failed",
+		err:  &acme.Error{StatusCode: 400, ProblemType: "urn:ietf:params:acme:error:connection"},
+	}, {
+		name: "self check",
+		err:  ordermanager.ErrSelfCheckFailed,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counts, immediate := failoverCause(test.err)
+			if counts != test.wantCounts || immediate != test.wantImmediate {
+				t.Errorf("failoverCause() = %v, %v, wanted %v, %v", counts, immediate, test.wantCounts, test.wantImmediate)
+			}
+		})
+	}
+}
+
+func TestReconcileFailover(t *testing.T) {
+	tc := makeTLSCert(t, []string{"example.com"}, time.Now().Add(100*24*time.Hour))
+	serverErr := &acme.Error{StatusCode: 503, ProblemType: "urn:ietf:params:acme:error:serverInternal"}
+	rateLimitErr := &acme.Error{StatusCode: 429, ProblemType: "urn:ietf:params:acme:error:rateLimited"}
+
+	table := TableTest{{
+		Name:    "failure is counted",
+		WantErr: true,
+		Ctx:     withOrderResult(context.Background(), nil, serverErr),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				withStatusAnnotation(issuerFailuresAnnotationKey, "1"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonServerError, serverErr.Error())
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, ordermanager.ReasonServerError, ordermanager.DescribeError(serverErr)),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name:    "fail over after repeated failures",
+		WantErr: true,
+		Ctx:     withOrderResult(context.Background(), nil, serverErr),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				withStatusAnnotation(issuerFailuresAnnotationKey, "1")),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				withStatusAnnotation(activeIssuerAnnotationKey, "backup"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady("FailingOver", fmt.Sprintf(`Failing over from issuer "default" to "backup": %v`, serverErr))
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, ordermanager.ReasonServerError, ordermanager.DescribeError(serverErr)),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name:    "fail over right away when rate limited",
+		WantErr: true,
+		Ctx:     withOrderResult(context.Background(), nil, rateLimitErr),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				withStatusAnnotation(activeIssuerAnnotationKey, "backup"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady("FailingOver", fmt.Sprintf(`Failing over from issuer "default" to "backup": %v`, rateLimitErr))
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, ordermanager.ReasonRateLimited, ordermanager.DescribeError(rateLimitErr)),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name:    "the last issuer fails over to the first",
+		WantErr: true,
+		Ctx:     withOrderResult(context.Background(), nil, rateLimitErr),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				withStatusAnnotation(activeIssuerAnnotationKey, "backup")),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					c.Status.Annotations = map[string]string{}
+					c.Status.MarkNotReady("FailingOver", fmt.Sprintf(`Failing over from issuer "backup" to "default": %v`, rateLimitErr))
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, ordermanager.ReasonRateLimited, ordermanager.DescribeError(rateLimitErr)),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "issued by the fallback, failing back on renewal",
+		Ctx:  withOrderResult(context.Background(), tc, nil),
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				withStatusAnnotation(activeIssuerAnnotationKey, "backup")),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantCreates: []runtime.Object{
+			mustMakeSecret(t, cert("kn-cert", "foo"), tc, issuedBy("backup")),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					markIssued(c, "backup")
+				}, withCertMetadata(tc.Leaf)),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonCertificateIssued, describeIssued(tc, "backup")),
+			Eventf(corev1.EventTypeNormal, ReasonSecretCreated, `Created Secret "kn-cert" with the certificate.`),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "certificate of the fallback is kept",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			mustMakeSecret(t, cert("kn-cert", "foo"), tc, issuedBy("backup")),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					markIssued(c, "backup")
+				}, withCertMetadata(tc.Leaf), withRenewAt(tc.Leaf)),
+		}},
+		Key: "foo/kn-cert",
+	}}
+
+	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+		cfg, err := config.NewHTTP01FromConfigMap(&corev1.ConfigMap{Data: map[string]string{
+			"fallback-issuers":             "backup",
+			"failover-failures":            "2",
+			"issuer.backup.acme-directory": ordermanager.Staging,
+		}})
+		if err != nil {
+			t.Fatalf("NewHTTP01FromConfigMap() = %v", err)
+		}
+		return newTestReconciler(ctx, listers, fakeOMFrom(ctx),
+			controller.Options{ConfigStore: &testConfigStore{config: &config.Config{HTTP01: cfg}}})
+	}))
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+)
+
+// IssuerAnnotationKey is the annotation through which a Certificate picks
+// the issuer of its certificate, by the name under which the issuer is
+// configured in the config-http01 ConfigMap.  Certificates without it use
+// the default issuer of their namespace.  It is also set on the Secrets of
+// certificates that weren't issued by the default issuer.
+const IssuerAnnotationKey = "net-http01.networking.knative.dev/issuer"
+
+type issuerKey struct{}
+
+// withIssuer attaches the issuer to the context, for the OrderManager and
+// renewal Policy to use.
+func withIssuer(ctx context.Context, issuer *config.Issuer) context.Context {
+	return context.WithValue(ctx, issuerKey{}, issuer)
+}
+
+// issuerFromContext returns the issuer attached to the context, or else the
+// default issuer.
+func issuerFromContext(ctx context.Context) *config.Issuer {
+	if issuer, ok := ctx.Value(issuerKey{}).(*config.Issuer); ok {
+		return issuer
+	}
+	return config.FromContextOrDefaults(ctx).HTTP01.Issuers[config.DefaultIssuerName]
+}
+
+// issuerOf returns the name of the issuer of the certificate in the Secret.
+func issuerOf(secret *corev1.Secret) string {
+	if name, ok := secret.Annotations[IssuerAnnotationKey]; ok {
+		return name
+	}
+	return config.DefaultIssuerName
+}
+
+// withSecretIssuer attaches the issuer of the certificate in the Secret to
+// the context, failing when that issuer is no longer configured.
+func withSecretIssuer(ctx context.Context, secret *corev1.Secret) (context.Context, error) {
+	name := issuerOf(secret)
+	issuer, ok := config.FromContextOrDefaults(ctx).HTTP01.Issuers[name]
+	if !ok {
+		return ctx, fmt.Errorf("issuer %q of the certificate is no longer configured", name)
+	}
+	return withIssuer(ctx, issuer), nil
+}
+
+// setIssuer records the issuer of the certificate in the Secret.
+func setIssuer(secret *corev1.Secret, issuer *config.Issuer) {
+	if issuer.Name == config.DefaultIssuerName {
+		delete(secret.Annotations, IssuerAnnotationKey)
+		return
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = make(map[string]string, 1)
+	}
+	secret.Annotations[IssuerAnnotationKey] = issuer.Name
+}
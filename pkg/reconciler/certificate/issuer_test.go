@@ -0,0 +1,146 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+	"knative.dev/net-http01/pkg/reconciler/certificate/resources"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+	configmap "knative.dev/pkg/configmap"
+	controller "knative.dev/pkg/controller"
+
+	. "knative.dev/net-http01/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+// testConfigStore attaches a fixed Config to the context.
+type testConfigStore struct {
+	config *config.Config
+}
+
+func (t *testConfigStore) ToContext(ctx context.Context) context.Context {
+	return config.ToContext(ctx, t.config)
+}
+
+func issuedBy(name string) func(*corev1.Secret) {
+	return func(s *corev1.Secret) {
+		s.Annotations = map[string]string{IssuerAnnotationKey: name}
+	}
+}
+
+func TestReconcileIssuers(t *testing.T) {
+	cfg, err := config.NewHTTP01FromConfigMap(&corev1.ConfigMap{Data: map[string]string{
+		"issuer.staging.acme-directory": ordermanager.Staging,
+		"issuer.staging.namespaces":     "dev",
+	}})
+	if err != nil {
+		t.Fatalf("NewHTTP01FromConfigMap() = %v", err)
+	}
+	tc := makeTLSCert(t, []string{"example.com"}, time.Now().Add(100*24*time.Hour))
+
+	table := TableTest{{
+		Name:    "unknown issuer",
+		WantErr: true,
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(IssuerAnnotationKey, "internal")),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(IssuerAnnotationKey, "internal"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.InitializeConditions()
+					c.Status.MarkNotReady("UnknownIssuer", `unknown issuer "internal"`)
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `unknown issuer "internal"`),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "certificate of another issuer is replaced",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(IssuerAnnotationKey, "staging"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			mustMakeSecret(t, cert("kn-cert", "foo"), tc),
+		},
+		WantUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: mustMakeSecret(t, cert("kn-cert", "foo"), tc, issuedBy("staging")),
+		}},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(IssuerAnnotationKey, "staging"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					markIssued(c, "staging")
+				}, withCertMetadata(tc.Leaf)),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonCertificateIssued, describeIssued(tc, "staging")),
+			Eventf(corev1.EventTypeNormal, ReasonSecretUpdated, `Updated Secret "kn-cert" with the certificate.`),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "namespace default issuer",
+		Objects: []runtime.Object{
+			cert("kn-cert", "dev", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "dev", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "dev", withDomains("example.com"))),
+		},
+		WantCreates: []runtime.Object{
+			mustMakeSecret(t, cert("kn-cert", "dev"), tc, issuedBy("staging")),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "dev", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					markIssued(c, "staging")
+				}, withCertMetadata(tc.Leaf)),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonCertificateIssued, describeIssued(tc, "staging")),
+			Eventf(corev1.EventTypeNormal, ReasonSecretCreated, `Created Secret "kn-cert" with the certificate.`),
+		},
+		Key: "dev/kn-cert",
+	}, {
+		Name: "certificate of the issuer is kept",
+		Objects: []runtime.Object{
+			cert("kn-cert", "dev", withDomains("example.com"), withChallenges),
+			resources.MakeService(cert("kn-cert", "dev", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "dev", withDomains("example.com"))),
+			mustMakeSecret(t, cert("kn-cert", "dev"), tc, issuedBy("staging")),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "dev", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					markIssued(c, "staging")
+				}, withCertMetadata(tc.Leaf), withRenewAt(tc.Leaf)),
+		}},
+		Key: "dev/kn-cert",
+	}}
+
+	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+		return newTestReconciler(ctx, listers, &fakeOM{cert: tc},
+			controller.Options{ConfigStore: &testConfigStore{config: &config.Config{HTTP01: cfg}}})
+	}))
+}
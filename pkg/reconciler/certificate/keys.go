@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+	"knative.dev/net-http01/pkg/reconciler/certificate/resources"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+	logging "knative.dev/pkg/logging"
+)
+
+const (
+	// KeyAlgorithmAnnotationKey is the annotation through which a Certificate
+	// picks the algorithm of its private key, one of "rsa" or "ecdsa".
+	KeyAlgorithmAnnotationKey = "net-http01.networking.knative.dev/key-algorithm"
+
+	// KeySizeAnnotationKey is the annotation through which a Certificate
+	// picks the size of its private key.
+	KeySizeAnnotationKey = "net-http01.networking.knative.dev/key-size"
+
+	// KeyRotationPolicyAnnotationKey is the annotation through which a
+	// Certificate picks whether its private key is rotated on renewal.
+	KeyRotationPolicyAnnotationKey = "net-http01.networking.knative.dev/key-rotation-policy"
+)
+
+// keyConfigFor applies the Certificate's annotations to the defaults.
+func keyConfigFor(o *v1alpha1.Certificate, defaults config.KeyConfig) (config.KeyConfig, error) {
+	kc := defaults
+	if alg, ok := o.Annotations[KeyAlgorithmAnnotationKey]; ok {
+		kc.Spec.Algorithm = alg
+		if alg != defaults.Spec.Algorithm {
+			// The default size is for another algorithm.
+			kc.Spec.Size = 0
+		}
+	}
+	if size, ok := o.Annotations[KeySizeAnnotationKey]; ok {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return config.KeyConfig{}, fmt.Errorf("invalid %s annotation %q: %w", KeySizeAnnotationKey, size, err)
+		}
+		kc.Spec.Size = n
+	}
+	if policy, ok := o.Annotations[KeyRotationPolicyAnnotationKey]; ok {
+		kc.RotationPolicy = config.KeyRotationPolicy(policy)
+	}
+	if err := kc.Validate(); err != nil {
+		return config.KeyConfig{}, err
+	}
+	return kc, nil
+}
+
+// keyOrderOptions returns the options for the private key of the certificate,
+// which reuse the private key within the existing Secret when configured to.
+func keyOrderOptions(ctx context.Context, kc config.KeyConfig, secret *corev1.Secret) []ordermanager.OrderOption {
+	opts := []ordermanager.OrderOption{ordermanager.WithKeySpec(kc.Spec)}
+	if kc.RotationPolicy != config.ReuseKey || secret == nil {
+		return opts
+	}
+	if key, err := resources.ParsePrivateKey(secret); err != nil {
+		logging.FromContext(ctx).Warnf("Unable to reuse the existing private key, a new one will be generated: %v", err)
+	} else if key != nil {
+		opts = append(opts, ordermanager.WithPrivateKey(key))
+	}
+	return opts
+}
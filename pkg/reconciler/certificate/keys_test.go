@@ -0,0 +1,164 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+	"knative.dev/net-http01/pkg/reconciler/certificate/resources"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+func TestKeyConfigFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaults    config.KeyConfig
+		annotations map[string]string
+		want        config.KeyConfig
+		wantErr     bool
+	}{{
+		name:     "defaults",
+		defaults: config.DefaultKeyConfig,
+		want:     config.DefaultKeyConfig,
+	}, {
+		name:     "rsa with the default size",
+		defaults: config.DefaultKeyConfig,
+		annotations: map[string]string{
+			KeyAlgorithmAnnotationKey: "rsa",
+		},
+		want: config.KeyConfig{
+			Spec:           ordermanager.KeySpec{Algorithm: ordermanager.RSA},
+			RotationPolicy: config.RotateAlways,
+		},
+	}, {
+		name:     "rsa 4096, reused",
+		defaults: config.DefaultKeyConfig,
+		annotations: map[string]string{
+			KeyAlgorithmAnnotationKey:      "rsa",
+			KeySizeAnnotationKey:           "4096",
+			KeyRotationPolicyAnnotationKey: "reuse",
+		},
+		want: config.KeyConfig{
+			Spec:           ordermanager.KeySpec{Algorithm: ordermanager.RSA, Size: 4096},
+			RotationPolicy: config.ReuseKey,
+		},
+	}, {
+		name: "size only",
+		defaults: config.KeyConfig{
+			Spec:           ordermanager.KeySpec{Algorithm: ordermanager.RSA, Size: 2048},
+			RotationPolicy: config.ReuseKey,
+		},
+		annotations: map[string]string{
+			KeySizeAnnotationKey: "3072",
+		},
+		want: config.KeyConfig{
+			Spec:           ordermanager.KeySpec{Algorithm: ordermanager.RSA, Size: 3072},
+			RotationPolicy: config.ReuseKey,
+		},
+	}, {
+		name:     "bad size",
+		defaults: config.DefaultKeyConfig,
+		annotations: map[string]string{
+			KeySizeAnnotationKey: "big",
+		},
+		wantErr: true,
+	}, {
+		name:     "unsupported size",
+		defaults: config.DefaultKeyConfig,
+		annotations: map[string]string{
+			KeySizeAnnotationKey: "2048",
+		},
+		wantErr: true,
+	}, {
+		name:     "bad rotation policy",
+		defaults: config.DefaultKeyConfig,
+		annotations: map[string]string{
+			KeyRotationPolicyAnnotationKey: "sometimes",
+		},
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := cert("kn-cert", "foo", func(c *v1alpha1.Certificate) {
+				c.Annotations = test.annotations
+			})
+			got, err := keyConfigFor(o, test.defaults)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("keyConfigFor() = %v, wanted error", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("keyConfigFor() = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("keyConfigFor() = %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOrderOptionsReuseKey(t *testing.T) {
+	ctx := context.Background()
+	o := cert("kn-cert", "foo", withDomains("example.com"))
+	secret, err := resources.MakeSecret(o, makeTLSCert(t, []string{"example.com"}, time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("MakeSecret() = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		kc     config.KeyConfig
+		secret *corev1.Secret
+		want   int
+	}{{
+		name:   "rotate",
+		kc:     config.DefaultKeyConfig,
+		secret: secret,
+		want:   1,
+	}, {
+		name:   "reuse",
+		kc:     config.KeyConfig{Spec: ordermanager.DefaultKeySpec, RotationPolicy: config.ReuseKey},
+		secret: secret,
+		want:   2,
+	}, {
+		name: "reuse without a secret",
+		kc:   config.KeyConfig{Spec: ordermanager.DefaultKeySpec, RotationPolicy: config.ReuseKey},
+		want: 1,
+	}, {
+		name: "reuse with a bad key",
+		kc:   config.KeyConfig{Spec: ordermanager.DefaultKeySpec, RotationPolicy: config.ReuseKey},
+		secret: &corev1.Secret{Data: map[string][]byte{
+			corev1.TLSPrivateKeyKey: []byte("garbage"),
+		}},
+		want: 1,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := len(keyOrderOptions(ctx, test.kc, test.secret)); got != test.want {
+				t.Errorf("len(keyOrderOptions()) = %d, wanted %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+// The status annotations describing the certificate in the Certificate's
+// Secret, next to Status.NotAfter.
+const (
+	// SerialNumberAnnotationKey is the hex encoded serial number of the
+	// certificate.
+	SerialNumberAnnotationKey = "net-http01.networking.knative.dev/serial-number"
+
+	// FingerprintAnnotationKey is the hex encoded SHA-256 fingerprint of the
+	// certificate.
+	FingerprintAnnotationKey = "net-http01.networking.knative.dev/sha256-fingerprint"
+
+	// CertificateIssuerAnnotationKey is the distinguished name of the CA
+	// certificate that signed the certificate.
+	CertificateIssuerAnnotationKey = "net-http01.networking.knative.dev/certificate-issuer"
+
+	// RenewAtAnnotationKey is when the certificate is scheduled to be
+	// renewed, in RFC 3339 format.
+	RenewAtAnnotationKey = "net-http01.networking.knative.dev/renew-at"
+)
+
+// setCertificateMetadata describes the certificate in the status of the
+// Certificate, or clears the description when there is no certificate.
+func setCertificateMetadata(o *v1alpha1.Certificate, cert *x509.Certificate) {
+	if cert == nil {
+		o.Status.NotAfter = nil
+		for _, k := range []string{SerialNumberAnnotationKey, FingerprintAnnotationKey, CertificateIssuerAnnotationKey, RenewAtAnnotationKey} {
+			delete(o.Status.Annotations, k)
+		}
+		return
+	}
+
+	o.Status.NotAfter = &metav1.Time{Time: cert.NotAfter}
+	if o.Status.Annotations == nil {
+		o.Status.Annotations = make(map[string]string, 4)
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	o.Status.Annotations[SerialNumberAnnotationKey] = serialOf(cert)
+	o.Status.Annotations[FingerprintAnnotationKey] = hex.EncodeToString(fingerprint[:])
+	o.Status.Annotations[CertificateIssuerAnnotationKey] = cert.Issuer.String()
+}
+
+// setRenewAt records when the certificate is scheduled to be renewed.
+func setRenewAt(o *v1alpha1.Certificate, renewAt time.Time) {
+	if o.Status.Annotations == nil {
+		o.Status.Annotations = make(map[string]string, 1)
+	}
+	o.Status.Annotations[RenewAtAnnotationKey] = renewAt.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestCertificateMetadata(t *testing.T) {
+	tc := makeTLSCert(t, []string{"example.com"}, time.Now().Add(100*24*time.Hour))
+	o := cert("kn-cert", "foo", withDomains("example.com"), withStatusAnnotation(IssuedByAnnotationKey, "default"))
+
+	setCertificateMetadata(o, tc.Leaf)
+	renewAt := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	setRenewAt(o, renewAt)
+
+	if got, want := o.Status.NotAfter.Time, tc.Leaf.NotAfter; !got.Equal(want) {
+		t.Errorf("NotAfter = %v, wanted %v", got, want)
+	}
+	fingerprint := sha256.Sum256(tc.Leaf.Raw)
+	for k, want := range map[string]string{
+		SerialNumberAnnotationKey:      serialOf(tc.Leaf),
+		FingerprintAnnotationKey:       hex.EncodeToString(fingerprint[:]),
+		CertificateIssuerAnnotationKey: "O=Knative Ingress Conformance Testing",
+		RenewAtAnnotationKey:           "2020-06-01T12:00:00Z",
+	} {
+		if got := o.Status.Annotations[k]; got != want {
+			t.Errorf("Annotations[%s] = %q, wanted %q", k, got, want)
+		}
+	}
+
+	// Without a certificate, only the description of the certificate goes.
+	setCertificateMetadata(o, nil)
+	if o.Status.NotAfter != nil {
+		t.Errorf("NotAfter = %v, wanted nil", o.Status.NotAfter)
+	}
+	if got, want := len(o.Status.Annotations), 1; got != want {
+		t.Errorf("Annotations = %v, wanted only %s", o.Status.Annotations, IssuedByAnnotationKey)
+	}
+}
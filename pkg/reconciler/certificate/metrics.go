@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"crypto/x509"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/pkg/metrics"
+	"knative.dev/pkg/metrics/metricskey"
+)
+
+var (
+	// certificateNotAfterM is when the certificate in the Certificate's
+	// Secret expires, as a Unix timestamp, so that the time left is
+	// computed at query time rather than going stale between reconciles.
+	certificateNotAfterM = stats.Float64(
+		"certificate_expiration_timestamp_seconds",
+		"The time at which the certificate expires, in seconds since the Unix epoch",
+		stats.UnitSeconds)
+
+	namespaceKey = tag.MustNewKey(metricskey.LabelNamespaceName)
+	nameKey      = tag.MustNewKey("certificate_name")
+)
+
+func init() {
+	if err := view.Register(&view.View{
+		Description: certificateNotAfterM.Description(),
+		Measure:     certificateNotAfterM,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{namespaceKey, nameKey},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// recordExpiration records when the given certificate of the named
+// Certificate expires.
+func recordExpiration(ctx context.Context, namespace, name string, cert *x509.Certificate) {
+	if cert == nil {
+		return
+	}
+	ctx, err := tag.New(ctx,
+		tag.Insert(namespaceKey, namespace),
+		tag.Insert(nameKey, name))
+	if err != nil {
+		return
+	}
+	metrics.Record(ctx, certificateNotAfterM.M(float64(cert.NotAfter.Unix())))
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/pkg/metrics"
+)
+
+func TestRecordExpiration(t *testing.T) {
+	metrics.InitForTesting()
+	ctx := context.Background()
+
+	// Nothing is recorded without a certificate.
+	recordExpiration(ctx, "ns", "none", nil)
+	notAfter := time.Now().Add(time.Hour)
+	recordExpiration(ctx, "ns", "cert", &x509.Certificate{NotAfter: time.Now().Add(-time.Hour)})
+	recordExpiration(ctx, "ns", "cert", &x509.Certificate{NotAfter: notAfter})
+
+	rows, err := view.RetrieveData(certificateNotAfterM.Name())
+	if err != nil {
+		t.Fatalf("RetrieveData() = %v", err)
+	}
+	got := map[string]float64{}
+	for _, row := range rows {
+		tags := map[tag.Key]string{}
+		for _, tg := range row.Tags {
+			tags[tg.Key] = tg.Value
+		}
+		if tags[namespaceKey] == "ns" {
+			got[tags[nameKey]] = row.Data.(*view.LastValueData).Value
+		}
+	}
+	if _, ok := got["none"]; ok {
+		t.Error("Recorded an expiration without a certificate")
+	}
+	// The last value wins.
+	if got, want := got["cert"], float64(notAfter.Unix()); got != want {
+		t.Errorf("expiration = %v, wanted %v", got, want)
+	}
+}
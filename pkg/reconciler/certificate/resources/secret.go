@@ -18,12 +18,12 @@ package resources
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"time"
 
 	"knative.dev/networking/pkg/apis/networking"
 	"knative.dev/networking/pkg/apis/networking/v1alpha1"
@@ -34,12 +34,11 @@ import (
 	"k8s.io/apimachinery/pkg/util/sets"
 )
 
-// IsValidCertificate checks whether the certificate within the given Secret is
-// valid for a list of domains with at least the specified minimum lifespan
-// remaining in the NotAfter field.
-func IsValidCertificate(s *corev1.Secret, domains []string, minimumLifespan time.Duration) (bool, error) {
+// ParseCertificate returns the leaf certificate within the given Secret,
+// or nil if the Secret doesn't hold one.
+func ParseCertificate(s *corev1.Secret) (*x509.Certificate, error) {
 	if s.Data == nil {
-		return false, nil
+		return nil, nil
 	}
 
 	// TODO(#9): Consider checking the private key as well, in case someone messed with it.
@@ -47,28 +46,40 @@ func IsValidCertificate(s *corev1.Secret, domains []string, minimumLifespan time
 	// Crack open the certificate key.
 	certPEM, ok := s.Data[corev1.TLSCertKey]
 	if !ok {
-		return false, nil
+		return nil, nil
 	}
 	certBlock, _ := pem.Decode(certPEM)
 	if certBlock == nil {
-		return false, fmt.Errorf("%q is not PEM encoded", corev1.TLSCertKey)
+		return nil, fmt.Errorf("%q is not PEM encoded", corev1.TLSCertKey)
 	}
-	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	return x509.ParseCertificate(certBlock.Bytes)
+}
+
+// ParsePrivateKey returns the private key within the given Secret, or nil
+// if the Secret doesn't hold one.
+func ParsePrivateKey(s *corev1.Secret) (crypto.Signer, error) {
+	keyPEM, ok := s.Data[corev1.TLSPrivateKeyKey]
+	if !ok {
+		return nil, nil
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("%q is not PEM encoded", corev1.TLSPrivateKeyKey)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-
-	// Check whether all of the domains that we want covered are listed in the certificate.
-	certDomains := sets.NewString(cert.DNSNames...)
-	if !certDomains.HasAll(domains...) {
-		return false, nil
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
 	}
+	return signer, nil
+}
 
-	// Compute the remaining useful lifespan of the certificate.
-	lifespanLeft := time.Until(cert.NotAfter)
-
-	// See if it is useful for at least our minimum.
-	return lifespanLeft >= minimumLifespan, nil
+// CoversDomains checks whether all of the domains are listed in the certificate.
+func CoversDomains(cert *x509.Certificate, domains []string) bool {
+	return sets.NewString(cert.DNSNames...).HasAll(domains...)
 }
 
 // MakeSecret creates a TLS-type secret from the given tls.Certificate.
@@ -211,13 +211,12 @@ func makeCert(t *testing.T, domains []string, expiry time.Time) []byte {
 	return certPEM.Bytes()
 }
 
-func TestIsValid(t *testing.T) {
+func TestCoversDomains(t *testing.T) {
 	tests := []struct {
-		name            string
-		secret          *corev1.Secret
-		domains         []string
-		minimumLifespan time.Duration
-		want            *bool // nil means we want an error
+		name    string
+		secret  *corev1.Secret
+		domains []string
+		want    *bool // nil means we want an error
 	}{{
 		name: "empty secret is invalid",
 		secret: &corev1.Secret{
@@ -264,9 +263,8 @@ func TestIsValid(t *testing.T) {
 		},
 		want: nil, // want an error
 	}, {
-		name:            "missing domain",
-		domains:         []string{"foo.com", "example.com"},
-		minimumLifespan: 10 * time.Minute,
+		name:    "missing domain",
+		domains: []string{"foo.com", "example.com"},
 		secret: &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "foo",
@@ -278,23 +276,8 @@ func TestIsValid(t *testing.T) {
 		},
 		want: ptr.Bool(false),
 	}, {
-		name:            "insufficient time left",
-		domains:         []string{"example.com"},
-		minimumLifespan: 10 * time.Minute,
-		secret: &corev1.Secret{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "foo",
-				Namespace: "bar",
-			},
-			Data: map[string][]byte{
-				corev1.TLSCertKey: makeCert(t, []string{"example.com"}, time.Now().Add(5*time.Minute)),
-			},
-		},
-		want: ptr.Bool(false),
-	}, {
-		name:            "good cert, single domain",
-		domains:         []string{"example.com"},
-		minimumLifespan: 10 * time.Minute,
+		name:    "good cert, single domain",
+		domains: []string{"example.com"},
 		secret: &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "foo",
@@ -306,9 +289,8 @@ func TestIsValid(t *testing.T) {
 		},
 		want: ptr.Bool(true),
 	}, {
-		name:            "good cert, multi-domain",
-		domains:         []string{"example.com", "mattmoor.io"},
-		minimumLifespan: 10 * time.Minute,
+		name:    "good cert, multi-domain",
+		domains: []string{"example.com", "mattmoor.io"},
 		secret: &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "foo",
@@ -320,9 +302,8 @@ func TestIsValid(t *testing.T) {
 		},
 		want: ptr.Bool(true),
 	}, {
-		name:            "good cert, extra domain",
-		domains:         []string{"mattmoor.io"},
-		minimumLifespan: 10 * time.Minute,
+		name:    "good cert, extra domain",
+		domains: []string{"mattmoor.io"},
 		secret: &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "foo",
@@ -337,16 +318,16 @@ func TestIsValid(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			ok, err := IsValidCertificate(test.secret, test.domains, test.minimumLifespan)
+			cert, err := ParseCertificate(test.secret)
 			switch {
 			case test.want == nil:
 				if err == nil {
-					t.Errorf("IsValidCertificate() = %v, wanted error", ok)
+					t.Errorf("ParseCertificate() = %v, wanted error", cert)
 				}
 			case err != nil:
-				t.Errorf("IsValidCertificate() = %v", err)
-			case *test.want != ok:
-				t.Errorf("IsValidCertificate() = %v, wanted %v", ok, *test.want)
+				t.Errorf("ParseCertificate() = %v", err)
+			case *test.want != (cert != nil && CoversDomains(cert, test.domains)):
+				t.Errorf("CoversDomains() = %v, wanted %v", !*test.want, *test.want)
 			}
 		})
 	}
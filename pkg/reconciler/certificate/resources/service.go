@@ -120,3 +120,20 @@ func WithEndpointsPort(p int) func(*corev1.Endpoints) {
 		}
 	}
 }
+
+// WithEndpointsAddresses replaces the addresses populated by MakeEndpoints
+// with the given IPs, e.g. those of every replica of the controller.
+func WithEndpointsAddresses(ips ...string) func(*corev1.Endpoints) {
+	return func(ep *corev1.Endpoints) {
+		if len(ips) == 0 {
+			return
+		}
+		addrs := make([]corev1.EndpointAddress, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, corev1.EndpointAddress{IP: ip})
+		}
+		for i := range ep.Subsets {
+			ep.Subsets[i].Addresses = addrs
+		}
+	}
+}
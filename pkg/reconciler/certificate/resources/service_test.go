@@ -262,6 +262,40 @@ func TestMakeEndpoints(t *testing.T) {
 			}},
 		},
 		opts: []func(*corev1.Endpoints){WithEndpointsPort(1234)},
+	}, {
+		name: "replica addresses",
+		o: &v1alpha1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "bar",
+			},
+		},
+		want: &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "foo",
+				Namespace: "bar",
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion:         "networking.internal.knative.dev/v1alpha1",
+					Kind:               "Certificate",
+					Name:               "foo",
+					Controller:         ptr.Bool(true),
+					BlockOwnerDeletion: ptr.Bool(true),
+				}},
+			},
+			Subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{
+					IP: "10.0.0.1",
+				}, {
+					IP: "10.0.0.2",
+				}},
+				Ports: []corev1.EndpointPort{{
+					Name:     portName,
+					Port:     8080,
+					Protocol: corev1.ProtocolTCP,
+				}},
+			}},
+		},
+		opts: []func(*corev1.Endpoints){WithEndpointsAddresses("10.0.0.1", "10.0.0.2")},
 	}, {
 		name: "name has dots",
 		o: &v1alpha1.Certificate{
@@ -0,0 +1,266 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"knative.dev/net-http01/pkg/reconciler/certificate/resources"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/networking/pkg/client/clientset/versioned"
+	certificate "knative.dev/networking/pkg/client/injection/reconciler/networking/v1alpha1/certificate"
+	controller "knative.dev/pkg/controller"
+	logging "knative.dev/pkg/logging"
+	reconciler "knative.dev/pkg/reconciler"
+)
+
+const (
+	// RevokeOnDeleteAnnotationKey is the annotation through which a
+	// Certificate opts out ("false") of having its certificate revoked when
+	// it is deleted, where the controller revokes the certificates of
+	// deleted Certificates.
+	RevokeOnDeleteAnnotationKey = "net-http01.networking.knative.dev/revoke-on-delete"
+
+	// RevokeAnnotationKey is the annotation through which the certificate of
+	// a Certificate is revoked and re-issued, e.g. because its key was
+	// compromised.  Its value is the RFC 5280 reason code, by name (e.g.
+	// "keyCompromise") or number.  The certificate is revoked once; remove
+	// the annotation after it has been re-issued to allow revoking again.
+	RevokeAnnotationKey = "net-http01.networking.knative.dev/revoke"
+
+	// revokedSerialAnnotationKey is the status annotation that records the
+	// serial number of the certificate revoked for RevokeAnnotationKey.
+	revokedSerialAnnotationKey = "net-http01.networking.knative.dev/revoked-serial"
+
+	// finalizerName is the finalizer that the generated reconciler adds to
+	// Certificates when they are finalized.
+	finalizerName = "certificates.networking.internal.knative.dev"
+)
+
+// reasonCodes are the RFC 5280 CRLReason names.
+var reasonCodes = map[string]acme.CRLReasonCode{
+	"unspecified":          acme.CRLReasonUnspecified,
+	"keyCompromise":        acme.CRLReasonKeyCompromise,
+	"cACompromise":         acme.CRLReasonCACompromise,
+	"affiliationChanged":   acme.CRLReasonAffiliationChanged,
+	"superseded":           acme.CRLReasonSuperseded,
+	"cessationOfOperation": acme.CRLReasonCessationOfOperation,
+	"certificateHold":      acme.CRLReasonCertificateHold,
+	"removeFromCRL":        acme.CRLReasonRemoveFromCRL,
+	"privilegeWithdrawn":   acme.CRLReasonPrivilegeWithdrawn,
+	"aACompromise":         acme.CRLReasonAACompromise,
+}
+
+// ParseReasonCode parses an RFC 5280 reason code, by name or number.
+func ParseReasonCode(s string) (acme.CRLReasonCode, error) {
+	if code, ok := reasonCodes[s]; ok {
+		return code, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("unknown revocation reason %q", s)
+	}
+	for _, code := range reasonCodes {
+		if int(code) == n {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason code %d", n)
+}
+
+// revokeOnDelete returns whether the Certificate's certificate should be
+// revoked when it is deleted, which it is unless it opted out.
+func revokeOnDelete(o *v1alpha1.Certificate) bool {
+	if v, ok := o.Annotations[RevokeOnDeleteAnnotationKey]; ok {
+		b, err := strconv.ParseBool(v)
+		return err != nil || b
+	}
+	return true
+}
+
+// reconcileRevocation revokes the certificate within the Secret when
+// RevokeAnnotationKey asks for it.  It returns whether the certificate
+// within the Secret has been revoked, so that it is re-issued.
+func (r *Reconciler) reconcileRevocation(ctx context.Context, o *v1alpha1.Certificate, secret *corev1.Secret) (bool, error) {
+	v, ok := o.Annotations[RevokeAnnotationKey]
+	if !ok {
+		// Forget about past revocations so that the next one is honored.
+		delete(o.Status.Annotations, revokedSerialAnnotationKey)
+		return false, nil
+	}
+	reason, err := ParseReasonCode(v)
+	if err != nil {
+		return false, controller.NewPermanentError(err)
+	}
+	if secret == nil {
+		return false, nil
+	}
+	cert, err := resources.ParseCertificate(secret)
+	if err != nil || cert == nil {
+		return false, nil
+	}
+
+	switch revoked := o.Status.Annotations[revokedSerialAnnotationKey]; revoked {
+	case "":
+		// This revocation hasn't been handled yet.
+	case serialOf(cert):
+		// The revoked certificate hasn't been replaced yet.
+		return true, nil
+	default:
+		// The certificate has been re-issued since.
+		return false, nil
+	}
+
+	// Revoke the certificate with the issuer that issued it.
+	ictx, err := withSecretIssuer(ctx, secret)
+	if err != nil {
+		return false, err
+	}
+	if err := r.orderManager.Revoke(ictx, cert.Raw, reason); alreadyRevoked(err) {
+		// We revoked it before, but failed to record that.
+		logging.FromContext(ctx).Infof("Certificate %s was already revoked.", serialOf(cert))
+	} else if err != nil {
+		return false, fmt.Errorf("revoking certificate %s: %w", serialOf(cert), err)
+	} else {
+		logging.FromContext(ctx).Infof("Revoked certificate %s for reason %q.", serialOf(cert), v)
+	}
+	if o.Status.Annotations == nil {
+		o.Status.Annotations = make(map[string]string, 1)
+	}
+	o.Status.Annotations[revokedSerialAnnotationKey] = serialOf(cert)
+	return true, nil
+}
+
+// finalizingReconciler is the Reconciler of controllers that revoke the
+// certificates of deleted Certificates.  The generated reconciler only adds
+// its finalizer to Certificates when they are finalized, so that they aren't
+// held up on deletion otherwise.
+type finalizingReconciler struct {
+	*Reconciler
+}
+
+// Check that our finalizingReconciler implements Finalizer
+var _ certificate.Finalizer = finalizingReconciler{}
+
+// FinalizeKind implements Finalizer.FinalizeKind.  It revokes the certificate
+// within the Secret, unless the Certificate opted out.
+func (r finalizingReconciler) FinalizeKind(ctx context.Context, o *v1alpha1.Certificate) reconciler.Event {
+	// The Certificate is going away, so it no longer waits on any order.
+	r.orderManager.Forget(ctx, o, nil)
+
+	if !revokeOnDelete(o) {
+		return nil
+	}
+
+	secret, err := r.secretLister.Secrets(o.Namespace).Get(o.Spec.SecretName)
+	if apierrs.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cert, err := resources.ParseCertificate(secret)
+	if err != nil || cert == nil {
+		logging.FromContext(ctx).Warnf("Not revoking the certificate, it can't be read: %v", err)
+		return nil
+	}
+	if serialOf(cert) == o.Status.Annotations[revokedSerialAnnotationKey] {
+		// Already revoked.
+		return nil
+	}
+
+	if time.Now().After(cert.NotAfter) {
+		// Expired certificates can't be revoked, nor do they need to be.
+		return nil
+	}
+
+	ctx, err = withSecretIssuer(ctx, secret)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Not revoking certificate %s: %v", serialOf(cert), err)
+		return nil
+	}
+	if err := r.orderManager.Revoke(ctx, cert.Raw, acme.CRLReasonCessationOfOperation); err != nil {
+		var ae *acme.Error
+		if errors.As(err, &ae) && ae.StatusCode >= 400 && ae.StatusCode < 500 {
+			// The CA won't ever revoke it (e.g. it was already revoked), so
+			// don't hold up the deletion over it.
+			logging.FromContext(ctx).Warnf("Not revoking certificate %s: %v", serialOf(cert), err)
+			return nil
+		}
+		return fmt.Errorf("revoking certificate %s: %w", serialOf(cert), err)
+	}
+	logging.FromContext(ctx).Infof("Revoked certificate %s of deleted Certificate.", serialOf(cert))
+	return nil
+}
+
+// releaseFinalizer returns the handler that removes the finalizer from
+// Certificates that were finalized before the controller stopped revoking
+// the certificates of deleted Certificates, which would otherwise never be
+// deleted.  Failed patches are retried as the Certificate is updated or
+// resynced.
+func releaseFinalizer(ctx context.Context, client versioned.Interface) func(interface{}) {
+	return func(obj interface{}) {
+		o, ok := obj.(*v1alpha1.Certificate)
+		if !ok {
+			return
+		}
+		finalizers := sets.New(o.Finalizers...)
+		if !finalizers.Has(finalizerName) {
+			return
+		}
+		finalizers.Delete(finalizerName)
+
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"finalizers":      sets.List(finalizers),
+				"resourceVersion": o.ResourceVersion,
+			},
+		})
+		if err != nil {
+			logging.FromContext(ctx).Errorf("Error marshaling the finalizers of %s/%s: %v", o.Namespace, o.Name, err)
+			return
+		}
+		_, err = client.NetworkingV1alpha1().Certificates(o.Namespace).Patch(ctx, o.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			logging.FromContext(ctx).Errorf("Error removing the finalizer of %s/%s: %v", o.Namespace, o.Name, err)
+		}
+	}
+}
+
+// alreadyRevoked returns whether the CA refused to revoke a certificate
+// because it was revoked already.
+func alreadyRevoked(err error) bool {
+	var ae *acme.Error
+	return errors.As(err, &ae) && ae.StatusCode >= 400 && ae.StatusCode < 500 &&
+		ae.ProblemType == "urn:ietf:params:acme:error:alreadyRevoked"
+}
+
+// serialOf returns the hex encoded serial number of the certificate.
+func serialOf(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
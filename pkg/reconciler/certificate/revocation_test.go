@@ -0,0 +1,365 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certificate
+
+import (
+	context "context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgotesting "k8s.io/client-go/testing"
+	"knative.dev/net-http01/pkg/ordermanager"
+	"knative.dev/net-http01/pkg/reconciler/certificate/config"
+	"knative.dev/net-http01/pkg/reconciler/certificate/resources"
+	v1alpha1 "knative.dev/networking/pkg/apis/networking/v1alpha1"
+	networkingfake "knative.dev/networking/pkg/client/clientset/versioned/fake"
+	"knative.dev/pkg/apis"
+	configmap "knative.dev/pkg/configmap"
+	controller "knative.dev/pkg/controller"
+
+	. "knative.dev/net-http01/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+func TestParseReasonCode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    acme.CRLReasonCode
+		wantErr bool
+	}{{
+		in:   "keyCompromise",
+		want: acme.CRLReasonKeyCompromise,
+	}, {
+		in:   "1",
+		want: acme.CRLReasonKeyCompromise,
+	}, {
+		in:   "cessationOfOperation",
+		want: acme.CRLReasonCessationOfOperation,
+	}, {
+		in:   "0",
+		want: acme.CRLReasonUnspecified,
+	}, {
+		// 7 is not used by RFC 5280.
+		in:      "7",
+		wantErr: true,
+	}, {
+		in:      "oops",
+		wantErr: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			got, err := ParseReasonCode(test.in)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("ParseReasonCode() = %v, wanted error", got)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("ParseReasonCode() = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("ParseReasonCode() = %v, wanted %v", got, test.want)
+			}
+		})
+	}
+}
+
+func withRevokedSerial(serial string) certOption {
+	return func(c *v1alpha1.Certificate) {
+		if c.Status.Annotations == nil {
+			c.Status.Annotations = make(map[string]string, 1)
+		}
+		c.Status.Annotations[revokedSerialAnnotationKey] = serial
+	}
+}
+
+func withChallenges(c *v1alpha1.Certificate) {
+	c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
+	c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
+		ServiceName:      "kn-cert",
+		ServiceNamespace: "foo",
+		ServicePort:      intstr.FromInt(80),
+		URL: &apis.URL{
+			Scheme: "http",
+			Host:   "example.com",
+			Path:   "/.acme/well-known/gobbledy-gook",
+		},
+	}}
+}
+
+func TestReconcileRevocation(t *testing.T) {
+	tc := makeTLSCert(t, []string{"example.com"}, time.Now().Add(100*24*time.Hour))
+	serial := serialOf(tc.Leaf)
+	secret := mustMakeSecret(t, cert("kn-cert", "foo", withDomains("example.com")), tc)
+
+	table := TableTest{{
+		Name: "add finalizer",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withoutFinalizer),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+		},
+		WantPatches: []clientgotesting.PatchActionImpl{
+			patchFinalizers("foo", "kn-cert", finalizerName),
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withoutFinalizer,
+				func(c *v1alpha1.Certificate) {
+					c.Status.MarkNotReady(ordermanager.ReasonChallengePending, "Waiting for the CA to validate the HTTP01 challenges.")
+					c.Status.HTTP01Challenges = []v1alpha1.HTTP01Challenge{{
+						ServiceName:      "kn-cert",
+						ServiceNamespace: "foo",
+						ServicePort:      intstr.FromInt(80),
+						URL: &apis.URL{
+							Scheme: "http",
+							Host:   "example.com",
+							Path:   "/.acme/well-known/gobbledy-gook",
+						},
+					}}
+				}),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, "FinalizerUpdate", `Updated "kn-cert" finalizers`),
+			Eventf(corev1.EventTypeNormal, ReasonChallengesPublished, "Published the HTTP01 challenges at http://example.com/.acme/well-known/gobbledy-gook."),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "revoke on demand",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeAnnotationKey, "keyCompromise")),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			secret,
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeAnnotationKey, "keyCompromise"),
+				withRevokedSerial(serial), withChallenges, withCertMetadata(tc.Leaf)),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, ReasonChallengesPublished, "Published the HTTP01 challenges at http://example.com/.acme/well-known/gobbledy-gook."),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "revoked certificate is being re-issued",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeAnnotationKey, "keyCompromise"),
+				withRevokedSerial(serial), withChallenges, withCertMetadata(tc.Leaf)),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			secret,
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "certificate was re-issued",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeAnnotationKey, "keyCompromise"),
+				withRevokedSerial("123abc"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			secret,
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeAnnotationKey, "keyCompromise"),
+				withRevokedSerial("123abc"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					markIssued(c, config.DefaultIssuerName)
+				}, withCertMetadata(tc.Leaf), withRenewAt(tc.Leaf)),
+		}},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "revocation request removed",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withRevokedSerial("123abc"), withChallenges),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			secret,
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withChallenges,
+				func(c *v1alpha1.Certificate) {
+					c.Status.Annotations = map[string]string{}
+					markIssued(c, config.DefaultIssuerName)
+				}, withCertMetadata(tc.Leaf), withRenewAt(tc.Leaf)),
+		}},
+		Key: "foo/kn-cert",
+	}, {
+		Name:    "invalid revocation reason",
+		WantErr: true,
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeAnnotationKey, "bored")),
+			resources.MakeService(cert("kn-cert", "foo", withDomains("example.com"))),
+			resources.MakeEndpoints(cert("kn-cert", "foo", withDomains("example.com"))),
+			secret,
+		},
+		WantStatusUpdates: []clientgotesting.UpdateActionImpl{{
+			Object: cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeAnnotationKey, "bored"),
+				func(c *v1alpha1.Certificate) {
+					c.Status.InitializeConditions()
+					c.Status.MarkNotReady("RevocationFailed", `unknown revocation reason "bored"`)
+				}, withCertMetadata(tc.Leaf)),
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", `unknown revocation reason "bored"`),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "revoke on delete",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeOnDeleteAnnotationKey, "true"), withDeletion),
+			secret,
+		},
+		WantPatches: []clientgotesting.PatchActionImpl{
+			patchFinalizers("foo", "kn-cert"),
+		},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, "FinalizerUpdate", `Updated "kn-cert" finalizers`),
+		},
+		Key: "foo/kn-cert",
+	}, {
+		Name: "not revoked on delete",
+		Objects: []runtime.Object{
+			cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeOnDeleteAnnotationKey, "false"), withDeletion),
+			secret,
+		},
+		WantPatches: []clientgotesting.PatchActionImpl{
+			patchFinalizers("foo", "kn-cert"),
+		},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, "FinalizerUpdate", `Updated "kn-cert" finalizers`),
+		},
+		Key: "foo/kn-cert",
+	}}
+
+	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+		return newFinalizingTestReconciler(ctx, listers, &fakeOM{challenges: fakeChallenges})
+	}))
+}
+
+func TestReconcileRevocationError(t *testing.T) {
+	ctx := context.Background()
+	o := cert("kn-cert", "foo", withDomains("example.com"), withAnnotation(RevokeAnnotationKey, "keyCompromise"))
+	tc := makeTLSCert(t, []string{"example.com"}, time.Now().Add(100*24*time.Hour))
+	secret := mustMakeSecret(t, o, tc)
+
+	tests := []struct {
+		name      string
+		revokeErr error
+		wantErr   bool
+	}{{
+		name: "revoked",
+	}, {
+		name:      "transient error",
+		revokeErr: errors.New("connection reset"),
+		wantErr:   true,
+	}, {
+		// The status update recording an earlier revocation was lost.
+		name:      "already revoked",
+		revokeErr: &acme.Error{StatusCode: 400, ProblemType: "urn:ietf:params:acme:error:alreadyRevoked"},
+	}, {
+		name:      "refused by the CA",
+		revokeErr: &acme.Error{StatusCode: 403, ProblemType: "urn:ietf:params:acme:error:unauthorized"},
+		wantErr:   true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := o.DeepCopy()
+			r := &Reconciler{orderManager: &fakeOM{revokeErr: test.revokeErr}}
+			revoked, err := r.reconcileRevocation(ctx, o, secret)
+			if (err != nil) != test.wantErr {
+				t.Errorf("reconcileRevocation() = %v, wanted error: %v", err, test.wantErr)
+			}
+			if revoked == test.wantErr {
+				t.Errorf("reconcileRevocation() = %v, wanted %v", revoked, !test.wantErr)
+			}
+			got := o.Status.Annotations[revokedSerialAnnotationKey]
+			if want := serialOf(tc.Leaf); !test.wantErr && got != want {
+				t.Errorf("revoked serial = %q, wanted %q", got, want)
+			}
+		})
+	}
+}
+
+func TestFinalizeRevocationError(t *testing.T) {
+	ctx := context.Background()
+	o := cert("kn-cert", "foo", withDomains("example.com"), withDeletion)
+	secret := mustMakeSecret(t, o, makeTLSCert(t, []string{"example.com"}, time.Now().Add(100*24*time.Hour)))
+
+	tests := []struct {
+		name      string
+		revokeErr error
+		wantErr   bool
+	}{{
+		name: "revoked",
+	}, {
+		name:      "transient error",
+		revokeErr: errors.New("connection reset"),
+		wantErr:   true,
+	}, {
+		name:      "refused by the CA",
+		revokeErr: &acme.Error{StatusCode: 400, ProblemType: "urn:ietf:params:acme:error:alreadyRevoked"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ls := NewListers([]runtime.Object{secret})
+			om := &fakeOM{revokeErr: test.revokeErr}
+			r := finalizingReconciler{&Reconciler{
+				secretLister: ls.GetSecretLister(),
+				orderManager: om,
+			}}
+			err := r.FinalizeKind(ctx, o)
+			if (err != nil) != test.wantErr {
+				t.Errorf("FinalizeKind() = %v, wanted error: %v", err, test.wantErr)
+			}
+			if test.revokeErr == nil && (len(om.revoked) != 1 || om.revoked[0] != acme.CRLReasonCessationOfOperation) {
+				t.Errorf("revoked = %v, wanted [%v]", om.revoked, acme.CRLReasonCessationOfOperation)
+			}
+			// The Certificate no longer holds on to in-flight orders.
+			if len(om.forgotten) != 1 || om.forgotten[0] != o {
+				t.Errorf("forgotten = %v, wanted [%v]", om.forgotten, o)
+			}
+		})
+	}
+}
+
+func TestReleaseFinalizer(t *testing.T) {
+	ctx := context.Background()
+	o := cert("kn-cert", "foo", withDomains("example.com"), func(c *v1alpha1.Certificate) {
+		c.Finalizers = append(c.Finalizers, "other")
+	})
+	client := networkingfake.NewSimpleClientset(o)
+
+	releaseFinalizer(ctx, client)(o)
+
+	got, err := client.NetworkingV1alpha1().Certificates("foo").Get(ctx, "kn-cert", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	// Only our own finalizer is removed.
+	if want := []string{"other"}; !cmp.Equal(got.Finalizers, want) {
+		t.Errorf("finalizers = %v, wanted %v", got.Finalizers, want)
+	}
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package renewal
+
+import (
+	context "context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"knative.dev/net-http01/pkg/ordermanager"
+)
+
+const (
+	// defaultRecheck is how long we wait before checking for an updated
+	// renewal window when the CA doesn't send a Retry-After.
+	defaultRecheck = 6 * time.Hour
+
+	// minRecheck and maxRecheck bound the Retry-After sent by the CA.
+	// Failures to get renewal information are retried after minRecheck.
+	minRecheck = time.Minute
+	maxRecheck = 24 * time.Hour
+
+	// defaultTimeout bounds the requests for renewal information, unless
+	// WithARI is given a client.
+	defaultTimeout = 10 * time.Second
+)
+
+// errNoARI is returned when the directory doesn't offer renewal information.
+var errNoARI = errors.New("the ACME directory doesn't offer renewal information")
+
+// ariClient fetches the renewal windows suggested by the CA.
+type ariClient struct {
+	directoryURL string
+	client       *http.Client
+
+	// discovering collapses concurrent fetches of the directory.
+	discovering singleflight.Group
+
+	mu sync.Mutex
+	// directory is the outcome of fetching the directory, if we did.
+	directory *discovery
+	// decisions holds the outcome of fetching the renewal information of
+	// certificates, by certificate identifier, until we are to check back.
+	decisions map[string]cachedDecision
+}
+
+// cachedDecision is the outcome of fetching the renewal information of a
+// certificate, which holds until the given time.
+type cachedDecision struct {
+	decision Decision
+	err      error
+	until    time.Time
+}
+
+// discovery is the outcome of fetching the directory: the renewalInfo URL,
+// which is empty when the directory doesn't offer one, or the failure to
+// fetch it, which holds until the given time.
+type discovery struct {
+	renewalInfo string
+	err         error
+	until       time.Time
+}
+
+// window is the suggestedWindow of a RenewalInfo object.
+type window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// decide picks the renewal time of the certificate from within the window
+// suggested by the CA.  The renewal information is only fetched again once
+// the CA asked us to check back, or a minute after failing to fetch it.
+func (a *ariClient) decide(ctx context.Context, cert *x509.Certificate, now time.Time) (Decision, error) {
+	base, err := a.discover(ctx, now)
+	if err != nil {
+		return Decision{}, err
+	}
+	id, err := CertID(cert)
+	if err != nil {
+		return Decision{}, err
+	}
+	if c, ok := a.cached(id, now); ok {
+		return c.decision, c.err
+	}
+
+	d, err := a.fetch(ctx, base, id, now)
+	c := cachedDecision{decision: d, err: err, until: d.RecheckAt}
+	if err != nil {
+		c.until = now.Add(minRecheck)
+	}
+	a.remember(id, c, now)
+	return d, err
+}
+
+// cached returns the outcome of fetching the renewal information of the
+// certificate, if it still holds.
+func (a *ariClient) cached(id string, now time.Time) (cachedDecision, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.decisions[id]
+	return c, ok && now.Before(c.until)
+}
+
+// remember caches the outcome of fetching the renewal information of the
+// certificate, dropping the outcomes that no longer hold, e.g. those of
+// certificates that have since been replaced.
+func (a *ariClient) remember(id string, c cachedDecision, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.decisions == nil {
+		a.decisions = make(map[string]cachedDecision, 1)
+	}
+	for k, old := range a.decisions {
+		if !now.Before(old.until) {
+			delete(a.decisions, k)
+		}
+	}
+	a.decisions[id] = c
+}
+
+// fetch fetches the renewal information of the certificate from the CA.
+func (a *ariClient) fetch(ctx context.Context, base, id string, now time.Time) (Decision, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(base, "/")+"/"+id, nil)
+	if err != nil {
+		return Decision{}, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("fetching renewal information for %s: unexpected status %d", id, resp.StatusCode)
+	}
+	var info struct {
+		SuggestedWindow window `json:"suggestedWindow"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&info); err != nil {
+		return Decision{}, fmt.Errorf("decoding renewal information for %s: %w", id, err)
+	}
+	w := info.SuggestedWindow
+	if w.Start.IsZero() || w.End.Before(w.Start) {
+		return Decision{}, fmt.Errorf("invalid renewal window for %s: [%v, %v]", id, w.Start, w.End)
+	}
+
+	return Decision{
+		RenewAt:   pickTime(w, id),
+		RecheckAt: now.Add(recheckAfter(resp.Header, now)),
+	}, nil
+}
+
+// discover returns the renewalInfo URL of the directory.  The directory is
+// fetched outside of the lock, once for all of the concurrent callers, and
+// failures to fetch it are retried after minRecheck.
+func (a *ariClient) discover(ctx context.Context, now time.Time) (string, error) {
+	d, ok := func() (*discovery, bool) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		d := a.directory
+		return d, d != nil && (d.err == nil || now.Before(d.until))
+	}()
+	if !ok {
+		v, _, _ := a.discovering.Do("", func() (interface{}, error) {
+			d := &discovery{until: now.Add(minRecheck)}
+			d.renewalInfo, d.err = a.fetchDirectory(ctx)
+
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.directory = d
+			return d, nil
+		})
+		d = v.(*discovery)
+	}
+	switch {
+	case d.err != nil:
+		return "", d.err
+	case d.renewalInfo == "":
+		return "", errNoARI
+	default:
+		return d.renewalInfo, nil
+	}
+}
+
+// fetchDirectory fetches the renewalInfo URL of the directory.
+func (a *ariClient) fetchDirectory(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.directoryURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching ACME directory: unexpected status %d", resp.StatusCode)
+	}
+	var dir struct {
+		RenewalInfo string `json:"renewalInfo"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&dir); err != nil {
+		return "", fmt.Errorf("decoding ACME directory: %w", err)
+	}
+	return dir.RenewalInfo, nil
+}
+
+// CertID returns the ARI certificate identifier of the certificate, which is
+// made up of its Authority Key Identifier and its serial number.
+func CertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", errors.New("certificate has no authority key identifier")
+	}
+	if cert.SerialNumber == nil || cert.SerialNumber.Sign() <= 0 {
+		return "", errors.New("certificate has no valid serial number")
+	}
+	// The serial number is encoded as the contents of its DER INTEGER,
+	// which has a leading zero when its high bit is set.
+	serial := cert.SerialNumber.Bytes()
+	if serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// pickTime picks a point within the window.  The point is derived from the
+// certificate identifier rather than chosen at random, so that it is stable
+// across reconciliations while still spreading renewals over the window.
+func pickTime(w window, id string) time.Time {
+	width := w.End.Sub(w.Start)
+	if width <= 0 {
+		return w.Start
+	}
+	sum := sha256.Sum256([]byte(id))
+	offset := binary.BigEndian.Uint64(sum[:8]) % uint64(width)
+	return w.Start.Add(time.Duration(offset))
+}
+
+// recheckAfter returns how long to wait before checking for an updated
+// renewal window, following the Retry-After header within bounds.
+func recheckAfter(h http.Header, now time.Time) time.Duration {
+	d := ordermanager.RetryAfter(h, now)
+	if d == 0 {
+		d = defaultRecheck
+	}
+	switch {
+	case d < minRecheck:
+		return minRecheck
+	case d > maxRecheck:
+		return maxRecheck
+	default:
+		return d
+	}
+}
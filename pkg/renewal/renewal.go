@@ -0,0 +1,128 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package renewal decides when certificates should be renewed, following
+// the CA's ACME Renewal Information (RFC 9773) when it is offered, and a
+// fraction of the certificate's lifetime otherwise.
+package renewal
+
+import (
+	context "context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"time"
+
+	logging "knative.dev/pkg/logging"
+)
+
+// DefaultLifetimeFraction is the fraction of a certificate's lifetime after
+// which it is renewed when the CA doesn't suggest a renewal window, e.g.
+// after 60 days for a 90-day certificate, or 4 days for a 6-day one.
+const DefaultLifetimeFraction = 2.0 / 3.0
+
+// Decision is the outcome of a Policy.
+type Decision struct {
+	// RenewAt is when the certificate should be renewed.
+	RenewAt time.Time
+
+	// RecheckAt, when non-zero, is when the CA asked us to check back for
+	// an updated renewal window, which may move RenewAt.
+	RecheckAt time.Time
+}
+
+// Next returns when the certificate should next be looked at.
+func (d Decision) Next() time.Time {
+	if !d.RecheckAt.IsZero() && d.RecheckAt.Before(d.RenewAt) {
+		return d.RecheckAt
+	}
+	return d.RenewAt
+}
+
+// Policy decides when certificates should be renewed.
+type Policy interface {
+	// Decide returns when the given certificate should be renewed.
+	Decide(ctx context.Context, cert *x509.Certificate) Decision
+}
+
+// Option customizes the Policy returned by New.
+type Option func(*policy)
+
+// WithLifetimeFraction sets the fraction of the certificate's lifetime after
+// which it is renewed when the CA doesn't suggest a renewal window.
+func WithLifetimeFraction(f float64) Option {
+	return func(p *policy) {
+		p.fraction = f
+	}
+}
+
+// WithARI makes the policy follow the renewal windows suggested through the
+// ACME Renewal Information endpoint of the given ACME directory, if the
+// directory offers one.  A nil client uses a client whose requests time out
+// after 10 seconds.
+func WithARI(directoryURL string, client *http.Client) Option {
+	return func(p *policy) {
+		if client == nil {
+			client = &http.Client{Timeout: defaultTimeout}
+		}
+		p.ari = &ariClient{
+			directoryURL: directoryURL,
+			client:       client,
+		}
+	}
+}
+
+// New returns a Policy that renews certificates within the window suggested
+// by the CA when ARI is configured and available, and otherwise after a
+// fraction of their lifetime.
+func New(opts ...Option) Policy {
+	p := &policy{
+		fraction: DefaultLifetimeFraction,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+type policy struct {
+	fraction float64
+	ari      *ariClient
+	now      func() time.Time
+}
+
+var _ Policy = (*policy)(nil)
+
+// Decide implements Policy
+func (p *policy) Decide(ctx context.Context, cert *x509.Certificate) Decision {
+	if p.ari != nil {
+		d, err := p.ari.decide(ctx, cert, p.now())
+		if err == nil {
+			return d
+		} else if !errors.Is(err, errNoARI) {
+			logging.FromContext(ctx).Warnf("Falling back on the certificate lifetime, unable to get renewal information: %v", err)
+		}
+	}
+	return Decision{RenewAt: fractionOf(cert, p.fraction)}
+}
+
+// fractionOf returns the time at which the given fraction of the
+// certificate's lifetime has elapsed.
+func fractionOf(cert *x509.Certificate, f float64) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * f))
+}
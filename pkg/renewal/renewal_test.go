@@ -0,0 +1,302 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package renewal
+
+import (
+	context "context"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	notBefore = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now       = notBefore.Add(24 * time.Hour)
+)
+
+func testCert(lifetime time.Duration) *x509.Certificate {
+	return &x509.Certificate{
+		NotBefore:      notBefore,
+		NotAfter:       notBefore.Add(lifetime),
+		SerialNumber:   big.NewInt(0x87654321),
+		AuthorityKeyId: []byte{0x69, 0x88, 0x5B, 0x6B, 0x87, 0x46, 0x40, 0x41, 0xE1, 0xB3, 0x7B, 0x84, 0x7B, 0xA0, 0xAE, 0x2C, 0xDE, 0x01, 0xC8, 0xD4},
+	}
+}
+
+func TestLifetimeFraction(t *testing.T) {
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		opts     []Option
+		want     time.Time
+	}{{
+		name:     "90 days",
+		lifetime: 90 * 24 * time.Hour,
+		want:     notBefore.Add(60 * 24 * time.Hour),
+	}, {
+		name:     "6 days",
+		lifetime: 6 * 24 * time.Hour,
+		want:     notBefore.Add(4 * 24 * time.Hour),
+	}, {
+		name:     "custom fraction",
+		lifetime: 90 * 24 * time.Hour,
+		opts:     []Option{WithLifetimeFraction(0.5)},
+		want:     notBefore.Add(45 * 24 * time.Hour),
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := New(test.opts...).Decide(context.Background(), testCert(test.lifetime))
+			if !d.RenewAt.Equal(test.want) {
+				t.Errorf("RenewAt = %v, wanted %v", d.RenewAt, test.want)
+			}
+			if !d.RecheckAt.IsZero() {
+				t.Errorf("RecheckAt = %v, wanted zero", d.RecheckAt)
+			}
+			if !d.Next().Equal(test.want) {
+				t.Errorf("Next() = %v, wanted %v", d.Next(), test.want)
+			}
+		})
+	}
+}
+
+func TestCertID(t *testing.T) {
+	// This is the example from RFC 9773, section 4.1.
+	got, err := CertID(testCert(time.Hour))
+	if err != nil {
+		t.Fatalf("CertID() = %v", err)
+	}
+	if want := "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"; got != want {
+		t.Errorf("CertID() = %q, wanted %q", got, want)
+	}
+
+	if _, err := CertID(&x509.Certificate{SerialNumber: big.NewInt(1)}); err == nil {
+		t.Error("CertID(no AKI) = nil, wanted error")
+	}
+}
+
+func TestARI(t *testing.T) {
+	const id = "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"
+	start := notBefore.Add(50 * 24 * time.Hour)
+	end := start.Add(48 * time.Hour)
+
+	tests := []struct {
+		name        string
+		directory   map[string]string
+		status      int
+		retryAfter  string
+		wantWindow  bool
+		wantRecheck time.Duration
+	}{{
+		name:        "suggested window",
+		status:      http.StatusOK,
+		retryAfter:  "21600",
+		wantWindow:  true,
+		wantRecheck: 6 * time.Hour,
+	}, {
+		name:        "retry-after is bounded",
+		status:      http.StatusOK,
+		retryAfter:  "5",
+		wantWindow:  true,
+		wantRecheck: time.Minute,
+	}, {
+		name:        "default retry-after",
+		status:      http.StatusOK,
+		wantWindow:  true,
+		wantRecheck: defaultRecheck,
+	}, {
+		name:      "no renewal info in the directory",
+		directory: map[string]string{},
+	}, {
+		name:   "renewal info error",
+		status: http.StatusInternalServerError,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/directory":
+					dir := test.directory
+					if dir == nil {
+						dir = map[string]string{"renewalInfo": server.URL + "/renewal-info"}
+					}
+					json.NewEncoder(w).Encode(dir)
+				case "/renewal-info/" + id:
+					if test.retryAfter != "" {
+						w.Header().Set("Retry-After", test.retryAfter)
+					}
+					w.WriteHeader(test.status)
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"suggestedWindow": map[string]time.Time{"start": start, "end": end},
+					})
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			p := New(WithARI(server.URL+"/directory", server.Client())).(*policy)
+			p.now = func() time.Time { return now }
+
+			cert := testCert(90 * 24 * time.Hour)
+			d := p.Decide(context.Background(), cert)
+			if !test.wantWindow {
+				if want := fractionOf(cert, DefaultLifetimeFraction); !d.RenewAt.Equal(want) {
+					t.Errorf("RenewAt = %v, wanted fallback %v", d.RenewAt, want)
+				}
+				return
+			}
+			if d.RenewAt.Before(start) || !d.RenewAt.Before(end) {
+				t.Errorf("RenewAt = %v, wanted within [%v, %v)", d.RenewAt, start, end)
+			}
+			if got := d.RecheckAt.Sub(now); got != test.wantRecheck {
+				t.Errorf("RecheckAt = now + %v, wanted now + %v", got, test.wantRecheck)
+			}
+			if !d.Next().Equal(d.RecheckAt) {
+				t.Errorf("Next() = %v, wanted %v", d.Next(), d.RecheckAt)
+			}
+
+			// The renewal time is stable across calls.
+			if again := p.Decide(context.Background(), cert); !again.RenewAt.Equal(d.RenewAt) {
+				t.Errorf("RenewAt = %v, then %v", d.RenewAt, again.RenewAt)
+			}
+		})
+	}
+}
+
+func TestARICache(t *testing.T) {
+	const id = "aYhba4dGQEHhs3uEe6CuLN4ByNQ.AIdlQyE"
+	start := notBefore.Add(50 * 24 * time.Hour)
+
+	var fetched int
+	status := http.StatusInternalServerError
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directory":
+			json.NewEncoder(w).Encode(map[string]string{"renewalInfo": server.URL + "/renewal-info"})
+		case "/renewal-info/" + id:
+			fetched++
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"suggestedWindow": map[string]time.Time{"start": start, "end": start.Add(48 * time.Hour)},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	clock := now
+	p := New(WithARI(server.URL+"/directory", server.Client())).(*policy)
+	p.now = func() time.Time { return clock }
+	cert := testCert(90 * 24 * time.Hour)
+
+	for _, step := range []struct {
+		name        string
+		after       time.Duration
+		status      int
+		wantFetched int
+	}{{
+		name:        "failure is fetched",
+		status:      http.StatusInternalServerError,
+		wantFetched: 1,
+	}, {
+		name:        "failure is retried after a while",
+		after:       30 * time.Second,
+		status:      http.StatusOK,
+		wantFetched: 1,
+	}, {
+		name:        "window is fetched",
+		after:       minRecheck,
+		status:      http.StatusOK,
+		wantFetched: 2,
+	}, {
+		name:        "window is cached until Retry-After",
+		after:       30 * time.Minute,
+		status:      http.StatusOK,
+		wantFetched: 2,
+	}, {
+		name:        "window is fetched again",
+		after:       30 * time.Minute,
+		status:      http.StatusOK,
+		wantFetched: 3,
+	}} {
+		clock = clock.Add(step.after)
+		status = step.status
+		p.Decide(context.Background(), cert)
+		if fetched != step.wantFetched {
+			t.Errorf("%s: fetched %d times, wanted %d", step.name, fetched, step.wantFetched)
+		}
+	}
+}
+
+func TestARIDiscoveryCache(t *testing.T) {
+	var fetched int
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{})
+	}))
+	defer server.Close()
+
+	clock := now
+	p := New(WithARI(server.URL, server.Client())).(*policy)
+	p.now = func() time.Time { return clock }
+	cert := testCert(90 * 24 * time.Hour)
+
+	for _, step := range []struct {
+		name        string
+		after       time.Duration
+		status      int
+		wantFetched int
+	}{{
+		name:        "failure is fetched",
+		status:      http.StatusInternalServerError,
+		wantFetched: 1,
+	}, {
+		name:        "failure is retried after a while",
+		after:       30 * time.Second,
+		status:      http.StatusOK,
+		wantFetched: 1,
+	}, {
+		name:        "directory is fetched",
+		after:       minRecheck,
+		status:      http.StatusOK,
+		wantFetched: 2,
+	}, {
+		name:        "directory is cached",
+		after:       maxRecheck,
+		status:      http.StatusOK,
+		wantFetched: 2,
+	}} {
+		clock = clock.Add(step.after)
+		status = step.status
+		p.Decide(context.Background(), cert)
+		if fetched != step.wantFetched {
+			t.Errorf("%s: fetched %d times, wanted %d", step.name, fetched, step.wantFetched)
+		}
+	}
+}